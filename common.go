@@ -9,6 +9,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	"github.com/sirupsen/logrus"
 )
@@ -39,113 +40,242 @@ func GetJoinedWD(dir string) (string, error) {
 	return ajwd, nil
 }
 
-var i2pdefault, i2pkserr = GetJoinedWD("i2pkeys")
-var tordefault, torkserr = GetJoinedWD("onionkeys")
-var tlsdefault, tlskserr = GetJoinedWD("tlskeys")
+// KEYSTORE_ROOT is the directory holding the "i2pkeys", "onionkeys" and
+// "tlskeys" key stores. If it is empty, KeystoreRoot finds one the first
+// time it is needed.
+var KEYSTORE_ROOT = ""
+
+// KEYSTORE_APP_NAME names the directory of the application in
+// $XDG_STATE_HOME. It defaults to the name of the executable.
+var KEYSTORE_APP_NAME = ""
 
 // I2P_KEYSTORE_PATH is the place where I2P Keys will be saved.
-// it defaults to the directory "i2pkeys" current working directory.
-// reference it by calling I2PKeystorePath() to check for errors
-var I2P_KEYSTORE_PATH = i2pdefault
+// If it is empty, it is the directory "i2pkeys" of KeystoreRoot(). It
+// stays empty then, so call I2PKeystorePath() for the directory in use.
+var I2P_KEYSTORE_PATH = ""
 
 // ONION_KEYSTORE_PATH is the place where Onion Keys will be saved.
-// it defaults to the directory "onionkeys" current working directory.
-// reference it by calling OnionKeystorePath() to check for errors
-var ONION_KEYSTORE_PATH = tordefault
+// If it is empty, it is the directory "onionkeys" of KeystoreRoot(). It
+// stays empty then, so call TorKeystorePath() for the directory in use.
+var ONION_KEYSTORE_PATH = ""
 
 // TLS_KEYSTORE_PATH is the place where TLS Keys will be saved.
-// it defaults to the directory "tlskeys" current working directory.
-// reference it by calling TLSKeystorePath() to check for errors
-var TLS_KEYSTORE_PATH = tlsdefault
+// If it is empty, it is the directory "tlskeys" of KeystoreRoot(). It
+// stays empty then, so call TLSKeystorePath() for the directory in use.
+var TLS_KEYSTORE_PATH = ""
 
-// I2PKeystorePath returns the path to the I2P Keystore. If the
-// path is not set, it returns the default path. If the path does
-// not exist, it creates it.
-func I2PKeystorePath() (string, error) {
-	log.WithField("path", I2P_KEYSTORE_PATH).Debug("Checking I2P keystore path")
-	if _, err := os.Stat(I2P_KEYSTORE_PATH); err != nil {
-		log.WithField("path", I2P_KEYSTORE_PATH).Debug("I2P keystore directory does not exist, creating")
-		err := os.MkdirAll(I2P_KEYSTORE_PATH, 0755)
+// keystoreDirs are the directories of the key stores in the root.
+var keystoreDirs = []string{"i2pkeys", "onionkeys", "tlskeys"}
+
+// resolvedRoot is the root KeystoreRoot found, so the process keeps its
+// identities when the working directory or its contents change. It is
+// resolved again when KEYSTORE_ROOT is changed.
+var resolvedRoot struct {
+	sync.Mutex
+	// keystoreRoot is the value of KEYSTORE_ROOT root was resolved with
+	keystoreRoot string
+	root         string
+}
+
+// KeystoreRoot returns the directory the key stores are kept in, which is
+// the first of:
+//   - KEYSTORE_ROOT
+//   - $ONRAMP_KEYSTORE
+//   - $STATE_DIRECTORY, which systemd sets for units with a StateDirectory
+//   - the working directory, if it holds keys of earlier versions, which
+//     always kept them there
+//   - $XDG_STATE_HOME/KEYSTORE_APP_NAME, or ~/.local/state/KEYSTORE_APP_NAME
+//
+// The root is found once per process, and again only if KEYSTORE_ROOT
+// changes. It doesn't create the directory.
+func KeystoreRoot() (string, error) {
+	resolvedRoot.Lock()
+	defer resolvedRoot.Unlock()
+	if resolvedRoot.root != "" && resolvedRoot.keystoreRoot == KEYSTORE_ROOT {
+		return resolvedRoot.root, nil
+	}
+	root, source, err := keystoreRoot()
+	if err != nil {
+		return "", err
+	}
+	log.WithFields(logrus.Fields{
+		"root":   root,
+		"source": source,
+	}).Debug("Resolved keystore root")
+	resolvedRoot.keystoreRoot, resolvedRoot.root = KEYSTORE_ROOT, root
+	return root, nil
+}
+
+func keystoreRoot() (root, source string, err error) {
+	if KEYSTORE_ROOT != "" {
+		root, source = KEYSTORE_ROOT, "KEYSTORE_ROOT"
+	} else if env := os.Getenv("ONRAMP_KEYSTORE"); env != "" {
+		root, source = env, "ONRAMP_KEYSTORE"
+	} else if env := filepath.SplitList(os.Getenv("STATE_DIRECTORY")); len(env) > 0 && env[0] != "" {
+		root, source = env[0], "STATE_DIRECTORY"
+	} else if wd, err := os.Getwd(); err == nil && hasLegacyKeystore(wd) {
+		root, source = wd, "working directory"
+	} else if state, err := xdgStateDir(); err == nil {
+		root, source = state, "XDG_STATE_HOME"
+	} else if wd, err := os.Getwd(); err == nil {
+		root, source = wd, "working directory"
+	} else {
+		return "", "", err
+	}
+	root, err = filepath.Abs(root)
+	return root, source, err
+}
+
+// hasLegacyKeystore reports whether dir has a key store with files in it.
+// Earlier versions created empty ones in every working directory.
+func hasLegacyKeystore(dir string) bool {
+	for _, sub := range keystoreDirs {
+		if entries, err := os.ReadDir(filepath.Join(dir, sub)); err == nil && len(entries) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// xdgStateDir returns the state directory of the application.
+func xdgStateDir() (string, error) {
+	app := KEYSTORE_APP_NAME
+	if app == "" {
+		app = strings.TrimSuffix(filepath.Base(os.Args[0]), filepath.Ext(os.Args[0]))
+	}
+	state := os.Getenv("XDG_STATE_HOME")
+	if state == "" {
+		home, err := os.UserHomeDir()
 		if err != nil {
-			log.WithError(err).WithField("path", I2P_KEYSTORE_PATH).Error("Failed to create I2P keystore directory")
 			return "", err
 		}
+		state = filepath.Join(home, ".local", "state")
 	}
-	log.WithField("path", I2P_KEYSTORE_PATH).Debug("I2P keystore path verified")
-	return I2P_KEYSTORE_PATH, nil
+	return filepath.Join(state, app), nil
 }
 
-// DeleteI2PKeyStore deletes the I2P Keystore.
-func DeleteI2PKeyStore() error {
-	log.WithField("path", I2P_KEYSTORE_PATH).Debug("Attempting to delete I2P keystore")
-	err := os.RemoveAll(I2P_KEYSTORE_PATH)
+// keystoreRoots returns every root KeystoreRoot could choose, and the
+// directory of the executable, which earlier versions were often run in.
+func keystoreRoots() []string {
+	var roots []string
+	for _, root := range []string{KEYSTORE_ROOT, os.Getenv("ONRAMP_KEYSTORE")} {
+		if root != "" {
+			roots = append(roots, root)
+		}
+	}
+	roots = append(roots, filepath.SplitList(os.Getenv("STATE_DIRECTORY"))...)
+	if wd, err := os.Getwd(); err == nil {
+		roots = append(roots, wd)
+	}
+	if state, err := xdgStateDir(); err == nil {
+		roots = append(roots, state)
+	}
+	if exe, err := os.Executable(); err == nil {
+		roots = append(roots, filepath.Dir(exe))
+	}
+	return roots
+}
+
+// warnIdentityElsewhere warns if the key file about to be generated in the
+// key store dir, named sub in a root, exists in another key store, since
+// the application probably meant to use that identity.
+func warnIdentityElsewhere(dir, sub, file string) {
+	dir, _ = filepath.Abs(dir)
+	for _, root := range keystoreRoots() {
+		other, err := filepath.Abs(filepath.Join(root, sub))
+		if err != nil || other == dir {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(other, file)); err == nil {
+			log.WithFields(logrus.Fields{
+				"existing": filepath.Join(other, file),
+				"keystore": dir,
+				"root":     root,
+			}).Warn("Generating a new identity, but one with the same name exists in another key store; set KEYSTORE_ROOT or ONRAMP_KEYSTORE to root to keep using that identity")
+			return
+		}
+	}
+}
+
+// keystoreDir returns path, or the directory sub of KeystoreRoot() if path
+// is empty.
+func keystoreDir(path, sub string) (string, error) {
+	if path != "" {
+		return path, nil
+	}
+	root, err := KeystoreRoot()
 	if err != nil {
-		log.WithError(err).WithField("path", I2P_KEYSTORE_PATH).Error("Failed to delete I2P keystore")
+		return "", err
+	}
+	return filepath.Join(root, sub), nil
+}
+
+// keystorePath is like keystoreDir, but creates the directory.
+func keystorePath(path, sub string) (string, error) {
+	dir, err := keystoreDir(path, sub)
+	if err != nil {
+		return "", err
+	}
+	log.WithField("path", dir).Debug("Checking keystore path")
+	if _, err := os.Stat(dir); err != nil {
+		log.WithField("path", dir).Debug("Keystore directory does not exist, creating")
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			log.WithError(err).WithField("path", dir).Error("Failed to create keystore directory")
+			return "", err
+		}
+	}
+	return dir, nil
+}
+
+// deleteKeystore deletes the key store at path, or sub of KeystoreRoot().
+func deleteKeystore(path, sub string) error {
+	dir, err := keystoreDir(path, sub)
+	if err != nil {
+		return err
+	}
+	log.WithField("path", dir).Debug("Attempting to delete keystore")
+	if err := os.RemoveAll(dir); err != nil {
+		log.WithError(err).WithField("path", dir).Error("Failed to delete keystore")
 		return err
 	}
-	log.WithField("path", I2P_KEYSTORE_PATH).Debug("Successfully deleted I2P keystore")
+	log.WithField("path", dir).Debug("Successfully deleted keystore")
 	return nil
-	//return os.RemoveAll(I2P_KEYSTORE_PATH)
+}
+
+// I2PKeystorePath returns the path to the I2P Keystore. If the
+// path is not set, it returns the default path. If the path does
+// not exist, it creates it.
+func I2PKeystorePath() (string, error) {
+	return keystorePath(I2P_KEYSTORE_PATH, "i2pkeys")
+}
+
+// DeleteI2PKeyStore deletes the I2P Keystore.
+func DeleteI2PKeyStore() error {
+	return deleteKeystore(I2P_KEYSTORE_PATH, "i2pkeys")
 }
 
 // TorKeystorePath returns the path to the Onion Keystore. If the
 // path is not set, it returns the default path. If the path does
 // not exist, it creates it.
 func TorKeystorePath() (string, error) {
-	log.WithField("path", ONION_KEYSTORE_PATH).Debug("Checking Tor keystore path")
-	if _, err := os.Stat(ONION_KEYSTORE_PATH); err != nil {
-		log.WithField("path", ONION_KEYSTORE_PATH).Debug("Tor keystore directory does not exist, creating")
-		err := os.MkdirAll(ONION_KEYSTORE_PATH, 0755)
-		if err != nil {
-			log.WithError(err).WithField("path", ONION_KEYSTORE_PATH).Error("Failed to create Tor keystore directory")
-			return "", err
-		}
-	}
-	log.WithField("path", ONION_KEYSTORE_PATH).Debug("Tor keystore path verified")
-	return ONION_KEYSTORE_PATH, nil
+	return keystorePath(ONION_KEYSTORE_PATH, "onionkeys")
 }
 
 // DeleteTorKeyStore deletes the Onion Keystore.
 func DeleteTorKeyStore() error {
-	log.WithField("path", ONION_KEYSTORE_PATH).Debug("Attempting to delete Tor keystore")
-	err := os.RemoveAll(ONION_KEYSTORE_PATH)
-	if err != nil {
-		log.WithError(err).WithField("path", ONION_KEYSTORE_PATH).Error("Failed to delete Tor keystore")
-		return err
-	}
-	log.WithField("path", ONION_KEYSTORE_PATH).Debug("Successfully deleted Tor keystore")
-	return nil
-	//return os.RemoveAll(ONION_KEYSTORE_PATH)
+	return deleteKeystore(ONION_KEYSTORE_PATH, "onionkeys")
 }
 
 // TLSKeystorePath returns the path to the TLS Keystore. If the
 // path is not set, it returns the default path. If the path does
 // not exist, it creates it.
 func TLSKeystorePath() (string, error) {
-	log.WithField("path", TLS_KEYSTORE_PATH).Debug("Checking TLS keystore path")
-	if _, err := os.Stat(TLS_KEYSTORE_PATH); err != nil {
-		log.WithField("path", TLS_KEYSTORE_PATH).Debug("TLS keystore directory does not exist, creating")
-		err := os.MkdirAll(TLS_KEYSTORE_PATH, 0755)
-		if err != nil {
-			log.WithError(err).WithField("path", TLS_KEYSTORE_PATH).Error("Failed to create TLS keystore directory")
-			return "", err
-		}
-	}
-	log.WithField("path", TLS_KEYSTORE_PATH).Debug("TLS keystore path verified")
-	return TLS_KEYSTORE_PATH, nil
+	return keystorePath(TLS_KEYSTORE_PATH, "tlskeys")
 }
 
 // DeleteTLSKeyStore deletes the TLS Keystore.
 func DeleteTLSKeyStore() error {
-	log.WithField("path", TLS_KEYSTORE_PATH).Debug("Attempting to delete TLS keystore")
-	err := os.RemoveAll(TLS_KEYSTORE_PATH)
-	if err != nil {
-		log.WithError(err).WithField("path", TLS_KEYSTORE_PATH).Error("Failed to delete TLS keystore")
-		return err
-	}
-	log.WithField("path", TLS_KEYSTORE_PATH).Debug("Successfully deleted TLS keystore")
-	return nil
-	//return os.RemoveAll(TLS_KEYSTORE_PATH)
+	return deleteKeystore(TLS_KEYSTORE_PATH, "tlskeys")
 }
 
 // Dial returns a connection for the given network and address.
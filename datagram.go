@@ -0,0 +1,166 @@
+package onramp
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/go-i2p/i2pkeys"
+)
+
+// datagramHeaderSize is room for the header line the SAM bridge puts before
+// every repliable datagram, the sender's destination and its ports.
+const datagramHeaderSize = 4096
+
+// datagramConn is a DATAGRAM subsession of a primary session. Its datagrams
+// are signed and carry their sender's destination, so ReadFrom returns an
+// i2pkeys.I2PAddr which WriteTo can reply to. It is also a net.Listener
+// whose Accept returns the datagramConn itself, for Listen("udp").
+type datagramConn struct {
+	udp    *net.UDPConn
+	bridge *net.UDPAddr
+	id     string
+	addr   i2pkeys.I2PAddr
+	remote net.Addr
+	// remove is called by Close to remove the subsession.
+	remove func() error
+}
+
+// newDatagramSubSession adds the DATAGRAM subsession named id to primary.
+// remove is called to remove it when it is closed.
+func newDatagramSubSession(primary *primarySession, id string, remove func() error) (*datagramConn, error) {
+	log.WithField("id", id).Debug("Creating datagram subsession")
+	bridge, err := samBridgeUDPAddr(primary.samAddr)
+	if err != nil {
+		return nil, err
+	}
+	lhost, err := localIPFor(bridge)
+	if err != nil {
+		return nil, fmt.Errorf("onramp newDatagramSubSession: %v", err)
+	}
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: lhost})
+	if err != nil {
+		return nil, err
+	}
+	port := udp.LocalAddr().(*net.UDPAddr).Port
+	if err := primary.add("DATAGRAM", id, fmt.Sprintf("PORT=%d", port), "HOST="+lhost.String()); err != nil {
+		log.WithError(err).Error("Failed to create datagram subsession")
+		udp.Close()
+		return nil, err
+	}
+	return &datagramConn{
+		udp:    udp,
+		bridge: bridge,
+		id:     id,
+		addr:   primary.keys.Addr(),
+		remove: remove,
+	}, nil
+}
+
+// ReadFrom reads one datagram. The address is the sender's
+// i2pkeys.I2PAddr.
+// implements net.PacketConn
+func (c *datagramConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buf := make([]byte, len(b)+datagramHeaderSize)
+	for {
+		n, from, err := c.udp.ReadFromUDP(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		// only the bridge forwards datagrams
+		if !from.IP.Equal(c.bridge.IP) {
+			log.WithField("from", from.String()).Debug("Dropping datagram which doesn't come from the SAM bridge")
+			continue
+		}
+		i := bytes.IndexByte(buf[:n], '\n')
+		if i < 0 {
+			log.Debug("Dropping datagram without header")
+			continue
+		}
+		// the sender comes first, its ports may follow
+		fields := strings.Fields(string(buf[:i]))
+		if len(fields) == 0 {
+			log.Debug("Dropping datagram without sender")
+			continue
+		}
+		return copy(b, buf[i+1:n]), i2pkeys.I2PAddr(fields[0]), nil
+	}
+}
+
+// WriteTo sends b as one datagram to addr, which must be an
+// i2pkeys.I2PAddr.
+// implements net.PacketConn
+func (c *datagramConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	dest, ok := addr.(i2pkeys.I2PAddr)
+	if !ok {
+		return 0, fmt.Errorf("onramp: can't send datagrams to %s address %s", addr.Network(), addr.String())
+	}
+	header := fmt.Sprintf("3.0 %s %s\n", c.id, dest.Base64())
+	if _, err := c.udp.WriteToUDP(append([]byte(header), b...), c.bridge); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Read reads one datagram.
+// implements net.Conn
+func (c *datagramConn) Read(b []byte) (int, error) {
+	n, _, err := c.ReadFrom(b)
+	return n, err
+}
+
+// Write sends b as one datagram to the remote address.
+// implements net.Conn
+func (c *datagramConn) Write(b []byte) (int, error) {
+	if c.remote == nil {
+		return 0, fmt.Errorf("onramp: datagram session %s has no remote address", c.id)
+	}
+	return c.WriteTo(b, c.remote)
+}
+
+// Accept returns the datagramConn itself.
+// implements net.Listener
+func (c *datagramConn) Accept() (net.Conn, error) {
+	return c, nil
+}
+
+// Addr returns the destination of the subsession.
+// implements net.Listener
+func (c *datagramConn) Addr() net.Addr {
+	return c.addr
+}
+
+// Close closes the UDP socket and removes the subsession.
+func (c *datagramConn) Close() error {
+	if err := c.udp.Close(); err != nil {
+		return err
+	}
+	if c.remove != nil {
+		return c.remove()
+	}
+	return nil
+}
+
+// LocalAddr returns the destination of the subsession.
+func (c *datagramConn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+// RemoteAddr returns the remote destination, or nil.
+func (c *datagramConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *datagramConn) SetDeadline(t time.Time) error {
+	return c.udp.SetDeadline(t)
+}
+
+func (c *datagramConn) SetReadDeadline(t time.Time) error {
+	return c.udp.SetReadDeadline(t)
+}
+
+func (c *datagramConn) SetWriteDeadline(t time.Time) error {
+	return c.udp.SetWriteDeadline(t)
+}
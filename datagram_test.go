@@ -0,0 +1,73 @@
+//go:build !gen
+// +build !gen
+
+package onramp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-i2p/i2pkeys"
+)
+
+func TestDatagramSubSession(t *testing.T) {
+	sam := newFakeSAM(t)
+	open := func(name string) (*primarySession, *datagramConn) {
+		keys := i2pkeys.NewKeys(i2pkeys.I2PAddr("fake"+name), "fake"+name+"-priv")
+		primary, err := newPrimarySession(sam.Addr(), name, keys, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { primary.Close() })
+		conn, err := newDatagramSubSession(primary, name+"-datagram", func() error {
+			return primary.remove(name + "-datagram")
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return primary, conn
+	}
+	primary, listener := open("listener")
+	_, dialer := open("dialer")
+	defer dialer.Close()
+
+	dest, err := primary.lookup("fakedialer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := primary.lookup("unknown.i2p"); err == nil {
+		t.Error("looked up an unknown name")
+	}
+	if _, err := listener.WriteTo([]byte("hello"), dest); err != nil {
+		t.Fatal(err)
+	}
+	dialer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 64)
+	n, from, err := dialer.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "hello" || from.String() != listener.LocalAddr().String() {
+		t.Errorf("read %q from %s", buf[:n], from)
+	}
+	// the sender can be replied to
+	if _, err := dialer.WriteTo([]byte("hi"), from); err != nil {
+		t.Fatal(err)
+	}
+	listener.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := listener.Read(buf); err != nil || string(buf[:n]) != "hi" {
+		t.Errorf("read %q, %v", buf[:n], err)
+	}
+
+	if err := listener.Close(); err != nil {
+		t.Fatal(err)
+	}
+	sam.mu.Lock()
+	defer sam.mu.Unlock()
+	if _, ok := sam.sessions["listener-datagram"]; ok {
+		t.Error("closing the subsession didn't remove it")
+	}
+	if _, ok := sam.sessions["listener"]; !ok {
+		t.Error("closing the subsession closed the primary session")
+	}
+}
@@ -0,0 +1,10 @@
+// Package onramp provides listeners and dialers for I2P and Tor hidden
+// services which keep their keys between runs of the application.
+//
+// The keys are kept in the "i2pkeys", "onionkeys" and "tlskeys" key stores
+// of the directory KeystoreRoot finds once per process, unless KEYSTORE
+// keeps them elsewhere. I2P_KEYSTORE_PATH, ONION_KEYSTORE_PATH and
+// TLS_KEYSTORE_PATH override the directory of one key store. They are
+// empty unless set, also once the root is found, so read the directories
+// in use with I2PKeystorePath, TorKeystorePath and TLSKeystorePath.
+package onramp
@@ -0,0 +1,153 @@
+package onramp
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/pion/dtls/v2"
+	"github.com/sirupsen/logrus"
+)
+
+// DTLS_MTU is the largest DTLS record onramp sends in a single datagram.
+// I2P datagrams up to about 11KB are delivered reliably.
+var DTLS_MTU = 8 * 1024
+
+// DTLS_FLIGHT_INTERVAL is how long a DTLS handshake waits for an answer
+// before retransmitting. It is long because of hidden service latency.
+var DTLS_FLIGHT_INTERVAL = 3 * time.Second
+
+// DTLSListener accepts DTLS sessions, one per remote peer of a packet
+// session. Handshakes run concurrently, Accept returns connections which
+// completed them. Sessions which aren't accepted within
+// TLS_HANDSHAKE_TIMEOUT are closed.
+type DTLSListener struct {
+	mux    *packetMux
+	config *dtls.Config
+	accept *virtualListener
+}
+
+// NewDTLSListener returns a DTLSListener for the peers of pc. It takes
+// over reading from pc.
+func NewDTLSListener(pc net.PacketConn, config *dtls.Config) *DTLSListener {
+	return newDTLSListener(newPacketMux(pc), config)
+}
+
+func newDTLSListener(mux *packetMux, config *dtls.Config) *DTLSListener {
+	log.WithField("address", mux.Addr().String()).Debug("Creating DTLS listener")
+	l := &DTLSListener{
+		mux:    mux,
+		config: config,
+		accept: newVirtualListener(mux.Addr()),
+	}
+	mux.listen()
+	go l.serve()
+	return l
+}
+
+func (l *DTLSListener) serve() {
+	for {
+		conn, err := l.mux.Accept()
+		if err != nil {
+			log.WithError(err).Debug("DTLS listener stopped accepting")
+			l.accept.Close()
+			return
+		}
+		go l.handshake(conn)
+	}
+}
+
+func (l *DTLSListener) handshake(conn net.Conn) {
+	ctx, cancel := context.WithTimeout(context.Background(), TLS_HANDSHAKE_TIMEOUT)
+	defer cancel()
+	dconn, err := dtls.ServerWithContext(ctx, conn, l.config)
+	if err != nil {
+		log.WithError(err).WithField("peer", conn.RemoteAddr().String()).Debug("DTLS handshake failed")
+		conn.Close()
+		return
+	}
+	if !l.accept.deliverTimeout(dconn, TLS_HANDSHAKE_TIMEOUT) {
+		log.WithField("peer", conn.RemoteAddr().String()).Debug("Closing unaccepted DTLS session")
+		dconn.Close()
+	}
+}
+
+// Accept returns the next DTLS session.
+// implements net.Listener
+func (l *DTLSListener) Accept() (net.Conn, error) {
+	return l.accept.Accept()
+}
+
+// Close closes the listener and the packet session it reads from.
+// implements net.Listener
+func (l *DTLSListener) Close() error {
+	l.accept.Close()
+	return l.mux.Close()
+}
+
+// implements net.Listener
+func (l *DTLSListener) Addr() net.Addr {
+	return l.mux.Addr()
+}
+
+// Dial opens a DTLS session to addr over the listener's packet session,
+// so the peer sees the same return address as for accepted sessions.
+func (l *DTLSListener) Dial(addr net.Addr, config *dtls.Config) (net.Conn, error) {
+	return dialDTLS(l.mux, addr, config)
+}
+
+func dialDTLS(mux *packetMux, addr net.Addr, config *dtls.Config) (net.Conn, error) {
+	log.WithField("address", addr.String()).Debug("Dialing DTLS session")
+	conn := mux.Connect(addr)
+	ctx, cancel := context.WithTimeout(context.Background(), TLS_HANDSHAKE_TIMEOUT)
+	defer cancel()
+	dconn, err := dtls.ClientWithContext(ctx, conn, config)
+	if err != nil {
+		log.WithError(err).Error("DTLS handshake failed")
+		conn.Close()
+		return nil, err
+	}
+	return dconn, nil
+}
+
+// DTLSServerConfig returns the DTLS configuration onramp uses to serve
+// cert over a hidden service.
+func DTLSServerConfig(cert tls.Certificate) *dtls.Config {
+	return &dtls.Config{
+		Certificates:         []tls.Certificate{cert},
+		ExtendedMasterSecret: dtls.RequireExtendedMasterSecret,
+		MTU:                  DTLS_MTU,
+		FlightInterval:       DTLS_FLIGHT_INTERVAL,
+	}
+}
+
+// DTLSClientConfig returns the DTLS configuration onramp uses to connect
+// to host. Like DialTLS it accepts self-signed certificates, since the
+// hidden service address authenticates the server, unless they were
+// revoked in the TLS keystore.
+func DTLSClientConfig(host string) *dtls.Config {
+	return &dtls.Config{
+		ServerName:           host,
+		InsecureSkipVerify:   true,
+		ExtendedMasterSecret: dtls.RequireExtendedMasterSecret,
+		MTU:                  DTLS_MTU,
+		FlightInterval:       DTLS_FLIGHT_INTERVAL,
+		VerifyConnection: func(state *dtls.State) error {
+			if len(state.PeerCertificates) == 0 {
+				return fmt.Errorf("onramp: DTLS server sent no certificate")
+			}
+			cert, err := x509.ParseCertificate(state.PeerCertificates[0])
+			if err != nil {
+				return err
+			}
+			log.WithFields(logrus.Fields{
+				"host":   host,
+				"serial": cert.SerialNumber.Text(16),
+			}).Debug("Checking DTLS server certificate")
+			return CheckTLSRevocation(host, cert)
+		},
+	}
+}
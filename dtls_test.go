@@ -0,0 +1,77 @@
+//go:build !gen
+// +build !gen
+
+package onramp
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+func TestDTLSListener(t *testing.T) {
+	defer func(path string) { TLS_KEYSTORE_PATH = path }(TLS_KEYSTORE_PATH)
+	TLS_KEYSTORE_PATH = t.TempDir()
+	const host = "dtls.example.i2p"
+	cert, err := TLSKeysWithProfile(host, &CertProfile{KeyAlgorithm: CERT_KEY_ECDSA_P256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewDTLSListener(server, DTLSServerConfig(cert))
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 1024)
+				n, err := conn.Read(buf)
+				if err != nil {
+					return
+				}
+				conn.Write(buf[:n])
+			}()
+		}
+	}()
+
+	dial := func() (net.Conn, error) {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { pc.Close() })
+		return dialDTLS(newPacketMux(pc), server.LocalAddr(), DTLSClientConfig(host))
+	}
+	for i := 0; i < 2; i++ {
+		conn, err := dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != "ping" {
+			t.Errorf("echoed %q", buf)
+		}
+		conn.Close()
+	}
+
+	if err := RevokeTLSCertificate(host, CRL_REASON_KEY_COMPROMISE); err != nil {
+		t.Fatal(err)
+	}
+	if conn, err := dial(); err == nil {
+		conn.Close()
+		t.Error("dialed a server with a revoked certificate")
+	}
+}
@@ -0,0 +1,278 @@
+package onramp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// FRAGMENT_SIZE is the most payload a FragmentConn puts in one datagram.
+// I2P delivers datagrams up to about 11KB reliably, larger ones often get
+// lost. A FragmentConn drops messages split into more fragments than its
+// maximum message size needs at its own FRAGMENT_SIZE, so the sender's
+// can't be smaller than the receiver's.
+var FRAGMENT_SIZE = 10 * 1024
+
+// FRAGMENT_MAX_MESSAGE_SIZE is the largest message a FragmentConn sends or
+// reassembles when no other size is given.
+var FRAGMENT_MAX_MESSAGE_SIZE = 256 * 1024
+
+// FRAGMENT_REASSEMBLY_TIMEOUT is how long a FragmentConn waits for the
+// missing fragments of a message before it drops the message, and how
+// long it remembers delivered messages to drop duplicates of them.
+var FRAGMENT_REASSEMBLY_TIMEOUT = 30 * time.Second
+
+// FRAGMENT_MAX_PARTIAL_MESSAGES is how many incomplete messages a
+// FragmentConn keeps at most, and FRAGMENT_MAX_PARTIAL_PER_SENDER how many
+// of them from one sender. When a message would exceed either, the oldest
+// incomplete one is dropped.
+var (
+	FRAGMENT_MAX_PARTIAL_MESSAGES   = 64
+	FRAGMENT_MAX_PARTIAL_PER_SENDER = 8
+)
+
+// fragmentHeaderSize is the size of the header before every fragment: the
+// message ID as a big-endian uint32, then the fragment index and the
+// fragment count as big-endian uint16s.
+const fragmentHeaderSize = 8
+
+// fragmentKey identifies a message by its sender and ID.
+type fragmentKey struct {
+	addr string
+	id   uint32
+}
+
+// partialMessage collects the fragments of a message until all of them
+// arrived.
+type partialMessage struct {
+	fragments [][]byte
+	missing   int
+	size      int
+	started   time.Time
+	// seq orders the partial messages by arrival, since started may not
+	// tell them apart
+	seq uint64
+}
+
+// FragmentConn is a net.PacketConn which splits messages larger than
+// FRAGMENT_SIZE into several datagrams and puts them back together on the
+// other side. Each ReadFrom returns one whole message. Messages with lost
+// fragments are dropped after FRAGMENT_REASSEMBLY_TIMEOUT, and duplicated
+// messages are delivered once. Both ends must use a FragmentConn.
+type FragmentConn struct {
+	net.PacketConn
+	maxMessageSize int
+
+	mu        sync.Mutex
+	next      uint32
+	partial   map[fragmentKey]*partialMessage
+	seq       uint64
+	delivered map[fragmentKey]time.Time
+	swept     time.Time
+}
+
+// NewFragmentConn wraps pc, which sends and receives messages of up to
+// maxMessageSize bytes, or FRAGMENT_MAX_MESSAGE_SIZE if it is 0.
+func NewFragmentConn(pc net.PacketConn, maxMessageSize int) *FragmentConn {
+	if maxMessageSize <= 0 {
+		maxMessageSize = FRAGMENT_MAX_MESSAGE_SIZE
+	}
+	var id [4]byte
+	rand.Read(id[:])
+	return &FragmentConn{
+		PacketConn:     pc,
+		maxMessageSize: maxMessageSize,
+		next:           binary.BigEndian.Uint32(id[:]),
+		partial:        make(map[fragmentKey]*partialMessage),
+		delivered:      make(map[fragmentKey]time.Time),
+	}
+}
+
+// MaxMessageSize returns the largest message c sends or reassembles.
+func (c *FragmentConn) MaxMessageSize() int {
+	return c.maxMessageSize
+}
+
+// WriteTo sends b as one message to addr, in as many datagrams as needed.
+// implements net.PacketConn
+func (c *FragmentConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if len(b) > c.maxMessageSize {
+		return 0, fmt.Errorf("onramp: message of %d bytes is larger than the maximum of %d", len(b), c.maxMessageSize)
+	}
+	count := (len(b) + FRAGMENT_SIZE - 1) / FRAGMENT_SIZE
+	if count == 0 {
+		count = 1
+	}
+	if count > 0xffff {
+		return 0, fmt.Errorf("onramp: message of %d bytes needs too many fragments", len(b))
+	}
+	c.mu.Lock()
+	id := c.next
+	c.next++
+	c.mu.Unlock()
+	log.WithFields(logrus.Fields{
+		"id":        id,
+		"size":      len(b),
+		"fragments": count,
+	}).Debug("Sending fragmented message")
+	datagram := make([]byte, fragmentHeaderSize+FRAGMENT_SIZE)
+	for i := 0; i < count; i++ {
+		chunk := b[i*FRAGMENT_SIZE : min((i+1)*FRAGMENT_SIZE, len(b))]
+		binary.BigEndian.PutUint32(datagram[0:], id)
+		binary.BigEndian.PutUint16(datagram[4:], uint16(i))
+		binary.BigEndian.PutUint16(datagram[6:], uint16(count))
+		n := copy(datagram[fragmentHeaderSize:], chunk)
+		if _, err := c.PacketConn.WriteTo(datagram[:fragmentHeaderSize+n], addr); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// ReadFrom reads the next complete message. If b is too small the message
+// is truncated and the error wraps io.ErrShortBuffer.
+// implements net.PacketConn
+func (c *FragmentConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buf := make([]byte, MAX_DATAGRAM_SIZE)
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		message, err := c.reassemble(buf[:n], addr)
+		if err != nil {
+			log.WithError(err).WithField("from", addr.String()).Debug("Dropping fragment")
+			continue
+		}
+		if message == nil {
+			continue
+		}
+		if len(message) > len(b) {
+			return copy(b, message), addr, fmt.Errorf("onramp: message of %d bytes doesn't fit in %d: %w", len(message), len(b), io.ErrShortBuffer)
+		}
+		return copy(b, message), addr, nil
+	}
+}
+
+// reassemble adds a fragment and returns the message once it is complete.
+func (c *FragmentConn) reassemble(datagram []byte, addr net.Addr) ([]byte, error) {
+	if len(datagram) < fragmentHeaderSize {
+		return nil, fmt.Errorf("onramp: fragment of %d bytes is too short", len(datagram))
+	}
+	key := fragmentKey{addr: addr.String(), id: binary.BigEndian.Uint32(datagram[0:])}
+	index := int(binary.BigEndian.Uint16(datagram[4:]))
+	count := int(binary.BigEndian.Uint16(datagram[6:]))
+	if count == 0 || index >= count {
+		return nil, fmt.Errorf("onramp: bad fragment %d of %d", index, count)
+	}
+	if count > (c.maxMessageSize+FRAGMENT_SIZE-1)/FRAGMENT_SIZE {
+		return nil, fmt.Errorf("onramp: message in %d fragments is larger than the maximum of %d", count, c.maxMessageSize)
+	}
+	payload := datagram[fragmentHeaderSize:]
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	c.sweep(now)
+	if _, ok := c.delivered[key]; ok {
+		return nil, nil
+	}
+	p, ok := c.partial[key]
+	if !ok {
+		c.evict(key.addr)
+		c.seq++
+		p = &partialMessage{fragments: make([][]byte, count), missing: count, started: now, seq: c.seq}
+		c.partial[key] = p
+	}
+	if len(p.fragments) != count {
+		delete(c.partial, key)
+		return nil, fmt.Errorf("onramp: fragment count of message %d changed", key.id)
+	}
+	if p.fragments[index] != nil {
+		return nil, nil
+	}
+	p.size += len(payload)
+	if p.size > c.maxMessageSize {
+		delete(c.partial, key)
+		return nil, fmt.Errorf("onramp: message %d is larger than the maximum of %d", key.id, c.maxMessageSize)
+	}
+	p.fragments[index] = append([]byte{}, payload...)
+	p.missing--
+	if p.missing > 0 {
+		return nil, nil
+	}
+	delete(c.partial, key)
+	c.delivered[key] = now
+	message := make([]byte, 0, p.size)
+	for _, fragment := range p.fragments {
+		message = append(message, fragment...)
+	}
+	return message, nil
+}
+
+// sweep forgets partial messages which timed out and delivered messages
+// which are too old to be duplicated. mu must be held.
+func (c *FragmentConn) sweep(now time.Time) {
+	if now.Sub(c.swept) < FRAGMENT_REASSEMBLY_TIMEOUT/10 {
+		return
+	}
+	c.swept = now
+	for key, p := range c.partial {
+		if now.Sub(p.started) > FRAGMENT_REASSEMBLY_TIMEOUT {
+			log.WithFields(logrus.Fields{
+				"id":      key.id,
+				"from":    key.addr,
+				"missing": p.missing,
+			}).Debug("Dropping incomplete message")
+			delete(c.partial, key)
+		}
+	}
+	for key, t := range c.delivered {
+		if now.Sub(t) > FRAGMENT_REASSEMBLY_TIMEOUT {
+			delete(c.delivered, key)
+		}
+	}
+}
+
+// evict drops the oldest incomplete messages until another one from addr
+// fits in FRAGMENT_MAX_PARTIAL_PER_SENDER and FRAGMENT_MAX_PARTIAL_MESSAGES.
+// mu must be held.
+func (c *FragmentConn) evict(addr string) {
+	for {
+		var total, fromAddr int
+		var oldest, oldestFromAddr fragmentKey
+		for key, p := range c.partial {
+			total++
+			if total == 1 || p.seq < c.partial[oldest].seq {
+				oldest = key
+			}
+			if key.addr == addr {
+				fromAddr++
+				if fromAddr == 1 || p.seq < c.partial[oldestFromAddr].seq {
+					oldestFromAddr = key
+				}
+			}
+		}
+		var drop fragmentKey
+		switch {
+		case fromAddr > 0 && fromAddr >= FRAGMENT_MAX_PARTIAL_PER_SENDER:
+			drop = oldestFromAddr
+		case total > 0 && total >= FRAGMENT_MAX_PARTIAL_MESSAGES:
+			drop = oldest
+		default:
+			return
+		}
+		log.WithFields(logrus.Fields{
+			"id":      drop.id,
+			"from":    drop.addr,
+			"missing": c.partial[drop].missing,
+		}).Debug("Dropping incomplete message for a newer one")
+		delete(c.partial, drop)
+	}
+}
@@ -0,0 +1,160 @@
+//go:build !gen
+// +build !gen
+
+package onramp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// duplicatingPacketConn sends every datagram twice.
+type duplicatingPacketConn struct {
+	net.PacketConn
+}
+
+func (d *duplicatingPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if _, err := d.PacketConn.WriteTo(b, addr); err != nil {
+		return 0, err
+	}
+	return d.PacketConn.WriteTo(b, addr)
+}
+
+func TestFragmentConn(t *testing.T) {
+	defer func(size int) { FRAGMENT_SIZE = size }(FRAGMENT_SIZE)
+	FRAGMENT_SIZE = 1024
+	listen := func() net.PacketConn {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pc
+	}
+	server := NewFragmentConn(listen(), 32*1024)
+	defer server.Close()
+	client := NewFragmentConn(&duplicatingPacketConn{listen()}, 32*1024)
+	defer client.Close()
+
+	message := make([]byte, 20*1024+17)
+	rand.Read(message)
+	if _, err := client.WriteTo(message, server.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.WriteTo([]byte("next"), server.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 64*1024)
+	n, _, err := server.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:n], message) {
+		t.Fatalf("read %d bytes, which differ from the %d sent", n, len(message))
+	}
+	// the duplicated fragments must not deliver the message again
+	n, _, err = server.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "next" {
+		t.Errorf("read %d bytes instead of the next message", n)
+	}
+
+	if _, err := client.WriteTo(make([]byte, 32*1024+1), server.LocalAddr()); err == nil {
+		t.Error("sent a message larger than the maximum")
+	}
+	if _, err := client.WriteTo(message, server.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := server.ReadFrom(buf[:100]); !errors.Is(err, io.ErrShortBuffer) {
+		t.Errorf("read into a short buffer: %v", err)
+	}
+}
+
+// fragment returns a datagram with the fragment header of a FragmentConn.
+func fragment(id, index, count uint16, payload string) []byte {
+	return append([]byte{0, 0, byte(id >> 8), byte(id), byte(index >> 8), byte(index), byte(count >> 8), byte(count)}, payload...)
+}
+
+func TestFragmentReassembly(t *testing.T) {
+	defer func(d time.Duration) { FRAGMENT_REASSEMBLY_TIMEOUT = d }(FRAGMENT_REASSEMBLY_TIMEOUT)
+	defer func(size int) { FRAGMENT_SIZE = size }(FRAGMENT_SIZE)
+	FRAGMENT_REASSEMBLY_TIMEOUT = 50 * time.Millisecond
+	FRAGMENT_SIZE = 5
+	c := NewFragmentConn(nil, 10)
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+
+	// fragments may arrive in any order
+	if m, err := c.reassemble(fragment(1, 1, 2, "lo"), addr); m != nil || err != nil {
+		t.Fatalf("reassembled %q, %v from half a message", m, err)
+	}
+	if m, _ := c.reassemble(fragment(1, 0, 2, "hel"), addr); string(m) != "hello" {
+		t.Errorf("reassembled %q", m)
+	}
+
+	// incomplete messages time out
+	c.reassemble(fragment(2, 0, 2, "a"), addr)
+	time.Sleep(2 * FRAGMENT_REASSEMBLY_TIMEOUT)
+	if m, _ := c.reassemble(fragment(2, 1, 2, "b"), addr); m != nil {
+		t.Errorf("reassembled %q after the timeout", m)
+	}
+
+	if _, err := c.reassemble(fragment(3, 0, 2, "0123456789a"), addr); err == nil {
+		t.Error("reassembled a message larger than the maximum")
+	}
+	if _, err := c.reassemble(fragment(4, 2, 2, "x"), addr); err == nil {
+		t.Error("accepted a fragment index beyond the count")
+	}
+}
+
+func TestFragmentHostilePeer(t *testing.T) {
+	defer func(n int) { FRAGMENT_MAX_PARTIAL_MESSAGES = n }(FRAGMENT_MAX_PARTIAL_MESSAGES)
+	defer func(n int) { FRAGMENT_MAX_PARTIAL_PER_SENDER = n }(FRAGMENT_MAX_PARTIAL_PER_SENDER)
+	FRAGMENT_MAX_PARTIAL_MESSAGES = 6
+	FRAGMENT_MAX_PARTIAL_PER_SENDER = 3
+	c := NewFragmentConn(nil, 3*FRAGMENT_SIZE)
+	hostile := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+
+	// a count the maximum message size can't need allocates nothing
+	if _, err := c.reassemble(fragment(1, 0, 0xffff, "x"), hostile); err == nil {
+		t.Error("accepted 65535 fragments")
+	}
+	if _, err := c.reassemble(fragment(1, 0, 4, "x"), hostile); err == nil {
+		t.Error("accepted more fragments than the maximum message size needs")
+	}
+	if len(c.partial) != 0 {
+		t.Errorf("kept %d partial messages", len(c.partial))
+	}
+
+	// a sender only has a few incomplete messages, the newest ones
+	for id := uint16(1); id <= 10; id++ {
+		c.reassemble(fragment(id, 0, 3, "x"), hostile)
+	}
+	if len(c.partial) != FRAGMENT_MAX_PARTIAL_PER_SENDER {
+		t.Errorf("kept %d partial messages of one sender", len(c.partial))
+	}
+	if _, ok := c.partial[fragmentKey{hostile.String(), 10}]; !ok {
+		t.Error("dropped the newest partial message")
+	}
+
+	// and all senders together a few more
+	for port := 2; port <= 10; port++ {
+		c.reassemble(fragment(1, 0, 3, "x"), &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+	}
+	if len(c.partial) != FRAGMENT_MAX_PARTIAL_MESSAGES {
+		t.Errorf("kept %d partial messages", len(c.partial))
+	}
+
+	// which doesn't keep others from completing messages
+	honest := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 1}
+	c.reassemble(fragment(7, 0, 2, "hel"), honest)
+	if m, _ := c.reassemble(fragment(7, 1, 2, "lo"), honest); string(m) != "hello" {
+		t.Errorf("reassembled %q", m)
+	}
+}
@@ -6,31 +6,79 @@ package onramp
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
 
 	"github.com/go-i2p/i2pkeys"
 	"github.com/go-i2p/sam3"
+	"github.com/quic-go/quic-go"
 )
 
 // Garlic is a ready-made I2P streaming manager. Once initialized it always
-// has a valid I2PKeys and StreamSession.
+// has a valid I2PKeys and stream session. Its stream, datagram and raw
+// sessions are subsessions of one SAM primary session, so they share a
+// destination and a set of tunnels.
 type Garlic struct {
-	*sam3.StreamListener
-	*sam3.StreamSession
-	*sam3.DatagramSession
 	ServiceKeys *i2pkeys.I2PKeys
-	*sam3.SAM
 	name        string
 	addr        string
 	opts        []string
 	AddrMode    int
 	TorrentMode bool
+	// CertProfile controls how TLS certificates are generated for the
+	// service, DefaultGarlicCertProfile() if nil.
+	CertProfile *CertProfile
+	// TLSClientConfig is used by DialTLS. If nil, self-signed server
+	// certificates are accepted unless they have been revoked.
+	TLSClientConfig *tls.Config
+	// NextProtos is the list of ALPN protocols offered by ListenTLS, in
+	// order of preference, for instance "h2" and "http/1.1".
+	NextProtos []string
+	// QUICConfig is used by ListenQUIC and DialQUIC, DefaultQUICConfig()
+	// if nil.
+	QUICConfig *quic.Config
+	// EncryptedLeaseSet makes the service reachable only by its b33
+	// address, and optionally only by authorized clients. It has to be
+	// set before the first session is created.
+	EncryptedLeaseSet *EncryptedLeaseSet
+	// LeaseSetCredentials are used to reach services with encrypted
+	// LeaseSets. They have to be set before the first session is created.
+	LeaseSetCredentials *LeaseSetCredentials
+	// KeyTypes are the types of the keys the Garlic structure generates,
+	// and requires of stored keys. If nil, I2P_KEY_TYPES are used to
+	// generate keys and stored keys of any type are accepted.
+	KeyTypes *I2PKeyTypes
+
+	// primaryMu guards the primary session and its stream and datagram
+	// subsessions.
+	primaryMu sync.Mutex
+	primary   *primarySession
+	streamID  string
+	datagram  *datagramConn
+	rawMu     sync.Mutex
+	rawConns  []*RawConn
+
+	streamMu       sync.Mutex
+	streamListener *portListener
+	portListeners  map[int]*portListener
+
+	packetMu         sync.Mutex
+	packetMux        *packetMux
+	packetProtocol   string
+	dtlsListener     *DTLSListener
+	reliableListener *ReliableListener
+	quicTransport    *quic.Transport
+	quicSessions     tls.ClientSessionCache
+	fragmentConn     *FragmentConn
 }
 
 const (
@@ -40,14 +88,22 @@ const (
 	DEST_BASE32_TRUNCATED = 3
 	DEST_BASE64           = 4
 	DEST_BASE64_BYTES     = 5
+	DEST_BASE33           = 6
 )
 
+// Network returns "udp" if the Garlic structure only has datagram or raw
+// sessions and "tcp" otherwise, since streaming is what it sets up by
+// default.
 func (g *Garlic) Network() string {
-	if g.StreamListener != nil {
-		return "tcp"
-	} else {
+	g.primaryMu.Lock()
+	stream, datagram := g.streamID != "", g.datagram != nil
+	g.primaryMu.Unlock()
+	g.rawMu.Lock()
+	defer g.rawMu.Unlock()
+	if !stream && (datagram || len(g.rawConns) > 0) {
 		return "udp"
 	}
+	return "tcp"
 }
 
 func (g *Garlic) addrString(addr string) string {
@@ -73,6 +129,12 @@ func (g *Garlic) String() string {
 		r = g.ServiceKeys.Address.Base64()
 	case DEST_BASE64_BYTES:
 		r = string(g.ServiceKeys.Address.Bytes())
+	case DEST_BASE33:
+		var err error
+		if r, err = g.Base33(); err != nil {
+			log.WithError(err).Error("Failed to get b33 address, using b32 address")
+			r = g.ServiceKeys.Address.Base32()
+		}
 	default:
 		r = g.ServiceKeys.Address.DestHash().Hash()
 	}
@@ -100,75 +162,133 @@ func (g *Garlic) getOptions() []string {
 	return g.opts
 }
 
-func (g *Garlic) samSession() (*sam3.SAM, error) {
-	if g.SAM == nil {
-		log.WithField("address", g.getAddr()).Debug("Creating new SAM session")
+// hasOption reports whether opts set the option name.
+func hasOption(opts []string, name string) bool {
+	for _, opt := range opts {
+		if strings.HasPrefix(opt, name+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+// setupPrimarySession creates the SAM primary session which the stream,
+// datagram and raw subsessions are added to.
+func (g *Garlic) setupPrimarySession() (*primarySession, error) {
+	g.primaryMu.Lock()
+	defer g.primaryMu.Unlock()
+	return g.primarySession()
+}
+
+// primarySession is setupPrimarySession for callers holding primaryMu.
+func (g *Garlic) primarySession() (*primarySession, error) {
+	if g.primary == nil {
+		log.WithField("name", g.getName()).Debug("Setting up primary session")
 		var err error
-		g.SAM, err = sam3.NewSAM(g.getAddr())
+		g.ServiceKeys, err = g.Keys()
 		if err != nil {
-			log.WithError(err).Error("Failed to create SAM session")
-			return nil, fmt.Errorf("onramp samSession: %v", err)
+			log.WithError(err).Error("Failed to get keys for primary session")
+			return nil, fmt.Errorf("onramp setupPrimarySession: %v", err)
 		}
-		log.Debug("SAM session created successfully")
+		lsopts, err := g.leaseSetOptions()
+		if err != nil {
+			log.WithError(err).Error("Invalid LeaseSet configuration")
+			return nil, fmt.Errorf("onramp setupPrimarySession: %v", err)
+		}
+		log.WithField("address", g.ServiceKeys.Address.Base32()).Debug("Creating primary session with keys")
+		opts := append(append([]string{}, g.getOptions()...), lsopts...)
+		if g.KeyTypes != nil && !hasOption(opts, "i2cp.leaseSetEncType") {
+			opts = append(opts, g.KeyTypes.options()...)
+		}
+		g.primary, err = newPrimarySession(g.getAddr(), g.getName(), *g.ServiceKeys, opts)
+		if err != nil {
+			log.WithError(err).Error("Failed to create primary session")
+			return nil, fmt.Errorf("onramp setupPrimarySession: %v", err)
+		}
+		log.Debug("Primary session created successfully")
 	}
-	return g.SAM, nil
+	return g.primary, nil
 }
 
-func (g *Garlic) setupStreamSession() (*sam3.StreamSession, error) {
-	if g.StreamSession == nil {
+// setupStreamSession adds the STREAM subsession on port 0, which dials the
+// Garlic structure's streams and accepts those to ports without a
+// listener, and returns its ID.
+func (g *Garlic) setupStreamSession() (string, error) {
+	g.primaryMu.Lock()
+	defer g.primaryMu.Unlock()
+	if g.streamID == "" {
 		log.WithField("name", g.getName()).Debug("Setting up stream session")
-		var err error
-		g.ServiceKeys, err = g.Keys()
+		primary, err := g.primarySession()
 		if err != nil {
-			log.WithError(err).Error("Failed to get keys for stream session")
-			return nil, fmt.Errorf("onramp setupStreamSession: %v", err)
+			log.WithError(err).Error("Failed to get primary session for stream session")
+			return "", fmt.Errorf("onramp setupStreamSession: %v", err)
 		}
 		log.WithField("address", g.ServiceKeys.Address.Base32()).Debug("Creating stream session with keys")
-		log.Println("Creating stream session with keys:", g.ServiceKeys.Address.Base32())
-		g.StreamSession, err = g.SAM.NewStreamSession(g.getName(), *g.ServiceKeys, g.getOptions())
-		if err != nil {
+		id := g.getName() + "-stream"
+		if err := primary.add("STREAM", id, "FROM_PORT=0", "TO_PORT=0"); err != nil {
 			log.WithError(err).Error("Failed to create stream session")
-			return nil, fmt.Errorf("onramp setupStreamSession: %v", err)
+			return "", fmt.Errorf("onramp setupStreamSession: %v", err)
 		}
+		g.streamID = id
 		log.Debug("Stream session created successfully")
-		return g.StreamSession, nil
 	}
-	return g.StreamSession, nil
+	return g.streamID, nil
 }
 
-func (g *Garlic) setupDatagramSession() (*sam3.DatagramSession, error) {
-	if g.DatagramSession == nil {
+func (g *Garlic) setupDatagramSession() (*datagramConn, error) {
+	g.primaryMu.Lock()
+	defer g.primaryMu.Unlock()
+	if g.datagram == nil {
 		log.WithField("name", g.getName()).Debug("Setting up datagram session")
-		var err error
-		g.ServiceKeys, err = g.Keys()
+		primary, err := g.primarySession()
 		if err != nil {
-			log.WithError(err).Error("Failed to get keys for datagram session")
+			log.WithError(err).Error("Failed to get primary session for datagram session")
 			return nil, fmt.Errorf("onramp setupDatagramSession: %v", err)
 		}
 		log.WithField("address", g.ServiceKeys.Address.Base32()).Debug("Creating datagram session with keys")
-		log.Println("Creating datagram session with keys:", g.ServiceKeys.Address.Base32())
-		g.DatagramSession, err = g.SAM.NewDatagramSession(g.getName(), *g.ServiceKeys, g.getOptions(), 0)
+		var conn *datagramConn
+		id := g.getName() + "-datagram"
+		conn, err = newDatagramSubSession(primary, id, func() error {
+			g.primaryMu.Lock()
+			if g.datagram == conn {
+				g.datagram = nil
+			}
+			g.primaryMu.Unlock()
+			return g.removeSubSession(id)
+		})
 		if err != nil {
-			log.WithError(err).Error("Failed to create datagram session")
 			return nil, fmt.Errorf("onramp setupDatagramSession: %v", err)
 		}
+		g.datagram = conn
 		log.Debug("Datagram session created successfully")
-		return g.DatagramSession, nil
+		return g.datagram, nil
 	}
 
 	log.Debug("Using existing datagram session")
-	return g.DatagramSession, nil
+	return g.datagram, nil
 }
 
-// NewListener returns a net.Listener for the Garlic structure's I2P keys.
-// accepts a variable list of arguments, arguments after the first one are ignored.
+// removeSubSession removes the subsession id from the primary session,
+// unless the primary session was closed meanwhile.
+func (g *Garlic) removeSubSession(id string) error {
+	g.primaryMu.Lock()
+	primary := g.primary
+	g.primaryMu.Unlock()
+	if primary == nil {
+		return nil
+	}
+	return primary.remove(id)
+}
+
+// NewListener returns a net.Listener for the Garlic structure's I2P keys,
+// see Listen.
 func (g *Garlic) NewListener(n, addr string) (net.Listener, error) {
 	log.WithFields(logrus.Fields{
 		"network": n,
 		"address": addr,
 		"name":    g.getName(),
 	}).Debug("Creating new listener")
-	listener, err := g.Listen(n)
+	listener, err := g.Listen(n, addr)
 	if err != nil {
 		log.WithError(err).Error("Failed to create listener")
 		return nil, err
@@ -180,7 +300,9 @@ func (g *Garlic) NewListener(n, addr string) (net.Listener, error) {
 }
 
 // Listen returns a net.Listener for the Garlic structure's I2P keys.
-// accepts a variable list of arguments, arguments after the first one are ignored.
+// accepts a variable list of arguments: the network, and an address whose
+// port is the I2P port to listen on, for instance Listen("tcp", ":8080").
+// Arguments after the second one are ignored. See ListenPort.
 func (g *Garlic) Listen(args ...string) (net.Listener, error) {
 	log.WithFields(logrus.Fields{
 		"args": args,
@@ -199,76 +321,151 @@ func (g *Garlic) Listen(args ...string) (net.Listener, error) {
 }
 
 // OldListen returns a net.Listener for the Garlic structure's I2P keys.
-// accepts a variable list of arguments, arguments after the first one are ignored.
+// accepts a variable list of arguments, see Listen.
 func (g *Garlic) OldListen(args ...string) (net.Listener, error) {
 	log.WithField("args", args).Debug("Starting OldListen")
+	port, err := listenPort(args)
+	if err != nil {
+		log.WithError(err).Error("Failed to parse listener address")
+		return nil, err
+	}
 	if len(args) > 0 {
 		protocol := args[0]
 		log.WithField("protocol", protocol).Debug("Checking protocol type")
 		// if args[0] == "tcp" || args[0] == "tcp6" || args[0] == "st" || args[0] == "st6" {
 		if protocol == "tcp" || protocol == "tcp6" || protocol == "st" || protocol == "st6" {
-			log.Debug("Using TCP stream listener")
-			return g.ListenStream()
+			log.WithField("port", port).Debug("Using TCP stream listener")
+			return g.ListenPort(port)
 			//} else if args[0] == "udp" || args[0] == "udp6" || args[0] == "dg" || args[0] == "dg6" {
 		} else if protocol == "udp" || protocol == "udp6" || protocol == "dg" || protocol == "dg6" {
 			log.Debug("Using UDP datagram listener")
+			if port != 0 {
+				return nil, fmt.Errorf("onramp Listen: datagram listeners can't have a port")
+			}
 			pk, err := g.ListenPacket()
 			if err != nil {
 				log.WithError(err).Error("Failed to create packet listener")
 				return nil, err
 			}
 			log.Debug("Successfully created datagram session")
-			return pk.(*sam3.DatagramSession), nil
+			return pk.(*datagramConn), nil
 		}
 
 	}
 	log.Debug("No protocol specified, defaulting to stream listener")
-	return g.ListenStream()
+	return g.ListenPort(port)
 }
 
 // Listen returns a net.Listener for the Garlic structure's I2P keys.
 func (g *Garlic) ListenStream() (net.Listener, error) {
 	log.Debug("Setting up stream listener")
-	var err error
-	if g.SAM, err = g.samSession(); err != nil {
-		log.WithError(err).Error("Failed to create SAM session for stream listener")
-		return nil, fmt.Errorf("onramp NewGarlic: %v", err)
-	}
-	if g.StreamSession, err = g.setupStreamSession(); err != nil {
+	id, err := g.setupStreamSession()
+	if err != nil {
 		log.WithError(err).Error("Failed to setup stream session")
 		return nil, fmt.Errorf("onramp Listen: %v", err)
 	}
-	if g.StreamListener == nil {
+	g.streamMu.Lock()
+	defer g.streamMu.Unlock()
+	if g.streamListener == nil {
 		log.Debug("Creating new stream listener")
-		g.StreamListener, err = g.StreamSession.Listen()
-		if err != nil {
-			log.WithError(err).Error("Failed to create stream listener")
-			return nil, fmt.Errorf("onramp Listen: %v", err)
-		}
+		var l *portListener
+		// closing it leaves the stream session, which dials too
+		l = newPortListener(g.getAddr(), id, g.ServiceKeys.Addr(), 0, func() error {
+			g.streamMu.Lock()
+			if g.streamListener == l {
+				g.streamListener = nil
+			}
+			g.streamMu.Unlock()
+			return nil
+		})
+		g.streamListener = l
 		log.Debug("Stream listener created successfully")
 	}
-	return g.StreamListener, nil
+	return g.streamListener, nil
 }
 
 // ListenPacket returns a net.PacketConn for the Garlic structure's I2P keys.
+// It is a subsession of the Garlic structure's primary session, closing it
+// removes only that subsession.
+// Datagrams larger than about 11KB are often lost and larger than 31KB
+// can't be sent, ListenFragmented splits larger messages.
 func (g *Garlic) ListenPacket() (net.PacketConn, error) {
 	log.Debug("Setting up packet connection")
-	var err error
-	if g.SAM, err = g.samSession(); err != nil {
-		log.WithError(err).Error("Failed to create SAM session for packet connection")
-		return nil, fmt.Errorf("onramp NewGarlic: %v", err)
-	}
-	if g.DatagramSession, err = g.setupDatagramSession(); err != nil {
+	conn, err := g.setupDatagramSession()
+	if err != nil {
 		log.WithError(err).Error("Failed to setup datagram session")
 		return nil, fmt.Errorf("onramp Listen: %v", err)
 	}
 	log.Debug("Packet connection successfully established")
-	return g.DatagramSession, nil
+	return conn, nil
+}
+
+// ListenFragmented returns a FragmentConn over the Garlic structure's
+// datagram session, which sends and receives messages of up to
+// maxMessageSize bytes, or FRAGMENT_MAX_MESSAGE_SIZE if it is 0. Once it
+// is called the datagram session is read by onramp, and can't be used for
+// DTLS, QUIC or reliable connections.
+func (g *Garlic) ListenFragmented(maxMessageSize int) (*FragmentConn, error) {
+	log.WithField("max_message_size", maxMessageSize).Debug("Setting up fragmented packet connection")
+	g.packetMu.Lock()
+	defer g.packetMu.Unlock()
+	if g.fragmentConn == nil {
+		pc, err := g.claimDatagramSession("fragmented messages")
+		if err != nil {
+			log.WithError(err).Error("Failed to claim datagram session")
+			return nil, fmt.Errorf("onramp ListenFragmented: %v", err)
+		}
+		g.fragmentConn = NewFragmentConn(pc, maxMessageSize)
+	}
+	return g.fragmentConn, nil
+}
+
+// claimDatagramSession returns the datagram session for protocol, which
+// reads from it from now on. A datagram session carries one protocol.
+// packetMu must be held.
+func (g *Garlic) claimDatagramSession(protocol string) (net.PacketConn, error) {
+	if g.packetProtocol != "" && g.packetProtocol != protocol {
+		return nil, fmt.Errorf("onramp: datagram session is already used for %s", g.packetProtocol)
+	}
+	pc, err := g.ListenPacket()
+	if err != nil {
+		return nil, err
+	}
+	g.packetProtocol = protocol
+	return datagramSubSession{pc.(*datagramConn)}, nil
+}
+
+// datagramSubSession keeps the listeners over the datagram subsession from
+// closing it, since the Garlic structure keeps using it. Close only stops
+// pending reads, Garlic.Close tears it down.
+type datagramSubSession struct {
+	*datagramConn
+}
+
+func (d datagramSubSession) Close() error {
+	return d.SetReadDeadline(time.Now())
+}
+
+// datagramMux returns the mux over the datagram session used by protocol,
+// creating it on first use.
+func (g *Garlic) datagramMux(protocol string, tag func(data []byte) string) (*packetMux, error) {
+	g.packetMu.Lock()
+	defer g.packetMu.Unlock()
+	if g.packetMux != nil && g.packetProtocol == protocol {
+		return g.packetMux, nil
+	}
+	pc, err := g.claimDatagramSession(protocol)
+	if err != nil {
+		return nil, err
+	}
+	g.packetMux = newTaggedPacketMux(pc, tag)
+	return g.packetMux, nil
 }
 
 // ListenTLS returns a net.Listener for the Garlic structure's I2P keys,
 // which also uses TLS either for additional encryption, authentication,
-// or browser-compatibility.
+// or browser-compatibility. Datagram protocols ("udp", "dg") get a DTLS
+// listener, see ListenDTLS.
 func (g *Garlic) ListenTLS(args ...string) (net.Listener, error) {
 	log.WithField("args", args).Debug("Starting TLS listener")
 	listener, err := g.Listen(args...)
@@ -289,35 +486,32 @@ func (g *Garlic) ListenTLS(args ...string) (net.Listener, error) {
 		if protocol == "tcp" || protocol == "tcp6" || protocol == "st" || protocol == "st6" {
 			log.Debug("Creating TLS stream listener")
 			return tls.NewListener(
-				g.StreamListener,
-				&tls.Config{
-					Certificates: []tls.Certificate{cert},
-				},
+				listener,
+				g.tlsServerConfig(cert),
 			), nil
 			//} else if args[0] == "udp" || args[0] == "udp6" || args[0] == "dg" || args[0] == "dg6" {
 		} else if protocol == "udp" || protocol == "udp6" || protocol == "dg" || protocol == "dg6" {
-			log.Debug("Creating TLS datagram listener")
-			return tls.NewListener(
-				g.DatagramSession,
-				&tls.Config{
-					Certificates: []tls.Certificate{cert},
-				},
-			), nil
+			log.Debug("Creating DTLS datagram listener")
+			return g.ListenDTLS()
 		}
 
 	} else {
 		log.Debug("No protocol specified, using stream listener")
-		g.StreamListener = listener.(*sam3.StreamListener)
 	}
 	log.Debug("Successfully created TLS listener")
 	return tls.NewListener(
-		g.StreamListener,
-		&tls.Config{
-			Certificates: []tls.Certificate{cert},
-		},
+		listener,
+		g.tlsServerConfig(cert),
 	), nil
 }
 
+func (g *Garlic) tlsServerConfig(cert tls.Certificate) *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   g.NextProtos,
+	}
+}
+
 // Dial returns a net.Conn for the Garlic structure's I2P keys.
 func (g *Garlic) Dial(net, addr string) (net.Conn, error) {
 	log.WithFields(logrus.Fields{
@@ -328,17 +522,12 @@ func (g *Garlic) Dial(net, addr string) (net.Conn, error) {
 		log.Debug("Non-I2P address detected, returning null connection")
 		return &NullConn{}, nil
 	}
-	var err error
-	if g.SAM, err = g.samSession(); err != nil {
-		log.WithError(err).Error("Failed to create SAM session")
-		return nil, fmt.Errorf("onramp NewGarlic: %v", err)
-	}
-	if g.StreamSession, err = g.setupStreamSession(); err != nil {
+	if _, err := g.setupStreamSession(); err != nil {
 		log.WithError(err).Error("Failed to setup stream session")
 		return nil, fmt.Errorf("onramp Dial: %v", err)
 	}
 	log.Debug("Attempting to establish connection")
-	conn, err := g.StreamSession.Dial(net, addr)
+	conn, err := g.dialStream(context.Background(), addr)
 	if err != nil {
 		log.WithError(err).Error("Failed to establish connection")
 		return nil, err
@@ -358,17 +547,12 @@ func (g *Garlic) DialContext(ctx context.Context, net, addr string) (net.Conn, e
 		log.Debug("Non-I2P address detected, returning null connection")
 		return &NullConn{}, nil
 	}
-	var err error
-	if g.SAM, err = g.samSession(); err != nil {
-		log.WithError(err).Error("Failed to create SAM session")
-		return nil, fmt.Errorf("onramp NewGarlic: %v", err)
-	}
-	if g.StreamSession, err = g.setupStreamSession(); err != nil {
+	if _, err := g.setupStreamSession(); err != nil {
 		log.WithError(err).Error("Failed to setup stream session")
 		return nil, fmt.Errorf("onramp Dial: %v", err)
 	}
 	log.Debug("Attempting to establish connection with context")
-	conn, err := g.StreamSession.DialContext(ctx, net, addr)
+	conn, err := g.dialStream(ctx, addr)
 	if err != nil {
 		log.WithError(err).Error("Failed to establish connection")
 		return nil, err
@@ -382,27 +566,62 @@ func (g *Garlic) DialContext(ctx context.Context, net, addr string) (net.Conn, e
 // Close closes the Garlic structure's sessions and listeners.
 func (g *Garlic) Close() error {
 	log.WithField("name", g.getName()).Debug("Closing Garlic sessions")
-	e1 := g.StreamSession.Close()
-	var err error
-	if e1 != nil {
-		log.WithError(e1).Error("Failed to close stream session")
-		err = fmt.Errorf("onramp Close: %v", e1)
-	} else {
-		log.Debug("Stream session closed successfully")
+	var errs []error
+	closeOne := func(what string, c io.Closer) {
+		if err := c.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			log.WithError(err).WithField("session", what).Error("Failed to close")
+			errs = append(errs, err)
+		}
 	}
-	e2 := g.SAM.Close()
-	if e2 != nil {
-		log.WithError(e2).Error("Failed to close SAM session")
-		err = fmt.Errorf("onramp Close: %v %v", e1, e2)
-	} else {
-		log.Debug("SAM session closed successfully")
+	g.packetMu.Lock()
+	if g.dtlsListener != nil {
+		closeOne("DTLS listener", g.dtlsListener)
 	}
-
-	if err == nil {
-		log.Debug("All sessions closed successfully")
+	if g.reliableListener != nil {
+		closeOne("reliable listener", g.reliableListener)
 	}
-
-	return err
+	if g.packetMux != nil {
+		closeOne("datagram mux", g.packetMux)
+	}
+	if g.quicTransport != nil {
+		closeOne("QUIC transport", g.quicTransport)
+	}
+	g.packetMu.Unlock()
+	g.streamMu.Lock()
+	listeners := make([]*portListener, 0, len(g.portListeners)+1)
+	for _, l := range g.portListeners {
+		listeners = append(listeners, l)
+	}
+	if g.streamListener != nil {
+		listeners = append(listeners, g.streamListener)
+	}
+	g.streamMu.Unlock()
+	for _, l := range listeners {
+		closeOne("port listener", l)
+	}
+	g.rawMu.Lock()
+	for _, conn := range g.rawConns {
+		closeOne("raw subsession", conn)
+	}
+	g.rawConns = nil
+	g.rawMu.Unlock()
+	// Closing the primary session's control connection ends the
+	// subsessions left, the datagram subsession also has a UDP socket.
+	g.primaryMu.Lock()
+	datagram, primary := g.datagram, g.primary
+	g.datagram, g.primary, g.streamID = nil, nil, ""
+	g.primaryMu.Unlock()
+	if datagram != nil {
+		closeOne("datagram session", datagram.udp)
+	}
+	if primary != nil {
+		closeOne("primary session", primary)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("onramp Close: %v", errors.Join(errs...))
+	}
+	log.Debug("All sessions closed successfully")
+	return nil
 }
 
 // Keys returns the I2PKeys for the Garlic structure. If none
@@ -413,7 +632,7 @@ func (g *Garlic) Keys() (*i2pkeys.I2PKeys, error) {
 		"address": g.getAddr(),
 	}).Debug("Retrieving I2P keys")
 
-	keys, err := I2PKeys(g.getName(), g.getAddr())
+	keys, err := i2pKeys(g.getName(), g.getAddr(), g.KeyTypes)
 	if err != nil {
 		log.WithError(err).Error("Failed to get I2P keys")
 		return &i2pkeys.I2PKeys{}, fmt.Errorf("onramp Keys: %v", err)
@@ -442,16 +661,25 @@ func NewGarlic(tunName, samAddr string, options []string) (*Garlic, error) {
 		"options":     options,
 	}).Debug("Creating new Garlic instance")
 
+	return newGarlic(tunName, samAddr, options, nil)
+}
+
+// NewGarlicWithKeyTypes is like NewGarlic, but the Garlic structure's keys
+// have the given types. See KeyTypes.
+func NewGarlicWithKeyTypes(tunName, samAddr string, types I2PKeyTypes, options []string) (*Garlic, error) {
+	if err := types.validate(); err != nil {
+		return nil, fmt.Errorf("onramp NewGarlicWithKeyTypes: %v", err)
+	}
+	return newGarlic(tunName, samAddr, options, &types)
+}
+
+func newGarlic(tunName, samAddr string, options []string, types *I2PKeyTypes) (*Garlic, error) {
 	g := new(Garlic)
 	g.name = tunName
 	g.addr = samAddr
 	g.opts = options
-	var err error
-	if g.SAM, err = g.samSession(); err != nil {
-		log.WithError(err).Error("Failed to create SAM session")
-		return nil, fmt.Errorf("onramp NewGarlic: %v", err)
-	}
-	if g.StreamSession, err = g.setupStreamSession(); err != nil {
+	g.KeyTypes = types
+	if _, err := g.setupStreamSession(); err != nil {
 		log.WithError(err).Error("Failed to setup stream session")
 		return nil, fmt.Errorf("onramp NewGarlic: %v", err)
 	}
@@ -466,6 +694,12 @@ func NewGarlic(tunName, samAddr string, options []string) (*Garlic, error) {
 // address.
 func DeleteGarlicKeys(tunName string) error {
 	log.WithField("tunnel_name", tunName).Debug("Attempting to delete Garlic keys")
+	if KEYSTORE != nil {
+		if err := KEYSTORE.Delete("i2pkeys/" + tunName + ".i2p.private"); err != nil {
+			return fmt.Errorf("onramp DeleteGarlicKeys: %v", err)
+		}
+		return nil
+	}
 	keystore, err := I2PKeystorePath()
 	if err != nil {
 		log.WithError(err).Error("Failed to get keystore path")
@@ -477,66 +711,221 @@ func DeleteGarlicKeys(tunName string) error {
 		log.WithError(err).WithField("path", keyspath).Error("Failed to delete key file")
 		return fmt.Errorf("onramp DeleteGarlicKeys: %v", err)
 	}
+	metapath := filepath.Join(keystore, tunName+".i2p.meta")
+	if err := os.Remove(metapath); err != nil && !os.IsNotExist(err) {
+		log.WithError(err).WithField("path", metapath).Error("Failed to delete key metadata")
+		return fmt.Errorf("onramp DeleteGarlicKeys: %v", err)
+	}
 	log.Debug("Successfully deleted Garlic keys")
 	return nil
 }
 
 // I2PKeys returns the I2PKeys at the keystore directory for the given
-// tunnel name. If none exist, they are created and stored.
+// tunnel name. If none exist, they are created with I2P_KEY_TYPES and
+// stored with the SAM bridge at samAddr, or without it if I2P_LOCAL_KEYGEN
+// is set and they have an Ed25519 signing key.
 func I2PKeys(tunName, samAddr string) (i2pkeys.I2PKeys, error) {
+	return i2pKeys(tunName, samAddr, nil)
+}
+
+// I2PKeysWithTypes is like I2PKeys, but creates the keys with the given
+// types, and returns an error if the stored keys have other types.
+func I2PKeysWithTypes(tunName, samAddr string, types I2PKeyTypes) (i2pkeys.I2PKeys, error) {
+	return i2pKeys(tunName, samAddr, &types)
+}
+
+// StoredI2PKeyTypes returns the types of the I2PKeys at the keystore
+// directory for the given tunnel name. The encryption types are only known
+// for keys generated with their metadata.
+func StoredI2PKeyTypes(tunName string) (I2PKeyTypes, error) {
+	keys, err := storedI2PKeys(tunName)
+	if err != nil {
+		return I2PKeyTypes{}, fmt.Errorf("onramp StoredI2PKeyTypes: load error %v", err)
+	}
+	// a Keystore holds no metadata
+	var meta *i2pKeyMetadata
+	if KEYSTORE == nil {
+		keystore, err := I2PKeystorePath()
+		if err != nil {
+			return I2PKeyTypes{}, fmt.Errorf("onramp StoredI2PKeyTypes: discovery error %v", err)
+		}
+		if meta, err = readI2PKeyMetadata(filepath.Join(keystore, tunName+".i2p.meta")); err != nil {
+			return I2PKeyTypes{}, fmt.Errorf("onramp StoredI2PKeyTypes: %v", err)
+		}
+	}
+	types, err := storedI2PKeyTypes(keys, meta)
+	if err != nil {
+		return I2PKeyTypes{}, fmt.Errorf("onramp StoredI2PKeyTypes: %v", err)
+	}
+	return types, nil
+}
+
+// generateI2PKeys generates new keys of the given types, locally if they
+// have an Ed25519 signing key and I2P_LOCAL_KEYGEN is set, or else with
+// the SAM bridge at samAddr.
+func generateI2PKeys(samAddr string, want I2PKeyTypes) (i2pkeys.I2PKeys, error) {
+	if I2P_LOCAL_KEYGEN && want.Signature == SIG_ED25519 {
+		log.Debug("Generating keys locally")
+		keys, err := GenerateI2PKeys()
+		if err != nil {
+			log.WithError(err).Error("Failed to generate new keys")
+			return i2pkeys.I2PKeys{}, fmt.Errorf("onramp I2PKeys: keygen error %v", err)
+		}
+		return keys, nil
+	}
+	sam, err := sam3.NewSAM(samAddr)
+	if err != nil {
+		log.WithError(err).Error("Failed to create SAM connection")
+		return i2pkeys.I2PKeys{}, fmt.Errorf("onramp I2PKeys: SAM error %v", err)
+	}
+	defer sam.Close()
+	log.Debug("SAM connection established")
+	keys, err := sam.NewKeys(want.generateArg())
+	if err != nil {
+		log.WithError(err).Error("Failed to generate new keys")
+		return i2pkeys.I2PKeys{}, fmt.Errorf("onramp I2PKeys: keygen error %v", err)
+	}
+	log.Debug("New keys generated successfully")
+	if sig, err := destSigType(keys.Addr()); err != nil || sig != want.Signature {
+		log.WithField("types", want.String()).Error("Router generated keys of another type")
+		return i2pkeys.I2PKeys{}, fmt.Errorf("onramp I2PKeys: the router didn't generate keys of type %s", want)
+	}
+	return keys, nil
+}
+
+// i2pKeys loads or generates the keys for tunName. If types is nil, keys
+// are generated with I2P_KEY_TYPES and loaded keys of any type are
+// accepted.
+func i2pKeys(tunName, samAddr string, types *I2PKeyTypes) (i2pkeys.I2PKeys, error) {
 	log.WithFields(logrus.Fields{
 		"tunnel_name": tunName,
 		"sam_address": samAddr,
 	}).Debug("Looking up I2P keys")
 
+	want := I2P_KEY_TYPES
+	if types != nil {
+		want = *types
+	}
+	if err := want.validate(); err != nil {
+		return i2pkeys.I2PKeys{}, fmt.Errorf("onramp I2PKeys: %v", err)
+	}
+	if KEYSTORE != nil {
+		return keystoreI2PKeys(tunName, samAddr, want, types != nil)
+	}
 	keystore, err := I2PKeystorePath()
 	if err != nil {
 		log.WithError(err).Error("Failed to get keystore path")
 		return i2pkeys.I2PKeys{}, fmt.Errorf("onramp I2PKeys: discovery error %v", err)
 	}
 	keyspath := filepath.Join(keystore, tunName+".i2p.private")
+	metapath := filepath.Join(keystore, tunName+".i2p.meta")
+	unlock, err := lockKeyFile(keyspath)
+	if err != nil {
+		return i2pkeys.I2PKeys{}, fmt.Errorf("onramp I2PKeys: %v", err)
+	}
+	defer unlock()
 	log.WithField("path", keyspath).Debug("Checking for existing keys")
 	info, err := os.Stat(keyspath)
-	if info != nil {
-		if info.Size() == 0 {
-			log.WithField("path", keyspath).Debug("Keystore empty, will regenerate keys")
-			log.Println("onramp I2PKeys: keystore empty, re-generating keys")
-		} else {
-			log.WithField("path", keyspath).Debug("Found existing keystore")
+	if info != nil && info.Size() == 0 {
+		// left by an interrupted write, it never held an identity
+		log.WithField("path", keyspath).Warn("Keystore empty, re-generating keys")
+		if err := os.Remove(keyspath); err != nil {
+			return i2pkeys.I2PKeys{}, fmt.Errorf("onramp I2PKeys: %v", err)
 		}
+		info, err = nil, os.ErrNotExist
 	}
-	if err != nil {
-		log.WithField("path", keyspath).Debug("Keys not found, generating new keys")
-		sam, err := sam3.NewSAM(samAddr)
-		if err != nil {
-			log.WithError(err).Error("Failed to create SAM connection")
-			return i2pkeys.I2PKeys{}, fmt.Errorf("onramp I2PKeys: SAM error %v", err)
+	if info != nil {
+		log.WithField("path", keyspath).Debug("Found existing keystore")
+	}
+	if os.IsNotExist(err) {
+		if err := checkQuarantine(keyspath); err != nil {
+			return i2pkeys.I2PKeys{}, fmt.Errorf("onramp I2PKeys: %v", err)
 		}
-		log.Debug("SAM connection established")
-		keys, err := sam.NewKeys(tunName)
+		warnIdentityElsewhere(keystore, "i2pkeys", tunName+".i2p.private")
+		log.WithFields(logrus.Fields{
+			"path":  keyspath,
+			"types": want.String(),
+		}).Debug("Keys not found, generating new keys")
+		keys, err := generateI2PKeys(samAddr, want)
 		if err != nil {
-			log.WithError(err).Error("Failed to generate new keys")
-			return i2pkeys.I2PKeys{}, fmt.Errorf("onramp I2PKeys: keygen error %v", err)
+			return i2pkeys.I2PKeys{}, err
 		}
-		log.Debug("New keys generated successfully")
-		if err = i2pkeys.StoreKeys(keys, keyspath); err != nil {
+		if err = writeI2PKeys(keyspath, keys); err != nil {
 			log.WithError(err).WithField("path", keyspath).Error("Failed to store generated keys")
 			return i2pkeys.I2PKeys{}, fmt.Errorf("onramp I2PKeys: store error %v", err)
 		}
+		if err = writeI2PKeyMetadata(metapath, want); err != nil {
+			log.WithError(err).WithField("path", metapath).Error("Failed to store key metadata")
+			return i2pkeys.I2PKeys{}, fmt.Errorf("onramp I2PKeys: store error %v", err)
+		}
 		log.WithField("path", keyspath).Debug("Successfully stored new keys")
 		return keys, nil
+	} else if err != nil {
+		log.WithError(err).WithField("path", keyspath).Error("Failed to check for existing keys")
+		return i2pkeys.I2PKeys{}, fmt.Errorf("onramp I2PKeys: %v", err)
 	} else {
 		log.WithField("path", keyspath).Debug("Loading existing keys")
-		keys, err := i2pkeys.LoadKeys(keyspath)
+		keys, err := readI2PKeys(keyspath)
 		if err != nil {
 			log.WithError(err).WithField("path", keyspath).Error("Failed to load existing keys")
 			return i2pkeys.I2PKeys{}, fmt.Errorf("onramp I2PKeys: load error %v", err)
 		}
+		if err := checkOfflineExpiry(keys); err != nil {
+			return i2pkeys.I2PKeys{}, fmt.Errorf("onramp I2PKeys: %s: %v", keyspath, err)
+		}
+		if types != nil {
+			meta, err := readI2PKeyMetadata(metapath)
+			if err != nil {
+				return i2pkeys.I2PKeys{}, fmt.Errorf("onramp I2PKeys: %v", err)
+			}
+			stored, err := storedI2PKeyTypes(keys, meta)
+			if err == nil {
+				err = checkI2PKeyTypes(stored, want)
+			}
+			if err != nil {
+				log.WithError(err).WithField("path", keyspath).Error("Existing keys have the wrong type")
+				return i2pkeys.I2PKeys{}, fmt.Errorf("onramp I2PKeys: %s: %v", keyspath, err)
+			}
+		}
 		log.Debug("Successfully loaded existing keys")
 		return keys, nil
 	}
 }
 
+// keystoreI2PKeys is i2pKeys for keys in KEYSTORE. The stored keys'
+// signature type is checked if check is set.
+func keystoreI2PKeys(tunName, samAddr string, want I2PKeyTypes, check bool) (i2pkeys.I2PKeys, error) {
+	name := "i2pkeys/" + tunName + ".i2p.private"
+	data, err := keystoreKey(name, func() ([]byte, error) {
+		keys, err := generateI2PKeys(samAddr, want)
+		if err != nil {
+			return nil, err
+		}
+		return marshalI2PKeys(keys)
+	})
+	if err != nil {
+		log.WithError(err).WithField("name", name).Error("Failed to get keys from the keystore")
+		return i2pkeys.I2PKeys{}, err
+	}
+	keys, err := parseI2PKeys(data)
+	if err != nil {
+		return i2pkeys.I2PKeys{}, fmt.Errorf("onramp I2PKeys: %s: %v", name, err)
+	}
+	if err := checkOfflineExpiry(keys); err != nil {
+		return i2pkeys.I2PKeys{}, fmt.Errorf("onramp I2PKeys: %s: %v", name, err)
+	}
+	if check {
+		stored, err := storedI2PKeyTypes(keys, nil)
+		if err == nil {
+			err = checkI2PKeyTypes(stored, want)
+		}
+		if err != nil {
+			return i2pkeys.I2PKeys{}, fmt.Errorf("onramp I2PKeys: %s: %v", name, err)
+		}
+	}
+	return keys, nil
+}
+
 var garlics map[string]*Garlic
 
 // CloseAllGarlic closes all garlics managed by the onramp package. It does not
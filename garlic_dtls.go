@@ -0,0 +1,69 @@
+//go:build !gen
+// +build !gen
+
+package onramp
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ListenDTLS returns a DTLS net.Listener over the Garlic structure's
+// datagram session, which accepts one connection per remote destination.
+// Once it is called the datagram session is read by onramp, so it should
+// not be read from directly anymore, nor used for reliable connections.
+// There is one DTLS listener per Garlic.
+func (g *Garlic) ListenDTLS() (net.Listener, error) {
+	log.Debug("Starting DTLS listener")
+	mux, err := g.datagramMux("DTLS", nil)
+	if err != nil {
+		return nil, err
+	}
+	g.packetMu.Lock()
+	defer g.packetMu.Unlock()
+	if g.dtlsListener != nil {
+		return g.dtlsListener, nil
+	}
+	cert, err := g.TLSKeys()
+	if err != nil {
+		log.WithError(err).Error("Failed to get TLS keys")
+		return nil, fmt.Errorf("onramp ListenDTLS: %v", err)
+	}
+	config := DTLSServerConfig(cert)
+	config.SupportedProtocols = g.NextProtos
+	g.dtlsListener = newDTLSListener(mux, config)
+	return g.dtlsListener, nil
+}
+
+// DialDTLS returns a DTLS net.Conn to the given I2P address, sent from the
+// Garlic structure's datagram session. The server's certificate is checked
+// against the CRLs in the TLS keystore.
+func (g *Garlic) DialDTLS(addr string) (net.Conn, error) {
+	log.WithField("address", addr).Debug("Dialing DTLS connection over I2P")
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	if !strings.HasSuffix(host, ".i2p") {
+		return nil, fmt.Errorf("onramp DialDTLS: %s is not an I2P address", addr)
+	}
+	mux, err := g.datagramMux("DTLS", nil)
+	if err != nil {
+		return nil, err
+	}
+	raddr, err := g.lookup(host)
+	if err != nil {
+		log.WithError(err).Error("Failed to look up DTLS peer")
+		return nil, fmt.Errorf("onramp DialDTLS: %v", err)
+	}
+	log.WithFields(logrus.Fields{
+		"host":        host,
+		"destination": raddr.String(),
+	}).Debug("Resolved DTLS peer")
+	config := DTLSClientConfig(host)
+	config.SupportedProtocols = g.NextProtos
+	return dialDTLS(mux, raddr, config)
+}
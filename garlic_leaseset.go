@@ -0,0 +1,115 @@
+//go:build !gen
+// +build !gen
+
+package onramp
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Base33 returns the b33 address of the Garlic structure's encrypted
+// LeaseSet, which clients need to reach it. See EncryptedLeaseSet.
+func (g *Garlic) Base33() (string, error) {
+	if g.EncryptedLeaseSet == nil {
+		return "", fmt.Errorf("onramp Base33: the Garlic structure has no encrypted LeaseSet")
+	}
+	keys := g.ServiceKeys
+	if keys == nil {
+		var err error
+		if keys, err = g.Keys(); err != nil {
+			return "", fmt.Errorf("onramp Base33: %v", err)
+		}
+	}
+	return blindedAddress(keys.Addr(), g.EncryptedLeaseSet.Secret != "", g.EncryptedLeaseSet.authenticated())
+}
+
+// leaseSetOptions returns the I2CP options for EncryptedLeaseSet and
+// LeaseSetCredentials.
+func (g *Garlic) leaseSetOptions() ([]string, error) {
+	var opts []string
+	if g.EncryptedLeaseSet != nil {
+		hosting, err := g.EncryptedLeaseSet.options()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, hosting...)
+	}
+	if g.LeaseSetCredentials != nil {
+		// the router has one option for the secret of both sides
+		if g.EncryptedLeaseSet != nil && g.EncryptedLeaseSet.Secret != "" && g.LeaseSetCredentials.Secret != "" &&
+			g.EncryptedLeaseSet.Secret != g.LeaseSetCredentials.Secret {
+			return nil, fmt.Errorf("onramp: a Garlic structure can't use different LeaseSet secrets to host and to dial")
+		}
+		dialing, err := g.LeaseSetCredentials.options()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, dialing...)
+	}
+	return opts, nil
+}
+
+// LeaseSetClientKeys returns the LeaseSet client authorization key stored
+// at the given key name in the I2P key store, generating it if it doesn't
+// exist.
+func LeaseSetClientKeys(keyName string) (*LeaseSetClientKey, error) {
+	log.WithField("key_name", keyName).Debug("Getting LeaseSet client authorization keys")
+	if KEYSTORE != nil {
+		data, err := keystoreKey("i2pkeys/"+keyName+".i2p.auth_private", func() ([]byte, error) {
+			key, err := GenerateLeaseSetClientKey()
+			if err != nil {
+				return nil, err
+			}
+			return []byte(key.String() + "\n"), nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		return ParseLeaseSetClientKey(string(data))
+	}
+	keystore, err := I2PKeystorePath()
+	if err != nil {
+		return nil, fmt.Errorf("onramp LeaseSetClientKeys: discovery error %v", err)
+	}
+	keyPath := filepath.Join(keystore, keyName+".i2p.auth_private")
+	unlock, err := lockKeyFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("onramp LeaseSetClientKeys: %v", err)
+	}
+	defer unlock()
+	if data, err := os.ReadFile(keyPath); err == nil {
+		return ParseLeaseSetClientKey(string(data))
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("onramp LeaseSetClientKeys: %v", err)
+	}
+	log.WithField("path", keyPath).Debug("Generating LeaseSet client authorization keys")
+	key, err := GenerateLeaseSetClientKey()
+	if err != nil {
+		return nil, err
+	}
+	if err := writeKeyFile(keyPath, []byte(key.String()+"\n"), 0600); err != nil {
+		return nil, fmt.Errorf("onramp LeaseSetClientKeys: %v", err)
+	}
+	return key, nil
+}
+
+// DeleteLeaseSetClientKeys deletes the LeaseSet client authorization key
+// stored at the given key name in the I2P key store.
+func DeleteLeaseSetClientKeys(keyName string) error {
+	if KEYSTORE != nil {
+		if err := KEYSTORE.Delete("i2pkeys/" + keyName + ".i2p.auth_private"); err != nil {
+			return fmt.Errorf("onramp DeleteLeaseSetClientKeys: %v", err)
+		}
+		return nil
+	}
+	keystore, err := I2PKeystorePath()
+	if err != nil {
+		return fmt.Errorf("onramp DeleteLeaseSetClientKeys: discovery error %v", err)
+	}
+	if err := os.Remove(filepath.Join(keystore, keyName+".i2p.auth_private")); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("onramp DeleteLeaseSetClientKeys: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+//go:build !gen
+// +build !gen
+
+package onramp
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/go-i2p/i2pkeys"
+	"github.com/sirupsen/logrus"
+)
+
+// StoreTransientI2PKeys signs transient keys valid until expires with the
+// offline keys, see SignTransientKeys, and stores them in the keystore
+// directory for the given tunnel name, replacing the keys there. Only the
+// transient keys are stored, and Garlic structures of the tunnel name use
+// them until they expire. Call it again with the offline keys before then.
+func StoreTransientI2PKeys(tunName string, offline i2pkeys.I2PKeys, expires time.Time) (i2pkeys.I2PKeys, error) {
+	log.WithFields(logrus.Fields{
+		"tunnel_name": tunName,
+		"expires":     expires,
+	}).Debug("Storing transient I2P keys")
+	if KEYSTORE != nil {
+		// a Keystore can't replace keys
+		return i2pkeys.I2PKeys{}, fmt.Errorf("onramp StoreTransientI2PKeys: %w", ErrKeystoreUnsupported)
+	}
+	keystore, err := I2PKeystorePath()
+	if err != nil {
+		return i2pkeys.I2PKeys{}, fmt.Errorf("onramp StoreTransientI2PKeys: discovery error %v", err)
+	}
+	keyspath := filepath.Join(keystore, tunName+".i2p.private")
+	unlock, err := lockKeyFile(keyspath)
+	if err != nil {
+		return i2pkeys.I2PKeys{}, fmt.Errorf("onramp StoreTransientI2PKeys: %v", err)
+	}
+	defer unlock()
+	if stored, err := readI2PKeys(keyspath); err == nil && stored.Addr() != offline.Addr() {
+		return i2pkeys.I2PKeys{}, fmt.Errorf("onramp StoreTransientI2PKeys: %s holds the keys of another destination", keyspath)
+	}
+	transient, err := SignTransientKeys(offline, expires)
+	if err != nil {
+		return i2pkeys.I2PKeys{}, err
+	}
+	if err := writeI2PKeys(keyspath, transient); err != nil {
+		log.WithError(err).WithField("path", keyspath).Error("Failed to store transient keys")
+		return i2pkeys.I2PKeys{}, fmt.Errorf("onramp StoreTransientI2PKeys: store error %v", err)
+	}
+	metapath := filepath.Join(keystore, tunName+".i2p.meta")
+	if meta, err := readI2PKeyMetadata(metapath); err != nil || meta == nil {
+		types := I2P_KEY_TYPES
+		types.Signature = SIG_ED25519
+		if err := writeI2PKeyMetadata(metapath, types); err != nil {
+			return i2pkeys.I2PKeys{}, fmt.Errorf("onramp StoreTransientI2PKeys: store error %v", err)
+		}
+	}
+	return transient, nil
+}
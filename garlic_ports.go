@@ -0,0 +1,132 @@
+//go:build !gen
+// +build !gen
+
+package onramp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/go-i2p/i2pkeys"
+	"github.com/sirupsen/logrus"
+)
+
+// ListenPort returns a net.Listener for the streams sent to the given I2P
+// port of the Garlic structure's I2P keys. Each port gets a STREAM
+// subsession of the primary session, and the bridge routes streams to the
+// subsession listening on their port. Streams to ports without a listener
+// go to port 0, which is the listener returned by ListenStream.
+func (g *Garlic) ListenPort(port int) (net.Listener, error) {
+	if port == 0 {
+		return g.ListenStream()
+	}
+	if port < 0 || port > 65535 {
+		return nil, fmt.Errorf("onramp ListenPort: invalid port %d", port)
+	}
+	log.WithField("port", port).Debug("Setting up port listener")
+	g.streamMu.Lock()
+	defer g.streamMu.Unlock()
+	if l, ok := g.portListeners[port]; ok {
+		return l, nil
+	}
+	id := fmt.Sprintf("%s-port-%d", g.getName(), port)
+	if err := g.addPortSubSession(id, port); err != nil {
+		return nil, err
+	}
+	l := newPortListener(g.getAddr(), id, g.ServiceKeys.Addr(), port, func() error {
+		g.streamMu.Lock()
+		delete(g.portListeners, port)
+		g.streamMu.Unlock()
+		return g.removeSubSession(id)
+	})
+	if g.portListeners == nil {
+		g.portListeners = make(map[int]*portListener)
+	}
+	g.portListeners[port] = l
+	log.WithFields(logrus.Fields{
+		"port": port,
+		"id":   id,
+	}).Debug("Port listener created")
+	return l, nil
+}
+
+// addPortSubSession adds the STREAM subsession named id listening on port
+// to the primary session.
+func (g *Garlic) addPortSubSession(id string, port int) error {
+	g.primaryMu.Lock()
+	defer g.primaryMu.Unlock()
+	primary, err := g.primarySession()
+	if err != nil {
+		log.WithError(err).Error("Failed to get primary session for port listener")
+		return fmt.Errorf("onramp ListenPort: %v", err)
+	}
+	// a subsession listens on its FROM_PORT unless LISTEN_PORT is given
+	if err := primary.add("STREAM", id, fmt.Sprintf("FROM_PORT=%d", port), "TO_PORT=0"); err != nil {
+		log.WithError(err).Error("Failed to create stream subsession for port")
+		return fmt.Errorf("onramp ListenPort: %v", err)
+	}
+	return nil
+}
+
+// dialStream opens a stream to addr, which is an I2P host name with an
+// optional port, from the Garlic structure's stream session.
+func (g *Garlic) dialStream(ctx context.Context, addr string) (net.Conn, error) {
+	host, port, err := splitGarlicAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	id, err := g.setupStreamSession()
+	if err != nil {
+		log.WithError(err).Error("Failed to setup stream session")
+		return nil, err
+	}
+	// the router resolves b33 addresses itself with the session's
+	// LeaseSet credentials, which the lookup session doesn't have
+	dest := i2pkeys.I2PAddr(host)
+	if !isBlindedAddress(host) {
+		if dest, err = g.lookup(host); err != nil {
+			log.WithError(err).Error("Failed to look up stream peer")
+			return nil, err
+		}
+	}
+	return connectStream(ctx, g.getAddr(), id, g.ServiceKeys.Addr(), dest, 0, port)
+}
+
+// listenPort returns the port of the address given to Listen, 0 if
+// there is none.
+func listenPort(args []string) (int, error) {
+	if len(args) < 2 || args[1] == "" {
+		return 0, nil
+	}
+	_, port, err := splitGarlicAddr(args[1])
+	return port, err
+}
+
+// splitGarlicAddr splits an I2P address like "example.i2p:8080" into its
+// host and port. The port is 0 if there is none.
+func splitGarlicAddr(addr string) (string, int, error) {
+	host, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		var aerr *net.AddrError
+		if errors.As(err, &aerr) && aerr.Err == "missing port in address" {
+			return addr, 0, nil
+		}
+		return "", 0, fmt.Errorf("onramp: invalid address %q: %v", addr, err)
+	}
+	if p == "" {
+		return host, 0, nil
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil {
+		if port, err = net.LookupPort("tcp", p); err != nil {
+			return "", 0, fmt.Errorf("onramp: invalid port %q", p)
+		}
+	}
+	if port < 0 || port > 65535 {
+		return "", 0, fmt.Errorf("onramp: invalid port %d", port)
+	}
+	return host, port, nil
+}
@@ -0,0 +1,102 @@
+//go:build !gen
+// +build !gen
+
+package onramp
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/quic-go/quic-go"
+	"github.com/sirupsen/logrus"
+)
+
+func (g *Garlic) quicConfig() *quic.Config {
+	if g.QUICConfig != nil {
+		return g.QUICConfig
+	}
+	return DefaultQUICConfig()
+}
+
+// transport returns the QUIC transport over the Garlic structure's
+// datagram session, creating it on first use.
+func (g *Garlic) transport() (*quic.Transport, error) {
+	g.packetMu.Lock()
+	defer g.packetMu.Unlock()
+	if g.quicTransport == nil {
+		pc, err := g.claimDatagramSession("QUIC")
+		if err != nil {
+			return nil, err
+		}
+		g.quicTransport = &quic.Transport{Conn: pc}
+		g.quicSessions = tls.NewLRUClientSessionCache(QUIC_SESSION_CACHE_SIZE)
+	}
+	return g.quicTransport, nil
+}
+
+// ListenQUIC returns a QUIC listener over the Garlic structure's datagram
+// session, using the certificate from TLSKeys and NextProtos for ALPN.
+// Connections carry any number of streams and may start with 0-RTT data.
+// Once it is called the datagram session is read by onramp, and can't be
+// used for DTLS or reliable connections.
+func (g *Garlic) ListenQUIC() (*quic.EarlyListener, error) {
+	log.Debug("Starting QUIC listener")
+	tr, err := g.transport()
+	if err != nil {
+		return nil, err
+	}
+	cert, err := g.TLSKeys()
+	if err != nil {
+		log.WithError(err).Error("Failed to get TLS keys")
+		return nil, fmt.Errorf("onramp ListenQUIC: %v", err)
+	}
+	l, err := tr.ListenEarly(quicServerConfig(cert, g.NextProtos), g.quicConfig())
+	if err != nil {
+		log.WithError(err).Error("Failed to create QUIC listener")
+		return nil, fmt.Errorf("onramp ListenQUIC: %v", err)
+	}
+	return l, nil
+}
+
+// DialQUIC returns a QUIC connection to the given I2P address, see
+// DialQUICContext.
+func (g *Garlic) DialQUIC(addr string) (quic.EarlyConnection, error) {
+	return g.DialQUICContext(context.Background(), addr)
+}
+
+// DialQUICContext returns a QUIC connection to the given I2P address, sent
+// from the Garlic structure's datagram session. The server's certificate
+// is checked like by DialTLS. Connections to a server dialed before
+// resume with 0-RTT.
+func (g *Garlic) DialQUICContext(ctx context.Context, addr string) (quic.EarlyConnection, error) {
+	log.WithField("address", addr).Debug("Dialing QUIC connection over I2P")
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	if !strings.HasSuffix(host, ".i2p") {
+		return nil, fmt.Errorf("onramp DialQUIC: %s is not an I2P address", addr)
+	}
+	tr, err := g.transport()
+	if err != nil {
+		return nil, err
+	}
+	raddr, err := g.lookup(host)
+	if err != nil {
+		log.WithError(err).Error("Failed to look up QUIC peer")
+		return nil, fmt.Errorf("onramp DialQUIC: %v", err)
+	}
+	conn, err := tr.DialEarly(ctx, raddr, quicClientConfig(g.TLSClientConfig, host, g.NextProtos, g.quicSessions), g.quicConfig())
+	if err != nil {
+		log.WithError(err).Error("Failed to establish QUIC connection")
+		return nil, err
+	}
+	log.WithFields(logrus.Fields{
+		"host": host,
+		"0rtt": conn.ConnectionState().Used0RTT,
+	}).Debug("QUIC connection established")
+	return conn, nil
+}
@@ -0,0 +1,80 @@
+//go:build !gen
+// +build !gen
+
+package onramp
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/go-i2p/i2pkeys"
+	"github.com/go-i2p/sam3"
+)
+
+// ListenRaw returns a RawConn which receives raw datagrams of the given
+// I2CP protocol sent to the Garlic structure's I2P keys. Protocol 0 means
+// RAW_PROTOCOL. Raw datagrams have no sender, so they can't be answered.
+// The RawConn is a subsession of the Garlic structure's primary session,
+// next to its stream and datagram sessions.
+func (g *Garlic) ListenRaw(protocol int) (*RawConn, error) {
+	log.WithField("protocol", protocol).Debug("Starting raw listener")
+	primary, err := g.setupPrimarySession()
+	if err != nil {
+		log.WithError(err).Error("Failed to get primary session for raw session")
+		return nil, fmt.Errorf("onramp ListenRaw: %v", err)
+	}
+	conn, err := newRawSubSession(primary.samConn, g.getAddr(), g.getName()+"-raw-"+sam3.RandString(), *g.ServiceKeys, protocol)
+	if err != nil {
+		return nil, err
+	}
+	g.rawMu.Lock()
+	g.rawConns = append(g.rawConns, conn)
+	g.rawMu.Unlock()
+	return conn, nil
+}
+
+// lookup resolves an I2P host name on the primary session's control
+// connection.
+func (g *Garlic) lookup(host string) (i2pkeys.I2PAddr, error) {
+	primary, err := g.setupPrimarySession()
+	if err != nil {
+		return "", err
+	}
+	return primary.lookup(host)
+}
+
+// DialRaw returns a RawConn which sends raw datagrams of the given I2CP
+// protocol to addr. Like ListenRaw it is a subsession of the Garlic
+// structure's primary session, so dialing builds no new tunnels, and the
+// receiver can't see who sent the datagrams anyway. Protocol 0 means
+// RAW_PROTOCOL.
+func (g *Garlic) DialRaw(protocol int, addr string) (*RawConn, error) {
+	log.WithField("address", addr).Debug("Dialing raw session")
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	if !strings.HasSuffix(host, ".i2p") {
+		return nil, fmt.Errorf("onramp DialRaw: %s is not an I2P address", addr)
+	}
+	raddr, err := g.lookup(host)
+	if err != nil {
+		log.WithError(err).Error("Failed to look up raw peer")
+		return nil, fmt.Errorf("onramp DialRaw: %v", err)
+	}
+	primary, err := g.setupPrimarySession()
+	if err != nil {
+		log.WithError(err).Error("Failed to get primary session for raw session")
+		return nil, fmt.Errorf("onramp DialRaw: %v", err)
+	}
+	conn, err := newRawSubSession(primary.samConn, g.getAddr(), g.getName()+"-raw-"+sam3.RandString(), *g.ServiceKeys, protocol)
+	if err != nil {
+		return nil, err
+	}
+	conn.remote = raddr
+	g.rawMu.Lock()
+	g.rawConns = append(g.rawConns, conn)
+	g.rawMu.Unlock()
+	return conn, nil
+}
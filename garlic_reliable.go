@@ -0,0 +1,52 @@
+//go:build !gen
+// +build !gen
+
+package onramp
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ListenReliable returns a net.Listener of reliable, ordered connections
+// carried over the Garlic structure's datagram session, see
+// ReliableListener. They open faster than I2P streaming connections. Once
+// it is called the datagram session is read by onramp, and can't be used
+// for DTLS. There is one reliable listener per Garlic.
+func (g *Garlic) ListenReliable() (net.Listener, error) {
+	log.Debug("Starting reliable listener")
+	mux, err := g.datagramMux("reliable connections", reliableTag)
+	if err != nil {
+		return nil, err
+	}
+	g.packetMu.Lock()
+	defer g.packetMu.Unlock()
+	if g.reliableListener == nil {
+		g.reliableListener = newReliableListener(mux)
+	}
+	return g.reliableListener, nil
+}
+
+// DialReliable returns a reliable, ordered net.Conn to the given I2P
+// address, which must be served by ListenReliable.
+func (g *Garlic) DialReliable(addr string) (net.Conn, error) {
+	log.WithField("address", addr).Debug("Dialing reliable connection over I2P")
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	if !strings.HasSuffix(host, ".i2p") {
+		return nil, fmt.Errorf("onramp DialReliable: %s is not an I2P address", addr)
+	}
+	mux, err := g.datagramMux("reliable connections", reliableTag)
+	if err != nil {
+		return nil, err
+	}
+	raddr, err := g.lookup(host)
+	if err != nil {
+		log.WithError(err).Error("Failed to look up reliable peer")
+		return nil, fmt.Errorf("onramp DialReliable: %v", err)
+	}
+	return dialReliable(mux, raddr)
+}
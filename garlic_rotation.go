@@ -0,0 +1,104 @@
+//go:build !gen
+// +build !gen
+
+package onramp
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"path/filepath"
+	"time"
+)
+
+// RotateGarlic starts moving the service of g to a successor key, which is
+// stored under g's name with a ".next" suffix until the rotation ends. The
+// rotation takes over g, and closes it when its key is retired after
+// overlap, KEY_ROTATION_OVERLAP if zero. If a rotation of g's name was
+// started before, it resumes with the same successor key and end. It
+// returns the rotation and the Garlic structure of the successor key.
+func RotateGarlic(g *Garlic, overlap time.Duration) (*KeyRotation, *Garlic, error) {
+	name := g.getName()
+	ks, keystore := KEYSTORE, ""
+	statePath := "i2pkeys/" + name + ".i2p.rotation"
+	if ks == nil {
+		var err error
+		if keystore, err = I2PKeystorePath(); err != nil {
+			return nil, nil, fmt.Errorf("onramp RotateGarlic: discovery error %v", err)
+		}
+		statePath = filepath.Join(keystore, name+".i2p.rotation")
+	}
+	next := &Garlic{
+		name:                name + ".next",
+		addr:                g.addr,
+		opts:                g.opts,
+		AddrMode:            g.AddrMode,
+		TorrentMode:         g.TorrentMode,
+		CertProfile:         g.CertProfile,
+		TLSClientConfig:     g.TLSClientConfig,
+		NextProtos:          g.NextProtos,
+		QUICConfig:          g.QUICConfig,
+		EncryptedLeaseSet:   g.EncryptedLeaseSet,
+		LeaseSetCredentials: g.LeaseSetCredentials,
+		KeyTypes:            g.KeyTypes,
+	}
+	keys, err := g.Keys()
+	if err != nil {
+		return nil, nil, fmt.Errorf("onramp RotateGarlic: %v", err)
+	}
+	g.ServiceKeys = keys
+	if next.ServiceKeys, err = next.Keys(); err != nil {
+		return nil, nil, fmt.Errorf("onramp RotateGarlic: %v", err)
+	}
+	r := &KeyRotation{
+		current:   g,
+		successor: next,
+		statePath: statePath,
+		keystore:  ks,
+		sign: func(m *MovedTo) error {
+			if o, err := ParseOfflineSignature(*keys); err != nil || o != nil {
+				return fmt.Errorf("transient keys can't sign for their destination")
+			}
+			_, _, seed, _, err := privateKeyParts(*keys)
+			if err != nil {
+				return err
+			}
+			if sigType, _ := destSigType(keys.Addr()); sigType != SIG_ED25519 {
+				return fmt.Errorf("can't sign with keys of signature type %d", sigType)
+			}
+			m.Destination = string(keys.Addr())
+			m.Signature = ed25519.Sign(ed25519.NewKeyFromSeed(seed), []byte(m.signed()))
+			return nil
+		},
+		retire: func() error {
+			var err error
+			if ks != nil {
+				err = archiveKeystoreKeys(ks, "i2pkeys", name, next.name, ".i2p.private")
+			} else {
+				err = archiveKeyFiles(keystore, name, next.name, ".i2p.private", ".i2p.meta")
+			}
+			if err != nil {
+				return err
+			}
+			next.name = name
+			return nil
+		},
+	}
+	if r.From, err = rotationAddr(g); err != nil {
+		return nil, nil, fmt.Errorf("onramp RotateGarlic: %v", err)
+	}
+	if r.To, err = rotationAddr(next); err != nil {
+		return nil, nil, fmt.Errorf("onramp RotateGarlic: %v", err)
+	}
+	if err := r.start(overlap); err != nil {
+		return nil, nil, fmt.Errorf("onramp RotateGarlic: %v", err)
+	}
+	return r, next, nil
+}
+
+// rotationAddr returns the address clients reach g at.
+func rotationAddr(g *Garlic) (string, error) {
+	if g.EncryptedLeaseSet != nil {
+		return g.Base33()
+	}
+	return g.ServiceKeys.Addr().Base32(), nil
+}
@@ -0,0 +1,88 @@
+package onramp
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"github.com/go-i2p/i2pkeys"
+)
+
+// I2P_LOCAL_KEYGEN makes I2PKeys generate destinations with an Ed25519
+// signing key itself instead of asking the SAM bridge, so keys can be
+// created before a router runs. It is off by default because some routers
+// don't accept destinations with an X25519 encryption key.
+var I2P_LOCAL_KEYGEN = false
+
+// GenerateI2PKeys generates the private keys of a new destination without
+// a router, with an Ed25519 signing key and an X25519 encryption key, in
+// SAM's format.
+func GenerateI2PKeys() (i2pkeys.I2PKeys, error) {
+	d, err := newLocalDestination(rand.Reader)
+	if err != nil {
+		return i2pkeys.I2PKeys{}, err
+	}
+	return d.keys(), nil
+}
+
+// localDestination is an I2P destination generated without a router, with
+// an Ed25519 signing key and an X25519 encryption key.
+type localDestination struct {
+	enc *ecdh.PrivateKey
+	sig ed25519.PrivateKey
+	// padding fills the unused space between the keys. It is repeated,
+	// so routers can compress the destination.
+	padding [32]byte
+}
+
+func newLocalDestination(random io.Reader) (*localDestination, error) {
+	enc, err := ecdh.X25519().GenerateKey(random)
+	if err != nil {
+		return nil, fmt.Errorf("onramp: %v", err)
+	}
+	_, sig, err := ed25519.GenerateKey(random)
+	if err != nil {
+		return nil, fmt.Errorf("onramp: %v", err)
+	}
+	d := &localDestination{enc: enc, sig: sig}
+	if _, err := io.ReadFull(random, d.padding[:]); err != nil {
+		return nil, fmt.Errorf("onramp: %v", err)
+	}
+	return d, nil
+}
+
+// dest returns the destination: the encryption key, padding, the signing
+// key at the end of the 384 bytes of keys, and a key certificate with
+// their types.
+func (d *localDestination) dest() []byte {
+	b := make([]byte, 0, 391)
+	b = append(b, d.enc.PublicKey().Bytes()...)
+	for len(b) < 352 {
+		b = append(b, d.padding[:]...)
+	}
+	b = append(b, d.sig.Public().(ed25519.PublicKey)...)
+	return append(b, 5, 0, 4, 0, SIG_ED25519, 0, ENC_ECIES_X25519)
+}
+
+// setPadding rewrites the padding of dest, which dest returned.
+func (d *localDestination) setPadding(dest []byte) {
+	for i := 32; i < 352; i += 32 {
+		copy(dest[i:], d.padding[:])
+	}
+}
+
+// destBase32 returns the b32 address of dest without .b32.i2p.
+func destBase32(dest []byte) string {
+	hash := sha256.Sum256(dest)
+	return i2pBase32.EncodeToString(hash[:])
+}
+
+// keys returns the private keys in SAM's format.
+func (d *localDestination) keys() i2pkeys.I2PKeys {
+	dest := d.dest()
+	both := append(append(append([]byte{}, dest...), d.enc.Bytes()...), d.sig.Seed()...)
+	return i2pkeys.NewKeys(i2pkeys.I2PAddr(i2pBase64.EncodeToString(dest)), i2pBase64.EncodeToString(both))
+}
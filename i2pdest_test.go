@@ -0,0 +1,86 @@
+//go:build !gen
+// +build !gen
+
+package onramp
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"testing"
+)
+
+func TestGenerateI2PKeys(t *testing.T) {
+	keys, err := GenerateI2PKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest, enc, seed, rest, err := privateKeyParts(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dest) != 391 || len(rest) != 0 {
+		t.Errorf("destination of %d bytes with %d more", len(dest), len(rest))
+	}
+	if sigType, _ := certSigType(dest); sigType != SIG_ED25519 || certCryptoType(dest) != ENC_ECIES_X25519 {
+		t.Errorf("destination has types %d/%d", sigType, certCryptoType(dest))
+	}
+	if string(keys.Addr()) != i2pBase64.EncodeToString(dest) {
+		t.Error("the address isn't the destination of the private keys")
+	}
+	if pub := ed25519.NewKeyFromSeed(seed).Public().(ed25519.PublicKey); !bytes.Equal(pub, dest[352:384]) {
+		t.Error("the signing key doesn't belong to the destination")
+	}
+	x, err := ecdh.X25519().NewPrivateKey(enc)
+	if err != nil || !bytes.Equal(x.PublicKey().Bytes(), dest[:32]) {
+		t.Errorf("the encryption key doesn't belong to the destination: %v", err)
+	}
+	if keys.Addr().Base32() != destBase32(dest)+".b32.i2p" {
+		t.Errorf("b32 address %s", keys.Addr().Base32())
+	}
+	if other, _ := GenerateI2PKeys(); other.Addr() == keys.Addr() {
+		t.Error("generated the same destination twice")
+	}
+}
+
+// localKeygen makes I2PKeys generate keys without a router for the
+// duration of the test.
+func localKeygen(t *testing.T) {
+	local := I2P_LOCAL_KEYGEN
+	t.Cleanup(func() { I2P_LOCAL_KEYGEN = local })
+	I2P_LOCAL_KEYGEN = true
+}
+
+func TestI2PKeysLocal(t *testing.T) {
+	localKeygen(t)
+	defer func(path string) { I2P_KEYSTORE_PATH = path }(I2P_KEYSTORE_PATH)
+	I2P_KEYSTORE_PATH = t.TempDir()
+	// no bridge listens on the port
+	keys, err := I2PKeys("local", "127.0.0.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, _, err := privateKeyParts(keys); err != nil {
+		t.Error(err)
+	}
+	stored, err := StoredI2PKeyTypes("local")
+	if err != nil || stored.String() != I2P_KEY_TYPES.String() {
+		t.Errorf("stored types %s, %v", stored, err)
+	}
+	if again, err := I2PKeys("local", "127.0.0.1:1"); err != nil || again.Both != keys.Both {
+		t.Errorf("loaded other keys: %v", err)
+	}
+
+	defer func(local bool) { I2P_LOCAL_KEYGEN = local }(I2P_LOCAL_KEYGEN)
+	I2P_LOCAL_KEYGEN = false
+	if _, err := I2PKeys("router", "127.0.0.1:1"); err == nil {
+		t.Error("generated keys without the router")
+	}
+	sam := newFakeSAM(t)
+	if _, err := I2PKeys("router", sam.Addr()); err != nil {
+		t.Fatal(err)
+	}
+	if open := sam.openConns(); open != 0 {
+		t.Errorf("%d connections to the bridge are still open", open)
+	}
+}
@@ -0,0 +1,427 @@
+//go:build !gen
+// +build !gen
+
+package onramp
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cretz/bine/torutil/ed25519"
+	"github.com/go-i2p/i2pkeys"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/argon2"
+)
+
+// ExportI2PKeys returns the private keys stored for the given tunnel name
+// in the binary format of i2ptunnel's and i2pd's .dat key files.
+func ExportI2PKeys(tunName string) ([]byte, error) {
+	keys, err := storedI2PKeys(tunName)
+	if err != nil {
+		return nil, fmt.Errorf("onramp ExportI2PKeys: %v", err)
+	}
+	dat, err := i2pkeys.I2PAddr(keys.Both).ToBytes()
+	if err != nil {
+		return nil, fmt.Errorf("onramp ExportI2PKeys: %v", err)
+	}
+	return dat, nil
+}
+
+// ExportI2PKeysBase64 returns the private keys stored for the given tunnel
+// name as the base64 private destination SAM and i2ptunnel use.
+func ExportI2PKeysBase64(tunName string) (string, error) {
+	keys, err := storedI2PKeys(tunName)
+	if err != nil {
+		return "", fmt.Errorf("onramp ExportI2PKeysBase64: %v", err)
+	}
+	return keys.Both, nil
+}
+
+// ImportI2PKeys stores private keys, the contents of a .dat key file or a
+// base64 private destination, for the given tunnel name. It refuses to
+// replace other keys stored for the name.
+func ImportI2PKeys(tunName string, data []byte) (i2pkeys.I2PKeys, error) {
+	log.WithField("tunnel_name", tunName).Debug("Importing I2P keys")
+	both := i2pBase64.EncodeToString(data)
+	if text := strings.TrimSpace(string(data)); len(text) > 0 {
+		if b, err := i2pBase64.DecodeString(text); err == nil && len(b) >= 387 {
+			both = text
+		}
+	}
+	keys := i2pkeys.NewKeys("", both)
+	dest, _, _, _, err := privateKeyParts(keys)
+	if err != nil {
+		return i2pkeys.I2PKeys{}, fmt.Errorf("onramp ImportI2PKeys: %v", err)
+	}
+	keys.Address = i2pkeys.I2PAddr(i2pBase64.EncodeToString(dest))
+	if KEYSTORE != nil {
+		data, err := marshalI2PKeys(keys)
+		if err == nil {
+			err = storeKeystoreKey("i2pkeys/"+tunName+".i2p.private", data)
+		}
+		if err != nil {
+			return i2pkeys.I2PKeys{}, fmt.Errorf("onramp ImportI2PKeys: %w", err)
+		}
+		return keys, nil
+	}
+	keystore, err := I2PKeystorePath()
+	if err != nil {
+		return i2pkeys.I2PKeys{}, fmt.Errorf("onramp ImportI2PKeys: discovery error %v", err)
+	}
+	keyspath := filepath.Join(keystore, tunName+".i2p.private")
+	unlock, err := lockKeyFile(keyspath)
+	if err != nil {
+		return i2pkeys.I2PKeys{}, fmt.Errorf("onramp ImportI2PKeys: %v", err)
+	}
+	defer unlock()
+	if stored, err := storedI2PKeys(tunName); err == nil && stored.Addr() != keys.Addr() {
+		return i2pkeys.I2PKeys{}, fmt.Errorf("onramp ImportI2PKeys: %s holds the keys of another destination", keyspath)
+	}
+	if err := writeI2PKeys(keyspath, keys); err != nil {
+		return i2pkeys.I2PKeys{}, fmt.Errorf("onramp ImportI2PKeys: store error %v", err)
+	}
+	sigType, _ := certSigType(dest)
+	metapath := filepath.Join(keystore, tunName+".i2p.meta")
+	if err := writeI2PKeyMetadata(metapath, I2PKeyTypes{Signature: sigType}); err != nil {
+		return i2pkeys.I2PKeys{}, fmt.Errorf("onramp ImportI2PKeys: store error %v", err)
+	}
+	log.WithField("address", keys.Addr().Base32()).Debug("Imported I2P keys")
+	return keys, nil
+}
+
+// keyFileExists reports whether the key store at keystore has the file.
+func keyFileExists(keystore, file string) bool {
+	_, err := os.Stat(filepath.Join(keystore, file))
+	return err == nil
+}
+
+// keyStored reports whether the key store sub, like "i2pkeys", has the
+// file: in KEYSTORE if it is set, and at the path keystore returns if not.
+func keyStored(keystore func() (string, error), sub, file string) (bool, error) {
+	if KEYSTORE != nil {
+		_, err := KEYSTORE.Load(sub + "/" + file)
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	dir, err := keystore()
+	if err != nil {
+		return false, fmt.Errorf("discovery error %v", err)
+	}
+	return keyFileExists(dir, file), nil
+}
+
+// storedI2PKeys loads the keys stored for the given tunnel name, without
+// generating them if there are none.
+func storedI2PKeys(tunName string) (i2pkeys.I2PKeys, error) {
+	if KEYSTORE != nil {
+		data, err := KEYSTORE.Load("i2pkeys/" + tunName + ".i2p.private")
+		if err != nil {
+			return i2pkeys.I2PKeys{}, err
+		}
+		return parseI2PKeys(data)
+	}
+	keystore, err := I2PKeystorePath()
+	if err != nil {
+		return i2pkeys.I2PKeys{}, err
+	}
+	keyspath := filepath.Join(keystore, tunName+".i2p.private")
+	return readI2PKeys(keyspath)
+}
+
+// ExportTorKeys returns the key stored for the given onion key name in the
+// format of Tor's hs_ed25519_secret_key file.
+func ExportTorKeys(keyName string) ([]byte, error) {
+	keys, err := storedTorKeys(keyName)
+	if err != nil {
+		return nil, fmt.Errorf("onramp ExportTorKeys: %v", err)
+	}
+	return append([]byte(torSecretKeyHeader), keys.PrivateKey()...), nil
+}
+
+// storedTorKeys loads the key stored for the given onion key name, without
+// generating it if there is none.
+func storedTorKeys(keyName string) (ed25519.KeyPair, error) {
+	if KEYSTORE != nil {
+		data, err := KEYSTORE.Load("onionkeys/" + keyName + ".tor.private")
+		if err != nil {
+			return nil, err
+		}
+		return parseTorKeys(data)
+	}
+	keystore, err := TorKeystorePath()
+	if err != nil {
+		return nil, fmt.Errorf("discovery error %v", err)
+	}
+	return readTorKeys(filepath.Join(keystore, keyName+".tor.private"))
+}
+
+// ImportTorKeys stores a key, the contents of Tor's hs_ed25519_secret_key
+// file or a 64-byte expanded key, for the given onion key name. It refuses
+// to replace another key stored for the name.
+func ImportTorKeys(keyName string, data []byte) (ed25519.KeyPair, error) {
+	log.WithField("key_name", keyName).Debug("Importing Tor keys")
+	if bytes.HasPrefix(data, []byte(torSecretKeyHeader)) {
+		data = data[len(torSecretKeyHeader):]
+	}
+	if len(data) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("onramp ImportTorKeys: not an ed25519 secret key")
+	}
+	keys := ed25519.PrivateKey(append([]byte{}, data...)).KeyPair()
+	if KEYSTORE != nil {
+		if err := storeKeystoreKey("onionkeys/"+keyName+".tor.private", append([]byte(torSecretKeyHeader), keys.PrivateKey()...)); err != nil {
+			return nil, fmt.Errorf("onramp ImportTorKeys: %w", err)
+		}
+		return keys, nil
+	}
+	keystore, err := TorKeystorePath()
+	if err != nil {
+		return nil, fmt.Errorf("onramp ImportTorKeys: discovery error %v", err)
+	}
+	keysPath := filepath.Join(keystore, keyName+".tor.private")
+	unlock, err := lockKeyFile(keysPath)
+	if err != nil {
+		return nil, fmt.Errorf("onramp ImportTorKeys: %v", err)
+	}
+	defer unlock()
+	if stored, err := readTorKeys(keysPath); err == nil && !bytes.Equal(stored.PrivateKey(), keys.PrivateKey()) {
+		return nil, fmt.Errorf("onramp ImportTorKeys: %s holds another key", keysPath)
+	}
+	if err := writeKeyFile(keysPath, append([]byte(torSecretKeyHeader), keys.PrivateKey()...), 0600); err != nil {
+		return nil, fmt.Errorf("onramp ImportTorKeys: %v", err)
+	}
+	if err := writeTorKeyMetadata(filepath.Join(keystore, keyName+".tor.meta")); err != nil {
+		return nil, fmt.Errorf("onramp ImportTorKeys: store error %v", err)
+	}
+	return keys, nil
+}
+
+// KeyBundle holds the keys of a named service, to move them to another
+// machine with ExportKeyBundle and ImportKeyBundle.
+type KeyBundle struct {
+	Name string `json:"name"`
+	// I2P holds private keys in the .dat format, see ExportI2PKeys.
+	I2P []byte `json:"i2p,omitempty"`
+	// Tor holds a key in the hs_ed25519_secret_key format, see
+	// ExportTorKeys.
+	Tor []byte `json:"tor,omitempty"`
+	// TLS holds TLS certificates and keys by host name.
+	TLS map[string]TLSKeyPair `json:"tls,omitempty"`
+}
+
+// TLSKeyPair is a PEM certificate and key of the TLS key store.
+type TLSKeyPair struct {
+	Cert []byte `json:"cert"`
+	Key  []byte `json:"key"`
+}
+
+// keyBundleMagic starts key bundles, followed by the salt of the key, the
+// nonce and the sealed JSON of the KeyBundle.
+const keyBundleMagic = "onramp-key-bundle-1\n"
+
+// keyBundleKey derives the key of a bundle from its passphrase.
+func keyBundleKey(passphrase string, salt []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(argon2.IDKey([]byte(passphrase), salt, 1, 64*1024, 4, 32))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// ExportKeyBundle returns the I2P and Tor keys stored under name and the
+// TLS certificates of tlsHosts in one bundle, encrypted and authenticated
+// with passphrase.
+func ExportKeyBundle(name string, tlsHosts []string, passphrase string) ([]byte, error) {
+	log.WithFields(logrus.Fields{
+		"name":      name,
+		"tls_hosts": tlsHosts,
+	}).Debug("Exporting key bundle")
+	if passphrase == "" {
+		return nil, fmt.Errorf("onramp ExportKeyBundle: empty passphrase")
+	}
+	bundle := &KeyBundle{Name: name}
+	if ok, err := keyStored(I2PKeystorePath, "i2pkeys", name+".i2p.private"); err != nil {
+		return nil, fmt.Errorf("onramp ExportKeyBundle: %v", err)
+	} else if ok {
+		if bundle.I2P, err = ExportI2PKeys(name); err != nil {
+			return nil, err
+		}
+	}
+	if ok, err := keyStored(TorKeystorePath, "onionkeys", name+".tor.private"); err != nil {
+		return nil, fmt.Errorf("onramp ExportKeyBundle: %v", err)
+	} else if ok {
+		if bundle.Tor, err = ExportTorKeys(name); err != nil {
+			return nil, err
+		}
+	}
+	if len(tlsHosts) > 0 {
+		bundle.TLS = make(map[string]TLSKeyPair)
+		for _, host := range tlsHosts {
+			pair, err := storedTLSKeyPair(host)
+			if err != nil {
+				return nil, fmt.Errorf("onramp ExportKeyBundle: %v", err)
+			}
+			bundle.TLS[host] = pair
+		}
+	}
+	if bundle.I2P == nil && bundle.Tor == nil && bundle.TLS == nil {
+		return nil, fmt.Errorf("onramp ExportKeyBundle: no keys stored under %s", name)
+	}
+	plain, err := json.Marshal(bundle)
+	if err != nil {
+		return nil, fmt.Errorf("onramp ExportKeyBundle: %v", err)
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("onramp ExportKeyBundle: %v", err)
+	}
+	aead, err := keyBundleKey(passphrase, salt)
+	if err != nil {
+		return nil, fmt.Errorf("onramp ExportKeyBundle: %v", err)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("onramp ExportKeyBundle: %v", err)
+	}
+	out := append([]byte(keyBundleMagic), salt...)
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, plain, []byte(keyBundleMagic)), nil
+}
+
+// OpenKeyBundle decrypts a bundle of ExportKeyBundle.
+func OpenKeyBundle(data []byte, passphrase string) (*KeyBundle, error) {
+	if !bytes.HasPrefix(data, []byte(keyBundleMagic)) {
+		return nil, fmt.Errorf("onramp OpenKeyBundle: not a key bundle")
+	}
+	data = data[len(keyBundleMagic):]
+	if len(data) < 16 {
+		return nil, fmt.Errorf("onramp OpenKeyBundle: truncated key bundle")
+	}
+	aead, err := keyBundleKey(passphrase, data[:16])
+	if err != nil {
+		return nil, fmt.Errorf("onramp OpenKeyBundle: %v", err)
+	}
+	data = data[16:]
+	if len(data) < aead.NonceSize() {
+		return nil, fmt.Errorf("onramp OpenKeyBundle: truncated key bundle")
+	}
+	plain, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], []byte(keyBundleMagic))
+	if err != nil {
+		return nil, fmt.Errorf("onramp OpenKeyBundle: wrong passphrase or damaged key bundle")
+	}
+	bundle := &KeyBundle{}
+	if err := json.Unmarshal(plain, bundle); err != nil {
+		return nil, fmt.Errorf("onramp OpenKeyBundle: %v", err)
+	}
+	return bundle, nil
+}
+
+// ImportKeyBundle decrypts a bundle of ExportKeyBundle and stores its keys
+// in the key stores, under the name it was exported with. It refuses to
+// replace other keys.
+func ImportKeyBundle(data []byte, passphrase string) (*KeyBundle, error) {
+	bundle, err := OpenKeyBundle(data, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	log.WithField("name", bundle.Name).Debug("Importing key bundle")
+	if bundle.I2P != nil {
+		if _, err := ImportI2PKeys(bundle.Name, bundle.I2P); err != nil {
+			return nil, err
+		}
+	}
+	if bundle.Tor != nil {
+		if _, err := ImportTorKeys(bundle.Name, bundle.Tor); err != nil {
+			return nil, err
+		}
+	}
+	if len(bundle.TLS) > 0 && KEYSTORE != nil {
+		for host, pair := range bundle.TLS {
+			// the key file of the TLS key store holds the certificate too
+			data := pair.Key
+			if !bytes.Contains(data, []byte("CERTIFICATE")) {
+				data = append(append([]byte{}, pair.Key...), pair.Cert...)
+			}
+			if err := storeKeystoreKey("tlskeys/"+host+".pem", data); err != nil {
+				return nil, fmt.Errorf("onramp ImportKeyBundle: %w", err)
+			}
+		}
+	} else if len(bundle.TLS) > 0 {
+		keystore, err := TLSKeystorePath()
+		if err != nil {
+			return nil, fmt.Errorf("onramp ImportKeyBundle: discovery error %v", err)
+		}
+		for host, pair := range bundle.TLS {
+			certPath := filepath.Join(keystore, host+".crt")
+			keyPath := filepath.Join(keystore, host+".pem")
+			if err := importTLSKeyPair(certPath, keyPath, pair); err != nil {
+				return nil, fmt.Errorf("onramp ImportKeyBundle: %v", err)
+			}
+		}
+	}
+	return bundle, nil
+}
+
+// storedTLSKeyPair returns the certificate and key stored for host.
+func storedTLSKeyPair(host string) (TLSKeyPair, error) {
+	var pair TLSKeyPair
+	if KEYSTORE != nil {
+		data, err := KEYSTORE.Load("tlskeys/" + host + ".pem")
+		if err != nil {
+			return pair, err
+		}
+		for rest := data; ; {
+			var block *pem.Block
+			if block, rest = pem.Decode(rest); block == nil {
+				break
+			}
+			if block.Type == "CERTIFICATE" {
+				pair.Cert = append(pair.Cert, pem.EncodeToMemory(block)...)
+			}
+		}
+		if pair.Cert == nil {
+			return pair, fmt.Errorf("tlskeys/%s.pem holds no certificate", host)
+		}
+		pair.Key = data
+		return pair, nil
+	}
+	keystore, err := TLSKeystorePath()
+	if err != nil {
+		return pair, fmt.Errorf("discovery error %v", err)
+	}
+	if pair.Cert, err = os.ReadFile(filepath.Join(keystore, host+".crt")); err != nil {
+		return pair, err
+	}
+	if pair.Key, err = os.ReadFile(filepath.Join(keystore, host+".pem")); err != nil {
+		return pair, err
+	}
+	return pair, nil
+}
+
+// importTLSKeyPair stores pair at the paths of the TLS key store unless
+// another key is stored there.
+func importTLSKeyPair(certPath, keyPath string, pair TLSKeyPair) error {
+	unlock, err := lockKeyFile(keyPath)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if stored, err := os.ReadFile(keyPath); err == nil && !bytes.Equal(stored, pair.Key) {
+		return fmt.Errorf("%s holds another key", keyPath)
+	}
+	if err := writeKeyFile(certPath, pair.Cert, 0644); err != nil {
+		return err
+	}
+	return writeKeyFile(keyPath, pair.Key, 0600)
+}
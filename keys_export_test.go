@@ -0,0 +1,154 @@
+//go:build !gen
+// +build !gen
+
+package onramp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cretz/bine/torutil/ed25519"
+	"github.com/go-i2p/i2pkeys"
+)
+
+// tempKeystores points the key stores at temporary directories for the
+// duration of the test.
+func tempKeystores(t *testing.T) {
+	i2p, tor, tls := I2P_KEYSTORE_PATH, ONION_KEYSTORE_PATH, TLS_KEYSTORE_PATH
+	t.Cleanup(func() {
+		I2P_KEYSTORE_PATH, ONION_KEYSTORE_PATH, TLS_KEYSTORE_PATH = i2p, tor, tls
+	})
+	I2P_KEYSTORE_PATH, ONION_KEYSTORE_PATH, TLS_KEYSTORE_PATH = t.TempDir(), t.TempDir(), t.TempDir()
+}
+
+func TestI2PKeysExportImport(t *testing.T) {
+	tempKeystores(t)
+	keys := testOfflineKeys(t)
+	dat := i2pkeys.I2PAddr(keys.Both).Bytes()
+	imported, err := ImportI2PKeys("svc", dat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported.Addr() != keys.Addr() {
+		t.Error("imported keys have another destination")
+	}
+	if exported, err := ExportI2PKeys("svc"); err != nil || !bytes.Equal(exported, dat) {
+		t.Errorf("exported other keys: %v", err)
+	}
+	if exported, err := ExportI2PKeysBase64("svc"); err != nil || exported != keys.Both {
+		t.Errorf("exported other keys: %v", err)
+	}
+	if imported, err := ImportI2PKeys("text", []byte(keys.Both+"\n")); err != nil || imported.Addr() != keys.Addr() {
+		t.Errorf("base64 import: %v", err)
+	}
+	if loaded, err := I2PKeysWithTypes("svc", "127.0.0.1:1", I2PKeyTypes{Signature: SIG_ED25519}); err != nil || loaded.Both != keys.Both {
+		t.Errorf("loaded other keys: %v", err)
+	}
+	if _, err := ImportI2PKeys("svc", []byte(testOfflineKeys(t).Both)); err == nil {
+		t.Error("replaced the keys of another destination")
+	}
+	if _, err := ImportI2PKeys("bad", []byte("not keys")); err == nil {
+		t.Error("imported invalid keys")
+	}
+}
+
+func TestTorKeysExportImport(t *testing.T) {
+	tempKeystores(t)
+	keys, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ImportTorKeys("svc", keys.PrivateKey()); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := TorKeys("svc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(loaded.PublicKey(), keys.PublicKey()) {
+		t.Error("loaded another key than the imported one")
+	}
+	exported, err := ExportTorKeys("svc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exported) != 96 || !bytes.Equal(exported[32:], keys.PrivateKey()) {
+		t.Errorf("exported %x", exported)
+	}
+	if _, err := ImportTorKeys("copy", exported); err != nil {
+		t.Error(err)
+	}
+	other, _ := ed25519.GenerateKey(rand.Reader)
+	if _, err := ImportTorKeys("svc", other.PrivateKey()); err == nil {
+		t.Error("replaced another key")
+	}
+
+	// key files without Tor's header keep loading as they did
+	legacy := filepath.Join(ONION_KEYSTORE_PATH, "legacy.tor.private")
+	if err := os.WriteFile(legacy, keys.PrivateKey(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err = TorKeys("legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := ed25519.FromCryptoPrivateKey([]byte(keys.PrivateKey())).PrivateKey(); !bytes.Equal(loaded.PrivateKey(), want) {
+		t.Error("loaded another private key from a legacy key file")
+	}
+	if !bytes.Equal(loaded.PublicKey(), loaded.PrivateKey().PublicKey()) {
+		t.Error("the public key doesn't belong to the private key")
+	}
+}
+
+func TestKeyBundle(t *testing.T) {
+	tempKeystores(t)
+	keys := testOfflineKeys(t)
+	if _, err := ImportI2PKeys("svc", []byte(keys.Both)); err != nil {
+		t.Fatal(err)
+	}
+	torKeys, _ := ed25519.GenerateKey(rand.Reader)
+	if _, err := ImportTorKeys("svc", torKeys.PrivateKey()); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(TLS_KEYSTORE_PATH, "svc.b32.i2p.crt"), []byte("cert"), 0644)
+	os.WriteFile(filepath.Join(TLS_KEYSTORE_PATH, "svc.b32.i2p.pem"), []byte("key"), 0600)
+	bundle, err := ExportKeyBundle("svc", []string{"svc.b32.i2p"}, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(bundle, []byte("cert")) {
+		t.Error("bundle isn't encrypted")
+	}
+	if _, err := OpenKeyBundle(bundle, "wrong"); err == nil {
+		t.Error("opened a bundle with the wrong passphrase")
+	}
+	damaged := append([]byte{}, bundle...)
+	damaged[len(damaged)-1] ^= 1
+	if _, err := OpenKeyBundle(damaged, "correct horse"); err == nil {
+		t.Error("opened a damaged bundle")
+	}
+
+	tempKeystores(t)
+	imported, err := ImportKeyBundle(bundle, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported.Name != "svc" {
+		t.Errorf("bundle name %s", imported.Name)
+	}
+	if loaded, err := ExportI2PKeysBase64("svc"); err != nil || loaded != keys.Both {
+		t.Errorf("imported other I2P keys: %v", err)
+	}
+	if loaded, err := TorKeys("svc"); err != nil || !bytes.Equal(loaded.PublicKey(), torKeys.PublicKey()) {
+		t.Errorf("imported another Tor key: %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(TLS_KEYSTORE_PATH, "svc.b32.i2p.pem")); err != nil || string(data) != "key" {
+		t.Errorf("imported TLS key %q, %v", data, err)
+	}
+	if _, err := ExportKeyBundle("nothing", nil, "pass"); err == nil {
+		t.Error("exported an empty bundle")
+	}
+}
@@ -0,0 +1,306 @@
+//go:build !gen
+// +build !gen
+
+package onramp
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cretz/bine/torutil"
+)
+
+// Kinds of the identities ListKeys returns.
+const (
+	KEY_KIND_I2P = "i2p"
+	KEY_KIND_TOR = "tor"
+	KEY_KIND_TLS = "tls"
+)
+
+// KeyInfo describes an identity stored in the key stores.
+type KeyInfo struct {
+	// Kind is KEY_KIND_I2P, KEY_KIND_TOR or KEY_KIND_TLS.
+	Kind string `json:"kind"`
+	// Name is the tunnel or key name the identity is stored under, or the
+	// host name of a TLS certificate.
+	Name string `json:"name"`
+	// Address is the .b32.i2p or .onion address of the identity, or the
+	// first name a TLS certificate is valid for.
+	Address string `json:"address,omitempty"`
+	// SignatureType names the type of the identity's signing key.
+	SignatureType string `json:"signature_type,omitempty"`
+	// Created is when the keys were generated or imported, as far as the
+	// key store knows; the modification time of the key file if it doesn't.
+	Created time.Time `json:"created"`
+	// TLSExpiry is when the TLS certificate of the identity's address
+	// expires, or zero if it has none.
+	TLSExpiry time.Time `json:"tls_expiry,omitempty"`
+	// Files are the paths of the identity's files.
+	Files []string `json:"files"`
+	// Error is why the identity couldn't be read, if it couldn't.
+	Error string `json:"error,omitempty"`
+}
+
+// torKeyMetadata is stored next to Tor keys in a .tor.meta file.
+type torKeyMetadata struct {
+	Created time.Time `json:"created"`
+}
+
+// readTorKeyMetadata reads the metadata at path, or returns nil if there
+// is none.
+func readTorKeyMetadata(path string) (*torKeyMetadata, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var meta torKeyMetadata
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &meta, nil
+}
+
+// writeTorKeyMetadata stores the metadata of new keys at path, unless it
+// already has some.
+func writeTorKeyMetadata(path string) error {
+	if meta, err := readTorKeyMetadata(path); err == nil && meta != nil {
+		return nil
+	}
+	data, err := json.MarshalIndent(torKeyMetadata{Created: time.Now().UTC()}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeKeyFile(path, append(data, '\n'), 0644)
+}
+
+// ListKeys returns the identities in the I2P, Tor and TLS key stores, in
+// that order and sorted by name. Key stores that don't exist yet are
+// empty, and nothing is generated or changed. Identities that can't be
+// read are returned with their Error set. Lock files, temporary files,
+// quarantined corrupt files and archived keys are skipped. A Keystore
+// can't list its keys, so it returns ErrKeystoreUnsupported while KEYSTORE
+// is set.
+func ListKeys() ([]KeyInfo, error) {
+	if KEYSTORE != nil {
+		return nil, fmt.Errorf("onramp ListKeys: %w", ErrKeystoreUnsupported)
+	}
+	var infos []KeyInfo
+	tlsDir, err := keystoreDir(TLS_KEYSTORE_PATH, "tlskeys")
+	if err != nil {
+		return nil, fmt.Errorf("onramp ListKeys: discovery error %v", err)
+	}
+	tlsInfos, err := listTLSKeys(tlsDir)
+	if err != nil {
+		return nil, fmt.Errorf("onramp ListKeys: %v", err)
+	}
+	expiry := make(map[string]time.Time)
+	for _, info := range tlsInfos {
+		expiry[info.Name] = info.TLSExpiry
+	}
+
+	i2pDir, err := keystoreDir(I2P_KEYSTORE_PATH, "i2pkeys")
+	if err != nil {
+		return nil, fmt.Errorf("onramp ListKeys: discovery error %v", err)
+	}
+	names, err := keyFileNames(i2pDir, ".i2p.private")
+	if err != nil {
+		return nil, fmt.Errorf("onramp ListKeys: %v", err)
+	}
+	for _, name := range names {
+		info := i2pKeyInfo(i2pDir, name)
+		info.TLSExpiry = expiry[info.Address]
+		infos = append(infos, info)
+	}
+
+	torDir, err := keystoreDir(ONION_KEYSTORE_PATH, "onionkeys")
+	if err != nil {
+		return nil, fmt.Errorf("onramp ListKeys: discovery error %v", err)
+	}
+	names, err = keyFileNames(torDir, ".tor.private")
+	if err != nil {
+		return nil, fmt.Errorf("onramp ListKeys: %v", err)
+	}
+	for _, name := range names {
+		info := torKeyInfo(torDir, name)
+		// Onion.TLSKeys names certificates by the service ID alone
+		if t, ok := expiry[strings.TrimSuffix(info.Address, ".onion")]; ok {
+			info.TLSExpiry = t
+		} else {
+			info.TLSExpiry = expiry[info.Address]
+		}
+		infos = append(infos, info)
+	}
+
+	infos = append(infos, tlsInfos...)
+	order := map[string]int{KEY_KIND_I2P: 0, KEY_KIND_TOR: 1, KEY_KIND_TLS: 2}
+	sort.SliceStable(infos, func(i, j int) bool {
+		if infos[i].Kind != infos[j].Kind {
+			return order[infos[i].Kind] < order[infos[j].Kind]
+		}
+		return infos[i].Name < infos[j].Name
+	})
+	return infos, nil
+}
+
+// keyFileNames returns the names of the key files with the extension ext
+// in dir, which may not exist.
+func keyFileNames(dir, ext string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		file := entry.Name()
+		// temporary files of writeKeyFile start with a dot, quarantined
+		// and lock files have other extensions, and archives are
+		// directories
+		if entry.IsDir() || strings.HasPrefix(file, ".") || !strings.HasSuffix(file, ext) {
+			continue
+		}
+		names = append(names, strings.TrimSuffix(file, ext))
+	}
+	return names, nil
+}
+
+// existingFiles returns the paths of the files of name with the given
+// extensions in dir that exist.
+func existingFiles(dir, name string, exts ...string) []string {
+	var files []string
+	for _, ext := range exts {
+		if keyFileExists(dir, name+ext) {
+			files = append(files, filepath.Join(dir, name+ext))
+		}
+	}
+	return files
+}
+
+// modTime returns the modification time of the file at path.
+func modTime(path string) time.Time {
+	if info, err := os.Stat(path); err == nil {
+		return info.ModTime().UTC()
+	}
+	return time.Time{}
+}
+
+// i2pKeyInfo describes the I2P keys stored for name in dir without
+// quarantining them if they are corrupt.
+func i2pKeyInfo(dir, name string) KeyInfo {
+	keyspath := filepath.Join(dir, name+".i2p.private")
+	info := KeyInfo{
+		Kind:    KEY_KIND_I2P,
+		Name:    name,
+		Created: modTime(keyspath),
+		Files:   existingFiles(dir, name, ".i2p.private", ".i2p.meta", ".i2p.auth_private", ".i2p.rotation"),
+	}
+	data, err := os.ReadFile(keyspath)
+	if err != nil {
+		info.Error = err.Error()
+		return info
+	}
+	keys, err := parseI2PKeys(data)
+	if err != nil {
+		info.Error = err.Error()
+		return info
+	}
+	sig, err := destSigType(keys.Addr())
+	if err != nil {
+		info.Error = err.Error()
+		return info
+	}
+	info.Address = keys.Addr().Base32()
+	info.SignatureType = I2PKeyTypes{Signature: sig}.String()
+	meta, err := readI2PKeyMetadata(filepath.Join(dir, name+".i2p.meta"))
+	if err != nil {
+		info.Error = err.Error()
+	} else if meta != nil && !meta.Created.IsZero() {
+		info.Created = meta.Created
+	}
+	return info
+}
+
+// torKeyInfo describes the Tor key stored for name in dir without
+// quarantining it if it is corrupt.
+func torKeyInfo(dir, name string) KeyInfo {
+	keyspath := filepath.Join(dir, name+".tor.private")
+	info := KeyInfo{
+		Kind:    KEY_KIND_TOR,
+		Name:    name,
+		Created: modTime(keyspath),
+		Files:   existingFiles(dir, name, ".tor.private", ".tor.meta", ".tor.auth_private", ".tor.auth", ".tor.rotation"),
+	}
+	data, err := os.ReadFile(keyspath)
+	if err != nil {
+		info.Error = err.Error()
+		return info
+	}
+	keys, err := parseTorKeys(data)
+	if err != nil {
+		info.Error = err.Error()
+		return info
+	}
+	info.Address = torutil.OnionServiceIDFromV3PublicKey(keys.PublicKey()) + ".onion"
+	info.SignatureType = "ED25519-V3"
+	meta, err := readTorKeyMetadata(filepath.Join(dir, name+".tor.meta"))
+	if err != nil {
+		info.Error = err.Error()
+	} else if meta != nil && !meta.Created.IsZero() {
+		info.Created = meta.Created
+	}
+	return info
+}
+
+// listTLSKeys describes the certificates in the TLS key store at dir.
+func listTLSKeys(dir string) ([]KeyInfo, error) {
+	hosts, err := keyFileNames(dir, ".crt")
+	if err != nil {
+		return nil, err
+	}
+	var infos []KeyInfo
+	for _, host := range hosts {
+		info := KeyInfo{
+			Kind:  KEY_KIND_TLS,
+			Name:  host,
+			Files: existingFiles(dir, host, ".crt", ".pem", ".crl"),
+		}
+		cert, err := readCertificate(filepath.Join(dir, host+".crt"))
+		if err != nil {
+			info.Error = err.Error()
+			info.Created = modTime(filepath.Join(dir, host+".crt"))
+		} else {
+			info.Address = host
+			if len(cert.DNSNames) > 0 {
+				info.Address = cert.DNSNames[0]
+			}
+			info.SignatureType = cert.SignatureAlgorithm.String()
+			info.Created = cert.NotBefore.UTC()
+			info.TLSExpiry = cert.NotAfter.UTC()
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// readCertificate parses the first certificate in the PEM file at path.
+func readCertificate(path string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("%s holds no certificate", path)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
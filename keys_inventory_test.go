@@ -0,0 +1,80 @@
+//go:build !gen
+// +build !gen
+
+package onramp
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cretz/bine/torutil"
+)
+
+func TestListKeys(t *testing.T) {
+	localKeygen(t)
+	tempKeystores(t)
+	if infos, err := ListKeys(); err != nil || len(infos) != 0 {
+		t.Fatalf("listed %v, %v", infos, err)
+	}
+
+	i2p, err := I2PKeys("svc", "127.0.0.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tor, err := TorKeys("svc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	onion := torutil.OnionServiceIDFromV3PublicKey(tor.PublicKey())
+	if _, err := TLSKeys(i2p.Addr().Base32()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := TLSKeys(onion); err != nil {
+		t.Fatal(err)
+	}
+	// files that aren't identities
+	for _, file := range []string{"svc.i2p.private.lock", "svc.i2p.private.corrupt-20250101T000000Z", ".svc.i2p.private.tmp-1", "archive/old-20250101T000000Z.i2p.private"} {
+		path := filepath.Join(I2P_KEYSTORE_PATH, file)
+		os.MkdirAll(filepath.Dir(path), 0700)
+		os.WriteFile(path, []byte("x"), 0600)
+	}
+	os.WriteFile(filepath.Join(ONION_KEYSTORE_PATH, "bad.tor.private"), []byte("bad"), 0600)
+
+	infos, err := ListKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 5 {
+		t.Fatalf("listed %+v", infos)
+	}
+	i2pInfo, badInfo, torInfo := infos[0], infos[1], infos[2]
+	if i2pInfo.Kind != KEY_KIND_I2P || i2pInfo.Name != "svc" || i2pInfo.Address != i2p.Addr().Base32() || i2pInfo.SignatureType != "EdDSA_SHA512_Ed25519" || i2pInfo.Error != "" {
+		t.Errorf("I2P keys %+v", i2pInfo)
+	}
+	if i2pInfo.Created.IsZero() || i2pInfo.TLSExpiry.IsZero() || len(i2pInfo.Files) != 2 {
+		t.Errorf("I2P keys %+v", i2pInfo)
+	}
+	if badInfo.Kind != KEY_KIND_TOR || badInfo.Name != "bad" || badInfo.Error == "" {
+		t.Errorf("corrupt Tor key %+v", badInfo)
+	}
+	if torInfo.Kind != KEY_KIND_TOR || torInfo.Address != onion+".onion" || torInfo.Created.IsZero() || torInfo.TLSExpiry.IsZero() || len(torInfo.Files) != 2 {
+		t.Errorf("Tor key %+v", torInfo)
+	}
+	for _, info := range infos[3:] {
+		if info.Kind != KEY_KIND_TLS || info.TLSExpiry.Before(info.Created) || len(info.Files) != 3 || info.Error != "" {
+			t.Errorf("TLS certificate %+v", info)
+		}
+	}
+	// listing doesn't quarantine corrupt keys
+	if _, err := os.Stat(filepath.Join(ONION_KEYSTORE_PATH, "bad.tor.private")); err != nil {
+		t.Error(err)
+	}
+
+	if err := DeleteOnionKeys("svc"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(ONION_KEYSTORE_PATH, "svc.tor.meta")); !os.IsNotExist(err) {
+		t.Errorf("the key metadata wasn't deleted: %v", err)
+	}
+}
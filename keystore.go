@@ -0,0 +1,250 @@
+package onramp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/go-i2p/i2pkeys"
+	"github.com/sirupsen/logrus"
+)
+
+// writeKeyFile replaces the file at path with data atomically: data is
+// written to a temporary file next to it, synced and renamed over it, so a
+// crash leaves either the old or the new file, never a truncated one.
+func writeKeyFile(path string, data []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(path))
+	return nil
+}
+
+// syncDir makes a rename in dir durable where directories can be synced.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+// keyLocks serialize the goroutines of this process using a key file,
+// since not every platform's file locks do.
+var keyLocks sync.Map
+
+// lockKeyFile locks the key file at path against other goroutines and,
+// with an advisory lock on path.lock, other processes, until unlock is
+// called. Hold it from checking whether keys exist until they are written.
+func lockKeyFile(path string) (unlock func(), err error) {
+	lockPath := path + ".lock"
+	mu, _ := keyLocks.LoadOrStore(lockPath, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	f, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		mu.(*sync.Mutex).Unlock()
+		return nil, fmt.Errorf("onramp: lock error %v", err)
+	}
+	log.WithField("path", lockPath).Debug("Waiting for key lock")
+	if err := lockFile(f); err != nil {
+		f.Close()
+		mu.(*sync.Mutex).Unlock()
+		return nil, fmt.Errorf("onramp: lock error %v", err)
+	}
+	return func() {
+		unlockFile(f)
+		f.Close()
+		mu.(*sync.Mutex).Unlock()
+	}, nil
+}
+
+// quarantineKeyFile moves the corrupt key file at path aside to
+// path.corrupt-<time> and returns an error explaining what happened.
+func quarantineKeyFile(path string, cause error) error {
+	quarantine := path + ".corrupt-" + time.Now().UTC().Format("20060102T150405Z")
+	log.WithFields(logrus.Fields{
+		"path":       path,
+		"quarantine": quarantine,
+		"error":      cause,
+	}).Error("Quarantining corrupt key file")
+	if err := os.Rename(path, quarantine); err != nil {
+		return fmt.Errorf("%s is corrupt (%v) and can't be moved aside: %v", path, cause, err)
+	}
+	return fmt.Errorf("%s is corrupt (%v) and was moved to %s; restore the keys from a backup, or remove it to generate new ones", path, cause, quarantine)
+}
+
+// checkQuarantine returns an error if a corrupt key file at path was
+// quarantined, so new keys don't silently replace the identity it held.
+func checkQuarantine(path string) error {
+	quarantined, _ := filepath.Glob(path + ".corrupt-*")
+	if len(quarantined) > 0 {
+		return fmt.Errorf("the key file %s was corrupt; restore the keys from a backup to %s, or remove %s to generate new ones", quarantined[0], path, quarantined[0])
+	}
+	return nil
+}
+
+// readI2PKeys loads the keys in the I2P key file at path, and quarantines
+// the file if it doesn't hold valid keys.
+func readI2PKeys(path string) (i2pkeys.I2PKeys, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return i2pkeys.I2PKeys{}, err
+	}
+	keys, err := parseI2PKeys(data)
+	if err != nil {
+		return i2pkeys.I2PKeys{}, quarantineKeyFile(path, err)
+	}
+	return keys, nil
+}
+
+// parseI2PKeys parses keys in the format writeI2PKeys stores. Only the
+// layout every key type shares is checked, so keys of types this package
+// doesn't know aren't taken for corrupt ones.
+func parseI2PKeys(data []byte) (i2pkeys.I2PKeys, error) {
+	keys, err := i2pkeys.LoadKeysIncompat(bytes.NewReader(data))
+	if err != nil {
+		return i2pkeys.I2PKeys{}, err
+	}
+	dest, err := i2pBase64.DecodeString(string(keys.Address))
+	if err != nil || len(dest) < 387 {
+		return i2pkeys.I2PKeys{}, fmt.Errorf("invalid destination")
+	}
+	both, err := i2pBase64.DecodeString(keys.Both)
+	if err != nil || len(both) <= len(dest) {
+		return i2pkeys.I2PKeys{}, fmt.Errorf("invalid private keys")
+	}
+	if !bytes.Equal(both[:len(dest)], dest) {
+		return i2pkeys.I2PKeys{}, fmt.Errorf("the address isn't the destination of the private keys")
+	}
+	return keys, nil
+}
+
+// writeI2PKeys stores keys at path in the format readI2PKeys and
+// i2pkeys.LoadKeys read.
+func writeI2PKeys(path string, keys i2pkeys.I2PKeys) error {
+	data, err := marshalI2PKeys(keys)
+	if err != nil {
+		return err
+	}
+	return writeKeyFile(path, data, 0600)
+}
+
+// marshalI2PKeys encodes keys in the format parseI2PKeys reads.
+func marshalI2PKeys(keys i2pkeys.I2PKeys) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := i2pkeys.StoreKeysIncompat(keys, &buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Keystore stores keys somewhere else than the local key stores, see
+// KEYSTORE. Names are paths relative to a key store root, like
+// "i2pkeys/name.i2p.private", and the data is what the local key store
+// would hold in that file.
+type Keystore interface {
+	// Load returns the data stored under name, or an error matching
+	// fs.ErrNotExist if there is none.
+	Load(name string) ([]byte, error)
+	// Store stores data under name, unless something is stored there
+	// already, in which case it returns an error matching fs.ErrExist.
+	Store(name string, data []byte) error
+	// Delete removes what is stored under name, if anything.
+	Delete(name string) error
+}
+
+// KEYSTORE, if it is set, holds the keys of I2PKeys, TorKeys and TLSKeys
+// instead of the local key stores, and nothing is written to the local
+// disk for them. The key import, export and rotation functions use it too.
+// Key type metadata, CRLs and the other files of the local key stores
+// aren't kept for keys in a Keystore, and ListKeys, StoreTransientI2PKeys
+// and the CRL functions return ErrKeystoreUnsupported.
+var KEYSTORE Keystore
+
+// ErrKeystoreReadOnly is returned when keys would have to be stored in a
+// read-only Keystore.
+var ErrKeystoreReadOnly = errors.New("onramp: the keystore is read-only")
+
+// ErrKeystoreUnsupported is returned by the functions which only work with
+// the local key stores while KEYSTORE is set.
+var ErrKeystoreUnsupported = errors.New("onramp: not supported for keys in KEYSTORE")
+
+// lockKeystoreKey locks name in KEYSTORE against the other goroutines of
+// this process until unlock is called. A Keystore has no locks, so other
+// processes rely on its Store refusing to replace keys.
+func lockKeystoreKey(name string) (unlock func()) {
+	mu, _ := keyLocks.LoadOrStore("keystore:"+name, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	return mu.(*sync.Mutex).Unlock
+}
+
+// keystoreKey loads the data stored under name in KEYSTORE, or generates
+// and stores it if there is none. If another process stores data first,
+// that is returned instead. Errors of generate are returned unchanged.
+func keystoreKey(name string, generate func() ([]byte, error)) ([]byte, error) {
+	defer lockKeystoreKey(name)()
+	data, err := KEYSTORE.Load(name)
+	if err == nil {
+		log.WithField("name", name).Debug("Loaded keys from the keystore")
+		return data, nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("onramp keystore: %s: %w", name, err)
+	}
+	log.WithField("name", name).Debug("Keys not in the keystore, generating new keys")
+	data, err = generate()
+	if err != nil {
+		return nil, err
+	}
+	if err := KEYSTORE.Store(name, data); errors.Is(err, fs.ErrExist) {
+		log.WithField("name", name).Debug("Keys were stored meanwhile, loading them")
+		if data, err = KEYSTORE.Load(name); err != nil {
+			return nil, fmt.Errorf("onramp keystore: %s: %w", name, err)
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("onramp keystore: %s: %w", name, err)
+	}
+	return data, nil
+}
+
+// storeKeystoreKey stores data under name in KEYSTORE, unless other data
+// is stored there.
+func storeKeystoreKey(name string, data []byte) error {
+	defer lockKeystoreKey(name)()
+	err := KEYSTORE.Store(name, data)
+	if !errors.Is(err, fs.ErrExist) {
+		return err
+	}
+	stored, err := KEYSTORE.Load(name)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(stored, data) {
+		return fmt.Errorf("%s in the keystore holds other keys", name)
+	}
+	return nil
+}
@@ -0,0 +1,234 @@
+package onramp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// HTTPKeystore is a Keystore in a key-value store with the HTTP API of
+// Vault's KV secrets engine, version 2. Each key is a secret at
+// Mount/Prefix/name with the base64 encoded data in its "value" field,
+// which can be provisioned with
+//
+//	vault kv put -mount=secret onramp/i2pkeys/name.i2p.private value=$(base64 -w0 name.i2p.private)
+//
+// Set it as KEYSTORE to keep keys out of the local disk.
+type HTTPKeystore struct {
+	// URL is the address of the server, like "https://vault:8200". If it
+	// is empty, $VAULT_ADDR is used.
+	URL string
+	// Token authenticates the requests. If it is empty, $VAULT_TOKEN is
+	// used.
+	Token string
+	// Namespace is sent as X-Vault-Namespace if it is set.
+	Namespace string
+	// Mount is the path of the secrets engine, "secret" if it is empty.
+	Mount string
+	// Prefix is prepended to the names of the keys.
+	Prefix string
+	// Client makes the requests, http.DefaultClient if it is nil.
+	Client *http.Client
+	// CacheTTL is how long loaded keys are kept in memory. Keys are cached
+	// until the process exits if it is zero, and not at all if it is
+	// negative.
+	CacheTTL time.Duration
+	// ReadOnly makes Store and Delete fail with ErrKeystoreReadOnly, so
+	// keys have to be provisioned in the store beforehand.
+	ReadOnly bool
+
+	mu    sync.Mutex
+	cache map[string]httpKeystoreEntry
+}
+
+type httpKeystoreEntry struct {
+	data    []byte
+	expires time.Time
+}
+
+// kvSecret is the body of KV version 2 reads and writes.
+type kvSecret struct {
+	Data    map[string]string `json:"data"`
+	Options map[string]int    `json:"options,omitempty"`
+}
+
+// Load implements Keystore.
+func (k *HTTPKeystore) Load(name string) ([]byte, error) {
+	if data, ok := k.cached(name); ok {
+		return data, nil
+	}
+	resp, err := k.do(http.MethodGet, "data", name, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, kvError(resp)
+	}
+	var body struct {
+		Data kvSecret `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	value, ok := body.Data.Data["value"]
+	if !ok {
+		return nil, fmt.Errorf("%s has no value", name)
+	}
+	data, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	k.setCache(name, data)
+	return data, nil
+}
+
+// Store implements Keystore. It uses check-and-set, so of several
+// processes storing the same key only the first one succeeds.
+func (k *HTTPKeystore) Store(name string, data []byte) error {
+	if k.ReadOnly {
+		return ErrKeystoreReadOnly
+	}
+	body, err := json.Marshal(kvSecret{
+		Data:    map[string]string{"value": base64.StdEncoding.EncodeToString(data)},
+		Options: map[string]int{"cas": 0},
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := k.do(http.MethodPost, "data", name, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		err := kvError(resp)
+		if resp.StatusCode == http.StatusBadRequest && strings.Contains(err.Error(), "check-and-set") {
+			k.setCache(name, nil)
+			return fmt.Errorf("%s: %w", name, fs.ErrExist)
+		}
+		return err
+	}
+	k.setCache(name, data)
+	return nil
+}
+
+// Delete implements Keystore. It deletes every version of the key.
+func (k *HTTPKeystore) Delete(name string) error {
+	if k.ReadOnly {
+		return fmt.Errorf("%w: %s isn't deleted", ErrKeystoreReadOnly, name)
+	}
+	k.setCache(name, nil)
+	resp, err := k.do(http.MethodDelete, "metadata", name, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotFound {
+		return kvError(resp)
+	}
+	return nil
+}
+
+// cached returns the cached data of name, if it is cached.
+func (k *HTTPKeystore) cached(name string) ([]byte, bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	entry, ok := k.cache[name]
+	if !ok || (!entry.expires.IsZero() && time.Now().After(entry.expires)) {
+		return nil, false
+	}
+	return entry.data, true
+}
+
+// setCache caches data for name, or removes name from the cache if data
+// is nil.
+func (k *HTTPKeystore) setCache(name string, data []byte) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if data == nil || k.CacheTTL < 0 {
+		delete(k.cache, name)
+		return
+	}
+	if k.cache == nil {
+		k.cache = make(map[string]httpKeystoreEntry)
+	}
+	entry := httpKeystoreEntry{data: data}
+	if k.CacheTTL > 0 {
+		entry.expires = time.Now().Add(k.CacheTTL)
+	}
+	k.cache[name] = entry
+}
+
+// do sends a request for the secret name to the kind ("data" or
+// "metadata") endpoint of the secrets engine.
+func (k *HTTPKeystore) do(method, kind, name string, body []byte) (*http.Response, error) {
+	base := k.URL
+	if base == "" {
+		base = os.Getenv("VAULT_ADDR")
+	}
+	if base == "" {
+		return nil, fmt.Errorf("onramp HTTPKeystore: no URL")
+	}
+	mount := k.Mount
+	if mount == "" {
+		mount = "secret"
+	}
+	var segments []string
+	for _, s := range strings.Split(strings.Trim(k.Prefix, "/")+"/"+name, "/") {
+		if s != "" {
+			segments = append(segments, url.PathEscape(s))
+		}
+	}
+	u := strings.TrimSuffix(base, "/") + "/v1/" + strings.Trim(mount, "/") + "/" + kind + "/" + strings.Join(segments, "/")
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	token := k.Token
+	if token == "" {
+		token = os.Getenv("VAULT_TOKEN")
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if k.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", k.Namespace)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	client := k.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	log.WithFields(logrus.Fields{
+		"method": method,
+		"url":    u,
+	}).Debug("Sending keystore request")
+	return client.Do(req)
+}
+
+// kvError returns the errors of an unsuccessful response.
+func kvError(resp *http.Response) error {
+	var body struct {
+		Errors []string `json:"errors"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if json.Unmarshal(data, &body) == nil && len(body.Errors) > 0 {
+		return fmt.Errorf("onramp HTTPKeystore: %s: %s", resp.Status, strings.Join(body.Errors, "; "))
+	}
+	return fmt.Errorf("onramp HTTPKeystore: %s", resp.Status)
+}
@@ -0,0 +1,255 @@
+//go:build !gen
+// +build !gen
+
+package onramp
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/cretz/bine/torutil"
+)
+
+// fakeKV is a minimal server with the HTTP API of Vault's KV version 2
+// secrets engine, mounted at "secret", for tests.
+type fakeKV struct {
+	*httptest.Server
+	token   string
+	mu      sync.Mutex
+	secrets map[string]map[string]string
+	// reads counts the read requests
+	reads int
+}
+
+// newFakeKV starts a fake server accepting token for the duration of the
+// test.
+func newFakeKV(t *testing.T, token string) *fakeKV {
+	kv := &fakeKV{token: token, secrets: make(map[string]map[string]string)}
+	kv.Server = httptest.NewServer(http.HandlerFunc(kv.serve))
+	t.Cleanup(kv.Close)
+	return kv
+}
+
+func (kv *fakeKV) serve(w http.ResponseWriter, r *http.Request) {
+	reply := func(status int, body interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(body)
+	}
+	fail := func(status int, msg string) {
+		reply(status, map[string][]string{"errors": {msg}})
+	}
+	if r.Header.Get("X-Vault-Token") != kv.token {
+		fail(http.StatusForbidden, "permission denied")
+		return
+	}
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	switch path := r.URL.Path; {
+	case r.Method == http.MethodGet && strings.HasPrefix(path, "/v1/secret/data/"):
+		kv.reads++
+		data, ok := kv.secrets[strings.TrimPrefix(path, "/v1/secret/data/")]
+		if !ok {
+			reply(http.StatusNotFound, map[string][]string{"errors": {}})
+			return
+		}
+		reply(http.StatusOK, map[string]interface{}{
+			"data": map[string]interface{}{
+				"data":     data,
+				"metadata": map[string]interface{}{"version": 1},
+			},
+		})
+	case (r.Method == http.MethodPost || r.Method == http.MethodPut) && strings.HasPrefix(path, "/v1/secret/data/"):
+		var body struct {
+			Data    map[string]string `json:"data"`
+			Options map[string]int    `json:"options"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Data == nil {
+			fail(http.StatusBadRequest, "no data provided")
+			return
+		}
+		name := strings.TrimPrefix(path, "/v1/secret/data/")
+		if cas, ok := body.Options["cas"]; ok && cas == 0 && kv.secrets[name] != nil {
+			fail(http.StatusBadRequest, "check-and-set parameter did not match the current version")
+			return
+		}
+		kv.secrets[name] = body.Data
+		reply(http.StatusOK, map[string]interface{}{"data": map[string]interface{}{"version": 1}})
+	case r.Method == http.MethodDelete && strings.HasPrefix(path, "/v1/secret/metadata/"):
+		delete(kv.secrets, strings.TrimPrefix(path, "/v1/secret/metadata/"))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		fail(http.StatusNotFound, "unsupported path")
+	}
+}
+
+// useKeystore sets KEYSTORE to ks and the local key stores to temporary
+// directories for the duration of the test.
+func useKeystore(t *testing.T, ks Keystore) {
+	tempKeystores(t)
+	keystore := KEYSTORE
+	t.Cleanup(func() { KEYSTORE = keystore })
+	KEYSTORE = ks
+}
+
+func TestHTTPKeystore(t *testing.T) {
+	kv := newFakeKV(t, "token")
+	ks := &HTTPKeystore{URL: kv.URL, Token: "token", Prefix: "/onramp/"}
+	if _, err := ks.Load("i2pkeys/svc.i2p.private"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("loaded missing keys: %v", err)
+	}
+	if err := ks.Store("i2pkeys/svc.i2p.private", []byte("keys\x00")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := kv.secrets["onramp/i2pkeys/svc.i2p.private"]; !ok {
+		t.Fatalf("stored %v", kv.secrets)
+	}
+	if err := ks.Store("i2pkeys/svc.i2p.private", []byte("other")); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("replaced stored keys: %v", err)
+	}
+	reads := kv.reads
+	for i := 0; i < 2; i++ {
+		if data, err := ks.Load("i2pkeys/svc.i2p.private"); err != nil || string(data) != "keys\x00" {
+			t.Errorf("loaded %q, %v", data, err)
+		}
+	}
+	if kv.reads != reads+1 {
+		t.Errorf("%d reads, the keys weren't cached", kv.reads-reads)
+	}
+
+	uncached := &HTTPKeystore{URL: kv.URL, Token: "token", Prefix: "onramp", CacheTTL: -1}
+	for i := 0; i < 2; i++ {
+		if data, err := uncached.Load("i2pkeys/svc.i2p.private"); err != nil || string(data) != "keys\x00" {
+			t.Errorf("loaded %q, %v", data, err)
+		}
+	}
+	if kv.reads != reads+3 {
+		t.Errorf("%d reads, the keys were cached", kv.reads-reads)
+	}
+
+	readOnly := &HTTPKeystore{URL: kv.URL, Token: "token", Prefix: "onramp", ReadOnly: true}
+	if err := readOnly.Store("onionkeys/svc.tor.private", []byte("key")); !errors.Is(err, ErrKeystoreReadOnly) {
+		t.Errorf("stored in a read-only keystore: %v", err)
+	}
+	if err := readOnly.Delete("i2pkeys/svc.i2p.private"); !errors.Is(err, ErrKeystoreReadOnly) {
+		t.Errorf("deleted from a read-only keystore: %v", err)
+	}
+	if _, err := (&HTTPKeystore{URL: kv.URL, Token: "wrong"}).Load("i2pkeys/svc.i2p.private"); err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("loaded with the wrong token: %v", err)
+	}
+
+	if err := ks.Delete("i2pkeys/svc.i2p.private"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ks.Load("i2pkeys/svc.i2p.private"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("loaded deleted keys: %v", err)
+	}
+}
+
+func TestKeystoreKeys(t *testing.T) {
+	localKeygen(t)
+	kv := newFakeKV(t, "token")
+	t.Setenv("VAULT_ADDR", kv.URL)
+	t.Setenv("VAULT_TOKEN", "token")
+	useKeystore(t, &HTTPKeystore{Prefix: "onramp"})
+
+	i2p, err := I2PKeys("svc", "127.0.0.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tor, err := TorKeys("svc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	onion := torutil.OnionServiceIDFromV3PublicKey(tor.PublicKey())
+	cert, err := TLSKeys(onion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kv.secrets) != 3 {
+		t.Errorf("stored %v", kv.secrets)
+	}
+	for _, dir := range []string{I2P_KEYSTORE_PATH, ONION_KEYSTORE_PATH, TLS_KEYSTORE_PATH} {
+		if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+			t.Errorf("wrote %v to the local disk", entries)
+		}
+	}
+
+	// another process, which can only read them, gets the same keys
+	KEYSTORE = &HTTPKeystore{Prefix: "onramp", ReadOnly: true}
+	if keys, err := I2PKeys("svc", "127.0.0.1:1"); err != nil || keys.Both != i2p.Both {
+		t.Errorf("loaded other I2P keys: %v", err)
+	}
+	if _, err := I2PKeysWithTypes("svc", "127.0.0.1:1", I2PKeyTypes{Signature: SIG_ECDSA_SHA256_P256}); err == nil {
+		t.Error("loaded I2P keys of another type")
+	}
+	if keys, err := TorKeys("svc"); err != nil || !bytes.Equal(keys.PrivateKey(), tor.PrivateKey()) {
+		t.Errorf("loaded another Tor key: %v", err)
+	}
+	if other, err := TLSKeys(onion); err != nil || !bytes.Equal(other.Certificate[0], cert.Certificate[0]) {
+		t.Errorf("loaded another TLS certificate: %v", err)
+	}
+	if _, err := TorKeys("new"); !errors.Is(err, ErrKeystoreReadOnly) {
+		t.Errorf("generated keys in a read-only keystore: %v", err)
+	}
+	if _, err := (&Garlic{name: "svc"}).Keys(); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := ListKeys(); !errors.Is(err, ErrKeystoreUnsupported) {
+		t.Errorf("listed the keys of a keystore: %v", err)
+	}
+
+	KEYSTORE = &HTTPKeystore{Prefix: "onramp"}
+	bundle, err := ExportKeyBundle("svc", []string{onion}, "passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	KEYSTORE = &HTTPKeystore{URL: newFakeKV(t, "token").URL, Token: "token", Prefix: "onramp"}
+	if _, err := ImportKeyBundle(bundle, "passphrase"); err != nil {
+		t.Fatal(err)
+	}
+	if keys, err := I2PKeys("svc", "127.0.0.1:1"); err != nil || keys.Both != i2p.Both {
+		t.Errorf("imported other I2P keys: %v", err)
+	}
+	if other, err := TLSKeys(onion); err != nil || !bytes.Equal(other.Certificate[0], cert.Certificate[0]) {
+		t.Errorf("imported another TLS certificate: %v", err)
+	}
+	for _, dir := range []string{I2P_KEYSTORE_PATH, ONION_KEYSTORE_PATH, TLS_KEYSTORE_PATH} {
+		if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+			t.Errorf("wrote %v to the local disk", entries)
+		}
+	}
+
+	KEYSTORE = &HTTPKeystore{Prefix: "onramp"}
+	if err := DeleteOnionKeys("svc"); err != nil {
+		t.Fatal(err)
+	}
+	if keys, err := TorKeys("svc"); err != nil || bytes.Equal(keys.PrivateKey(), tor.PrivateKey()) {
+		t.Errorf("the deleted key was loaded: %v", err)
+	}
+}
+
+func TestKeystoreKeyRace(t *testing.T) {
+	kv := newFakeKV(t, "token")
+	useKeystore(t, &HTTPKeystore{URL: kv.URL, Token: "token", Prefix: "onramp"})
+	other := &HTTPKeystore{URL: kv.URL, Token: "token", Prefix: "onramp"}
+	data, err := keystoreKey("onionkeys/svc.tor.private", func() ([]byte, error) {
+		// another process stores its key meanwhile
+		if err := other.Store("onionkeys/svc.tor.private", []byte("first")); err != nil {
+			t.Fatal(err)
+		}
+		return []byte("second"), nil
+	})
+	if err != nil || string(data) != "first" {
+		t.Errorf("got %q, %v", data, err)
+	}
+}
@@ -0,0 +1,303 @@
+//go:build !gen
+// +build !gen
+
+package onramp
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestWriteKeyFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "svc.key")
+	for _, data := range []string{"first", "second"} {
+		if err := writeKeyFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if stored, err := os.ReadFile(path); err != nil || string(stored) != data {
+			t.Errorf("stored %q, %v", stored, err)
+		}
+	}
+	if info, err := os.Stat(path); err != nil || (runtime.GOOS != "windows" && info.Mode().Perm() != 0600) {
+		t.Errorf("key file mode %v, %v", info.Mode(), err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("temporary files were left: %v", entries)
+	}
+}
+
+func TestLockKeyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "svc.key")
+	unlock, err := lockKeyFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	locked := make(chan struct{})
+	go func() {
+		unlock, err := lockKeyFile(path)
+		if err == nil {
+			unlock()
+		}
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		t.Fatal("locked a locked key file")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	<-locked
+
+	switch runtime.GOOS {
+	case "darwin", "dragonfly", "freebsd", "linux", "netbsd", "openbsd", "windows":
+	default:
+		return
+	}
+	// other processes' locks are on other open files
+	f1, err := os.OpenFile(path+".lock", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f1.Close()
+	f2, err := os.OpenFile(path+".lock", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f2.Close()
+	if err := lockFile(f1); err != nil {
+		t.Fatal(err)
+	}
+	locked = make(chan struct{})
+	go func() {
+		lockFile(f2)
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		t.Fatal("locked a file another open file locks")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlockFile(f1)
+	<-locked
+	unlockFile(f2)
+}
+
+func TestI2PKeysConcurrent(t *testing.T) {
+	localKeygen(t)
+	defer func(path string) { I2P_KEYSTORE_PATH = path }(I2P_KEYSTORE_PATH)
+	I2P_KEYSTORE_PATH = t.TempDir()
+	var wg sync.WaitGroup
+	addrs := make([]string, 8)
+	for i := range addrs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			keys, err := I2PKeys("shared", "127.0.0.1:1")
+			if err != nil {
+				t.Error(err)
+			}
+			addrs[i] = keys.Addr().Base32()
+		}(i)
+	}
+	wg.Wait()
+	for _, addr := range addrs {
+		if addr != addrs[0] {
+			t.Fatalf("goroutines got different keys: %v", addrs)
+		}
+	}
+}
+
+func TestCorruptKeys(t *testing.T) {
+	localKeygen(t)
+	tempKeystores(t)
+	i2pPath := filepath.Join(I2P_KEYSTORE_PATH, "svc.i2p.private")
+	torPath := filepath.Join(ONION_KEYSTORE_PATH, "svc.tor.private")
+
+	// empty files never held keys, so new ones replace them
+	os.WriteFile(i2pPath, nil, 0600)
+	os.WriteFile(torPath, nil, 0600)
+	if _, err := I2PKeys("svc", "127.0.0.1:1"); err != nil {
+		t.Error(err)
+	}
+	if _, err := TorKeys("svc"); err != nil {
+		t.Error(err)
+	}
+
+	keys, err := I2PKeys("svc", "127.0.0.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(i2pPath)
+	os.WriteFile(i2pPath, data[:len(data)/2], 0600)
+	os.WriteFile(torPath, []byte("== ed25519v1-secret: type0 =="), 0600)
+	for name, load := range map[string]func() error{
+		"I2P": func() error { _, err := I2PKeys("svc", "127.0.0.1:1"); return err },
+		"Tor": func() error { _, err := TorKeys("svc"); return err },
+	} {
+		if err := load(); err == nil || !strings.Contains(err.Error(), "corrupt") {
+			t.Errorf("loaded corrupt %s keys: %v", name, err)
+		}
+		// the identity isn't silently replaced either
+		if err := load(); err == nil || !strings.Contains(err.Error(), "was corrupt") {
+			t.Errorf("replaced corrupt %s keys: %v", name, err)
+		}
+	}
+	quarantined, _ := filepath.Glob(i2pPath + ".corrupt-*")
+	if len(quarantined) != 1 {
+		t.Fatalf("quarantined %v", quarantined)
+	}
+	if _, err := os.Stat(i2pPath); !os.IsNotExist(err) {
+		t.Errorf("the corrupt key file wasn't moved: %v", err)
+	}
+	if err := writeI2PKeys(i2pPath, keys); err != nil {
+		t.Fatal(err)
+	}
+	if restored, err := I2PKeys("svc", "127.0.0.1:1"); err != nil || restored.Both != keys.Both {
+		t.Errorf("restored keys weren't loaded: %v", err)
+	}
+}
+
+// chdir changes the working directory for the duration of the test.
+func chdir(t *testing.T, dir string) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+// resetKeystoreRoot makes KeystoreRoot find the root again.
+func resetKeystoreRoot() {
+	resolvedRoot.Lock()
+	defer resolvedRoot.Unlock()
+	resolvedRoot.root = ""
+}
+
+// cleanKeystoreRoot clears what KeystoreRoot looks at for the duration of
+// the test, and returns the working directory and $XDG_STATE_HOME.
+func cleanKeystoreRoot(t *testing.T) (wd, state string) {
+	root, app := KEYSTORE_ROOT, KEYSTORE_APP_NAME
+	i2p, tor, tls := I2P_KEYSTORE_PATH, ONION_KEYSTORE_PATH, TLS_KEYSTORE_PATH
+	t.Cleanup(func() {
+		KEYSTORE_ROOT, KEYSTORE_APP_NAME = root, app
+		I2P_KEYSTORE_PATH, ONION_KEYSTORE_PATH, TLS_KEYSTORE_PATH = i2p, tor, tls
+		resetKeystoreRoot()
+	})
+	resetKeystoreRoot()
+	KEYSTORE_ROOT, KEYSTORE_APP_NAME = "", "app"
+	I2P_KEYSTORE_PATH, ONION_KEYSTORE_PATH, TLS_KEYSTORE_PATH = "", "", ""
+	t.Setenv("ONRAMP_KEYSTORE", "")
+	t.Setenv("STATE_DIRECTORY", "")
+	wd, state = t.TempDir(), t.TempDir()
+	t.Setenv("XDG_STATE_HOME", state)
+	chdir(t, wd)
+	// the temporary directories may be behind symbolic links
+	wd, _ = os.Getwd()
+	return wd, state
+}
+
+func TestKeystoreRoot(t *testing.T) {
+	wd, state := cleanKeystoreRoot(t)
+	explicit := t.TempDir()
+	for _, tt := range []struct {
+		name  string
+		setup func()
+		root  string
+	}{
+		{"XDG_STATE_HOME", func() {}, filepath.Join(state, "app")},
+		{"empty key stores of earlier versions", func() { os.Mkdir(filepath.Join(wd, "i2pkeys"), 0755) }, filepath.Join(state, "app")},
+		{"key stores of earlier versions", func() { os.WriteFile(filepath.Join(wd, "i2pkeys", "svc.i2p.private"), nil, 0600) }, wd},
+		{"STATE_DIRECTORY", func() { t.Setenv("STATE_DIRECTORY", "/var/lib/svc:/var/lib/other") }, "/var/lib/svc"},
+		{"ONRAMP_KEYSTORE", func() { t.Setenv("ONRAMP_KEYSTORE", "/srv/keys") }, "/srv/keys"},
+		{"KEYSTORE_ROOT", func() { KEYSTORE_ROOT = explicit }, explicit},
+	} {
+		tt.setup()
+		resetKeystoreRoot()
+		if root, err := KeystoreRoot(); err != nil || root != tt.root {
+			t.Errorf("%s: root %s, %v", tt.name, root, err)
+		}
+	}
+
+	// the root is kept when what it was found by changes, but not when
+	// KEYSTORE_ROOT does
+	KEYSTORE_ROOT = ""
+	t.Setenv("ONRAMP_KEYSTORE", "")
+	t.Setenv("STATE_DIRECTORY", "")
+	resetKeystoreRoot()
+	if root, err := KeystoreRoot(); err != nil || root != wd {
+		t.Fatalf("root %s, %v", root, err)
+	}
+	chdir(t, state)
+	if root, err := KeystoreRoot(); err != nil || root != wd {
+		t.Errorf("root %s after changing the working directory, %v", root, err)
+	}
+	KEYSTORE_ROOT = explicit
+	if root, err := KeystoreRoot(); err != nil || root != explicit {
+		t.Errorf("root %s after setting KEYSTORE_ROOT, %v", root, err)
+	}
+
+	// key stores are only created when used
+	if entries, _ := os.ReadDir(explicit); len(entries) != 0 {
+		t.Errorf("created %v", entries)
+	}
+	if dir, err := TorKeystorePath(); err != nil || dir != filepath.Join(explicit, "onionkeys") {
+		t.Errorf("Tor key store %s, %v", dir, err)
+	}
+	if entries, _ := os.ReadDir(explicit); len(entries) != 1 {
+		t.Errorf("created %v", entries)
+	}
+	ONION_KEYSTORE_PATH = filepath.Join(wd, "tor")
+	if dir, err := TorKeystorePath(); err != nil || dir != ONION_KEYSTORE_PATH {
+		t.Errorf("Tor key store %s, %v", dir, err)
+	}
+	if err := DeleteTorKeyStore(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(ONION_KEYSTORE_PATH); !os.IsNotExist(err) {
+		t.Errorf("the key store wasn't deleted: %v", err)
+	}
+}
+
+func TestWarnIdentityElsewhere(t *testing.T) {
+	wd, _ := cleanKeystoreRoot(t)
+	if _, err := TorKeys("svc"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(os.Getenv("XDG_STATE_HOME"), "app", "onionkeys", "svc.tor.private")); err != nil {
+		t.Fatal(err)
+	}
+	level := log.GetLevel()
+	defer log.SetLevel(level)
+	log.SetLevel(logrus.WarnLevel)
+	hook := logtest.NewLocal(log)
+	defer log.ReplaceHooks(make(logrus.LevelHooks))
+	KEYSTORE_ROOT = wd
+	if _, err := TorKeys("other"); err != nil {
+		t.Fatal(err)
+	}
+	if len(hook.Entries) != 0 {
+		t.Errorf("warned about a new name: %v", hook.Entries)
+	}
+	if _, err := TorKeys("svc"); err != nil {
+		t.Fatal(err)
+	}
+	entry := hook.LastEntry()
+	if entry == nil || !strings.Contains(entry.Data["existing"].(string), "app") {
+		t.Fatalf("didn't warn about the identity in the XDG state directory: %v", hook.Entries)
+	}
+	if entry.Data["root"] != filepath.Join(os.Getenv("XDG_STATE_HOME"), "app") || !strings.Contains(entry.Message, "KEYSTORE_ROOT") {
+		t.Errorf("the warning doesn't say how to use the identity: %v", entry)
+	}
+}
@@ -0,0 +1,213 @@
+package onramp
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-i2p/i2pkeys"
+)
+
+// Signature types of I2P destinations.
+const (
+	SIG_DSA_SHA1          = 0
+	SIG_ECDSA_SHA256_P256 = 1
+	SIG_ECDSA_SHA384_P384 = 2
+	SIG_ECDSA_SHA512_P521 = 3
+	SIG_ED25519           = 7
+	SIG_REDDSA_ED25519    = 11
+)
+
+// Encryption types of the LeaseSets of I2P destinations.
+const (
+	ENC_ELGAMAL      = 0
+	ENC_ECIES_X25519 = 4
+)
+
+// sigTypeNames are the names SAM's DEST GENERATE knows the signature
+// types by.
+var sigTypeNames = map[int]string{
+	SIG_DSA_SHA1:          "DSA_SHA1",
+	SIG_ECDSA_SHA256_P256: "ECDSA_SHA256_P256",
+	SIG_ECDSA_SHA384_P384: "ECDSA_SHA384_P384",
+	SIG_ECDSA_SHA512_P521: "ECDSA_SHA512_P521",
+	SIG_ED25519:           "EdDSA_SHA512_Ed25519",
+	SIG_REDDSA_ED25519:    "RedDSA_SHA512_Ed25519",
+}
+
+// encTypeNames are the names of the encryption types.
+var encTypeNames = map[int]string{
+	ENC_ELGAMAL:      "ElGamal",
+	ENC_ECIES_X25519: "ECIES_X25519",
+}
+
+// I2P_KEY_TYPES are the key types of destinations generated without
+// requested types.
+var I2P_KEY_TYPES = I2PKeyTypes{
+	Signature:  SIG_ED25519,
+	Encryption: []int{ENC_ECIES_X25519, ENC_ELGAMAL},
+}
+
+// I2PKeyTypes are the signature type of an I2P destination and the
+// encryption types of its LeaseSets, in order of preference.
+type I2PKeyTypes struct {
+	Signature int
+	// Encryption is left to the router if empty.
+	Encryption []int
+}
+
+func (t I2PKeyTypes) String() string {
+	s := sigTypeNames[t.Signature]
+	if s == "" {
+		s = strconv.Itoa(t.Signature)
+	}
+	for i, enc := range t.Encryption {
+		sep := ","
+		if i == 0 {
+			sep = "/"
+		}
+		if name := encTypeNames[enc]; name != "" {
+			s += sep + name
+		} else {
+			s += sep + strconv.Itoa(enc)
+		}
+	}
+	return s
+}
+
+func (t I2PKeyTypes) validate() error {
+	if _, ok := sigTypeNames[t.Signature]; !ok {
+		return fmt.Errorf("onramp: unknown I2P signature type %d", t.Signature)
+	}
+	for _, enc := range t.Encryption {
+		if _, ok := encTypeNames[enc]; !ok {
+			return fmt.Errorf("onramp: unknown I2P encryption type %d", enc)
+		}
+	}
+	return nil
+}
+
+// generateArg returns the DEST GENERATE argument for the signature type.
+func (t I2PKeyTypes) generateArg() string {
+	return "SIGNATURE_TYPE=" + sigTypeNames[t.Signature]
+}
+
+// options returns the I2CP options for the encryption types.
+func (t I2PKeyTypes) options() []string {
+	if len(t.Encryption) == 0 {
+		return nil
+	}
+	encs := make([]string, len(t.Encryption))
+	for i, enc := range t.Encryption {
+		encs[i] = strconv.Itoa(enc)
+	}
+	return []string{"i2cp.leaseSetEncType=" + strings.Join(encs, ",")}
+}
+
+// destSigType returns the signature type of dest from its certificate.
+func destSigType(dest i2pkeys.I2PAddr) (int, error) {
+	b, err := dest.ToBytes()
+	if err != nil {
+		return 0, fmt.Errorf("onramp: %v", err)
+	}
+	return certSigType(b)
+}
+
+// certSigType returns the signature type of the destination at the start
+// of b.
+func certSigType(b []byte) (int, error) {
+	// 256 bytes of encryption key and 128 bytes of signing key, then a
+	// certificate: null for DSA, or a key certificate with the types
+	if len(b) < 387 {
+		return 0, fmt.Errorf("onramp: destination is too short")
+	}
+	switch b[384] {
+	case 0:
+		return SIG_DSA_SHA1, nil
+	case 5:
+		if len(b) < 391 {
+			return 0, fmt.Errorf("onramp: destination has a truncated key certificate")
+		}
+		return int(binary.BigEndian.Uint16(b[387:])), nil
+	}
+	return 0, fmt.Errorf("onramp: destination has certificate type %d", b[384])
+}
+
+// certCryptoType returns the type of the encryption key of the destination
+// at the start of b, which b has to hold a valid certificate for.
+func certCryptoType(b []byte) int {
+	if b[384] != 5 {
+		return ENC_ELGAMAL
+	}
+	return int(binary.BigEndian.Uint16(b[389:]))
+}
+
+// i2pKeyMetadata is stored next to generated keys in a .i2p.meta file.
+type i2pKeyMetadata struct {
+	SignatureType   int       `json:"signature_type"`
+	EncryptionTypes []int     `json:"encryption_types,omitempty"`
+	Created         time.Time `json:"created"`
+}
+
+// readI2PKeyMetadata reads the metadata at path, or returns nil if there
+// is none.
+func readI2PKeyMetadata(path string) (*i2pKeyMetadata, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var meta i2pKeyMetadata
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &meta, nil
+}
+
+func writeI2PKeyMetadata(path string, types I2PKeyTypes) error {
+	data, err := json.MarshalIndent(i2pKeyMetadata{
+		SignatureType:   types.Signature,
+		EncryptionTypes: types.Encryption,
+		Created:         time.Now().UTC(),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeKeyFile(path, append(data, '\n'), 0644)
+}
+
+// storedI2PKeyTypes returns the types of keys, with the encryption types
+// from their metadata if they have any.
+func storedI2PKeyTypes(keys i2pkeys.I2PKeys, meta *i2pKeyMetadata) (I2PKeyTypes, error) {
+	sig, err := destSigType(keys.Addr())
+	if err != nil {
+		return I2PKeyTypes{}, err
+	}
+	types := I2PKeyTypes{Signature: sig}
+	if meta != nil {
+		if meta.SignatureType != sig {
+			return types, fmt.Errorf("onramp: key metadata says signature type %d, but the destination has %d", meta.SignatureType, sig)
+		}
+		types.Encryption = meta.EncryptionTypes
+	}
+	return types, nil
+}
+
+// checkI2PKeyTypes returns an error if the stored types don't match the
+// wanted ones. Encryption types are only compared if both are known.
+func checkI2PKeyTypes(stored, want I2PKeyTypes) error {
+	if stored.Signature != want.Signature {
+		return fmt.Errorf("onramp: stored keys have signature type %s, not the requested %s",
+			I2PKeyTypes{Signature: stored.Signature}, I2PKeyTypes{Signature: want.Signature})
+	}
+	if len(stored.Encryption) > 0 && len(want.Encryption) > 0 && !slices.Equal(stored.Encryption, want.Encryption) {
+		return fmt.Errorf("onramp: stored keys have key types %s, not the requested %s", stored, want)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+//go:build !gen
+// +build !gen
+
+package onramp
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-i2p/i2pkeys"
+)
+
+func TestI2PKeyTypes(t *testing.T) {
+	types := I2PKeyTypes{Signature: SIG_ECDSA_SHA256_P256, Encryption: []int{ENC_ECIES_X25519, ENC_ELGAMAL}}
+	if err := types.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if s := types.String(); s != "ECDSA_SHA256_P256/ECIES_X25519,ElGamal" {
+		t.Errorf("string %s", s)
+	}
+	if arg := types.generateArg(); arg != "SIGNATURE_TYPE=ECDSA_SHA256_P256" {
+		t.Errorf("DEST GENERATE argument %s", arg)
+	}
+	if opts := types.options(); len(opts) != 1 || opts[0] != "i2cp.leaseSetEncType=4,0" {
+		t.Errorf("options %v", opts)
+	}
+	if opts := (I2PKeyTypes{Signature: SIG_ED25519}).options(); opts != nil {
+		t.Errorf("options without encryption types %v", opts)
+	}
+	for _, bad := range []I2PKeyTypes{{Signature: 4}, {Signature: SIG_ED25519, Encryption: []int{1}}} {
+		if err := bad.validate(); err == nil {
+			t.Errorf("accepted %v", bad)
+		}
+	}
+	dsa, err := i2pkeys.NewI2PAddrFromBytes(make([]byte, 387))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sig, err := destSigType(dsa); err != nil || sig != SIG_DSA_SHA1 {
+		t.Errorf("signature type of a destination with a null certificate %d, %v", sig, err)
+	}
+	redDSA, _ := fakeTypedKeys(1, "RedDSA_SHA512_Ed25519")
+	if sig, err := destSigType(i2pkeys.I2PAddr(redDSA)); err != nil || sig != SIG_REDDSA_ED25519 {
+		t.Errorf("signature type %d, %v", sig, err)
+	}
+	if err := checkI2PKeyTypes(I2PKeyTypes{Signature: SIG_ED25519}, I2P_KEY_TYPES); err != nil {
+		t.Errorf("keys without known encryption types: %v", err)
+	}
+	if err := checkI2PKeyTypes(I2PKeyTypes{Signature: SIG_ED25519, Encryption: []int{ENC_ELGAMAL}}, I2P_KEY_TYPES); err == nil {
+		t.Error("accepted other encryption types")
+	}
+}
+
+func TestI2PKeysWithTypes(t *testing.T) {
+	defer func(path string) { I2P_KEYSTORE_PATH = path }(I2P_KEYSTORE_PATH)
+	I2P_KEYSTORE_PATH = t.TempDir()
+	sam := newFakeSAM(t)
+	p256 := I2PKeyTypes{Signature: SIG_ECDSA_SHA256_P256, Encryption: []int{ENC_ECIES_X25519}}
+	keys, err := I2PKeysWithTypes("typed", sam.Addr(), p256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sig, err := destSigType(keys.Addr()); err != nil || sig != SIG_ECDSA_SHA256_P256 {
+		t.Errorf("generated signature type %d, %v", sig, err)
+	}
+	stored, err := StoredI2PKeyTypes("typed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.String() != p256.String() {
+		t.Errorf("stored types %s", stored)
+	}
+	if again, err := I2PKeysWithTypes("typed", sam.Addr(), p256); err != nil || again.Addr() != keys.Addr() {
+		t.Errorf("loaded other keys: %v", err)
+	}
+	if again, err := I2PKeys("typed", sam.Addr()); err != nil || again.Addr() != keys.Addr() {
+		t.Errorf("loaded other keys without types: %v", err)
+	}
+	_, err = I2PKeysWithTypes("typed", sam.Addr(), I2P_KEY_TYPES)
+	if err == nil || !strings.Contains(err.Error(), "not the requested EdDSA_SHA512_Ed25519") {
+		t.Errorf("loaded keys of another type: %v", err)
+	}
+	if err := DeleteGarlicKeys("typed"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(I2P_KEYSTORE_PATH, "typed.i2p.meta")); !os.IsNotExist(err) {
+		t.Errorf("key metadata wasn't deleted: %v", err)
+	}
+}
@@ -0,0 +1,210 @@
+package onramp
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/base64"
+	"fmt"
+	"hash/crc32"
+	"strings"
+
+	"github.com/go-i2p/i2pkeys"
+)
+
+// LeaseSet client authorization types, see EncryptedLeaseSet.
+const (
+	LEASESET_AUTH_NONE = 0
+	LEASESET_AUTH_DH   = 1
+	LEASESET_AUTH_PSK  = 2
+)
+
+// i2pBase64 and i2pBase32 are the encodings of I2P keys and addresses.
+var (
+	i2pBase64 = base64.NewEncoding("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-~")
+	i2pBase32 = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+)
+
+// LeaseSetClientKey is an x25519 key for per-client authorization of an
+// encrypted LeaseSet. With DH authorization the client keeps the private
+// key and the service knows the public key. With PSK authorization the
+// service generates the key and gives it to the client.
+type LeaseSetClientKey struct {
+	*ecdh.PrivateKey
+}
+
+// GenerateLeaseSetClientKey returns a new client authorization key.
+func GenerateLeaseSetClientKey() (*LeaseSetClientKey, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("onramp GenerateLeaseSetClientKey: %v", err)
+	}
+	return &LeaseSetClientKey{key}, nil
+}
+
+// ParseLeaseSetClientKey parses a private key as written by String.
+func ParseLeaseSetClientKey(s string) (*LeaseSetClientKey, error) {
+	b, err := i2pBase64.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("onramp ParseLeaseSetClientKey: %v", err)
+	}
+	key, err := ecdh.X25519().NewPrivateKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("onramp ParseLeaseSetClientKey: %v", err)
+	}
+	return &LeaseSetClientKey{key}, nil
+}
+
+// String returns the private key in I2P's base64.
+func (k *LeaseSetClientKey) String() string {
+	return i2pBase64.EncodeToString(k.Bytes())
+}
+
+// Public returns the public key in I2P's base64.
+func (k *LeaseSetClientKey) Public() string {
+	return i2pBase64.EncodeToString(k.PublicKey().Bytes())
+}
+
+// DHClient returns the entry of a service for the client which holds k.
+func (k *LeaseSetClientKey) DHClient(name string) LeaseSetClient {
+	return LeaseSetClient{Name: name, Key: k.Public()}
+}
+
+// PSKClient returns the entry of a service for the client it gives k to.
+func (k *LeaseSetClientKey) PSKClient(name string) LeaseSetClient {
+	return LeaseSetClient{Name: name, Key: k.String()}
+}
+
+// LeaseSetClient is a client authorized to read an encrypted LeaseSet.
+type LeaseSetClient struct {
+	// Name identifies the client in the router's configuration.
+	Name string
+	// Key is the client's public key for DH authorization, or the key
+	// shared with the client for PSK authorization, in I2P's base64.
+	Key string
+}
+
+// EncryptedLeaseSet makes a Garlic service publish an encrypted LeaseSet2
+// under a blinded key. Only clients which know the service's b33 address,
+// see DEST_BASE33, can find it, and with per-client authorization only
+// the clients listed can read it.
+type EncryptedLeaseSet struct {
+	// Secret is an optional password clients need to look up the
+	// LeaseSet.
+	Secret string
+	// AuthType is LEASESET_AUTH_NONE, LEASESET_AUTH_DH or
+	// LEASESET_AUTH_PSK.
+	AuthType int
+	// Clients are the authorized clients, which AuthType needs.
+	Clients []LeaseSetClient
+}
+
+// options returns the I2CP options for the LeaseSet.
+func (e *EncryptedLeaseSet) options() ([]string, error) {
+	opts := []string{"i2cp.leaseSetType=5"}
+	if e.Secret != "" {
+		if strings.ContainsAny(e.Secret, " \t\n") {
+			return nil, fmt.Errorf("onramp: LeaseSet secrets can't contain whitespace")
+		}
+		opts = append(opts, "i2cp.leaseSetSecret="+e.Secret)
+	}
+	var kind string
+	switch e.AuthType {
+	case LEASESET_AUTH_NONE:
+		if len(e.Clients) > 0 {
+			return nil, fmt.Errorf("onramp: LeaseSet clients need an authorization type")
+		}
+		return opts, nil
+	case LEASESET_AUTH_DH:
+		kind = "dh"
+	case LEASESET_AUTH_PSK:
+		kind = "psk"
+	default:
+		return nil, fmt.Errorf("onramp: unknown LeaseSet authorization type %d", e.AuthType)
+	}
+	if len(e.Clients) == 0 {
+		return nil, fmt.Errorf("onramp: LeaseSet authorization needs clients")
+	}
+	opts = append(opts, fmt.Sprintf("i2cp.leaseSetAuthType=%d", e.AuthType))
+	for i, client := range e.Clients {
+		if client.Name == "" || strings.ContainsAny(client.Name, ": \t\n") {
+			return nil, fmt.Errorf("onramp: invalid LeaseSet client name %q", client.Name)
+		}
+		if b, err := i2pBase64.DecodeString(client.Key); err != nil || len(b) != 32 {
+			return nil, fmt.Errorf("onramp: invalid key for LeaseSet client %s", client.Name)
+		}
+		opts = append(opts, fmt.Sprintf("i2cp.leaseSetClient.%s.%d=%s:%s", kind, i, client.Name, client.Key))
+	}
+	return opts, nil
+}
+
+// authenticated reports whether the LeaseSet needs per-client
+// authorization.
+func (e *EncryptedLeaseSet) authenticated() bool {
+	return e.AuthType != LEASESET_AUTH_NONE
+}
+
+// LeaseSetCredentials let a Garlic structure reach services with encrypted
+// LeaseSets, by their b33 address.
+type LeaseSetCredentials struct {
+	// Key is the client's private key for DH authorization, or the key
+	// the service shared for PSK authorization.
+	Key *LeaseSetClientKey
+	// Secret is the password of the LeaseSet, if it has one.
+	Secret string
+}
+
+// options returns the I2CP options for the credentials, as understood by
+// i2pd and Java I2P client tunnels.
+func (c *LeaseSetCredentials) options() ([]string, error) {
+	var opts []string
+	if c.Key != nil {
+		opts = append(opts, "i2cp.leaseSetPrivKey="+c.Key.String())
+	}
+	if c.Secret != "" {
+		if strings.ContainsAny(c.Secret, " \t\n") {
+			return nil, fmt.Errorf("onramp: LeaseSet secrets can't contain whitespace")
+		}
+		opts = append(opts, "i2cp.leaseSetSecret="+c.Secret)
+	}
+	return opts, nil
+}
+
+// blindedAddress returns the b33 address of dest, the ".b32.i2p" name of
+// its encrypted LeaseSet. It encodes the destination's signing key and
+// whether the LeaseSet needs a secret or per-client authorization.
+func blindedAddress(dest i2pkeys.I2PAddr, secret, auth bool) (string, error) {
+	sigType, err := destSigType(dest)
+	if err != nil {
+		return "", err
+	}
+	if sigType != SIG_ED25519 && sigType != SIG_REDDSA_ED25519 {
+		return "", fmt.Errorf("onramp: blinded addresses need an Ed25519 or RedDSA destination, not signature type %d", sigType)
+	}
+	b, err := dest.ToBytes()
+	if err != nil {
+		return "", fmt.Errorf("onramp: %v", err)
+	}
+	// the Ed25519 key fills the end of the 128 bytes of signing key
+	pub := b[384-32 : 384]
+	var flags byte
+	if secret {
+		flags |= 0x02
+	}
+	if auth {
+		flags |= 0x04
+	}
+	data := append([]byte{flags, byte(sigType), SIG_REDDSA_ED25519}, pub...)
+	crc := crc32.ChecksumIEEE(pub)
+	data[0] ^= byte(crc)
+	data[1] ^= byte(crc >> 8)
+	data[2] ^= byte(crc >> 16)
+	return i2pBase32.EncodeToString(data) + ".b32.i2p", nil
+}
+
+// isBlindedAddress reports whether host is a b33 address, which is longer
+// than the 52 characters of a b32 address.
+func isBlindedAddress(host string) bool {
+	name, ok := strings.CutSuffix(host, ".b32.i2p")
+	return ok && len(name) >= 56
+}
@@ -0,0 +1,131 @@
+//go:build !gen
+// +build !gen
+
+package onramp
+
+import (
+	"bytes"
+	"hash/crc32"
+	"strings"
+	"testing"
+
+	"github.com/go-i2p/i2pkeys"
+)
+
+// testEd25519Dest returns a destination with an Ed25519 key certificate
+// and the given signing public key.
+func testEd25519Dest(t *testing.T, pub []byte) i2pkeys.I2PAddr {
+	b := make([]byte, 384, 391)
+	copy(b[352:], pub)
+	b = append(b, 5, 0, 4, 0, 7, 0, 4)
+	addr, err := i2pkeys.NewI2PAddrFromBytes(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return addr
+}
+
+func TestBlindedAddress(t *testing.T) {
+	pub := bytes.Repeat([]byte{0xab}, 32)
+	dest := testEd25519Dest(t, pub)
+	for _, tt := range []struct {
+		secret, auth bool
+		flags        byte
+	}{
+		{false, false, 0},
+		{true, false, 2},
+		{false, true, 4},
+		{true, true, 6},
+	} {
+		addr, err := blindedAddress(dest, tt.secret, tt.auth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !isBlindedAddress(addr) {
+			t.Errorf("%s is not a b33 address", addr)
+		}
+		data, err := i2pBase32.DecodeString(strings.TrimSuffix(addr, ".b32.i2p"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		crc := crc32.ChecksumIEEE(pub)
+		data[0] ^= byte(crc)
+		data[1] ^= byte(crc >> 8)
+		data[2] ^= byte(crc >> 16)
+		if data[0] != tt.flags || data[1] != SIG_ED25519 || data[2] != SIG_REDDSA_ED25519 || !bytes.Equal(data[3:], pub) {
+			t.Errorf("secret %v, auth %v: decoded %x", tt.secret, tt.auth, data)
+		}
+	}
+	if isBlindedAddress(strings.Repeat("a", 52) + ".b32.i2p") {
+		t.Error("a b32 address is a b33 address")
+	}
+}
+
+func TestEncryptedLeaseSetOptions(t *testing.T) {
+	key, err := GenerateLeaseSetClientKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ls := &EncryptedLeaseSet{
+		Secret:   "hunter2",
+		AuthType: LEASESET_AUTH_DH,
+		Clients:  []LeaseSetClient{key.DHClient("alice")},
+	}
+	opts, err := ls.options()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"i2cp.leaseSetType=5",
+		"i2cp.leaseSetSecret=hunter2",
+		"i2cp.leaseSetAuthType=1",
+		"i2cp.leaseSetClient.dh.0=alice:" + key.Public(),
+	}
+	if strings.Join(opts, " ") != strings.Join(want, " ") {
+		t.Errorf("options %v, want %v", opts, want)
+	}
+	for _, bad := range []*EncryptedLeaseSet{
+		{Secret: "two words"},
+		{AuthType: LEASESET_AUTH_PSK},
+		{AuthType: 3, Clients: []LeaseSetClient{key.PSKClient("bob")}},
+		{Clients: []LeaseSetClient{key.PSKClient("bob")}},
+		{AuthType: LEASESET_AUTH_PSK, Clients: []LeaseSetClient{key.PSKClient("b:ob")}},
+		{AuthType: LEASESET_AUTH_PSK, Clients: []LeaseSetClient{{Name: "bob", Key: "short"}}},
+	} {
+		if _, err := bad.options(); err == nil {
+			t.Errorf("accepted %+v", bad)
+		}
+	}
+	g := &Garlic{
+		EncryptedLeaseSet:   &EncryptedLeaseSet{Secret: "a"},
+		LeaseSetCredentials: &LeaseSetCredentials{Secret: "b"},
+	}
+	if _, err := g.leaseSetOptions(); err == nil {
+		t.Error("accepted different secrets")
+	}
+}
+
+func TestLeaseSetClientKeys(t *testing.T) {
+	defer func(path string) { I2P_KEYSTORE_PATH = path }(I2P_KEYSTORE_PATH)
+	I2P_KEYSTORE_PATH = t.TempDir()
+	key, err := LeaseSetClientKeys("client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed, err := ParseLeaseSetClientKey(key.String()); err != nil || parsed.Public() != key.Public() {
+		t.Errorf("parsed key: %v", err)
+	}
+	again, err := LeaseSetClientKeys("client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.String() != key.String() {
+		t.Error("loaded another key than the stored one")
+	}
+	if err := DeleteLeaseSetClientKeys("client"); err != nil {
+		t.Fatal(err)
+	}
+	if other, err := LeaseSetClientKeys("client"); err != nil || other.String() == key.String() {
+		t.Errorf("deleted key was loaded again: %v", err)
+	}
+}
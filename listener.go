@@ -0,0 +1,77 @@
+package onramp
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// virtualListener is a net.Listener whose connections are delivered by a
+// dispatcher which accepts them from another listener, for instance after
+// inspecting the TLS handshake or the destination port.
+type virtualListener struct {
+	addr   net.Addr
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newVirtualListener(addr net.Addr) *virtualListener {
+	return &virtualListener{
+		addr:   addr,
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+// Accept waits for the dispatcher to deliver the next connection.
+// implements net.Listener
+func (v *virtualListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-v.conns:
+		return conn, nil
+	case <-v.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops the listener. It does not close the listener the connections
+// are dispatched from.
+// implements net.Listener
+func (v *virtualListener) Close() error {
+	v.once.Do(func() {
+		close(v.closed)
+	})
+	return nil
+}
+
+// implements net.Listener
+func (v *virtualListener) Addr() net.Addr {
+	return v.addr
+}
+
+// deliver hands conn to the next caller of Accept. It returns false if the
+// listener was closed, in which case the caller still owns conn.
+func (v *virtualListener) deliver(conn net.Conn) bool {
+	select {
+	case v.conns <- conn:
+		return true
+	case <-v.closed:
+		return false
+	}
+}
+
+// deliverTimeout is like deliver, but also gives up and returns false if
+// no caller of Accept takes conn within timeout.
+func (v *virtualListener) deliverTimeout(conn net.Conn, timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case v.conns <- conn:
+		return true
+	case <-v.closed:
+		return false
+	case <-timer.C:
+		return false
+	}
+}
@@ -0,0 +1,215 @@
+package onramp
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/go-i2p/i2pkeys"
+	"github.com/sirupsen/logrus"
+)
+
+// I2P_OFFLINE_EXPIRY_WARNING is how long before the offline signature of
+// transient keys expires a warning is logged when they are loaded.
+var I2P_OFFLINE_EXPIRY_WARNING = 7 * 24 * time.Hour
+
+// I2P_OFFLINE_EXPIRY_MARGIN is how long before the offline signature of
+// transient keys expires they are refused. The router can't sign a
+// LeaseSet with them afterwards.
+var I2P_OFFLINE_EXPIRY_MARGIN = time.Hour
+
+// sigKeyLengths are the lengths of the public keys, private keys and
+// signatures of the signature types.
+var sigKeyLengths = map[int]struct{ public, private, signature int }{
+	SIG_DSA_SHA1:          {128, 20, 40},
+	SIG_ECDSA_SHA256_P256: {64, 32, 64},
+	SIG_ECDSA_SHA384_P384: {96, 48, 96},
+	SIG_ECDSA_SHA512_P521: {132, 66, 132},
+	SIG_ED25519:           {32, 32, 64},
+	SIG_REDDSA_ED25519:    {32, 32, 64},
+}
+
+// encKeyLengths are the lengths of the public and private keys of the
+// encryption types of destinations.
+var encKeyLengths = map[int]struct{ public, private int }{
+	ENC_ELGAMAL:      {256, 256},
+	ENC_ECIES_X25519: {32, 32},
+}
+
+// OfflineSignature is the signature of a destination's offline signing
+// key over a transient signing key, which the router uses instead until
+// Expires.
+type OfflineSignature struct {
+	Expires          time.Time
+	TransientSigType int
+	TransientPublic  []byte
+	Signature        []byte
+}
+
+// signed returns the data the offline key signs.
+func (o *OfflineSignature) signed() []byte {
+	b := binary.BigEndian.AppendUint32(nil, uint32(o.Expires.Unix()))
+	b = binary.BigEndian.AppendUint16(b, uint16(o.TransientSigType))
+	return append(b, o.TransientPublic...)
+}
+
+// Verify checks the signature with the signing key of dest.
+func (o *OfflineSignature) Verify(dest i2pkeys.I2PAddr) error {
+	sigType, err := destSigType(dest)
+	if err != nil {
+		return err
+	}
+	if sigType != SIG_ED25519 {
+		return fmt.Errorf("onramp: can't verify offline signatures of signature type %d", sigType)
+	}
+	b, err := dest.ToBytes()
+	if err != nil {
+		return fmt.Errorf("onramp: %v", err)
+	}
+	if !ed25519.Verify(ed25519.PublicKey(b[384-32:384]), o.signed(), o.Signature) {
+		return fmt.Errorf("onramp: invalid offline signature")
+	}
+	return nil
+}
+
+// privateKeyParts splits private keys in SAM's format into the
+// destination, the encryption private key, the signing private key and the
+// rest, which is the offline section if the signing private key is zero.
+func privateKeyParts(keys i2pkeys.I2PKeys) (dest, enc, sig, rest []byte, err error) {
+	b, err := i2pkeys.I2PAddr(keys.Both).ToBytes()
+	if err != nil {
+		return nil, nil, nil, nil, fmt.Errorf("onramp: %v", err)
+	}
+	if len(b) < 387 {
+		return nil, nil, nil, nil, fmt.Errorf("onramp: private keys are too short")
+	}
+	destLen := 387 + int(binary.BigEndian.Uint16(b[385:]))
+	sigType, err := certSigType(b)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	lengths, ok := sigKeyLengths[sigType]
+	if !ok {
+		return nil, nil, nil, nil, fmt.Errorf("onramp: unknown signature type %d", sigType)
+	}
+	encLengths, ok := encKeyLengths[certCryptoType(b)]
+	if !ok {
+		return nil, nil, nil, nil, fmt.Errorf("onramp: unknown encryption type %d", certCryptoType(b))
+	}
+	sigStart := destLen + encLengths.private
+	if len(b) < sigStart+lengths.private {
+		return nil, nil, nil, nil, fmt.Errorf("onramp: private keys are too short")
+	}
+	enc = b[destLen:sigStart]
+	sig = b[sigStart : sigStart+lengths.private]
+	return b[:destLen], enc, sig, b[sigStart+lengths.private:], nil
+}
+
+// ParseOfflineSignature returns the offline signature of transient keys,
+// or nil if keys hold the destination's own signing key.
+func ParseOfflineSignature(keys i2pkeys.I2PKeys) (*OfflineSignature, error) {
+	dest, _, sig, rest, err := privateKeyParts(keys)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(sig, make([]byte, len(sig))) {
+		return nil, nil
+	}
+	if len(rest) < 6 {
+		return nil, fmt.Errorf("onramp: private keys have a truncated offline signature")
+	}
+	o := &OfflineSignature{
+		Expires:          time.Unix(int64(binary.BigEndian.Uint32(rest)), 0),
+		TransientSigType: int(binary.BigEndian.Uint16(rest[4:])),
+	}
+	transient, ok := sigKeyLengths[o.TransientSigType]
+	if !ok {
+		return nil, fmt.Errorf("onramp: unknown transient signature type %d", o.TransientSigType)
+	}
+	sigType, _ := certSigType(dest)
+	offline := sigKeyLengths[sigType]
+	rest = rest[6:]
+	if len(rest) != transient.public+offline.signature+transient.private {
+		return nil, fmt.Errorf("onramp: private keys have a truncated offline signature")
+	}
+	o.TransientPublic = rest[:transient.public]
+	o.Signature = rest[transient.public : transient.public+offline.signature]
+	return o, nil
+}
+
+// SignTransientKeys returns transient keys for the destination of offline,
+// full private keys with an Ed25519 signing key, which are valid until
+// expires. The transient keys hold a new Ed25519 signing key signed by the
+// offline one instead of it, so the offline keys can be kept away from the
+// router. The router has to support offline signatures in SAM.
+func SignTransientKeys(offline i2pkeys.I2PKeys, expires time.Time) (i2pkeys.I2PKeys, error) {
+	dest, enc, sig, rest, err := privateKeyParts(offline)
+	if err != nil {
+		return i2pkeys.I2PKeys{}, fmt.Errorf("onramp SignTransientKeys: %v", err)
+	}
+	if o, _ := ParseOfflineSignature(offline); o != nil || len(rest) > 0 {
+		return i2pkeys.I2PKeys{}, fmt.Errorf("onramp SignTransientKeys: the keys are transient keys already")
+	}
+	if sigType, _ := certSigType(dest); sigType != SIG_ED25519 {
+		return i2pkeys.I2PKeys{}, fmt.Errorf("onramp SignTransientKeys: offline keys need an Ed25519 destination, not signature type %d", sigType)
+	}
+	if expires.Unix() > 1<<32-1 || time.Until(expires) <= I2P_OFFLINE_EXPIRY_MARGIN {
+		return i2pkeys.I2PKeys{}, fmt.Errorf("onramp SignTransientKeys: invalid expiry %s", expires)
+	}
+	key := ed25519.NewKeyFromSeed(sig)
+	if !bytes.Equal(key.Public().(ed25519.PublicKey), dest[384-32:384]) {
+		return i2pkeys.I2PKeys{}, fmt.Errorf("onramp SignTransientKeys: the signing key doesn't belong to the destination")
+	}
+	transientPub, transient, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return i2pkeys.I2PKeys{}, fmt.Errorf("onramp SignTransientKeys: %v", err)
+	}
+	o := &OfflineSignature{
+		Expires:          time.Unix(expires.Unix(), 0),
+		TransientSigType: SIG_ED25519,
+		TransientPublic:  transientPub,
+	}
+	o.Signature = ed25519.Sign(key, o.signed())
+	// the offline section follows a zero signing key
+	b := append(append([]byte{}, dest...), enc...)
+	b = append(b, make([]byte, len(sig))...)
+	b = append(b, o.signed()...)
+	b = append(b, o.Signature...)
+	b = append(b, transient.Seed()...)
+	log.WithFields(logrus.Fields{
+		"address": offline.Addr().Base32(),
+		"expires": o.Expires,
+	}).Debug("Signed transient keys")
+	return i2pkeys.NewKeys(offline.Addr(), i2pBase64.EncodeToString(b)), nil
+}
+
+// checkOfflineExpiry refuses transient keys whose offline signature expires
+// within I2P_OFFLINE_EXPIRY_MARGIN, and warns about those which expire
+// within I2P_OFFLINE_EXPIRY_WARNING. Keys it can't parse are left to the
+// router.
+func checkOfflineExpiry(keys i2pkeys.I2PKeys) error {
+	o, err := ParseOfflineSignature(keys)
+	if err != nil {
+		log.WithError(err).Debug("Can't check private keys for an offline signature")
+		return nil
+	}
+	if o == nil {
+		return nil
+	}
+	left := time.Until(o.Expires)
+	fields := logrus.Fields{
+		"address": keys.Addr().Base32(),
+		"expires": o.Expires,
+	}
+	if left < I2P_OFFLINE_EXPIRY_MARGIN {
+		log.WithFields(fields).Error("Offline signature of transient keys expired")
+		return fmt.Errorf("onramp: the offline signature of the keys expires at %s, sign new transient keys", o.Expires)
+	}
+	if left < I2P_OFFLINE_EXPIRY_WARNING {
+		log.WithFields(fields).Warn("Offline signature of transient keys expires soon")
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+//go:build !gen
+// +build !gen
+
+package onramp
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-i2p/i2pkeys"
+)
+
+// testOfflineKeys returns full private keys of an Ed25519 destination in
+// SAM's format.
+func testOfflineKeys(t *testing.T) i2pkeys.I2PKeys {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := make([]byte, 384, 391)
+	rand.Read(dest[:256])
+	copy(dest[352:], pub)
+	dest = append(dest, 5, 0, 4, 0, 7, 0, 0)
+	both := append(append(append([]byte{}, dest...), make([]byte, 256)...), priv.Seed()...)
+	return i2pkeys.NewKeys(i2pkeys.I2PAddr(i2pBase64.EncodeToString(dest)), i2pBase64.EncodeToString(both))
+}
+
+func TestSignTransientKeys(t *testing.T) {
+	offline := testOfflineKeys(t)
+	if o, err := ParseOfflineSignature(offline); o != nil || err != nil {
+		t.Fatalf("offline keys have an offline signature %v, %v", o, err)
+	}
+	expires := time.Now().Add(30 * 24 * time.Hour)
+	transient, err := SignTransientKeys(offline, expires)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if transient.Addr() != offline.Addr() {
+		t.Error("transient keys have another destination")
+	}
+	o, err := ParseOfflineSignature(transient)
+	if err != nil || o == nil {
+		t.Fatalf("transient keys have no offline signature: %v", err)
+	}
+	if o.Expires.Unix() != expires.Unix() || o.TransientSigType != SIG_ED25519 {
+		t.Errorf("offline signature %+v", o)
+	}
+	if err := o.Verify(offline.Addr()); err != nil {
+		t.Error(err)
+	}
+	o.Expires = o.Expires.Add(time.Hour)
+	if err := o.Verify(offline.Addr()); err == nil {
+		t.Error("verified a changed offline signature")
+	}
+	if _, err := SignTransientKeys(transient, expires); err == nil {
+		t.Error("signed transient keys with transient keys")
+	}
+	if _, err := SignTransientKeys(offline, time.Now()); err == nil {
+		t.Error("signed transient keys which expire now")
+	}
+	mixed := i2pkeys.I2PAddr(offline.Both).Bytes()
+	copy(mixed[391+256:], i2pkeys.I2PAddr(testOfflineKeys(t).Both).Bytes()[391+256:])
+	if _, err := SignTransientKeys(i2pkeys.NewKeys(offline.Addr(), i2pBase64.EncodeToString(mixed)), expires); err == nil {
+		t.Error("signed with the key of another destination")
+	}
+}
+
+func TestStoreTransientI2PKeys(t *testing.T) {
+	defer func(path string) { I2P_KEYSTORE_PATH = path }(I2P_KEYSTORE_PATH)
+	I2P_KEYSTORE_PATH = t.TempDir()
+	offline := testOfflineKeys(t)
+	transient, err := StoreTransientI2PKeys("offline", offline, time.Now().Add(30*24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the keys exist, so no SAM bridge is needed to load them
+	keys, err := I2PKeysWithTypes("offline", "127.0.0.1:1", I2PKeyTypes{Signature: SIG_ED25519})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys.Both != transient.Both {
+		t.Error("loaded other keys than the transient keys")
+	}
+	if _, err := StoreTransientI2PKeys("offline", testOfflineKeys(t), time.Now().Add(time.Hour*24)); err == nil {
+		t.Error("replaced the keys of another destination")
+	}
+	defer func(margin time.Duration) { I2P_OFFLINE_EXPIRY_MARGIN = margin }(I2P_OFFLINE_EXPIRY_MARGIN)
+	I2P_OFFLINE_EXPIRY_MARGIN = 60 * 24 * time.Hour
+	if _, err := I2PKeys("offline", "127.0.0.1:1"); err == nil || !strings.Contains(err.Error(), "sign new transient keys") {
+		t.Errorf("loaded expiring transient keys: %v", err)
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"sync"
 
 	"github.com/sirupsen/logrus"
 
@@ -27,7 +28,31 @@ type Onion struct {
 	*tor.ListenConf
 	*tor.DialConf
 	context.Context
-	name string
+	// CertProfile controls how TLS certificates are generated for the
+	// service, DefaultOnionCertProfile() if nil.
+	CertProfile *CertProfile
+	// TLSClientConfig is used by DialTLS. If nil, self-signed server
+	// certificates are accepted unless they have been revoked.
+	TLSClientConfig *tls.Config
+	// NextProtos is the list of ALPN protocols offered by ListenTLS, in
+	// order of preference, for instance "h2" and "http/1.1".
+	NextProtos []string
+	// AuthorizedClients are the x25519 public keys of the clients which
+	// may connect to the service, base32 or "descriptor:x25519:" lines
+	// like OnionClientKey.AuthorizedClient returns. Anyone may connect if
+	// it is empty.
+	AuthorizedClients []string
+	// ClientAuthKeys holds the keys Dial uses for onion services which only
+	// let authorized clients in, by onion address.
+	ClientAuthKeys map[string]*OnionClientKey
+	name           string
+
+	authMu    sync.Mutex
+	authAdded map[string]bool
+
+	portMu    sync.Mutex
+	ports     map[int]*onionPort
+	serviceID string
 }
 
 func (o *Onion) getStartConf() *tor.StartConf {
@@ -103,14 +128,18 @@ func (o *Onion) getName() string {
 
 // NewListener returns a net.Listener which will listen on an onion
 // address, and will automatically generate a keypair and store it.
-// the args are always ignored
+// See Listen.
 func (o *Onion) NewListener(n, addr string) (net.Listener, error) {
-	return o.Listen(n)
+	return o.Listen(n, addr)
 }
 
 // Listen returns a net.Listener which will listen on an onion
 // address, and will automatically generate a keypair and store it.
-// the args are always ignored
+// accepts a variable list of arguments: the network, which is ignored, and
+// an address whose port is the virtual port to listen on, for instance
+// Listen("tcp", ":22"). See ListenPort. Without a port the listener gets a
+// service of its own, which can't be combined with port listeners since
+// both use the same keys.
 func (o *Onion) Listen(args ...string) (net.Listener, error) {
 	log.WithFields(logrus.Fields{
 		"args": args,
@@ -129,9 +158,21 @@ func (o *Onion) Listen(args ...string) (net.Listener, error) {
 
 // OldListen returns a net.Listener which will listen on an onion
 // address, and will automatically generate a keypair and store it.
-// the args are always ignored
+// See Listen.
 func (o *Onion) OldListen(args ...string) (net.Listener, error) {
 	log.WithField("name", o.getName()).Debug("Creating Tor listener")
+	port, err := listenPort(args)
+	if err != nil {
+		log.WithError(err).Error("Failed to parse listener address")
+		return nil, err
+	}
+	if port == 0 && len(o.AuthorizedClients) > 0 {
+		// tor.Listen can't set up client authorization
+		port = 80
+	}
+	if port != 0 {
+		return o.ListenPort(port)
+	}
 
 	listener, err := o.getTor().Listen(o.getContext(), o.getListenConf())
 	if err != nil {
@@ -155,7 +196,7 @@ func (o *Onion) ListenTLS(args ...string) (net.Listener, error) {
 		return nil, fmt.Errorf("onramp ListenTLS: %v", err)
 	}
 	log.Debug("Creating base Tor listener")
-	l, err := o.getTor().Listen(o.getContext(), o.getListenConf())
+	l, err := o.OldListen(args...)
 	if err != nil {
 		log.WithError(err).Error("Failed to create base Tor listener")
 		return nil, err
@@ -165,6 +206,7 @@ func (o *Onion) ListenTLS(args ...string) (net.Listener, error) {
 		l,
 		&tls.Config{
 			Certificates: []tls.Certificate{cert},
+			NextProtos:   o.NextProtos,
 		},
 	), nil
 }
@@ -175,6 +217,12 @@ func (o *Onion) Dial(net, addr string) (net.Conn, error) {
 		"network": net,
 		"address": addr,
 	}).Debug("Attempting to dial via Tor")
+	o.authMu.Lock()
+	err := o.addClientAuth(onionServiceID(addr))
+	o.authMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
 	conn, err := o.getDialer().DialContext(o.getContext(), net, addr)
 	if err != nil {
 		log.WithError(err).Error("Failed to establish Tor connection")
@@ -189,7 +237,7 @@ func (o *Onion) Dial(net, addr string) (net.Conn, error) {
 // Close closes the Onion Service and all associated resources.
 func (o *Onion) Close() error {
 	log.WithField("name", o.getName()).Debug("Closing Onion service")
-
+	o.closePorts()
 	err := o.getTor().Close()
 	if err != nil {
 		log.WithError(err).Error("Failed to close Tor instance")
@@ -233,52 +281,121 @@ func NewOnion(name string) (*Onion, error) {
 
 // TorKeys returns a key pair which will be stored at the given key
 // name in the key store. If the key already exists, it will be
-// returned. If it does not exist, it will be generated.
+// returned. If it does not exist, it will be generated. The key is the
+// service's identity key: Tor can't host an onion service with only a
+// descriptor signing key and its certificate.
 func TorKeys(keyName string) (ed25519.KeyPair, error) {
 	log.WithField("key_name", keyName).Debug("Getting Tor keys")
+	if KEYSTORE != nil {
+		return keystoreTorKeys(keyName)
+	}
 	keystore, err := TorKeystorePath()
 	if err != nil {
 		log.WithError(err).Error("Failed to get keystore path")
 		return nil, fmt.Errorf("onramp OnionKeys: discovery error %v", err)
 	}
-	var keys ed25519.KeyPair
 	keysPath := filepath.Join(keystore, keyName+".tor.private")
+	unlock, err := lockKeyFile(keysPath)
+	if err != nil {
+		return nil, fmt.Errorf("onramp OnionKeys: %v", err)
+	}
+	defer unlock()
 	log.WithField("path", keysPath).Debug("Checking for existing keys")
-	if _, err := os.Stat(keysPath); os.IsNotExist(err) {
+	info, err := os.Stat(keysPath)
+	if info != nil && info.Size() == 0 {
+		// left by an interrupted write, it never held an identity
+		log.WithField("path", keysPath).Warn("Key file empty, re-generating keys")
+		if err := os.Remove(keysPath); err != nil {
+			return nil, fmt.Errorf("onramp OnionKeys: %v", err)
+		}
+		err = os.ErrNotExist
+	}
+	if os.IsNotExist(err) {
+		if err := checkQuarantine(keysPath); err != nil {
+			return nil, fmt.Errorf("onramp OnionKeys: %v", err)
+		}
+		warnIdentityElsewhere(keystore, "onionkeys", keyName+".tor.private")
 		log.Debug("Generating new Tor keys")
-		tkeys, err := ed25519.GenerateKey(nil)
+		keys, err := ed25519.GenerateKey(nil)
 		if err != nil {
 			log.WithError(err).Error("Failed to generate onion service key")
-			log.Fatal("Unable to generate onion service key")
+			return nil, fmt.Errorf("onramp OnionKeys: keygen error %v", err)
 		}
-		keys = tkeys
-
 		log.WithField("path", keysPath).Debug("Creating key file")
-		f, err := os.Create(keysPath)
-		if err != nil {
-			log.WithError(err).Error("Failed to create Tor keys file")
-			log.Fatal("Unable to create Tor keys file for writing")
-		}
-		defer f.Close()
-		_, err = f.Write(tkeys.PrivateKey())
-		if err != nil {
+		if err := writeKeyFile(keysPath, append([]byte(torSecretKeyHeader), keys.PrivateKey()...), 0600); err != nil {
 			log.WithError(err).Error("Failed to write Tor keys to disk")
-			log.Fatal("Unable to write Tor keys to disk")
+			return nil, fmt.Errorf("onramp OnionKeys: store error %v", err)
+		}
+		metaPath := filepath.Join(keystore, keyName+".tor.meta")
+		if err := writeTorKeyMetadata(metaPath); err != nil {
+			log.WithError(err).WithField("path", metaPath).Error("Failed to store key metadata")
+			return nil, fmt.Errorf("onramp OnionKeys: store error %v", err)
 		}
 		log.Debug("Successfully generated and stored new keys")
-	} else if err == nil {
-		log.Debug("Loading existing Tor keys")
-		tkeys, err := os.ReadFile(keysPath)
+		return keys, nil
+	} else if err != nil {
+		log.WithError(err).Error("Failed to set up Tor keys")
+		return nil, fmt.Errorf("onramp OnionKeys: %v", err)
+	}
+	log.Debug("Loading existing Tor keys")
+	keys, err := readTorKeys(keysPath)
+	if err != nil {
+		log.WithError(err).Error("Failed to read Tor keys from disk")
+		return nil, fmt.Errorf("onramp OnionKeys: load error %v", err)
+	}
+	log.Debug("Successfully loaded existing keys")
+	return keys, nil
+}
+
+// keystoreTorKeys is TorKeys for keys in KEYSTORE.
+func keystoreTorKeys(keyName string) (ed25519.KeyPair, error) {
+	name := "onionkeys/" + keyName + ".tor.private"
+	data, err := keystoreKey(name, func() ([]byte, error) {
+		keys, err := ed25519.GenerateKey(nil)
 		if err != nil {
-			log.WithError(err).Error("Failed to read Tor keys from disk")
-			log.Fatal("Unable to read Tor keys from disk")
+			return nil, fmt.Errorf("onramp OnionKeys: keygen error %v", err)
 		}
-		k := ed25519.FromCryptoPrivateKey(tkeys)
-		keys = k
-		log.Debug("Successfully loaded existing keys")
-	} else {
-		log.WithError(err).Error("Failed to set up Tor keys")
-		log.Fatal("Unable to set up Tor keys")
+		return append([]byte(torSecretKeyHeader), keys.PrivateKey()...), nil
+	})
+	if err != nil {
+		log.WithError(err).WithField("name", name).Error("Failed to get keys from the keystore")
+		return nil, err
+	}
+	keys, err := parseTorKeys(data)
+	if err != nil {
+		return nil, fmt.Errorf("onramp OnionKeys: %s: %v", name, err)
+	}
+	return keys, nil
+}
+
+// torSecretKeyHeader starts Tor's hs_ed25519_secret_key files, which hold
+// the 64-byte expanded key after it.
+const torSecretKeyHeader = "== ed25519v1-secret: type0 ==\x00\x00\x00"
+
+// parseTorKeys parses a key file of the key store. Keys are stored in
+// Tor's format. Older key files hold only the expanded key, which was
+// loaded as the seed of another key; that key is kept, since it is the one
+// their onion services have been published with.
+func parseTorKeys(data []byte) (ed25519.KeyPair, error) {
+	if len(data) == len(torSecretKeyHeader)+ed25519.PrivateKeySize && string(data[:len(torSecretKeyHeader)]) == torSecretKeyHeader {
+		return ed25519.PrivateKey(data[len(torSecretKeyHeader):]).KeyPair(), nil
+	}
+	if len(data) == ed25519.PrivateKeySize {
+		return ed25519.FromCryptoPrivateKey(data).PrivateKey().KeyPair(), nil
+	}
+	return nil, fmt.Errorf("not an ed25519 secret key")
+}
+
+// readTorKeys loads the key in the Tor key file at path, and quarantines
+// the file if it doesn't hold a valid key.
+func readTorKeys(path string) (ed25519.KeyPair, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := parseTorKeys(data)
+	if err != nil {
+		return nil, quarantineKeyFile(path, err)
 	}
 	return keys, nil
 }
@@ -363,18 +480,29 @@ func DialOnion(network, addr string) (net.Conn, error) {
 // keystore + tunName.
 func DeleteOnionKeys(tunName string) error {
 	log.WithField("tunnel_name", tunName).Debug("Attempting to delete Onion keys")
+	if KEYSTORE != nil {
+		if err := KEYSTORE.Delete("onionkeys/" + tunName + ".tor.private"); err != nil {
+			return fmt.Errorf("onramp DeleteOnionKeys: %v", err)
+		}
+		return nil
+	}
 
 	keystore, err := TorKeystorePath()
 	if err != nil {
 		log.WithError(err).Error("Failed to get keystore path")
 		return fmt.Errorf("onramp DeleteOnionKeys: discovery error %v", err)
 	}
-	keyspath := filepath.Join(keystore, tunName+".i2p.private")
-	log.WithError(err).Error("Failed to get keystore path")
+	keyspath := filepath.Join(keystore, tunName+".tor.private")
+	log.WithField("path", keyspath).Debug("Deleting key file")
 	if err := os.Remove(keyspath); err != nil {
 		log.WithError(err).WithField("path", keyspath).Error("Failed to delete key file")
 		return fmt.Errorf("onramp DeleteOnionKeys: %v", err)
 	}
+	metapath := filepath.Join(keystore, tunName+".tor.meta")
+	if err := os.Remove(metapath); err != nil && !os.IsNotExist(err) {
+		log.WithError(err).WithField("path", metapath).Error("Failed to delete key metadata")
+		return fmt.Errorf("onramp DeleteOnionKeys: %v", err)
+	}
 	log.Debug("Successfully deleted Onion keys")
 	return nil
 }
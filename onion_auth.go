@@ -0,0 +1,287 @@
+//go:build !gen
+// +build !gen
+
+package onramp
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cretz/bine/control"
+	"github.com/sirupsen/logrus"
+)
+
+// onionAuthEncoding is how Tor writes x25519 keys in its client
+// authorization files.
+var onionAuthEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// OnionClientKey is an x25519 key pair for v3 onion service client
+// authorization. A service publishes its descriptor encrypted for the
+// public keys of its authorized clients, and only clients with one of the
+// private keys can find and connect to it.
+type OnionClientKey struct {
+	*ecdh.PrivateKey
+}
+
+// GenerateOnionClientKey returns a new client authorization key pair.
+func GenerateOnionClientKey() (*OnionClientKey, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("onramp GenerateOnionClientKey: %v", err)
+	}
+	return &OnionClientKey{key}, nil
+}
+
+// ParseOnionClientKey parses a private key as written by String, or a line
+// of a Tor .auth_private file.
+func ParseOnionClientKey(s string) (*OnionClientKey, error) {
+	s = strings.TrimSpace(s)
+	if i := strings.LastIndex(s, ":"); i >= 0 {
+		if !strings.HasSuffix(s[:i], "descriptor:x25519") {
+			return nil, fmt.Errorf("onramp ParseOnionClientKey: not an x25519 descriptor key")
+		}
+		s = s[i+1:]
+	}
+	b, err := onionAuthEncoding.DecodeString(strings.ToUpper(s))
+	if err != nil {
+		return nil, fmt.Errorf("onramp ParseOnionClientKey: %v", err)
+	}
+	key, err := ecdh.X25519().NewPrivateKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("onramp ParseOnionClientKey: %v", err)
+	}
+	return &OnionClientKey{key}, nil
+}
+
+// String returns the base32 private key.
+func (k *OnionClientKey) String() string {
+	return onionAuthEncoding.EncodeToString(k.Bytes())
+}
+
+// Public returns the base32 public key, which the service authorizes.
+func (k *OnionClientKey) Public() string {
+	return onionAuthEncoding.EncodeToString(k.PublicKey().Bytes())
+}
+
+// AuthorizedClient returns the public key in the format of a Tor
+// authorized_clients file, which Onion.AuthorizedClients also accepts.
+func (k *OnionClientKey) AuthorizedClient() string {
+	return "descriptor:x25519:" + k.Public()
+}
+
+// ClientAuth returns the private key for the service at addr in the format
+// of a Tor .auth_private file.
+func (k *OnionClientKey) ClientAuth(addr string) string {
+	return onionServiceID(addr) + ":descriptor:x25519:" + k.String()
+}
+
+// OnionClientKeys returns the client authorization key stored at the given
+// key name in the onion key store, generating it if it doesn't exist. The
+// public key is stored next to it in a .tor.auth file, ready to be given to
+// the operator of the service.
+func OnionClientKeys(keyName string) (*OnionClientKey, error) {
+	log.WithField("key_name", keyName).Debug("Getting onion client authorization keys")
+	if KEYSTORE != nil {
+		// the public key isn't stored, AuthorizedClient returns it
+		data, err := keystoreKey("onionkeys/"+keyName+".tor.auth_private", func() ([]byte, error) {
+			key, err := GenerateOnionClientKey()
+			if err != nil {
+				return nil, err
+			}
+			return []byte("descriptor:x25519:" + key.String() + "\n"), nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		return ParseOnionClientKey(string(data))
+	}
+	keystore, err := TorKeystorePath()
+	if err != nil {
+		return nil, fmt.Errorf("onramp OnionClientKeys: discovery error %v", err)
+	}
+	keyPath := filepath.Join(keystore, keyName+".tor.auth_private")
+	unlock, err := lockKeyFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("onramp OnionClientKeys: %v", err)
+	}
+	defer unlock()
+	if data, err := os.ReadFile(keyPath); err == nil {
+		return ParseOnionClientKey(string(data))
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("onramp OnionClientKeys: %v", err)
+	}
+	log.WithField("path", keyPath).Debug("Generating onion client authorization keys")
+	key, err := GenerateOnionClientKey()
+	if err != nil {
+		return nil, err
+	}
+	if err := writeKeyFile(keyPath, []byte("descriptor:x25519:"+key.String()+"\n"), 0600); err != nil {
+		return nil, fmt.Errorf("onramp OnionClientKeys: %v", err)
+	}
+	pubPath := filepath.Join(keystore, keyName+".tor.auth")
+	if err := writeKeyFile(pubPath, []byte(key.AuthorizedClient()+"\n"), 0644); err != nil {
+		return nil, fmt.Errorf("onramp OnionClientKeys: %v", err)
+	}
+	return key, nil
+}
+
+// DeleteOnionClientKeys deletes the client authorization key stored at the
+// given key name in the onion key store.
+func DeleteOnionClientKeys(keyName string) error {
+	if KEYSTORE != nil {
+		if err := KEYSTORE.Delete("onionkeys/" + keyName + ".tor.auth_private"); err != nil {
+			return fmt.Errorf("onramp DeleteOnionClientKeys: %v", err)
+		}
+		return nil
+	}
+	keystore, err := TorKeystorePath()
+	if err != nil {
+		return fmt.Errorf("onramp DeleteOnionClientKeys: discovery error %v", err)
+	}
+	for _, ext := range []string{".tor.auth_private", ".tor.auth"} {
+		if err := os.Remove(filepath.Join(keystore, keyName+ext)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("onramp DeleteOnionClientKeys: %v", err)
+		}
+	}
+	return nil
+}
+
+// onionServiceID returns the service ID of an onion address, which may
+// have a ".onion" suffix and a port.
+func onionServiceID(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return strings.TrimSuffix(strings.ToLower(addr), ".onion")
+}
+
+// onionAuthorizedClient returns the base32 public key of an authorized
+// client given as a key or an authorized_clients line.
+func onionAuthorizedClient(client string) (string, error) {
+	client = strings.TrimSpace(client)
+	if i := strings.LastIndex(client, ":"); i >= 0 {
+		if client[:i] != "descriptor:x25519" {
+			return "", fmt.Errorf("onramp: %q is not an x25519 descriptor key", client)
+		}
+		client = client[i+1:]
+	}
+	client = strings.ToUpper(client)
+	if b, err := onionAuthEncoding.DecodeString(client); err != nil || len(b) != 32 {
+		return "", fmt.Errorf("onramp: %q is not an x25519 public key", client)
+	}
+	return client, nil
+}
+
+// AuthorizeClient adds a client to AuthorizedClients, and publishes the
+// onion service of the port listeners again if it is running.
+func (o *Onion) AuthorizeClient(client string) error {
+	if _, err := onionAuthorizedClient(client); err != nil {
+		return err
+	}
+	o.portMu.Lock()
+	defer o.portMu.Unlock()
+	o.AuthorizedClients = append(o.AuthorizedClients, client)
+	if o.serviceID == "" {
+		return nil
+	}
+	if err := o.publish(); err != nil {
+		return fmt.Errorf("onramp AuthorizeClient: %v", err)
+	}
+	return nil
+}
+
+// AddClientAuth sets the key Dial uses to reach the onion service at addr,
+// which only lets authorized clients in.
+func (o *Onion) AddClientAuth(addr string, key *OnionClientKey) error {
+	o.authMu.Lock()
+	defer o.authMu.Unlock()
+	if o.ClientAuthKeys == nil {
+		o.ClientAuthKeys = make(map[string]*OnionClientKey)
+	}
+	id := onionServiceID(addr)
+	o.ClientAuthKeys[id] = key
+	delete(o.authAdded, id)
+	return o.addClientAuth(id)
+}
+
+// addClientAuth hands the client authorization key for the service id to
+// Tor, once. authMu must be held.
+func (o *Onion) addClientAuth(id string) error {
+	if o.authAdded[id] {
+		return nil
+	}
+	var key *OnionClientKey
+	for addr, k := range o.ClientAuthKeys {
+		if onionServiceID(addr) == id {
+			key = k
+		}
+	}
+	if key == nil {
+		return nil
+	}
+	log.WithField("service_id", id).Debug("Adding onion client authorization")
+	if _, err := o.getTor().Control.SendRequest("ONION_CLIENT_AUTH_ADD %s x25519:%s", id, base64.StdEncoding.EncodeToString(key.Bytes())); err != nil {
+		log.WithError(err).Error("Failed to add onion client authorization")
+		return fmt.Errorf("onramp: adding client authorization for %s: %v", id, err)
+	}
+	if o.authAdded == nil {
+		o.authAdded = make(map[string]bool)
+	}
+	o.authAdded[id] = true
+	return nil
+}
+
+// onionAddCommand returns the ADD_ONION command for req, which bine can't
+// send with v3 client authorization.
+func onionAddCommand(req *control.AddOnionRequest, clients []string) (string, error) {
+	cmd := "ADD_ONION " + string(req.Key.Type()) + ":" + req.Key.Blob()
+	if len(req.Flags) > 0 {
+		cmd += " Flags=" + strings.Join(req.Flags, ",")
+	}
+	if req.MaxStreams > 0 {
+		cmd += fmt.Sprintf(" MaxStreams=%d", req.MaxStreams)
+	}
+	for _, port := range req.Ports {
+		cmd += " Port=" + port.Key
+		if port.Val != "" {
+			cmd += "," + port.Val
+		}
+	}
+	for _, client := range clients {
+		pub, err := onionAuthorizedClient(client)
+		if err != nil {
+			return "", err
+		}
+		cmd += " ClientAuthV3=" + pub
+	}
+	return cmd, nil
+}
+
+// addOnion sends the ADD_ONION command for req and returns the service ID.
+func addOnion(conn *control.Conn, req *control.AddOnionRequest, clients []string) (string, error) {
+	cmd, err := onionAddCommand(req, clients)
+	if err != nil {
+		return "", err
+	}
+	log.WithFields(logrus.Fields{
+		"ports":   len(req.Ports),
+		"clients": len(clients),
+	}).Debug("Adding onion service")
+	resp, err := conn.SendRequest("%s", cmd)
+	if err != nil {
+		return "", err
+	}
+	for _, data := range resp.Data {
+		if id, ok := strings.CutPrefix(data, "ServiceID="); ok {
+			return id, nil
+		}
+	}
+	return "", fmt.Errorf("onramp: ADD_ONION reply without a service ID")
+}
@@ -0,0 +1,88 @@
+//go:build !gen
+// +build !gen
+
+package onramp
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/cretz/bine/control"
+	"github.com/cretz/bine/torutil/ed25519"
+)
+
+func TestOnionClientKey(t *testing.T) {
+	key, err := GenerateOnionClientKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := strings.Repeat("a", 56)
+	for _, s := range []string{key.String(), "descriptor:x25519:" + key.String(), key.ClientAuth(id + ".onion:80")} {
+		parsed, err := ParseOnionClientKey(s)
+		if err != nil {
+			t.Fatalf("%s: %v", s, err)
+		}
+		if parsed.Public() != key.Public() {
+			t.Errorf("%s parsed to another key", s)
+		}
+	}
+	if !strings.HasPrefix(key.ClientAuth(id+".onion"), id+":descriptor:x25519:") {
+		t.Errorf("client auth %s", key.ClientAuth(id))
+	}
+	if _, err := ParseOnionClientKey("descriptor:ed25519:" + key.String()); err == nil {
+		t.Error("parsed a key of another type")
+	}
+	if pub, err := onionAuthorizedClient(key.AuthorizedClient()); err != nil || pub != key.Public() {
+		t.Errorf("authorized client %s, %v", pub, err)
+	}
+	if _, err := onionAuthorizedClient("not a key"); err == nil {
+		t.Error("authorized an invalid key")
+	}
+}
+
+func TestOnionClientKeys(t *testing.T) {
+	defer func(path string) { ONION_KEYSTORE_PATH = path }(ONION_KEYSTORE_PATH)
+	ONION_KEYSTORE_PATH = t.TempDir()
+	key, err := OnionClientKeys("client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := OnionClientKeys("client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.String() != key.String() {
+		t.Error("loaded another key than the stored one")
+	}
+	if err := DeleteOnionClientKeys("client"); err != nil {
+		t.Fatal(err)
+	}
+	if other, err := OnionClientKeys("client"); err != nil || other.String() == key.String() {
+		t.Errorf("deleted key was loaded again: %v", err)
+	}
+}
+
+func TestOnionAddCommand(t *testing.T) {
+	keys, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := GenerateOnionClientKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &control.AddOnionRequest{
+		Key:   &control.ED25519Key{KeyPair: keys},
+		Ports: []*control.KeyVal{{Key: "22", Val: "127.0.0.1:2222"}},
+	}
+	cmd, err := onionAddCommand(req, []string{client.AuthorizedClient()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(cmd, "ADD_ONION ED25519-V3:") || !strings.HasSuffix(cmd, " Port=22,127.0.0.1:2222 ClientAuthV3="+client.Public()) {
+		t.Errorf("command %s", cmd)
+	}
+	if _, err := onionAddCommand(req, []string{"descriptor:x25519:nope"}); err == nil {
+		t.Error("added an invalid client")
+	}
+}
@@ -0,0 +1,243 @@
+//go:build !gen
+// +build !gen
+
+package onramp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+
+	"github.com/cretz/bine/control"
+	"github.com/cretz/bine/tor"
+	"github.com/cretz/bine/torutil/ed25519"
+	"github.com/sirupsen/logrus"
+)
+
+// OnionAddr is the address of one virtual port of an onion service.
+type OnionAddr struct {
+	ServiceID string
+	Port      int
+}
+
+func (a *OnionAddr) Network() string {
+	return "tcp"
+}
+
+func (a *OnionAddr) String() string {
+	return fmt.Sprintf("%s.onion:%d", a.ServiceID, a.Port)
+}
+
+// onionPort is where Tor forwards the streams to one virtual port of the
+// onion service: a local listener created by ListenPort, or a backend
+// given to MapPort.
+type onionPort struct {
+	target   string
+	listener *onionPortListener
+}
+
+// onionPortListener accepts the streams to one virtual port of the onion
+// service from its local listener.
+type onionPortListener struct {
+	net.Listener
+	onion *Onion
+	port  int
+}
+
+// Addr returns the onion address and virtual port of the listener.
+// implements net.Listener
+func (l *onionPortListener) Addr() net.Addr {
+	l.onion.portMu.Lock()
+	defer l.onion.portMu.Unlock()
+	return &OnionAddr{ServiceID: l.onion.serviceID, Port: l.port}
+}
+
+// Close removes the port from the onion service and closes the local
+// listener.
+// implements net.Listener
+func (l *onionPortListener) Close() error {
+	err := l.onion.UnmapPort(l.port)
+	if cerr := l.Listener.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// ListenPort returns a net.Listener for the streams to the given virtual
+// port of the Onion's service. All ports share the Onion's keys and so its
+// address. Tor can't add a port to a running service, so the service is
+// published again with every change, which interrupts it briefly.
+func (o *Onion) ListenPort(port int) (net.Listener, error) {
+	log.WithField("port", port).Debug("Setting up onion port listener")
+	if port <= 0 || port > 65535 {
+		return nil, fmt.Errorf("onramp ListenPort: invalid port %d", port)
+	}
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.WithError(err).Error("Failed to create local listener")
+		return nil, fmt.Errorf("onramp ListenPort: %v", err)
+	}
+	l := &onionPortListener{Listener: local, onion: o, port: port}
+	if err := o.mapPort(port, &onionPort{target: local.Addr().String(), listener: l}); err != nil {
+		local.Close()
+		return nil, fmt.Errorf("onramp ListenPort: %v", err)
+	}
+	return l, nil
+}
+
+// MapPort forwards the streams to the given virtual port of the Onion's
+// service to target, a local address like "127.0.0.1:22", instead of a
+// listener. See ListenPort.
+func (o *Onion) MapPort(port int, target string) error {
+	log.WithFields(logrus.Fields{
+		"port":   port,
+		"target": target,
+	}).Debug("Mapping onion port")
+	if port <= 0 || port > 65535 {
+		return fmt.Errorf("onramp MapPort: invalid port %d", port)
+	}
+	if err := o.mapPort(port, &onionPort{target: target}); err != nil {
+		return fmt.Errorf("onramp MapPort: %v", err)
+	}
+	return nil
+}
+
+// UnmapPort removes a virtual port from the Onion's service. The service
+// is removed with its last port.
+func (o *Onion) UnmapPort(port int) error {
+	log.WithField("port", port).Debug("Unmapping onion port")
+	o.portMu.Lock()
+	defer o.portMu.Unlock()
+	if _, ok := o.ports[port]; !ok {
+		return nil
+	}
+	delete(o.ports, port)
+	if err := o.publish(); err != nil {
+		return fmt.Errorf("onramp UnmapPort: %v", err)
+	}
+	return nil
+}
+
+func (o *Onion) mapPort(port int, p *onionPort) error {
+	o.portMu.Lock()
+	defer o.portMu.Unlock()
+	if _, ok := o.ports[port]; ok {
+		return fmt.Errorf("port %d is already mapped", port)
+	}
+	if o.ports == nil {
+		o.ports = make(map[int]*onionPort)
+	}
+	o.ports[port] = p
+	if err := o.publish(); err != nil {
+		delete(o.ports, port)
+		return err
+	}
+	return nil
+}
+
+// publish replaces the onion service with one serving the current ports.
+// portMu must be held.
+func (o *Onion) publish() error {
+	t := o.getTor()
+	if o.serviceID != "" {
+		log.WithField("service_id", o.serviceID).Debug("Removing onion service before publishing it again")
+		if err := t.Control.DelOnion(o.serviceID); err != nil {
+			return err
+		}
+		o.serviceID = ""
+	}
+	if len(o.ports) == 0 {
+		return nil
+	}
+	keys, err := o.Keys()
+	if err != nil {
+		return err
+	}
+	conf := o.getListenConf()
+	id, err := addOnion(t.Control, onionPortsRequest(keys, conf, o.ports), o.AuthorizedClients)
+	if err != nil {
+		log.WithError(err).Error("Failed to publish onion service")
+		return err
+	}
+	o.serviceID = id
+	log.WithFields(logrus.Fields{
+		"service_id": o.serviceID,
+		"ports":      len(o.ports),
+	}).Debug("Published onion service")
+	if conf.NoWait {
+		return nil
+	}
+	return waitOnionPublished(o.getContext(), t, o.serviceID)
+}
+
+// closePorts removes the onion service of the port listeners and closes
+// their local listeners.
+func (o *Onion) closePorts() {
+	o.portMu.Lock()
+	defer o.portMu.Unlock()
+	for port, p := range o.ports {
+		if p.listener != nil {
+			p.listener.Listener.Close()
+		}
+		delete(o.ports, port)
+	}
+	if o.serviceID != "" {
+		o.getTor().Control.DelOnion(o.serviceID)
+		o.serviceID = ""
+	}
+}
+
+// onionPortsRequest returns the ADD_ONION request for a service with the
+// given keys and ports, which takes its other settings from conf.
+func onionPortsRequest(keys ed25519.KeyPair, conf *tor.ListenConf, ports map[int]*onionPort) *control.AddOnionRequest {
+	req := &control.AddOnionRequest{
+		Key:        &control.ED25519Key{KeyPair: keys},
+		MaxStreams: conf.MaxStreams,
+	}
+	if conf.NonAnonymous {
+		req.Flags = append(req.Flags, "NonAnonymous")
+	}
+	if conf.MaxStreamsCloseCircuit {
+		req.Flags = append(req.Flags, "MaxStreamsCloseCircuit")
+	}
+	remotes := make([]int, 0, len(ports))
+	for port := range ports {
+		remotes = append(remotes, port)
+	}
+	sort.Ints(remotes)
+	for _, port := range remotes {
+		req.Ports = append(req.Ports, &control.KeyVal{Key: strconv.Itoa(port), Val: ports[port].target})
+	}
+	return req
+}
+
+// waitOnionPublished waits until the descriptor of the onion service id
+// has been uploaded to a directory, like tor.Listen does.
+func waitOnionPublished(ctx context.Context, t *tor.Tor, id string) error {
+	if err := t.EnableNetwork(ctx, true); err != nil {
+		return err
+	}
+	uploads, failures := 0, 0
+	_, err := t.Control.EventWait(ctx, []control.EventCode{control.EventCodeHSDesc},
+		func(evt control.Event) (bool, error) {
+			hs, _ := evt.(*control.HSDescEvent)
+			if hs == nil || hs.Address != id {
+				return false, nil
+			}
+			switch hs.Action {
+			case "UPLOAD":
+				uploads++
+			case "FAILED":
+				failures++
+				if failures == uploads {
+					return false, fmt.Errorf("failed all uploads of the onion service, the last one because of %s", hs.Reason)
+				}
+			case "UPLOADED":
+				return true, nil
+			}
+			return false, nil
+		})
+	return err
+}
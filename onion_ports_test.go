@@ -0,0 +1,48 @@
+//go:build !gen
+// +build !gen
+
+package onramp
+
+import (
+	"testing"
+
+	"github.com/cretz/bine/tor"
+	"github.com/cretz/bine/torutil/ed25519"
+)
+
+func TestOnionPortsRequest(t *testing.T) {
+	keys, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ports := map[int]*onionPort{
+		443: {target: "127.0.0.1:8443"},
+		22:  {target: "127.0.0.1:22"},
+		80:  {target: "127.0.0.1:8080"},
+	}
+	req := onionPortsRequest(keys, &tor.ListenConf{MaxStreams: 10, NonAnonymous: true}, ports)
+	if len(req.Ports) != 3 {
+		t.Fatalf("request has %d ports", len(req.Ports))
+	}
+	for i, want := range []string{"22 127.0.0.1:22", "80 127.0.0.1:8080", "443 127.0.0.1:8443"} {
+		if got := req.Ports[i].Key + " " + req.Ports[i].Val; got != want {
+			t.Errorf("port %d is %q, want %q", i, got, want)
+		}
+	}
+	if req.MaxStreams != 10 || len(req.Flags) != 1 || req.Flags[0] != "NonAnonymous" {
+		t.Errorf("request has max streams %d and flags %v", req.MaxStreams, req.Flags)
+	}
+}
+
+func TestOnionListenPortInvalid(t *testing.T) {
+	o := &Onion{}
+	if _, err := o.Listen("tcp", ":99999"); err == nil {
+		t.Error("listened on an invalid port")
+	}
+	if err := o.MapPort(-1, "127.0.0.1:22"); err == nil {
+		t.Error("mapped an invalid port")
+	}
+	if addr := (&OnionAddr{ServiceID: "example", Port: 22}).String(); addr != "example.onion:22" {
+		t.Errorf("address %s", addr)
+	}
+}
@@ -0,0 +1,97 @@
+//go:build !gen
+// +build !gen
+
+package onramp
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/cretz/bine/torutil"
+	"github.com/cretz/bine/torutil/ed25519"
+)
+
+// RotateOnion starts moving the service of o to a successor key, which is
+// stored under o's name with a ".next" suffix until the rotation ends. The
+// rotation takes over o, and removes its onion services when its key is
+// retired after overlap, KEY_ROTATION_OVERLAP if zero. Tor keeps running
+// for the successor. If a rotation of o's name was started before, it
+// resumes with the same successor key and end. It returns the rotation and
+// the Onion structure of the successor key.
+func RotateOnion(o *Onion, overlap time.Duration) (*KeyRotation, *Onion, error) {
+	name := o.getName()
+	ks, keystore := KEYSTORE, ""
+	statePath := "onionkeys/" + name + ".tor.rotation"
+	if ks == nil {
+		var err error
+		if keystore, err = TorKeystorePath(); err != nil {
+			return nil, nil, fmt.Errorf("onramp RotateOnion: discovery error %v", err)
+		}
+		statePath = filepath.Join(keystore, name+".tor.rotation")
+	}
+	next := &Onion{
+		StartConf:         o.StartConf,
+		DialConf:          o.DialConf,
+		Context:           o.Context,
+		CertProfile:       o.CertProfile,
+		TLSClientConfig:   o.TLSClientConfig,
+		NextProtos:        o.NextProtos,
+		AuthorizedClients: o.AuthorizedClients,
+		ClientAuthKeys:    o.ClientAuthKeys,
+		name:              name + ".next",
+	}
+	keys, err := o.Keys()
+	if err != nil {
+		return nil, nil, fmt.Errorf("onramp RotateOnion: %v", err)
+	}
+	nextKeys, err := next.Keys()
+	if err != nil {
+		return nil, nil, fmt.Errorf("onramp RotateOnion: %v", err)
+	}
+	if o.ListenConf != nil {
+		conf := *o.ListenConf
+		conf.Key = nextKeys
+		next.ListenConf = &conf
+	}
+	r := &KeyRotation{
+		From:      torutil.OnionServiceIDFromV3PublicKey(keys.PublicKey()) + ".onion",
+		To:        torutil.OnionServiceIDFromV3PublicKey(nextKeys.PublicKey()) + ".onion",
+		current:   retiringOnion{o},
+		successor: next,
+		statePath: statePath,
+		keystore:  ks,
+		sign: func(m *MovedTo) error {
+			m.Signature = ed25519.Sign(keys, []byte(m.signed()))
+			return nil
+		},
+		retire: func() error {
+			var err error
+			if ks != nil {
+				err = archiveKeystoreKeys(ks, "onionkeys", name, next.name, ".tor.private")
+			} else {
+				err = archiveKeyFiles(keystore, name, next.name, ".tor.private", ".tor.meta")
+			}
+			if err != nil {
+				return err
+			}
+			next.name = name
+			return nil
+		},
+	}
+	if err := r.start(overlap); err != nil {
+		return nil, nil, fmt.Errorf("onramp RotateOnion: %v", err)
+	}
+	return r, next, nil
+}
+
+// retiringOnion is the Onion of a retired key. Closing it only removes its
+// onion services, since the successor uses the same Tor process.
+type retiringOnion struct {
+	*Onion
+}
+
+func (o retiringOnion) Close() error {
+	o.closePorts()
+	return nil
+}
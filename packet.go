@@ -0,0 +1,390 @@
+package onramp
+
+import (
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// PACKET_QUEUE_LENGTH is the number of datagrams buffered per peer by the
+// connections a packetMux hands out before further datagrams are dropped.
+var PACKET_QUEUE_LENGTH = 128
+
+// PACKET_MAX_PENDING_PEERS is the number of new peers a listening
+// packetMux keeps while their connections aren't accepted. Datagrams from
+// further unknown peers are dropped.
+var PACKET_MAX_PENDING_PEERS = 64
+
+// PACKET_IDLE_TIMEOUT is how long a packetMux keeps the connection of a
+// peer which contacted it without datagrams in either direction. The
+// connections of Connect are only closed by their owner.
+var PACKET_IDLE_TIMEOUT = 10 * time.Minute
+
+// MAX_DATAGRAM_SIZE is the largest datagram onramp reads from a packet
+// session. I2P repliable datagrams are limited to about 31KB.
+const MAX_DATAGRAM_SIZE = 32 * 1024
+
+// deadline is a resettable timer which closes a channel when it expires,
+// like the one used by net.Pipe.
+type deadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func newDeadline() *deadline {
+	return &deadline{cancel: make(chan struct{})}
+}
+
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // wait for the timer callback to finish and close cancel
+	}
+	d.timer = nil
+
+	closed := isClosedChan(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() {
+			close(cancel)
+		})
+		return
+	}
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+func (d *deadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+func isClosedChan(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+// packetMux turns a net.PacketConn into connection-oriented net.Conns, one
+// per remote address, or per remote address and tag if the mux has a tag
+// function. Datagrams from unknown peers create a new connection which is
+// returned by Accept, connections to a peer can be created with Connect.
+// Until listen is called datagrams from unknown peers are dropped. The mux
+// is the only reader of the PacketConn.
+type packetMux struct {
+	net.PacketConn
+	tag       func(data []byte) string
+	mu        sync.Mutex
+	peers     map[string]*packetConn
+	listening bool
+	// pending counts the new peers waiting for Accept
+	pending int
+	accept  *virtualListener
+	done    chan struct{}
+	err     error
+}
+
+func newPacketMux(pc net.PacketConn) *packetMux {
+	return newTaggedPacketMux(pc, nil)
+}
+
+// newTaggedPacketMux returns a packetMux which also separates the
+// datagrams of a remote address by the tag computed from their contents,
+// so one peer can have several connections.
+func newTaggedPacketMux(pc net.PacketConn, tag func(data []byte) string) *packetMux {
+	m := &packetMux{
+		PacketConn: pc,
+		tag:        tag,
+		peers:      make(map[string]*packetConn),
+		accept:     newVirtualListener(pc.LocalAddr()),
+		done:       make(chan struct{}),
+	}
+	go m.readLoop()
+	go m.expireLoop()
+	return m
+}
+
+func (m *packetMux) readLoop() {
+	defer close(m.done)
+	buf := make([]byte, MAX_DATAGRAM_SIZE)
+	for {
+		n, addr, err := m.PacketConn.ReadFrom(buf)
+		if err != nil {
+			log.WithError(err).Debug("Packet mux stopped reading")
+			m.mu.Lock()
+			m.err = err
+			for _, p := range m.peers {
+				p.closeLocal()
+			}
+			m.mu.Unlock()
+			m.accept.Close()
+			return
+		}
+		data := make([]byte, n)
+		copy(data, buf[:n])
+		tag := ""
+		if m.tag != nil {
+			tag = m.tag(data)
+		}
+		p, isNew := m.peer(addr, tag)
+		if p == nil {
+			log.WithField("peer", addr.String()).Debug("Dropping datagram from unknown peer")
+			continue
+		}
+		if isNew {
+			log.WithField("peer", addr.String()).Debug("New packet peer")
+			go func() {
+				accepted := m.accept.deliverTimeout(p, TLS_HANDSHAKE_TIMEOUT)
+				m.mu.Lock()
+				m.pending--
+				m.mu.Unlock()
+				if !accepted {
+					log.WithField("peer", addr.String()).Debug("Closing unaccepted packet peer")
+					p.Close()
+				}
+			}()
+		}
+		p.push(data)
+	}
+}
+
+// peer returns the connection for addr and tag, creating it if the mux is
+// listening and fewer than PACKET_MAX_PENDING_PEERS new peers wait for
+// Accept.
+func (m *packetMux) peer(addr net.Addr, tag string) (*packetConn, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if p, ok := m.peers[peerKey(addr, tag)]; ok {
+		return p, false
+	}
+	if !m.listening || m.pending >= PACKET_MAX_PENDING_PEERS {
+		return nil, false
+	}
+	m.pending++
+	p := newPacketConn(m, addr, tag)
+	p.incoming = true
+	m.peers[p.key()] = p
+	return p, true
+}
+
+// expireLoop closes the connections of peers which contacted the mux once
+// they are idle for PACKET_IDLE_TIMEOUT, until the mux stops reading.
+func (m *packetMux) expireLoop() {
+	ticker := time.NewTicker(PACKET_IDLE_TIMEOUT / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-ticker.C:
+			m.expire(time.Now().Add(-PACKET_IDLE_TIMEOUT))
+		}
+	}
+}
+
+// expire closes the connections of peers which contacted the mux and had
+// no datagrams since idleSince.
+func (m *packetMux) expire(idleSince time.Time) {
+	var idle []*packetConn
+	m.mu.Lock()
+	for _, p := range m.peers {
+		if p.incoming && p.lastActive().Before(idleSince) {
+			idle = append(idle, p)
+		}
+	}
+	m.mu.Unlock()
+	for _, p := range idle {
+		log.WithField("peer", p.raddr.String()).Debug("Closing idle packet peer")
+		p.Close()
+	}
+}
+
+func peerKey(addr net.Addr, tag string) string {
+	return addr.String() + "/" + tag
+}
+
+// listen makes datagrams from unknown peers create new connections.
+func (m *packetMux) listen() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.listening = true
+}
+
+// Accept returns the connection of the next new peer.
+func (m *packetMux) Accept() (net.Conn, error) {
+	return m.accept.Accept()
+}
+
+// Connect returns a connection to addr which is not returned by Accept.
+func (m *packetMux) Connect(addr net.Addr) net.Conn {
+	return m.connect(addr, "")
+}
+
+// connect returns the connection to addr for datagrams with the given tag.
+func (m *packetMux) connect(addr net.Addr, tag string) *packetConn {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if p, ok := m.peers[peerKey(addr, tag)]; ok {
+		return p
+	}
+	p := newPacketConn(m, addr, tag)
+	m.peers[p.key()] = p
+	return p
+}
+
+func (m *packetMux) remove(p *packetConn) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.peers[p.key()] == p {
+		delete(m.peers, p.key())
+	}
+}
+
+// Close closes the PacketConn and every connection.
+func (m *packetMux) Close() error {
+	m.accept.Close()
+	return m.PacketConn.Close()
+}
+
+// Addr returns the local address of the PacketConn.
+func (m *packetMux) Addr() net.Addr {
+	return m.PacketConn.LocalAddr()
+}
+
+// packetConn is one peer of a packetMux. Each Read returns one datagram.
+type packetConn struct {
+	mux   *packetMux
+	raddr net.Addr
+	tag   string
+	// incoming is set for the connections of peers which contacted the
+	// mux, which closes them when they are idle
+	incoming      bool
+	active        atomic.Int64
+	in            chan []byte
+	closed        chan struct{}
+	once          sync.Once
+	readDeadline  *deadline
+	writeDeadline *deadline
+}
+
+func newPacketConn(m *packetMux, raddr net.Addr, tag string) *packetConn {
+	p := &packetConn{
+		mux:           m,
+		raddr:         raddr,
+		tag:           tag,
+		in:            make(chan []byte, PACKET_QUEUE_LENGTH),
+		closed:        make(chan struct{}),
+		readDeadline:  newDeadline(),
+		writeDeadline: newDeadline(),
+	}
+	p.touch()
+	return p
+}
+
+func (p *packetConn) key() string {
+	return peerKey(p.raddr, p.tag)
+}
+
+// touch records a datagram from or to the peer.
+func (p *packetConn) touch() {
+	p.active.Store(time.Now().UnixNano())
+}
+
+// lastActive returns when the last datagram from or to the peer was seen.
+func (p *packetConn) lastActive() time.Time {
+	return time.Unix(0, p.active.Load())
+}
+
+func (p *packetConn) push(data []byte) {
+	p.touch()
+	select {
+	case p.in <- data:
+	case <-p.closed:
+	default:
+		log.WithFields(logrus.Fields{
+			"peer": p.raddr.String(),
+			"size": len(data),
+		}).Debug("Packet queue full, dropping datagram")
+	}
+}
+
+func (p *packetConn) Read(b []byte) (int, error) {
+	select {
+	case data := <-p.in:
+		return copy(b, data), nil
+	case <-p.closed:
+		return 0, net.ErrClosed
+	case <-p.readDeadline.wait():
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+func (p *packetConn) Write(b []byte) (int, error) {
+	select {
+	case <-p.closed:
+		return 0, net.ErrClosed
+	case <-p.writeDeadline.wait():
+		return 0, os.ErrDeadlineExceeded
+	default:
+	}
+	p.touch()
+	return p.mux.WriteTo(b, p.raddr)
+}
+
+func (p *packetConn) closeLocal() {
+	p.once.Do(func() {
+		close(p.closed)
+	})
+}
+
+// Close removes the connection from its mux. The underlying PacketConn
+// stays open.
+func (p *packetConn) Close() error {
+	p.closeLocal()
+	p.mux.remove(p)
+	return nil
+}
+
+func (p *packetConn) LocalAddr() net.Addr {
+	return p.mux.LocalAddr()
+}
+
+func (p *packetConn) RemoteAddr() net.Addr {
+	return p.raddr
+}
+
+func (p *packetConn) SetDeadline(t time.Time) error {
+	p.readDeadline.set(t)
+	p.writeDeadline.set(t)
+	return nil
+}
+
+func (p *packetConn) SetReadDeadline(t time.Time) error {
+	p.readDeadline.set(t)
+	return nil
+}
+
+func (p *packetConn) SetWriteDeadline(t time.Time) error {
+	p.writeDeadline.set(t)
+	return nil
+}
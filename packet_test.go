@@ -0,0 +1,72 @@
+//go:build !gen
+// +build !gen
+
+package onramp
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPacketMuxPeers(t *testing.T) {
+	defer func(n int) { PACKET_MAX_PENDING_PEERS = n }(PACKET_MAX_PENDING_PEERS)
+	PACKET_MAX_PENDING_PEERS = 2
+	defer func(timeout time.Duration) { TLS_HANDSHAKE_TIMEOUT = timeout }(TLS_HANDSHAKE_TIMEOUT)
+	TLS_HANDSHAKE_TIMEOUT = time.Second
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := newPacketMux(server)
+	defer m.Close()
+	m.listen()
+	peers := func() int {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return len(m.peers)
+	}
+	send := func() net.PacketConn {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { pc.Close() })
+		if _, err := pc.WriteTo([]byte("hello"), server.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+		return pc
+	}
+
+	// nobody accepts, so only two peers are kept until they are closed
+	for i := 0; i < 3; i++ {
+		send()
+	}
+	time.Sleep(200 * time.Millisecond)
+	if n := peers(); n != 2 {
+		t.Errorf("%d unaccepted peers", n)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if n := peers(); n != 0 {
+		t.Errorf("%d unaccepted peers weren't closed", n)
+	}
+
+	send()
+	conn, err := m.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Read(make([]byte, 8)); err != nil {
+		t.Fatal(err)
+	}
+	connected := m.Connect(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9})
+	m.expire(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 8)); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("read %v from an idle peer, want net.ErrClosed", err)
+	}
+	if n := peers(); n != 1 {
+		t.Errorf("%d peers, the idle peer wasn't removed or the connected one was", n)
+	}
+	connected.Close()
+}
@@ -0,0 +1,62 @@
+package onramp
+
+import (
+	"crypto/tls"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// ALPN_QUIC is the ALPN protocol offered over QUIC when NextProtos is
+// empty. QUIC requires one.
+const ALPN_QUIC = "onramp"
+
+// QUIC_SESSION_CACHE_SIZE is the number of servers a Garlic remembers TLS
+// session tickets for, which lets DialQUIC resume with 0-RTT.
+var QUIC_SESSION_CACHE_SIZE = 64
+
+// DefaultQUICConfig returns the QUIC configuration onramp uses over hidden
+// services. The timeouts are longer than quic-go's defaults because of the
+// latency of tunnels, path MTU discovery is disabled because datagram
+// sizes don't follow the IP path, and 0-RTT is accepted.
+func DefaultQUICConfig() *quic.Config {
+	return &quic.Config{
+		HandshakeIdleTimeout:    TLS_HANDSHAKE_TIMEOUT,
+		MaxIdleTimeout:          2 * time.Minute,
+		KeepAlivePeriod:         30 * time.Second,
+		DisablePathMTUDiscovery: true,
+		Allow0RTT:               true,
+	}
+}
+
+func quicProtos(protos []string) []string {
+	if len(protos) == 0 {
+		return []string{ALPN_QUIC}
+	}
+	return protos
+}
+
+// quicServerConfig returns the TLS configuration for serving cert over
+// QUIC, which only supports TLS 1.3.
+func quicServerConfig(cert tls.Certificate, protos []string) *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   quicProtos(protos),
+		MinVersion:   tls.VersionTLS13,
+	}
+}
+
+// quicClientConfig returns the TLS configuration for connecting to host
+// over QUIC, with the same certificate checks as DialTLS. Tickets are kept
+// in sessions for 0-RTT resumption.
+func quicClientConfig(config *tls.Config, host string, protos []string, sessions tls.ClientSessionCache) *tls.Config {
+	cfg := tlsClientConfig(config, host)
+	if len(cfg.NextProtos) == 0 {
+		cfg.NextProtos = quicProtos(protos)
+	}
+	if cfg.ClientSessionCache == nil {
+		cfg.ClientSessionCache = sessions
+	}
+	cfg.MinVersion = tls.VersionTLS13
+	return cfg
+}
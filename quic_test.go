@@ -0,0 +1,90 @@
+//go:build !gen
+// +build !gen
+
+package onramp
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/quic-go/quic-go"
+)
+
+func TestQUIC(t *testing.T) {
+	defer func(path string) { TLS_KEYSTORE_PATH = path }(TLS_KEYSTORE_PATH)
+	TLS_KEYSTORE_PATH = t.TempDir()
+	const host = "quic.example.i2p"
+	cert, err := TLSKeysWithProfile(host, &CertProfile{KeyAlgorithm: CERT_KEY_ECDSA_P256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := func() *quic.Transport {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr := &quic.Transport{Conn: pc}
+		t.Cleanup(func() { tr.Close() })
+		return tr
+	}
+	server := transport()
+	l, err := server.ListenEarly(quicServerConfig(cert, nil), DefaultQUICConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			go func() {
+				for {
+					stream, err := conn.AcceptStream(context.Background())
+					if err != nil {
+						return
+					}
+					go func() {
+						io.Copy(stream, stream)
+						stream.Close()
+					}()
+				}
+			}()
+		}
+	}()
+
+	client := transport()
+	sessions := tls.NewLRUClientSessionCache(1)
+	for i := 0; i < 2; i++ {
+		conn, err := client.DialEarly(context.Background(), server.Conn.LocalAddr(), quicClientConfig(nil, host, nil, sessions), DefaultQUICConfig())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, msg := range []string{"one", "two"} {
+			stream, err := conn.OpenStreamSync(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			stream.Write([]byte(msg))
+			stream.Close()
+			got, err := io.ReadAll(stream)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != msg {
+				t.Errorf("echoed %q, want %q", got, msg)
+			}
+		}
+		<-conn.HandshakeComplete()
+		if used := conn.ConnectionState().Used0RTT; used != (i == 1) {
+			t.Errorf("dial %d: used 0-RTT %v", i, used)
+		}
+		if proto := conn.ConnectionState().TLS.NegotiatedProtocol; proto != ALPN_QUIC {
+			t.Errorf("negotiated %q", proto)
+		}
+		conn.CloseWithError(0, "")
+	}
+}
@@ -0,0 +1,261 @@
+package onramp
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-i2p/i2pkeys"
+	"github.com/go-i2p/sam3"
+	"github.com/sirupsen/logrus"
+)
+
+// RAW_PROTOCOL is the I2CP protocol number of raw datagrams when none is
+// given.
+const RAW_PROTOCOL = 18
+
+// rawHeaderSize is room for the header line the SAM bridge puts before
+// every raw datagram when HEADER=true.
+const rawHeaderSize = 64
+
+// RawAddr describes where a raw datagram came from. Raw datagrams carry no
+// sender identity, only their I2CP ports and protocol, so a RawAddr can't
+// be replied to.
+type RawAddr struct {
+	Protocol int
+	FromPort int
+	ToPort   int
+}
+
+func (a *RawAddr) Network() string {
+	return "i2p-raw"
+}
+
+func (a *RawAddr) String() string {
+	return fmt.Sprintf("protocol=%d from=%d to=%d", a.Protocol, a.FromPort, a.ToPort)
+}
+
+// parseRawHeader splits a datagram forwarded by the SAM bridge into its
+// header and payload.
+func parseRawHeader(b []byte) (*RawAddr, []byte, error) {
+	i := bytes.IndexByte(b, '\n')
+	if i < 0 {
+		return nil, nil, fmt.Errorf("onramp: raw datagram without header")
+	}
+	addr := &RawAddr{}
+	for _, field := range strings.Fields(string(b[:i])) {
+		key, value, _ := strings.Cut(field, "=")
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, nil, fmt.Errorf("onramp: bad raw datagram header %q", b[:i])
+		}
+		switch key {
+		case "PROTOCOL":
+			addr.Protocol = n
+		case "FROM_PORT":
+			addr.FromPort = n
+		case "TO_PORT":
+			addr.ToPort = n
+		}
+	}
+	return addr, b[i+1:], nil
+}
+
+// RawConn is a SAM RAW session. Raw datagrams are not signed and carry no
+// sender, which makes them cheaper than repliable datagrams for
+// fire-and-forget traffic like announcements. RawConn is a net.PacketConn,
+// ReadFrom returns a *RawAddr and WriteTo needs an i2pkeys.I2PAddr. It is
+// also a net.Conn when it was dialed.
+type RawConn struct {
+	// control is the session's own control connection, or nil for a
+	// subsession of primary.
+	control  *samConn
+	primary  *samConn
+	udp      *net.UDPConn
+	bridge   *net.UDPAddr
+	id       string
+	keys     i2pkeys.I2PKeys
+	protocol int
+	remote   net.Addr
+}
+
+// newRawConn creates a RAW session named id on the SAM bridge at samAddr,
+// which sends and receives datagrams of protocol. If keys is nil the
+// session gets a new destination.
+func newRawConn(samAddr, id string, keys *i2pkeys.I2PKeys, protocol int, options []string) (*RawConn, error) {
+	control, err := dialSAM(samAddr)
+	if err != nil {
+		return nil, err
+	}
+	if keys == nil {
+		generated, err := control.generateKeys(sam3.Sig_EdDSA_SHA512_Ed25519)
+		if err != nil {
+			control.Close()
+			return nil, fmt.Errorf("onramp newRawConn: %v", err)
+		}
+		keys = &generated
+	}
+	c, err := openRawConn(control, samAddr, "CREATE", id, fmt.Sprintf("DESTINATION=%s", keys.String()), protocol, options)
+	if err != nil {
+		control.Close()
+		return nil, err
+	}
+	c.control = control
+	c.keys = *keys
+	return c, nil
+}
+
+// newRawSubSession adds a RAW subsession named id to the primary session
+// controlled by primary, whose destination is keys. Closing it removes
+// the subsession and leaves the primary session open.
+func newRawSubSession(primary *samConn, samAddr, id string, keys i2pkeys.I2PKeys, protocol int) (*RawConn, error) {
+	c, err := openRawConn(primary, samAddr, "ADD", id, "", protocol, nil)
+	if err != nil {
+		return nil, err
+	}
+	c.primary = primary
+	c.keys = keys
+	return c, nil
+}
+
+// openRawConn binds the UDP socket of a RAW session and sends the SESSION
+// CREATE or ADD command for it over control.
+func openRawConn(control *samConn, samAddr, verb, id, dest string, protocol int, options []string) (*RawConn, error) {
+	if protocol == 0 {
+		protocol = RAW_PROTOCOL
+	}
+	log.WithFields(logrus.Fields{
+		"id":       id,
+		"protocol": protocol,
+		"command":  verb,
+	}).Debug("Creating raw session")
+	bridge, err := samBridgeUDPAddr(samAddr)
+	if err != nil {
+		return nil, err
+	}
+	lhost, err := localIPFor(bridge)
+	if err != nil {
+		return nil, fmt.Errorf("onramp openRawConn: %v", err)
+	}
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: lhost})
+	if err != nil {
+		return nil, err
+	}
+	reply, err := control.command("SESSION %s STYLE=RAW ID=%s %s PORT=%d HOST=%s PROTOCOL=%d HEADER=true %s",
+		verb, id, dest, udp.LocalAddr().(*net.UDPAddr).Port, lhost, protocol, sam3.GenerateOptionString(options))
+	if err == nil {
+		err = reply.err()
+	}
+	if err != nil {
+		log.WithError(err).Error("Failed to create raw session")
+		udp.Close()
+		return nil, fmt.Errorf("onramp openRawConn: %v", err)
+	}
+	log.WithField("id", id).Debug("Raw session created")
+	return &RawConn{
+		udp:      udp,
+		bridge:   bridge,
+		id:       id,
+		protocol: protocol,
+	}, nil
+}
+
+// ReadFrom reads one raw datagram. The address is a *RawAddr.
+// implements net.PacketConn
+func (c *RawConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buf := make([]byte, len(b)+rawHeaderSize)
+	for {
+		n, from, err := c.udp.ReadFromUDP(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		// only the bridge forwards datagrams
+		if !from.IP.Equal(c.bridge.IP) {
+			log.WithField("from", from.String()).Debug("Dropping datagram which doesn't come from the SAM bridge")
+			continue
+		}
+		addr, payload, err := parseRawHeader(buf[:n])
+		if err != nil {
+			log.WithError(err).Debug("Dropping raw datagram")
+			continue
+		}
+		return copy(b, payload), addr, nil
+	}
+}
+
+// WriteTo sends b as one raw datagram to addr, which must be an
+// i2pkeys.I2PAddr.
+// implements net.PacketConn
+func (c *RawConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	dest, ok := addr.(i2pkeys.I2PAddr)
+	if !ok {
+		return 0, fmt.Errorf("onramp: can't send raw datagrams to %s address %s", addr.Network(), addr.String())
+	}
+	header := fmt.Sprintf("3.0 %s %s PROTOCOL=%d\n", c.id, dest.Base64(), c.protocol)
+	if _, err := c.udp.WriteToUDP(append([]byte(header), b...), c.bridge); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Read reads one raw datagram.
+// implements net.Conn
+func (c *RawConn) Read(b []byte) (int, error) {
+	n, _, err := c.ReadFrom(b)
+	return n, err
+}
+
+// Write sends b as one raw datagram to the dialed address.
+// implements net.Conn
+func (c *RawConn) Write(b []byte) (int, error) {
+	if c.remote == nil {
+		return 0, fmt.Errorf("onramp: raw session %s was not dialed", c.id)
+	}
+	return c.WriteTo(b, c.remote)
+}
+
+// Close closes the session. A subsession is removed from its primary
+// session.
+func (c *RawConn) Close() error {
+	if err := c.udp.Close(); err != nil {
+		return err
+	}
+	if c.control != nil {
+		return c.control.Close()
+	}
+	reply, err := c.primary.command("SESSION REMOVE ID=%s", c.id)
+	if err != nil {
+		return err
+	}
+	return reply.err()
+}
+
+// LocalAddr returns the destination of the session.
+func (c *RawConn) LocalAddr() net.Addr {
+	return c.keys.Addr()
+}
+
+// RemoteAddr returns the dialed destination, or nil.
+func (c *RawConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// Protocol returns the I2CP protocol of the session's datagrams.
+func (c *RawConn) Protocol() int {
+	return c.protocol
+}
+
+func (c *RawConn) SetDeadline(t time.Time) error {
+	return c.udp.SetDeadline(t)
+}
+
+func (c *RawConn) SetReadDeadline(t time.Time) error {
+	return c.udp.SetReadDeadline(t)
+}
+
+func (c *RawConn) SetWriteDeadline(t time.Time) error {
+	return c.udp.SetWriteDeadline(t)
+}
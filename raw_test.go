@@ -0,0 +1,161 @@
+//go:build !gen
+// +build !gen
+
+package onramp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-i2p/i2pkeys"
+)
+
+func TestRawConn(t *testing.T) {
+	sam := newFakeSAM(t)
+	keys := i2pkeys.NewKeys("fakelistener", "fakelistener-priv")
+	listener, err := newRawConn(sam.Addr(), "listener", &keys, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	other, err := newRawConn(sam.Addr(), "other", &keys, 20, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	dialer, err := newRawConn(sam.Addr(), "dialer", nil, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dialer.Close()
+	if dialer.LocalAddr().String() == keys.Addr().String() {
+		t.Error("dialer did not get its own destination")
+	}
+	dialer.remote = keys.Addr()
+
+	if _, err := dialer.Write([]byte("beacon")); err != nil {
+		t.Fatal(err)
+	}
+	listener.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 64)
+	n, addr, err := listener.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "beacon" {
+		t.Errorf("read %q", buf[:n])
+	}
+	if raw := addr.(*RawAddr); raw.Protocol != RAW_PROTOCOL {
+		t.Errorf("read from %s", raw)
+	}
+
+	// the session for protocol 20 must not see protocol 18 datagrams
+	other.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, _, err := other.ReadFrom(buf); err == nil {
+		t.Error("received a datagram of another protocol")
+	}
+	if _, err := listener.Write([]byte("x")); err == nil {
+		t.Error("wrote to a session which was not dialed")
+	}
+}
+
+func TestRawSubSession(t *testing.T) {
+	sam := newFakeSAM(t)
+	keys := i2pkeys.NewKeys("fakeprimary", "fakeprimary-priv")
+	primary, err := dialSAM(sam.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primary.Close()
+	reply, err := primary.command("SESSION CREATE STYLE=PRIMARY ID=primary DESTINATION=%s", keys.String())
+	if err == nil {
+		err = reply.err()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := newRawSubSession(primary, sam.Addr(), "primary-raw", keys, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer, err := newRawConn(sam.Addr(), "dialer", nil, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dialer.Close()
+	if _, err := dialer.WriteTo([]byte("beacon"), keys.Addr()); err != nil {
+		t.Fatal(err)
+	}
+	sub.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 64)
+	n, _, err := sub.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "beacon" {
+		t.Errorf("read %q", buf[:n])
+	}
+	if sub.LocalAddr().String() != keys.Addr().String() {
+		t.Errorf("subsession has destination %s", sub.LocalAddr())
+	}
+
+	// removing the subsession leaves the primary session usable
+	if err := sub.Close(); err != nil {
+		t.Fatal(err)
+	}
+	again, err := newRawSubSession(primary, sam.Addr(), "primary-raw", keys, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := again.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGarlicRaw(t *testing.T) {
+	localKeygen(t)
+	tempKeystores(t)
+	sam := newFakeSAM(t)
+	listener := &Garlic{name: "listener", addr: sam.Addr()}
+	defer listener.Close()
+	conn, err := listener.ListenRaw(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer := &Garlic{name: "dialer", addr: sam.Addr()}
+	defer dialer.Close()
+	dialed, err := dialer.DialRaw(0, listener.ServiceKeys.Addr().Base32())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the dialed session is a subsession of the dialer's primary session
+	if dialed.LocalAddr().String() != dialer.ServiceKeys.Addr().String() {
+		t.Errorf("dialed from %s", dialed.LocalAddr())
+	}
+	if _, err := dialed.Write([]byte("beacon")); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 64)
+	if n, err := conn.Read(buf); err != nil || string(buf[:n]) != "beacon" {
+		t.Errorf("read %q, %v", buf[:n], err)
+	}
+	sam.mu.Lock()
+	defer sam.mu.Unlock()
+	if sam.primaries != 2 {
+		t.Errorf("created %d primary sessions", sam.primaries)
+	}
+}
+
+func TestParseRawHeader(t *testing.T) {
+	addr, payload, err := parseRawHeader([]byte("FROM_PORT=1 TO_PORT=2 PROTOCOL=18\nhello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *addr != (RawAddr{Protocol: 18, FromPort: 1, ToPort: 2}) || string(payload) != "hello" {
+		t.Errorf("parsed %v %q", addr, payload)
+	}
+	if _, _, err := parseRawHeader([]byte("no header")); err == nil {
+		t.Error("parsed a datagram without header")
+	}
+}
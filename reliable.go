@@ -0,0 +1,464 @@
+package onramp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/xtaci/kcp-go/v5"
+)
+
+// RELIABLE_INTERVAL is how often a reliable connection flushes queued
+// segments, acknowledgements and retransmissions.
+var RELIABLE_INTERVAL = 20 * time.Millisecond
+
+// RELIABLE_WINDOW is the send and receive window of a reliable connection,
+// in segments.
+var RELIABLE_WINDOW = 128
+
+// RELIABLE_IDLE_TIMEOUT is how long a reliable connection waits without
+// hearing from its peer before it fails. Keepalives are sent four times
+// per timeout.
+var RELIABLE_IDLE_TIMEOUT = 2 * time.Minute
+
+// RELIABLE_DIAL_TIMEOUT is how long DialReliable waits for the peer to
+// answer.
+var RELIABLE_DIAL_TIMEOUT = 2 * time.Minute
+
+// RELIABLE_RETRY_INTERVAL is how often the unacknowledged control
+// datagrams which open and close a reliable connection are repeated.
+var RELIABLE_RETRY_INTERVAL = 3 * time.Second
+
+// RELIABLE_LINGER is how long Close waits for unacknowledged data to be
+// delivered.
+var RELIABLE_LINGER = 30 * time.Second
+
+// RELIABLE_MTU is the largest datagram a reliable connection sends. It is
+// limited by the KCP implementation.
+const RELIABLE_MTU = kcp.IKCP_MTU_DEF
+
+// Control datagrams are the conversation ID followed by one of these
+// commands, which don't collide with KCP's.
+const (
+	reliableCmdSyn  = 0x10
+	reliableCmdPing = 0x11
+	reliableCmdFin  = 0x12
+	reliableCmdAck  = 0x13
+)
+
+// reliableMessageSize is the largest message handed to KCP at once, its
+// fragments must fit in the receive window.
+const reliableMessageSize = (RELIABLE_MTU - kcp.IKCP_OVERHEAD) * 32
+
+var errReliableTimeout = fmt.Errorf("onramp: reliable connection timed out")
+
+// reliableTag separates the datagrams of a peer by KCP conversation ID, so
+// a peer can have several reliable connections.
+func reliableTag(data []byte) string {
+	if len(data) < 4 {
+		return ""
+	}
+	return string(data[:4])
+}
+
+func newReliableMux(pc net.PacketConn) *packetMux {
+	return newTaggedPacketMux(pc, reliableTag)
+}
+
+// ReliableListener accepts reliable, ordered connections carried over the
+// datagrams of a packet session. The connections use KCP for
+// retransmission and congestion control. Opening one takes a single round
+// trip, the dialer's SYN and the listener's PING answering it, which makes
+// them a low-latency alternative to I2P streaming. Connections which
+// aren't accepted within TLS_HANDSHAKE_TIMEOUT are closed.
+type ReliableListener struct {
+	mux    *packetMux
+	accept *virtualListener
+}
+
+// NewReliableListener returns a ReliableListener for the peers of pc. It
+// takes over reading from pc.
+func NewReliableListener(pc net.PacketConn) *ReliableListener {
+	return newReliableListener(newReliableMux(pc))
+}
+
+func newReliableListener(mux *packetMux) *ReliableListener {
+	log.WithField("address", mux.Addr().String()).Debug("Creating reliable listener")
+	l := &ReliableListener{
+		mux:    mux,
+		accept: newVirtualListener(mux.Addr()),
+	}
+	mux.listen()
+	go l.serve()
+	return l
+}
+
+func (l *ReliableListener) serve() {
+	for {
+		conn, err := l.mux.Accept()
+		if err != nil {
+			log.WithError(err).Debug("Reliable listener stopped accepting")
+			l.accept.Close()
+			return
+		}
+		go l.open(conn.(*packetConn))
+	}
+}
+
+// open starts a reliable connection for a new peer if its first datagram
+// is a SYN. Anything else is a leftover of a closed connection.
+func (l *ReliableListener) open(p *packetConn) {
+	buf := make([]byte, MAX_DATAGRAM_SIZE)
+	p.SetReadDeadline(time.Now().Add(RELIABLE_RETRY_INTERVAL))
+	n, err := p.Read(buf)
+	if err != nil || n != 5 || buf[4] != reliableCmdSyn {
+		p.Close()
+		return
+	}
+	p.SetReadDeadline(time.Time{})
+	c := newReliableConn(p, binary.LittleEndian.Uint32(buf[:4]))
+	c.control(reliableCmdPing)
+	if !l.accept.deliverTimeout(c, TLS_HANDSHAKE_TIMEOUT) {
+		log.WithField("peer", p.RemoteAddr().String()).Debug("Closing unaccepted reliable connection")
+		c.Close()
+	}
+}
+
+// Accept returns the next reliable connection.
+// implements net.Listener
+func (l *ReliableListener) Accept() (net.Conn, error) {
+	return l.accept.Accept()
+}
+
+// Close closes the listener and the packet session it reads from.
+// implements net.Listener
+func (l *ReliableListener) Close() error {
+	l.accept.Close()
+	return l.mux.Close()
+}
+
+// implements net.Listener
+func (l *ReliableListener) Addr() net.Addr {
+	return l.mux.Addr()
+}
+
+// Dial opens a reliable connection to addr over the listener's packet
+// session.
+func (l *ReliableListener) Dial(addr net.Addr) (net.Conn, error) {
+	return dialReliable(l.mux, addr)
+}
+
+func dialReliable(mux *packetMux, addr net.Addr) (net.Conn, error) {
+	var id [4]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	conv := binary.LittleEndian.Uint32(id[:])
+	log.WithFields(logrus.Fields{
+		"address":      addr.String(),
+		"conversation": conv,
+	}).Debug("Dialing reliable connection")
+	c := newReliableConn(mux.connect(addr, string(id[:])), conv)
+	timeout := time.NewTimer(RELIABLE_DIAL_TIMEOUT)
+	defer timeout.Stop()
+	for {
+		c.control(reliableCmdSyn)
+		select {
+		case <-c.established:
+			return c, nil
+		case <-time.After(RELIABLE_RETRY_INTERVAL):
+		case <-timeout.C:
+			c.shutdown(errReliableTimeout)
+			return nil, errReliableTimeout
+		}
+	}
+}
+
+// reliableConn is a KCP conversation over a packetConn.
+type reliableConn struct {
+	conn *packetConn
+	conv uint32
+
+	mu           sync.Mutex
+	kcp          *kcp.KCP
+	pending      []byte
+	lastRecv     time.Time
+	lastSend     time.Time
+	remoteClosed bool
+	err          error
+
+	readable    chan struct{}
+	writable    chan struct{}
+	established chan struct{}
+	estOnce     sync.Once
+	finAcked    chan struct{}
+	ackOnce     sync.Once
+	closed      chan struct{}
+	closeOnce   sync.Once
+	closing     sync.Once
+
+	readDeadline  *deadline
+	writeDeadline *deadline
+}
+
+func newReliableConn(conn *packetConn, conv uint32) *reliableConn {
+	now := time.Now()
+	c := &reliableConn{
+		conn:          conn,
+		conv:          conv,
+		lastRecv:      now,
+		lastSend:      now,
+		readable:      make(chan struct{}, 1),
+		writable:      make(chan struct{}, 1),
+		established:   make(chan struct{}),
+		finAcked:      make(chan struct{}),
+		closed:        make(chan struct{}),
+		readDeadline:  newDeadline(),
+		writeDeadline: newDeadline(),
+	}
+	c.kcp = kcp.NewKCP(conv, c.output)
+	c.kcp.WndSize(RELIABLE_WINDOW, RELIABLE_WINDOW)
+	c.kcp.NoDelay(0, int(RELIABLE_INTERVAL/time.Millisecond), 2, 0)
+	go c.recvLoop()
+	go c.updateLoop()
+	return c
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// output sends a KCP segment, it is called with mu held.
+func (c *reliableConn) output(buf []byte, size int) {
+	c.lastSend = time.Now()
+	if _, err := c.conn.Write(buf[:size]); err != nil {
+		log.WithError(err).Debug("Failed to send reliable segment")
+	}
+}
+
+func (c *reliableConn) control(cmd byte) {
+	var b [5]byte
+	binary.LittleEndian.PutUint32(b[:4], c.conv)
+	b[4] = cmd
+	if _, err := c.conn.Write(b[:]); err != nil {
+		log.WithError(err).Debug("Failed to send reliable control datagram")
+	}
+}
+
+func (c *reliableConn) recvLoop() {
+	buf := make([]byte, MAX_DATAGRAM_SIZE)
+	for {
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			c.shutdown(err)
+			return
+		}
+		c.estOnce.Do(func() { close(c.established) })
+		c.mu.Lock()
+		c.lastRecv = time.Now()
+		if n == 5 {
+			switch buf[4] {
+			case reliableCmdSyn:
+				c.control(reliableCmdPing)
+			case reliableCmdFin:
+				log.WithField("peer", c.conn.RemoteAddr().String()).Debug("Reliable connection closed by peer")
+				c.remoteClosed = true
+				c.control(reliableCmdAck)
+			case reliableCmdAck:
+				c.ackOnce.Do(func() { close(c.finAcked) })
+			}
+		} else if c.kcp.Input(buf[:n], true, false) < 0 {
+			log.WithField("size", n).Debug("Dropping malformed reliable segment")
+		}
+		c.mu.Unlock()
+		notify(c.readable)
+		notify(c.writable)
+	}
+}
+
+func (c *reliableConn) updateLoop() {
+	ticker := time.NewTicker(RELIABLE_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-ticker.C:
+		}
+		c.mu.Lock()
+		c.kcp.Update()
+		now := time.Now()
+		idle := now.Sub(c.lastRecv) > RELIABLE_IDLE_TIMEOUT
+		if !idle && now.Sub(c.lastSend) > RELIABLE_IDLE_TIMEOUT/4 {
+			c.lastSend = now
+			c.control(reliableCmdPing)
+		}
+		c.mu.Unlock()
+		if idle {
+			log.WithField("peer", c.conn.RemoteAddr().String()).Debug("Reliable connection timed out")
+			c.shutdown(errReliableTimeout)
+			return
+		}
+		notify(c.writable)
+	}
+}
+
+// shutdown records err as the reason the connection stopped and releases
+// its packetConn.
+func (c *reliableConn) shutdown(err error) {
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.mu.Unlock()
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	c.conn.Close()
+}
+
+func (c *reliableConn) Read(b []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		if c.err != nil {
+			err := c.err
+			c.mu.Unlock()
+			return 0, err
+		}
+		if len(c.pending) > 0 {
+			n := copy(b, c.pending)
+			c.pending = c.pending[n:]
+			c.mu.Unlock()
+			return n, nil
+		}
+		if size := c.kcp.PeekSize(); size > 0 {
+			if size <= len(b) {
+				n := c.kcp.Recv(b)
+				c.mu.Unlock()
+				return n, nil
+			}
+			msg := make([]byte, size)
+			c.kcp.Recv(msg)
+			n := copy(b, msg)
+			c.pending = msg[n:]
+			c.mu.Unlock()
+			return n, nil
+		}
+		if c.remoteClosed {
+			c.mu.Unlock()
+			return 0, io.EOF
+		}
+		c.mu.Unlock()
+		select {
+		case <-c.readable:
+		case <-c.closed:
+		case <-c.readDeadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+func (c *reliableConn) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		c.mu.Lock()
+		if c.err != nil {
+			err := c.err
+			c.mu.Unlock()
+			return written, err
+		}
+		if c.remoteClosed {
+			c.mu.Unlock()
+			return written, io.ErrClosedPipe
+		}
+		if c.kcp.WaitSnd() < 2*RELIABLE_WINDOW {
+			chunk := b
+			if len(chunk) > reliableMessageSize {
+				chunk = chunk[:reliableMessageSize]
+			}
+			c.kcp.Send(chunk)
+			c.mu.Unlock()
+			written += len(chunk)
+			b = b[len(chunk):]
+			continue
+		}
+		c.mu.Unlock()
+		select {
+		case <-c.writable:
+		case <-c.closed:
+		case <-c.writeDeadline.wait():
+			return written, os.ErrDeadlineExceeded
+		}
+	}
+	return written, nil
+}
+
+// Close waits up to RELIABLE_LINGER for written data to be acknowledged
+// and for the peer to acknowledge that the connection is closed.
+func (c *reliableConn) Close() error {
+	c.closing.Do(func() {
+		linger := time.NewTimer(RELIABLE_LINGER)
+		defer linger.Stop()
+		for {
+			c.mu.Lock()
+			done := c.err != nil || c.remoteClosed || c.kcp.WaitSnd() == 0
+			c.mu.Unlock()
+			if done {
+				break
+			}
+			select {
+			case <-c.writable:
+				continue
+			case <-c.closed:
+			case <-linger.C:
+			}
+			break
+		}
+		for {
+			c.control(reliableCmdFin)
+			select {
+			case <-time.After(RELIABLE_RETRY_INTERVAL):
+				continue
+			case <-c.finAcked:
+			case <-c.closed:
+			case <-linger.C:
+			}
+			break
+		}
+		c.shutdown(net.ErrClosed)
+	})
+	return nil
+}
+
+func (c *reliableConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *reliableConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *reliableConn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *reliableConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *reliableConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
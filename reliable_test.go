@@ -0,0 +1,97 @@
+//go:build !gen
+// +build !gen
+
+package onramp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// lossyPacketConn drops every tenth datagram it sends.
+type lossyPacketConn struct {
+	net.PacketConn
+	n int64
+}
+
+func (l *lossyPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if atomic.AddInt64(&l.n, 1)%10 == 0 {
+		return len(b), nil
+	}
+	return l.PacketConn.WriteTo(b, addr)
+}
+
+func TestReliableListener(t *testing.T) {
+	defer func(d time.Duration) { RELIABLE_RETRY_INTERVAL = d }(RELIABLE_RETRY_INTERVAL)
+	RELIABLE_RETRY_INTERVAL = 200 * time.Millisecond
+	listen := func() net.PacketConn {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &lossyPacketConn{PacketConn: pc}
+	}
+	server := NewReliableListener(listen())
+	defer server.Close()
+	client := NewReliableListener(listen())
+	defer client.Close()
+
+	payload := make([]byte, 128*1024)
+	rand.Read(payload)
+	done := make(chan struct{})
+	defer func() { <-done }()
+	go func() {
+		defer close(done)
+		conn, err := server.Accept()
+		if err != nil {
+			return
+		}
+		conn.Write(payload)
+		conn.Close()
+	}()
+
+	conn, err := client.Dial(server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("received %d bytes which differ from the %d sent", len(got), len(payload))
+	}
+}
+
+func TestReliableListenerUnaccepted(t *testing.T) {
+	defer func(timeout time.Duration) { TLS_HANDSHAKE_TIMEOUT = timeout }(TLS_HANDSHAKE_TIMEOUT)
+	TLS_HANDSHAKE_TIMEOUT = time.Second
+	listen := func() net.PacketConn {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pc
+	}
+	server := NewReliableListener(listen())
+	defer server.Close()
+	client := NewReliableListener(listen())
+	defer client.Close()
+
+	// nobody accepts, so the listener closes the connection
+	conn, err := client.Dial(server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read %v, want EOF", err)
+	}
+}
@@ -0,0 +1,501 @@
+package onramp
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cretz/bine/torutil"
+	"github.com/go-i2p/i2pkeys"
+	"github.com/sirupsen/logrus"
+)
+
+// KEY_ROTATION_OVERLAP is how long a key rotation serves both the current
+// and the successor key if it isn't given an overlap.
+var KEY_ROTATION_OVERLAP = 30 * 24 * time.Hour
+
+// MOVED_TO_PATH is where RedirectHandler serves the moved-to statement.
+var MOVED_TO_PATH = "/.well-known/onramp-moved-to"
+
+// MovedTo is a statement, signed by the key of the address From, that the
+// service moved to the address To.
+type MovedTo struct {
+	From string
+	To   string
+	Date time.Time
+	// Destination is the base64 I2P destination of From, which holds the
+	// signing key. Onion addresses hold it themselves.
+	Destination string
+	Signature   []byte
+}
+
+// signed returns the signed part of the statement.
+func (m *MovedTo) signed() string {
+	s := "onramp-moved-to: 1\n"
+	s += "from: " + m.From + "\n"
+	s += "to: " + m.To + "\n"
+	s += "date: " + m.Date.UTC().Format(time.RFC3339) + "\n"
+	if m.Destination != "" {
+		s += "destination: " + m.Destination + "\n"
+	}
+	return s
+}
+
+// String returns the statement in the text format ParseMovedTo reads.
+func (m *MovedTo) String() string {
+	return m.signed() + "signature: " + base64.StdEncoding.EncodeToString(m.Signature) + "\n"
+}
+
+// ParseMovedTo parses a statement as written by String. It doesn't verify
+// it, see Verify.
+func ParseMovedTo(s string) (*MovedTo, error) {
+	m := &MovedTo{}
+	fields := make(map[string]string)
+	scanner := bufio.NewScanner(strings.NewReader(s))
+	scanner.Buffer(nil, 64*1024)
+	for scanner.Scan() {
+		if scanner.Text() == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(scanner.Text(), ": ")
+		if !ok {
+			return nil, fmt.Errorf("onramp ParseMovedTo: invalid line %q", scanner.Text())
+		}
+		fields[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("onramp ParseMovedTo: %v", err)
+	}
+	if fields["onramp-moved-to"] != "1" {
+		return nil, fmt.Errorf("onramp ParseMovedTo: not a moved-to statement")
+	}
+	m.From, m.To, m.Destination = fields["from"], fields["to"], fields["destination"]
+	var err error
+	if m.Date, err = time.Parse(time.RFC3339, fields["date"]); err != nil {
+		return nil, fmt.Errorf("onramp ParseMovedTo: %v", err)
+	}
+	if m.Signature, err = base64.StdEncoding.DecodeString(fields["signature"]); err != nil {
+		return nil, fmt.Errorf("onramp ParseMovedTo: %v", err)
+	}
+	return m, nil
+}
+
+// Verify checks the signature of the statement with the key of From, an
+// onion address or the b32 address of Destination.
+func (m *MovedTo) Verify() error {
+	var pub ed25519.PublicKey
+	switch {
+	case strings.HasSuffix(m.From, ".onion"):
+		key, err := torutil.PublicKeyFromV3OnionServiceID(strings.TrimSuffix(m.From, ".onion"))
+		if err != nil {
+			return fmt.Errorf("onramp: %v", err)
+		}
+		pub = ed25519.PublicKey(key)
+	case strings.HasSuffix(m.From, ".b32.i2p"):
+		dest := i2pkeys.I2PAddr(m.Destination)
+		if dest.Base32() != m.From {
+			return fmt.Errorf("onramp: the destination of the statement isn't %s", m.From)
+		}
+		if sigType, err := destSigType(dest); err != nil || sigType != SIG_ED25519 {
+			return fmt.Errorf("onramp: can't verify statements of destinations of signature type %d", sigType)
+		}
+		pub = ed25519.PublicKey(dest.Bytes()[384-32 : 384])
+	default:
+		return fmt.Errorf("onramp: can't verify statements for %s", m.From)
+	}
+	if !ed25519.Verify(pub, []byte(m.signed()), m.Signature) {
+		return fmt.Errorf("onramp: invalid moved-to signature")
+	}
+	return nil
+}
+
+// KeyRotation moves a service to a successor key. Until Ends, it serves
+// both the current and the successor key, and then it closes the current
+// service and archives its key. The successor key becomes the key of the
+// service's name.
+type KeyRotation struct {
+	// From and To are the addresses of the current and the successor key.
+	From, To string
+	// Ends is when the current key is retired.
+	Ends time.Time
+
+	current   rotatingService
+	successor rotatingService
+	// sign signs with the current key.
+	sign func(m *MovedTo) error
+	// retire archives the current key and promotes the successor key.
+	retire func() error
+	// statePath is where the end of the rotation is kept across restarts,
+	// a name in keystore if that is set.
+	statePath string
+	keystore  Keystore
+
+	mu        sync.Mutex
+	listeners []*rotationListener
+	movedTo   *MovedTo
+	timer     *time.Timer
+	done      chan struct{}
+	err       error
+}
+
+// rotatingService is implemented by Garlic and Onion.
+type rotatingService interface {
+	Listen(args ...string) (net.Listener, error)
+	Close() error
+}
+
+// rotationState is kept next to the keys during a rotation.
+type rotationState struct {
+	Ends time.Time `json:"ends"`
+}
+
+// start resumes the rotation stored at statePath, or starts one which ends
+// after overlap, and retires the current key when it ends.
+func (r *KeyRotation) start(overlap time.Duration) error {
+	if overlap <= 0 {
+		overlap = KEY_ROTATION_OVERLAP
+	}
+	r.Ends = time.Now().Add(overlap)
+	if data, err := r.readState(); err == nil {
+		var state rotationState
+		if err := json.Unmarshal(data, &state); err != nil {
+			return fmt.Errorf("%s: %v", r.statePath, err)
+		}
+		r.Ends = state.Ends
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	} else if data, err := json.Marshal(rotationState{Ends: r.Ends.UTC()}); err != nil {
+		return err
+	} else if err := r.writeState(data); err != nil {
+		return err
+	}
+	log.WithFields(logrus.Fields{
+		"from": r.From,
+		"to":   r.To,
+		"ends": r.Ends,
+	}).Debug("Rotating keys")
+	r.done = make(chan struct{})
+	r.timer = time.AfterFunc(time.Until(r.Ends), func() {
+		r.Retire()
+	})
+	return nil
+}
+
+// readState reads the stored state of the rotation.
+func (r *KeyRotation) readState() ([]byte, error) {
+	if r.keystore != nil {
+		return r.keystore.Load(r.statePath)
+	}
+	return os.ReadFile(r.statePath)
+}
+
+// writeState stores the state of a new rotation.
+func (r *KeyRotation) writeState(data []byte) error {
+	if r.keystore != nil {
+		return r.keystore.Store(r.statePath, data)
+	}
+	return writeKeyFile(r.statePath, data, 0644)
+}
+
+// removeState removes the stored state of the rotation.
+func (r *KeyRotation) removeState() error {
+	if r.keystore != nil {
+		return r.keystore.Delete(r.statePath)
+	}
+	return os.Remove(r.statePath)
+}
+
+// Listen returns a net.Listener which accepts connections to both keys
+// until the current key is retired, and then only to the successor key.
+// Its address is the successor's.
+func (r *KeyRotation) Listen(args ...string) (net.Listener, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	next, err := r.successor.Listen(args...)
+	if err != nil {
+		return nil, fmt.Errorf("onramp KeyRotation.Listen: %v", err)
+	}
+	l := newRotationListener(next)
+	if r.current != nil {
+		current, err := r.current.Listen(args...)
+		if err != nil {
+			next.Close()
+			return nil, fmt.Errorf("onramp KeyRotation.Listen: %v", err)
+		}
+		l.add(current)
+	}
+	r.listeners = append(r.listeners, l)
+	return l, nil
+}
+
+// MovedTo returns the statement that the service moved from From to To,
+// signed by the current key. Only Ed25519 keys can sign it.
+func (r *KeyRotation) MovedTo() (*MovedTo, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.movedTo != nil {
+		return r.movedTo, nil
+	}
+	m := &MovedTo{From: r.From, To: r.To, Date: time.Now().UTC().Truncate(time.Second)}
+	if err := r.sign(m); err != nil {
+		return nil, fmt.Errorf("onramp MovedTo: %v", err)
+	}
+	r.movedTo = m
+	return m, nil
+}
+
+// RedirectHandler returns an http.Handler which redirects the requests to
+// the current address to the successor address with 301 Moved
+// Permanently, serves the moved-to statement at MOVED_TO_PATH, and passes
+// the other requests to next.
+func (r *KeyRotation) RedirectHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == MOVED_TO_PATH {
+			m, err := r.MovedTo()
+			if err != nil {
+				http.Error(w, "no moved-to statement", http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			fmt.Fprint(w, m.String())
+			return
+		}
+		host, port, err := net.SplitHostPort(req.Host)
+		if err != nil {
+			host, port = req.Host, ""
+		}
+		if !strings.EqualFold(host, r.From) {
+			next.ServeHTTP(w, req)
+			return
+		}
+		scheme := "http"
+		if req.TLS != nil {
+			scheme = "https"
+		}
+		to := r.To
+		if port != "" {
+			to = net.JoinHostPort(to, port)
+		}
+		http.Redirect(w, req, scheme+"://"+to+req.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// Retire ends the rotation now: it closes the current service, archives
+// its key, and makes the successor key the key of the service's name.
+func (r *KeyRotation) Retire() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.current == nil {
+		return r.err
+	}
+	r.timer.Stop()
+	log.WithFields(logrus.Fields{
+		"from": r.From,
+		"to":   r.To,
+	}).Debug("Retiring rotated key")
+	for _, l := range r.listeners {
+		l.retire()
+	}
+	if err := r.current.Close(); err != nil {
+		log.WithError(err).Warn("Failed to close the retired service")
+	}
+	r.current = nil
+	r.err = r.retire()
+	if r.err == nil {
+		r.err = r.removeState()
+	}
+	if r.err != nil {
+		log.WithError(r.err).Error("Failed to archive the rotated key")
+		r.err = fmt.Errorf("onramp Retire: %v", r.err)
+	}
+	close(r.done)
+	return r.err
+}
+
+// Done is closed when the current key has been retired.
+func (r *KeyRotation) Done() <-chan struct{} {
+	return r.done
+}
+
+// Err returns the error of retiring the current key, if any.
+func (r *KeyRotation) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+// Close closes both services without ending the rotation, which resumes
+// when the service is rotated again.
+func (r *KeyRotation) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.timer.Stop()
+	var err error
+	if r.current != nil {
+		err = r.current.Close()
+	}
+	if serr := r.successor.Close(); err == nil {
+		err = serr
+	}
+	return err
+}
+
+// archiveKeyFiles moves the files of the key name to the archive directory
+// of the keystore, and the files of the key successor to name. The first
+// extension is the key file's, which is locked meanwhile and has to exist
+// for both keys.
+func archiveKeyFiles(keystore, name, successor string, exts ...string) error {
+	for _, key := range []string{name, successor} {
+		unlock, err := lockKeyFile(filepath.Join(keystore, key+exts[0]))
+		if err != nil {
+			return err
+		}
+		defer unlock()
+		if _, err := os.Stat(filepath.Join(keystore, key+exts[0])); err != nil {
+			return err
+		}
+	}
+	archive := filepath.Join(keystore, "archive")
+	if err := os.MkdirAll(archive, 0700); err != nil {
+		return err
+	}
+	stamp := time.Now().UTC().Format("20060102T150405Z")
+	for _, ext := range exts {
+		if err := os.Rename(filepath.Join(keystore, name+ext), filepath.Join(archive, name+"-"+stamp+ext)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	for _, ext := range exts {
+		if err := os.Rename(filepath.Join(keystore, successor+ext), filepath.Join(keystore, name+ext)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// archiveKeystoreKeys is archiveKeyFiles for the key store sub, like
+// "i2pkeys", of ks: the key name is stored under sub/archive and removed,
+// and the key successor is stored as name. Only the key file with the
+// extension ext is kept in a Keystore.
+func archiveKeystoreKeys(ks Keystore, sub, name, successor, ext string) error {
+	key, next := sub+"/"+name+ext, sub+"/"+successor+ext
+	defer lockKeystoreKey(key)()
+	defer lockKeystoreKey(next)()
+	current, err := ks.Load(key)
+	if err != nil {
+		return err
+	}
+	data, err := ks.Load(next)
+	if err != nil {
+		return err
+	}
+	stamp := time.Now().UTC().Format("20060102T150405Z")
+	if err := ks.Store(sub+"/archive/"+name+"-"+stamp+ext, current); err != nil {
+		return err
+	}
+	if err := ks.Delete(key); err != nil {
+		return err
+	}
+	if err := ks.Store(key, data); err != nil {
+		return err
+	}
+	return ks.Delete(next)
+}
+
+// rotationListener accepts the connections of the listeners of both keys.
+type rotationListener struct {
+	next    net.Listener
+	conns   chan net.Conn
+	closed  chan struct{}
+	once    sync.Once
+	mu      sync.Mutex
+	current net.Listener
+}
+
+func newRotationListener(next net.Listener) *rotationListener {
+	l := &rotationListener{
+		next:   next,
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+	go l.accept(next)
+	return l
+}
+
+// add accepts the connections to the current key too.
+func (l *rotationListener) add(current net.Listener) {
+	l.mu.Lock()
+	l.current = current
+	l.mu.Unlock()
+	go l.accept(current)
+}
+
+func (l *rotationListener) accept(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			// the successor's listener failing ends the listener, the
+			// current key's is closed when it is retired
+			if ln == l.next {
+				l.Close()
+			}
+			return
+		}
+		select {
+		case l.conns <- conn:
+		case <-l.closed:
+			conn.Close()
+			return
+		}
+	}
+}
+
+// retire stops accepting connections to the current key.
+func (l *rotationListener) retire() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.current != nil {
+		l.current.Close()
+		l.current = nil
+	}
+}
+
+// Accept returns the next connection to either key.
+// implements net.Listener
+func (l *rotationListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Addr returns the successor's address.
+// implements net.Listener
+func (l *rotationListener) Addr() net.Addr {
+	return l.next.Addr()
+}
+
+// Close closes the listeners of both keys.
+// implements net.Listener
+func (l *rotationListener) Close() error {
+	var err error
+	l.once.Do(func() {
+		close(l.closed)
+		l.retire()
+		err = l.next.Close()
+	})
+	return err
+}
@@ -0,0 +1,287 @@
+//go:build !gen
+// +build !gen
+
+package onramp
+
+import (
+	stded25519 "crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cretz/bine/torutil"
+	"github.com/cretz/bine/torutil/ed25519"
+)
+
+func TestMovedTo(t *testing.T) {
+	onionKeys, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &MovedTo{
+		From: torutil.OnionServiceIDFromV3PublicKey(onionKeys.PublicKey()) + ".onion",
+		To:   strings.Repeat("b", 56) + ".onion",
+		Date: time.Now().UTC().Truncate(time.Second),
+	}
+	m.Signature = ed25519.Sign(onionKeys, []byte(m.signed()))
+	parsed, err := ParseMovedTo(m.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := parsed.Verify(); err != nil {
+		t.Error(err)
+	}
+	parsed.To = strings.Repeat("c", 56) + ".onion"
+	if err := parsed.Verify(); err == nil {
+		t.Error("verified a changed statement")
+	}
+
+	keys := testOfflineKeys(t)
+	_, _, seed, _, err := privateKeyParts(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m = &MovedTo{From: keys.Addr().Base32(), To: "new.b32.i2p", Date: time.Now(), Destination: string(keys.Addr())}
+	m.Signature = stded25519.Sign(stded25519.NewKeyFromSeed(seed), []byte(m.signed()))
+	if parsed, err := ParseMovedTo(m.String()); err != nil || parsed.Verify() != nil {
+		t.Errorf("I2P statement: %v", err)
+	}
+	m.From = testOfflineKeys(t).Addr().Base32()
+	if err := m.Verify(); err == nil {
+		t.Error("verified a statement for another destination")
+	}
+	if _, err := ParseMovedTo("hello"); err == nil {
+		t.Error("parsed an invalid statement")
+	}
+}
+
+func TestRedirectHandler(t *testing.T) {
+	r := &KeyRotation{
+		From: "old.b32.i2p",
+		To:   "new.b32.i2p",
+		sign: func(m *MovedTo) error {
+			m.Signature = []byte("signature")
+			return nil
+		},
+	}
+	h := r.RedirectHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, "served")
+	}))
+	for _, tt := range []struct {
+		host, path string
+		code       int
+		location   string
+	}{
+		{"old.b32.i2p", "/a?b=c", http.StatusMovedPermanently, "http://new.b32.i2p/a?b=c"},
+		{"OLD.b32.i2p:8080", "/", http.StatusMovedPermanently, "http://new.b32.i2p:8080/"},
+		{"new.b32.i2p", "/a", http.StatusOK, ""},
+		{"new.b32.i2p", MOVED_TO_PATH, http.StatusOK, ""},
+	} {
+		req := httptest.NewRequest("GET", "http://"+tt.host+tt.path, nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != tt.code || w.Header().Get("Location") != tt.location {
+			t.Errorf("%s%s: %d %s", tt.host, tt.path, w.Code, w.Header().Get("Location"))
+		}
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "http://new.b32.i2p"+MOVED_TO_PATH, nil))
+	if m, err := ParseMovedTo(w.Body.String()); err != nil || m.From != r.From || m.To != r.To {
+		t.Errorf("statement %q: %v", w.Body.String(), err)
+	}
+}
+
+// tcpService is a rotatingService on local TCP listeners.
+type tcpService struct {
+	listeners []net.Listener
+	closed    bool
+}
+
+func (s *tcpService) Listen(args ...string) (net.Listener, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err == nil {
+		s.listeners = append(s.listeners, l)
+	}
+	return l, err
+}
+
+func (s *tcpService) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestKeyRotation(t *testing.T) {
+	keystore := t.TempDir()
+	for _, name := range []string{"svc.key", "svc.next.key"} {
+		if err := os.WriteFile(filepath.Join(keystore, name), []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	current, successor := &tcpService{}, &tcpService{}
+	r := &KeyRotation{
+		current:   current,
+		successor: successor,
+		statePath: filepath.Join(keystore, "svc.rotation"),
+		retire: func() error {
+			return archiveKeyFiles(keystore, "svc", "svc.next", ".key")
+		},
+	}
+	if err := r.start(200 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	l, err := r.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if l.Addr() != successor.listeners[0].Addr() {
+		t.Errorf("listener address %s", l.Addr())
+	}
+	for _, addr := range []net.Addr{current.listeners[0].Addr(), successor.listeners[0].Addr()} {
+		conn, err := net.Dial("tcp", addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		if _, err := l.Accept(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case <-r.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("the rotation didn't end")
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if !current.closed || successor.closed {
+		t.Error("closed the wrong service")
+	}
+	if _, err := net.Dial("tcp", current.listeners[0].Addr().String()); err == nil {
+		t.Error("the retired key is still served")
+	}
+	if data, err := os.ReadFile(filepath.Join(keystore, "svc.key")); err != nil || string(data) != "svc.next.key" {
+		t.Errorf("promoted key %q, %v", data, err)
+	}
+	archived, _ := filepath.Glob(filepath.Join(keystore, "archive", "svc-*.key"))
+	if len(archived) != 1 {
+		t.Errorf("archived keys %v", archived)
+	}
+	if _, err := os.Stat(r.statePath); !os.IsNotExist(err) {
+		t.Errorf("rotation state wasn't removed: %v", err)
+	}
+}
+
+func TestKeyRotationResume(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "svc.rotation")
+	first := &KeyRotation{current: &tcpService{}, successor: &tcpService{}, statePath: statePath}
+	if err := first.start(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	first.Close()
+	second := &KeyRotation{current: &tcpService{}, successor: &tcpService{}, statePath: statePath}
+	if err := second.start(2 * time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	if !second.Ends.Equal(first.Ends) {
+		t.Errorf("resumed rotation ends at %s, not %s", second.Ends, first.Ends)
+	}
+}
+
+func TestRotateGarlic(t *testing.T) {
+	localKeygen(t)
+	defer func(path string) { I2P_KEYSTORE_PATH = path }(I2P_KEYSTORE_PATH)
+	I2P_KEYSTORE_PATH = t.TempDir()
+	sam := newFakeSAM(t)
+	g := &Garlic{name: "rotate", addr: sam.Addr()}
+	r, next, err := RotateGarlic(g, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.From == r.To || r.To != next.ServiceKeys.Addr().Base32() {
+		t.Errorf("rotation from %s to %s", r.From, r.To)
+	}
+	m, err := r.MovedTo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Verify(); err != nil {
+		t.Error(err)
+	}
+	if err := r.Retire(); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := I2PKeys("rotate", sam.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys.Addr() != next.ServiceKeys.Addr() || next.getName() != "rotate" {
+		t.Error("the successor key wasn't promoted")
+	}
+}
+
+func TestRotateKeystore(t *testing.T) {
+	kv := newFakeKV(t, "token")
+	useKeystore(t, &HTTPKeystore{URL: kv.URL, Token: "token", Prefix: "onramp"})
+	sam := newFakeSAM(t)
+	g := &Garlic{name: "rotate", addr: sam.Addr()}
+	r, next, err := RotateGarlic(g, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := &Onion{name: "rotate"}
+	onionRotation, nextOnion, err := RotateOnion(o, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"i2pkeys/rotate.next.i2p.private", "i2pkeys/rotate.i2p.rotation", "onionkeys/rotate.next.tor.private", "onionkeys/rotate.tor.rotation"} {
+		if _, ok := kv.secrets["onramp/"+name]; !ok {
+			t.Errorf("%s isn't in the keystore", name)
+		}
+	}
+	if err := r.Retire(); err != nil {
+		t.Fatal(err)
+	}
+	if err := onionRotation.Retire(); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := I2PKeys("rotate", sam.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys.Addr() != next.ServiceKeys.Addr() || next.getName() != "rotate" {
+		t.Error("the successor I2P keys weren't promoted")
+	}
+	torKeys, err := TorKeys("rotate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if torutil.OnionServiceIDFromV3PublicKey(torKeys.PublicKey())+".onion" != onionRotation.To || nextOnion.getName() != "rotate" {
+		t.Error("the successor Tor key wasn't promoted")
+	}
+	var archived []string
+	for name := range kv.secrets {
+		if strings.Contains(name, "/archive/") {
+			archived = append(archived, name)
+		} else if strings.Contains(name, ".next.") || strings.HasSuffix(name, ".rotation") {
+			t.Errorf("%s is still in the keystore", name)
+		}
+	}
+	if len(archived) != 2 {
+		t.Errorf("archived %v", archived)
+	}
+	for _, dir := range []string{I2P_KEYSTORE_PATH, ONION_KEYSTORE_PATH} {
+		if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+			t.Errorf("wrote %v to the local disk", entries)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package onramp
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/go-i2p/i2pkeys"
+	"github.com/go-i2p/sam3"
+	"github.com/sirupsen/logrus"
+)
+
+// SAM_UDP_PORT is the port the SAM bridge receives datagrams on, on the
+// same host as its TCP port.
+var SAM_UDP_PORT = 7655
+
+// samConn is a SAM control connection, used for the primary session and
+// the commands and options sam3 doesn't support.
+type samConn struct {
+	net.Conn
+	mu sync.Mutex
+	r  *bufio.Reader
+}
+
+// samReply is a parsed SAM reply line, for instance
+// "SESSION STATUS RESULT=OK DESTINATION=...".
+type samReply struct {
+	Topic string
+	Type  string
+	Pairs map[string]string
+}
+
+// dialSAM connects to the SAM bridge at addr and negotiates SAM 3.1 or
+// later.
+func dialSAM(addr string) (*samConn, error) {
+	log.WithField("address", addr).Debug("Connecting to SAM bridge")
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("onramp dialSAM: %v", err)
+	}
+	c := &samConn{Conn: conn, r: bufio.NewReader(conn)}
+	reply, err := c.command("HELLO VERSION MIN=3.1 MAX=3.3")
+	if err == nil {
+		err = reply.err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("onramp dialSAM: %v", err)
+	}
+	log.WithField("version", reply.Pairs["VERSION"]).Debug("SAM bridge connected")
+	return c, nil
+}
+
+// command sends one command line and reads the reply line.
+func (c *samConn) command(format string, args ...interface{}) (*samReply, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	line := fmt.Sprintf(format, args...)
+	if _, err := c.Write([]byte(line + "\n")); err != nil {
+		return nil, err
+	}
+	reply, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	return parseSAMReply(reply), nil
+}
+
+// readLine reads one line which isn't the answer to a command, for
+// instance the peer line of a STREAM ACCEPT.
+func (c *samConn) readLine() (string, error) {
+	line, err := c.r.ReadString('\n')
+	return strings.TrimRight(line, "\r\n"), err
+}
+
+// generateKeys asks the bridge for a new destination. sigType is one of
+// sam3's Sig_ constants.
+func (c *samConn) generateKeys(sigType string) (i2pkeys.I2PKeys, error) {
+	reply, err := c.command("DEST GENERATE %s", sigType)
+	if err != nil {
+		return i2pkeys.I2PKeys{}, err
+	}
+	if reply.Pairs["PUB"] == "" || reply.Pairs["PRIV"] == "" {
+		return i2pkeys.I2PKeys{}, fmt.Errorf("onramp: SAM DEST GENERATE failed: %s %s", reply.Pairs["RESULT"], reply.Pairs["MESSAGE"])
+	}
+	return i2pkeys.NewKeys(i2pkeys.I2PAddr(reply.Pairs["PUB"]), reply.Pairs["PRIV"]), nil
+}
+
+// lookup resolves an I2P host name or b32 address to a destination.
+func (c *samConn) lookup(name string) (i2pkeys.I2PAddr, error) {
+	reply, err := c.command("NAMING LOOKUP NAME=%s", name)
+	if err == nil {
+		err = reply.err()
+	}
+	if err != nil {
+		return "", fmt.Errorf("onramp: looking up %s: %v", name, err)
+	}
+	return i2pkeys.I2PAddr(reply.Pairs["VALUE"]), nil
+}
+
+// primarySession is a SAM PRIMARY session on its own control connection.
+// Its subsessions share its destination and tunnels. They are added and
+// removed with commands on the control connection, and closing it ends
+// them all.
+type primarySession struct {
+	*samConn
+	samAddr string
+	keys    i2pkeys.I2PKeys
+}
+
+// newPrimarySession creates the primary session named id for keys on the
+// SAM bridge at samAddr.
+func newPrimarySession(samAddr, id string, keys i2pkeys.I2PKeys, options []string) (*primarySession, error) {
+	control, err := dialSAM(samAddr)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := control.command("SESSION CREATE STYLE=PRIMARY ID=%s DESTINATION=%s %s", id, keys.String(), sam3.GenerateOptionString(options))
+	if err == nil {
+		err = reply.err()
+	}
+	if err != nil {
+		control.Close()
+		return nil, fmt.Errorf("onramp newPrimarySession: %v", err)
+	}
+	log.WithField("id", id).Debug("Primary session created")
+	return &primarySession{samConn: control, samAddr: samAddr, keys: keys}, nil
+}
+
+// add adds the subsession of the given style named id, with the extra
+// arguments of SESSION ADD.
+func (p *primarySession) add(style, id string, args ...string) error {
+	reply, err := p.command("SESSION ADD STYLE=%s ID=%s %s", style, id, strings.Join(args, " "))
+	if err == nil {
+		err = reply.err()
+	}
+	if err != nil {
+		return fmt.Errorf("onramp: adding %s subsession %s: %v", style, id, err)
+	}
+	log.WithFields(logrus.Fields{
+		"style": style,
+		"id":    id,
+	}).Debug("Subsession added")
+	return nil
+}
+
+// remove removes the subsession id.
+func (p *primarySession) remove(id string) error {
+	reply, err := p.command("SESSION REMOVE ID=%s", id)
+	if err == nil {
+		err = reply.err()
+	}
+	if err != nil {
+		return fmt.Errorf("onramp: removing subsession %s: %v", id, err)
+	}
+	return nil
+}
+
+// parseSAMReply splits a reply line into its topic, type and KEY=VALUE
+// pairs. Values may be quoted.
+func parseSAMReply(line string) *samReply {
+	line = strings.TrimRight(line, "\r\n")
+	reply := &samReply{Pairs: make(map[string]string)}
+	var fields []string
+	for len(line) > 0 {
+		line = strings.TrimLeft(line, " ")
+		if line == "" {
+			break
+		}
+		end := 0
+		quoted := false
+		for end < len(line) && (quoted || line[end] != ' ') {
+			if line[end] == '"' {
+				quoted = !quoted
+			}
+			end++
+		}
+		fields = append(fields, line[:end])
+		line = line[end:]
+	}
+	for i, field := range fields {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			switch i {
+			case 0:
+				reply.Topic = field
+			case 1:
+				reply.Type = field
+			}
+			continue
+		}
+		reply.Pairs[key] = strings.Trim(value, `"`)
+	}
+	return reply
+}
+
+// err returns an error unless the reply has RESULT=OK.
+func (r *samReply) err() error {
+	if r.Pairs["RESULT"] == "OK" {
+		return nil
+	}
+	log.WithFields(logrus.Fields{
+		"topic":  r.Topic,
+		"type":   r.Type,
+		"result": r.Pairs["RESULT"],
+	}).Debug("SAM command failed")
+	if msg := r.Pairs["MESSAGE"]; msg != "" {
+		return fmt.Errorf("SAM %s %s: %s: %s", r.Topic, r.Type, r.Pairs["RESULT"], msg)
+	}
+	return fmt.Errorf("SAM %s %s: %s", r.Topic, r.Type, r.Pairs["RESULT"])
+}
+
+// samBridgeUDPAddr returns the address the SAM bridge at addr receives
+// datagrams on.
+func samBridgeUDPAddr(addr string) (*net.UDPAddr, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	return net.ResolveUDPAddr("udp", net.JoinHostPort(host, fmt.Sprint(SAM_UDP_PORT)))
+}
+
+// localIPFor returns the local IP address used to reach addr, which the
+// bridge forwards datagrams to.
+func localIPFor(addr *net.UDPAddr) (net.IP, error) {
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
@@ -0,0 +1,336 @@
+//go:build !gen
+// +build !gen
+
+package onramp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-i2p/i2pkeys"
+)
+
+// fakeSAM is a minimal SAM bridge for tests. It routes datagrams between
+// its own sessions instead of I2P. A destination's private key is its
+// public key followed by "-priv".
+type fakeSAM struct {
+	tcp      net.Listener
+	udp      *net.UDPConn
+	mu       sync.Mutex
+	sessions map[string]*fakeSAMSession
+	keys     int
+	// primaries counts the primary sessions created
+	primaries int
+	// open counts the connections which haven't become streams and
+	// haven't been closed
+	open int
+	// accepting holds the connections waiting in STREAM ACCEPT, by
+	// session ID
+	accepting map[string][]*fakeSAMStream
+}
+
+// fakeSAMStream is a connection which became a stream.
+type fakeSAMStream struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+type fakeSAMSession struct {
+	style    string
+	dest     string
+	addr     *net.UDPAddr
+	protocol int
+	port     int
+}
+
+// newFakeSAM starts a fake bridge and points SAM_UDP_PORT at it for the
+// duration of the test.
+func newFakeSAM(t *testing.T) *fakeSAM {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSAM{
+		tcp:       tcp,
+		udp:       udp,
+		sessions:  make(map[string]*fakeSAMSession),
+		accepting: make(map[string][]*fakeSAMStream),
+	}
+	port := SAM_UDP_PORT
+	SAM_UDP_PORT = udp.LocalAddr().(*net.UDPAddr).Port
+	t.Cleanup(func() {
+		SAM_UDP_PORT = port
+		tcp.Close()
+		udp.Close()
+	})
+	go s.serve()
+	go s.forward()
+	return s
+}
+
+// fakeTypedKeys returns the destination and private keys of a
+// destination with a key certificate for the signature type named like in
+// DEST GENERATE, and otherwise only n.
+func fakeTypedKeys(n int, sigType string) (pub, priv string) {
+	sig := SIG_ED25519
+	for num, name := range sigTypeNames {
+		if name == sigType {
+			sig = num
+		}
+	}
+	b := make([]byte, 384, 391)
+	binary.BigEndian.PutUint64(b, uint64(n))
+	b = append(b, 5, 0, 4, byte(sig>>8), byte(sig), 0, 0)
+	keys := append(append([]byte{}, b...), make([]byte, 256)...)
+	keys = append(keys, bytes.Repeat([]byte{1}, sigKeyLengths[sig].private)...)
+	return i2pBase64.EncodeToString(b), i2pBase64.EncodeToString(keys)
+}
+
+// fakeSAMDest returns the destination of private keys from DEST GENERATE
+// or of real ones.
+func fakeSAMDest(priv string) string {
+	if strings.HasSuffix(priv, "-priv") {
+		return strings.TrimSuffix(priv, "-priv")
+	}
+	if dest, _, _, _, err := privateKeyParts(i2pkeys.NewKeys("", priv)); err == nil {
+		return i2pBase64.EncodeToString(dest)
+	}
+	return priv
+}
+
+// openConns returns the number of connections the bridge serves, waiting
+// a second for clients to close theirs.
+func (s *fakeSAM) openConns() int {
+	for i := 0; ; i++ {
+		s.mu.Lock()
+		open := s.open
+		s.mu.Unlock()
+		if open == 0 || i == 100 {
+			return open
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (s *fakeSAM) Addr() string {
+	return s.tcp.Addr().String()
+}
+
+func (s *fakeSAM) serve() {
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeSAM) handle(conn net.Conn) {
+	s.mu.Lock()
+	s.open++
+	s.mu.Unlock()
+	stream := false
+	defer func() {
+		if !stream {
+			conn.Close()
+		}
+		s.mu.Lock()
+		s.open--
+		s.mu.Unlock()
+	}()
+	r := bufio.NewReader(conn)
+	var ids []string
+	// primary is the destination of the primary session on conn, which
+	// SESSION ADD gives to subsessions
+	var primary string
+	defer func() {
+		s.mu.Lock()
+		for _, id := range ids {
+			delete(s.sessions, id)
+		}
+		s.mu.Unlock()
+	}()
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := parseSAMReply(line)
+		var reply string
+		switch cmd.Topic + " " + cmd.Type {
+		case "HELLO VERSION":
+			reply = "HELLO REPLY RESULT=OK VERSION=3.3"
+		case "DEST GENERATE":
+			s.mu.Lock()
+			s.keys++
+			pub := fmt.Sprintf("fakedest%d", s.keys)
+			priv := pub + "-priv"
+			if sigType, ok := cmd.Pairs["SIGNATURE_TYPE"]; ok {
+				pub, priv = fakeTypedKeys(s.keys, sigType)
+			}
+			s.mu.Unlock()
+			reply = fmt.Sprintf("DEST REPLY PUB=%s PRIV=%s", pub, priv)
+		case "SESSION CREATE", "SESSION ADD":
+			session := &fakeSAMSession{
+				style: cmd.Pairs["STYLE"],
+				dest:  fakeSAMDest(cmd.Pairs["DESTINATION"]),
+			}
+			if cmd.Type == "ADD" {
+				session.dest = primary
+			} else if session.style == "PRIMARY" || session.style == "MASTER" {
+				primary = session.dest
+				s.mu.Lock()
+				s.primaries++
+				s.mu.Unlock()
+			}
+			session.protocol, _ = strconv.Atoi(cmd.Pairs["PROTOCOL"])
+			session.port, _ = strconv.Atoi(cmd.Pairs["FROM_PORT"])
+			if port, err := strconv.Atoi(cmd.Pairs["PORT"]); err == nil {
+				session.addr = &net.UDPAddr{IP: net.ParseIP(cmd.Pairs["HOST"]), Port: port}
+			}
+			s.mu.Lock()
+			s.sessions[cmd.Pairs["ID"]] = session
+			s.mu.Unlock()
+			ids = append(ids, cmd.Pairs["ID"])
+			reply = "SESSION STATUS RESULT=OK DESTINATION=" + cmd.Pairs["DESTINATION"]
+		case "SESSION REMOVE":
+			s.mu.Lock()
+			if _, ok := s.sessions[cmd.Pairs["ID"]]; ok {
+				delete(s.sessions, cmd.Pairs["ID"])
+				reply = "SESSION STATUS RESULT=OK ID=" + cmd.Pairs["ID"]
+			} else {
+				reply = "SESSION STATUS RESULT=I2P_ERROR MESSAGE=\"no such session\""
+			}
+			s.mu.Unlock()
+		case "NAMING LOOKUP":
+			name := cmd.Pairs["NAME"]
+			reply = "NAMING REPLY RESULT=KEY_NOT_FOUND NAME=" + name
+			s.mu.Lock()
+			for _, session := range s.sessions {
+				if session.dest == name || i2pkeys.I2PAddr(session.dest).Base32() == name {
+					reply = fmt.Sprintf("NAMING REPLY RESULT=OK NAME=%s VALUE=%s", name, session.dest)
+				}
+			}
+			s.mu.Unlock()
+		case "STREAM ACCEPT":
+			s.mu.Lock()
+			s.accepting[cmd.Pairs["ID"]] = append(s.accepting[cmd.Pairs["ID"]], &fakeSAMStream{conn, r})
+			s.mu.Unlock()
+			conn.Write([]byte("STREAM STATUS RESULT=OK\n"))
+			stream = true
+			return
+		case "STREAM CONNECT":
+			// like I2P, give a listener some time to call STREAM ACCEPT
+			peer := s.connect(cmd)
+			for i := 0; peer == nil && i < 100; i++ {
+				time.Sleep(10 * time.Millisecond)
+				peer = s.connect(cmd)
+			}
+			if peer == nil {
+				reply = "STREAM STATUS RESULT=CANT_REACH_PEER"
+				break
+			}
+			conn.Write([]byte("STREAM STATUS RESULT=OK\n"))
+			go func() {
+				io.Copy(peer.conn, r)
+				peer.conn.Close()
+			}()
+			io.Copy(conn, peer.r)
+			return
+		default:
+			reply = cmd.Topic + " STATUS RESULT=I2P_ERROR MESSAGE=\"unsupported\""
+		}
+		conn.Write([]byte(reply + "\n"))
+	}
+}
+
+// connect finds a connection accepting streams to the destination and
+// port of a STREAM CONNECT command, preferring the session listening on
+// the port over the one listening on port 0, and sends it the peer line.
+func (s *fakeSAM) connect(cmd *samReply) *fakeSAMStream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	from := s.sessions[cmd.Pairs["ID"]]
+	port, _ := strconv.Atoi(cmd.Pairs["TO_PORT"])
+	for _, listen := range []int{port, 0} {
+		for id, session := range s.sessions {
+			if session.style != "STREAM" || session.dest != cmd.Pairs["DESTINATION"] || session.port != listen || len(s.accepting[id]) == 0 {
+				continue
+			}
+			peer := s.accepting[id][0]
+			s.accepting[id] = s.accepting[id][1:]
+			fmt.Fprintf(peer.conn, "%s FROM_PORT=%s TO_PORT=%d\n", from.dest, cmd.Pairs["FROM_PORT"], port)
+			return peer
+		}
+	}
+	return nil
+}
+
+// forward delivers raw and repliable datagrams to the sessions of their
+// destination.
+func (s *fakeSAM) forward() {
+	buf := make([]byte, MAX_DATAGRAM_SIZE)
+	for {
+		n, _, err := s.udp.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		i := bytes.IndexByte(buf[:n], '\n')
+		if i < 0 {
+			continue
+		}
+		fields := strings.Fields(string(buf[:i]))
+		if len(fields) < 3 {
+			continue
+		}
+		protocol := RAW_PROTOCOL
+		for _, f := range fields[3:] {
+			if v, ok := strings.CutPrefix(f, "PROTOCOL="); ok {
+				protocol, _ = strconv.Atoi(v)
+			}
+		}
+		s.mu.Lock()
+		from := s.sessions[fields[1]]
+		for _, session := range s.sessions {
+			switch {
+			case session.style == "RAW" && session.dest == fields[2] && session.protocol == protocol:
+				header := fmt.Sprintf("FROM_PORT=0 TO_PORT=0 PROTOCOL=%d\n", protocol)
+				s.udp.WriteToUDP(append([]byte(header), buf[i+1:n]...), session.addr)
+			case session.style == "DATAGRAM" && session.dest == fields[2] && from != nil:
+				header := fmt.Sprintf("%s FROM_PORT=0 TO_PORT=0\n", from.dest)
+				s.udp.WriteToUDP(append([]byte(header), buf[i+1:n]...), session.addr)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+func TestParseSAMReply(t *testing.T) {
+	reply := parseSAMReply("SESSION STATUS RESULT=I2P_ERROR MESSAGE=\"no tunnels yet\"\n")
+	if reply.Topic != "SESSION" || reply.Type != "STATUS" {
+		t.Errorf("parsed %q %q", reply.Topic, reply.Type)
+	}
+	if reply.Pairs["MESSAGE"] != "no tunnels yet" {
+		t.Errorf("parsed message %q", reply.Pairs["MESSAGE"])
+	}
+	if err := reply.err(); err == nil || !strings.Contains(err.Error(), "no tunnels yet") {
+		t.Errorf("error %v", err)
+	}
+	if err := parseSAMReply("HELLO REPLY RESULT=OK VERSION=3.3").err(); err != nil {
+		t.Error(err)
+	}
+}
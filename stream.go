@@ -0,0 +1,201 @@
+package onramp
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-i2p/i2pkeys"
+	"github.com/sirupsen/logrus"
+)
+
+// streamConn is an I2P stream carried by its own SAM connection, once the
+// STREAM ACCEPT or CONNECT command succeeded. It reads through the bufio
+// reader of the command, which may already hold stream data.
+type streamConn struct {
+	net.Conn
+	r        *bufio.Reader
+	laddr    net.Addr
+	raddr    net.Addr
+	fromPort int
+	toPort   int
+}
+
+func (c *streamConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// LocalAddr returns the local I2P destination.
+func (c *streamConn) LocalAddr() net.Addr {
+	return c.laddr
+}
+
+// RemoteAddr returns the destination of the peer.
+func (c *streamConn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+// acceptStream waits for the next incoming stream of the STREAM session or
+// subsession id, whose destination is laddr.
+func acceptStream(control *samConn, id string, laddr net.Addr) (*streamConn, error) {
+	reply, err := control.command("STREAM ACCEPT ID=%s SILENT=false", id)
+	if err == nil {
+		err = reply.err()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("onramp acceptStream: %v", err)
+	}
+	// the bridge sends "$destination FROM_PORT=n TO_PORT=n" once a peer
+	// connects
+	line, err := control.readLine()
+	if err != nil {
+		return nil, fmt.Errorf("onramp acceptStream: %v", err)
+	}
+	peer := parseSAMReply(line)
+	c := &streamConn{
+		Conn:  control.Conn,
+		r:     control.r,
+		laddr: laddr,
+		raddr: i2pkeys.I2PAddr(peer.Topic),
+	}
+	c.fromPort, _ = strconv.Atoi(peer.Pairs["FROM_PORT"])
+	c.toPort, _ = strconv.Atoi(peer.Pairs["TO_PORT"])
+	log.WithFields(logrus.Fields{
+		"id":        id,
+		"from_port": c.fromPort,
+		"to_port":   c.toPort,
+	}).Debug("Accepted stream")
+	return c, nil
+}
+
+// connectStream opens a stream from the STREAM session or subsession id,
+// whose destination is laddr, to port toPort of dest.
+func connectStream(ctx context.Context, samAddr, id string, laddr net.Addr, dest i2pkeys.I2PAddr, fromPort, toPort int) (*streamConn, error) {
+	log.WithFields(logrus.Fields{
+		"id":      id,
+		"to_port": toPort,
+	}).Debug("Connecting stream")
+	control, err := dialSAM(samAddr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		control.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		control.Close()
+	})
+	reply, err := control.command("STREAM CONNECT ID=%s DESTINATION=%s FROM_PORT=%d TO_PORT=%d SILENT=false",
+		id, dest.Base64(), fromPort, toPort)
+	if err == nil {
+		err = reply.err()
+	}
+	if !stop() {
+		err = ctx.Err()
+	}
+	if err != nil {
+		control.Close()
+		return nil, fmt.Errorf("onramp connectStream: %v", err)
+	}
+	control.SetDeadline(time.Time{})
+	return &streamConn{
+		Conn:     control.Conn,
+		r:        control.r,
+		laddr:    laddr,
+		raddr:    dest,
+		fromPort: fromPort,
+		toPort:   toPort,
+	}, nil
+}
+
+// portListener accepts the streams to one I2P port, which the bridge routes
+// to the STREAM subsession listening on it. Each pending Accept has its own
+// SAM connection.
+type portListener struct {
+	samAddr string
+	id      string
+	addr    net.Addr
+	port    int
+	// remove is called by Close to remove the subsession.
+	remove func() error
+
+	mu      sync.Mutex
+	pending map[*samConn]struct{}
+	closed  bool
+}
+
+func newPortListener(samAddr, id string, addr net.Addr, port int, remove func() error) *portListener {
+	return &portListener{
+		samAddr: samAddr,
+		id:      id,
+		addr:    addr,
+		port:    port,
+		remove:  remove,
+		pending: make(map[*samConn]struct{}),
+	}
+}
+
+// Accept waits for the next stream to the listener's port.
+// implements net.Listener
+func (l *portListener) Accept() (net.Conn, error) {
+	control, err := dialSAM(l.samAddr)
+	if err != nil {
+		return nil, err
+	}
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		control.Close()
+		return nil, net.ErrClosed
+	}
+	l.pending[control] = struct{}{}
+	l.mu.Unlock()
+	conn, err := acceptStream(control, l.id, l.addr)
+	l.mu.Lock()
+	delete(l.pending, control)
+	closed := l.closed
+	l.mu.Unlock()
+	if err != nil {
+		control.Close()
+		if closed {
+			return nil, net.ErrClosed
+		}
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Close stops the pending Accepts and removes the subsession.
+// implements net.Listener
+func (l *portListener) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	for control := range l.pending {
+		control.Close()
+	}
+	l.mu.Unlock()
+	log.WithField("port", l.port).Debug("Closing port listener")
+	if l.remove != nil {
+		return l.remove()
+	}
+	return nil
+}
+
+// Addr returns the destination of the listener.
+// implements net.Listener
+func (l *portListener) Addr() net.Addr {
+	return l.addr
+}
+
+// Port returns the I2P port the listener accepts streams to.
+func (l *portListener) Port() int {
+	return l.port
+}
@@ -0,0 +1,171 @@
+//go:build !gen
+// +build !gen
+
+package onramp
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-i2p/i2pkeys"
+)
+
+func TestPortListener(t *testing.T) {
+	sam := newFakeSAM(t)
+	command := func(c *samConn, format string, args ...interface{}) {
+		t.Helper()
+		reply, err := c.command(format, args...)
+		if err == nil {
+			err = reply.err()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	server, err := dialSAM(sam.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	command(server, "SESSION CREATE STYLE=PRIMARY ID=server DESTINATION=fakeserver-priv")
+	command(server, "SESSION ADD STYLE=STREAM ID=server-stream")
+	command(server, "SESSION ADD STYLE=STREAM ID=server-port-8080 FROM_PORT=8080")
+	client, err := dialSAM(sam.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	command(client, "SESSION CREATE STYLE=STREAM ID=client DESTINATION=fakeclient-priv")
+
+	addr := i2pkeys.I2PAddr("fakeserver")
+	fallback := newPortListener(sam.Addr(), "server-stream", addr, 0, nil)
+	defer fallback.Close()
+	http := newPortListener(sam.Addr(), "server-port-8080", addr, 8080, func() error {
+		command(server, "SESSION REMOVE ID=server-port-8080")
+		return nil
+	})
+
+	// expect dials port and checks which listener gets the stream
+	expect := func(port int, l *portListener) {
+		t.Helper()
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			conn, err := l.Accept()
+			if err != nil {
+				t.Error(err)
+			}
+			accepted <- conn
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		conn, err := connectStream(ctx, sam.Addr(), "client", i2pkeys.I2PAddr("fakeclient"), addr, 0, port)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		peer := <-accepted
+		if peer == nil {
+			return
+		}
+		defer peer.Close()
+		if sc := peer.(*streamConn); sc.toPort != port || sc.RemoteAddr().(i2pkeys.I2PAddr) != "fakeclient" {
+			t.Errorf("accepted a stream from %s to port %d", sc.RemoteAddr(), sc.toPort)
+		}
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(peer, buf); err != nil || string(buf) != "ping" {
+			t.Errorf("read %q, %v", buf, err)
+		}
+	}
+	expect(8080, http)
+	expect(22, fallback)
+	if err := http.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := http.Accept(); err != net.ErrClosed {
+		t.Errorf("accepted on a closed listener: %v", err)
+	}
+	expect(8080, fallback)
+}
+
+func TestGarlicPrimarySession(t *testing.T) {
+	tempKeystores(t)
+	sam := newFakeSAM(t)
+	g := &Garlic{name: "primary", addr: sam.Addr()}
+	defer g.Close()
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	run := func(f func() error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- f()
+		}()
+	}
+	for _, port := range []int{8080, 8081, 8082} {
+		port := port
+		run(func() error {
+			l, err := g.ListenPort(port)
+			if err != nil {
+				return err
+			}
+			return l.Close()
+		})
+	}
+	for i := 0; i < 3; i++ {
+		run(func() error {
+			conn, err := g.ListenRaw(0)
+			if err != nil {
+				return err
+			}
+			return conn.Close()
+		})
+	}
+	run(func() error {
+		_, err := g.ListenPacket()
+		return err
+	})
+	run(func() error {
+		_, err := g.setupStreamSession()
+		return err
+	})
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	sam.mu.Lock()
+	defer sam.mu.Unlock()
+	if sam.primaries != 1 {
+		t.Errorf("created %d primary sessions", sam.primaries)
+	}
+	// the primary session and its stream and datagram subsessions
+	if len(sam.sessions) != 3 {
+		t.Errorf("left sessions %v", sam.sessions)
+	}
+}
+
+func TestSplitGarlicAddr(t *testing.T) {
+	for addr, want := range map[string]int{
+		"example.i2p":      0,
+		"example.i2p:8080": 8080,
+		":22":              22,
+		"example.i2p:http": 80,
+	} {
+		_, port, err := splitGarlicAddr(addr)
+		if err != nil || port != want {
+			t.Errorf("%s: port %d, %v", addr, port, err)
+		}
+	}
+	if _, _, err := splitGarlicAddr("example.i2p:99999"); err == nil {
+		t.Error("accepted an invalid port")
+	}
+}
@@ -1,13 +1,11 @@
 package onramp
 
 import (
-	"crypto/ecdsa"
-	"crypto/elliptic"
+	"bytes"
+	"crypto"
 	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
-	"crypto/x509/pkix"
-	"encoding/asn1"
 	"encoding/pem"
 	"fmt"
 	"math/big"
@@ -34,7 +32,14 @@ func (g *Garlic) TLSKeys() (tls.Certificate, error) {
 	}
 	base32 := keys.Addr().Base32()
 	log.WithField("base32", base32).Debug("Retrieving TLS certificate for base32 address")
-	return TLSKeys(base32)
+	return TLSKeysWithProfile(base32, g.certProfile())
+}
+
+func (g *Garlic) certProfile() *CertProfile {
+	if g.CertProfile == nil {
+		return DefaultGarlicCertProfile()
+	}
+	return g.CertProfile
 }
 
 // TLSKeys returns the TLS certificate and key for the given Onion.
@@ -48,15 +53,81 @@ func (o *Onion) TLSKeys() (tls.Certificate, error) {
 	}
 	onionService := torutil.OnionServiceIDFromPrivateKey(keys)
 	log.WithField("onion_service", onionService).Debug("Retrieving TLS certificate for onion service")
-	return TLSKeys(onionService)
+	return TLSKeysWithProfile(onionService, o.certProfile())
+}
+
+func (o *Onion) certProfile() *CertProfile {
+	if o.CertProfile == nil {
+		return DefaultOnionCertProfile()
+	}
+	return o.CertProfile
+}
+
+// DialTLS returns a TLS net.Conn to the given I2P address. The server's
+// certificate is checked against the CRLs in the TLS keystore, and against
+// TLSClientConfig if it is set. Datagram networks ("udp", "dg") use DTLS,
+// see DialDTLS.
+func (g *Garlic) DialTLS(network, addr string) (net.Conn, error) {
+	log.WithFields(logrus.Fields{
+		"network": network,
+		"address": addr,
+	}).Debug("Dialing TLS connection over I2P")
+	switch network {
+	case "udp", "udp6", "dg", "dg6":
+		return g.DialDTLS(addr)
+	}
+	conn, err := g.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return tlsClientHandshake(conn, g.TLSClientConfig, addr)
+}
+
+// DialTLS returns a TLS net.Conn to the given onion address or clearnet
+// address. The server's certificate is checked against the CRLs in the
+// TLS keystore, and against TLSClientConfig if it is set.
+func (o *Onion) DialTLS(network, addr string) (net.Conn, error) {
+	log.WithFields(logrus.Fields{
+		"network": network,
+		"address": addr,
+	}).Debug("Dialing TLS connection over Tor")
+	conn, err := o.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return tlsClientHandshake(conn, o.TLSClientConfig, addr)
+}
+
+func tlsClientHandshake(conn net.Conn, config *tls.Config, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	tlsConn := tls.Client(conn, tlsClientConfig(config, host))
+	if err := tlsConn.Handshake(); err != nil {
+		log.WithError(err).Error("TLS handshake failed")
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
 }
 
 // TLSKeys returns the TLS certificate and key for the given hostname.
 func TLSKeys(tlsHost string) (tls.Certificate, error) {
+	return TLSKeysWithProfile(tlsHost, DefaultGarlicCertProfile())
+}
+
+// TLSKeysWithProfile returns the TLS certificate and key for the given
+// hostname. If they do not exist yet they are generated according to the
+// profile, existing certificates are returned unchanged.
+func TLSKeysWithProfile(tlsHost string, profile *CertProfile) (tls.Certificate, error) {
 	log.WithField("host", tlsHost).Debug("Getting TLS certificate and key")
+	if KEYSTORE != nil {
+		return keystoreTLSKeys(tlsHost, profile)
+	}
 	tlsCert := tlsHost + ".crt"
 	tlsKey := tlsHost + ".pem"
-	if err := CreateTLSCertificate(tlsHost); nil != err {
+	if err := CreateTLSCertificateWithProfile(tlsHost, profile); nil != err {
 		log.WithError(err).Error("Failed to create TLS certificate")
 		return tls.Certificate{}, err
 	}
@@ -79,6 +150,10 @@ func TLSKeys(tlsHost string) (tls.Certificate, error) {
 		return cert, err
 	}
 
+	if err := RefreshTLSCRL(tlsHost); err != nil {
+		log.WithError(err).Warn("Failed to refresh TLS CRL")
+	}
+
 	log.Debug("Successfully loaded TLS certificate and key")
 	return cert, nil
 }
@@ -87,7 +162,18 @@ func TLSKeys(tlsHost string) (tls.Certificate, error) {
 // and stores it in the TLS keystore for the application. If the keys already
 // exist, generation is skipped.
 func CreateTLSCertificate(tlsHost string) error {
+	return CreateTLSCertificateWithProfile(tlsHost, DefaultGarlicCertProfile())
+}
+
+// CreateTLSCertificateWithProfile generates a TLS certificate for the given
+// hostname according to profile, and stores it in the TLS keystore for the
+// application. If the keys already exist, generation is skipped.
+func CreateTLSCertificateWithProfile(tlsHost string, profile *CertProfile) error {
 	log.WithField("host", tlsHost).Debug("Creating TLS certificate")
+	if KEYSTORE != nil {
+		_, err := keystoreTLSKeys(tlsHost, profile)
+		return err
+	}
 	tlsCertName := tlsHost + ".crt"
 	tlsKeyName := tlsHost + ".pem"
 	tlsKeystorePath, err := TLSKeystorePath()
@@ -96,6 +182,11 @@ func CreateTLSCertificate(tlsHost string) error {
 	}
 	tlsCert := filepath.Join(tlsKeystorePath, tlsCertName)
 	tlsKey := filepath.Join(tlsKeystorePath, tlsKeyName)
+	unlock, err := lockKeyFile(tlsKey)
+	if err != nil {
+		return err
+	}
+	defer unlock()
 	_, certErr := os.Stat(tlsCert)
 	_, keyErr := os.Stat(tlsKey)
 	if certErr != nil || keyErr != nil {
@@ -114,7 +205,7 @@ func CreateTLSCertificate(tlsHost string) error {
 			fmt.Printf("Unable to read TLS key '%s'\n", tlsKey)
 		}
 
-		if err := createTLSCertificate(tlsHost); nil != err {
+		if err := createTLSCertificate(tlsHost, profile); nil != err {
 			log.WithError(err).Error("Failed to create TLS certificate")
 			return err
 		}
@@ -125,18 +216,29 @@ func CreateTLSCertificate(tlsHost string) error {
 	return nil
 }
 
-func createTLSCertificate(host string) error {
-	log.WithField("host", host).Debug("Generating new TLS certificate")
-	fmt.Println("Generating TLS keys. This may take a minute...")
-	priv, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+// keystoreTLSKeys is TLSKeysWithProfile for keys in KEYSTORE. The key and
+// certificate are stored together, as in the .pem files of the TLS key
+// store.
+func keystoreTLSKeys(host string, profile *CertProfile) (tls.Certificate, error) {
+	name := "tlskeys/" + host + ".pem"
+	data, err := keystoreKey(name, func() ([]byte, error) {
+		_, _, _, keyPEM, err := newTLSKeyPair(host, profile)
+		return keyPEM, err
+	})
 	if err != nil {
-		log.WithError(err).Error("Failed to generate private key")
-		return err
+		log.WithError(err).WithField("name", name).Error("Failed to get TLS keys from the keystore")
+		return tls.Certificate{}, err
+	}
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("onramp TLSKeys: %s: %v", name, err)
 	}
+	return cert, nil
+}
 
-	tlsCert, err := NewTLSCertificate(host, priv)
-	if nil != err {
-		log.WithError(err).Error("Failed to create new TLS certificate")
+func createTLSCertificate(host string, profile *CertProfile) error {
+	priv, tlsCert, certPEM, keyPEM, err := newTLSKeyPair(host, profile)
+	if err != nil {
 		return err
 	}
 	privStore, err := TLSKeystorePath()
@@ -148,92 +250,95 @@ func createTLSCertificate(host string) error {
 	certFile := filepath.Join(privStore, host+".crt")
 	log.WithField("path", certFile).Debug("Saving TLS certificate")
 	// save the TLS certificate
-	certOut, err := os.Create(certFile)
-	if err != nil {
-		log.WithError(err).WithField("path", certFile).Error("Failed to create certificate file")
-		return fmt.Errorf("failed to open %s for writing: %s", host+".crt", err)
+	if err := writeKeyFile(certFile, certPEM, 0644); err != nil {
+		log.WithError(err).WithField("path", certFile).Error("Failed to write certificate file")
+		return fmt.Errorf("failed to write %s: %s", host+".crt", err)
 	}
-	pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: tlsCert})
-	certOut.Close()
 	log.WithField("path", certFile).Debug("TLS certificate saved successfully")
 	fmt.Printf("\tTLS certificate saved to: %s\n", host+".crt")
 
 	// save the TLS private key
 	privFile := filepath.Join(privStore, host+".pem")
 	log.WithField("path", privFile).Debug("Saving TLS private key")
-	keyOut, err := os.OpenFile(privFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
-	if err != nil {
-		log.WithError(err).WithField("path", privFile).Error("Failed to create private key file")
-		return fmt.Errorf("failed to open %s for writing: %v", privFile, err)
+	if err := writeKeyFile(privFile, keyPEM, 0600); err != nil {
+		log.WithError(err).WithField("path", privFile).Error("Failed to write private key file")
+		return fmt.Errorf("failed to write %s: %v", privFile, err)
 	}
-	secp384r1, err := asn1.Marshal(asn1.ObjectIdentifier{1, 3, 132, 0, 34}) // http://www.ietf.org/rfc/rfc5480.txt
-	if err != nil {
-		log.WithError(err).Error("Failed to marshal EC parameters")
-		return err
-	}
-	pem.Encode(keyOut, &pem.Block{Type: "EC PARAMETERS", Bytes: secp384r1})
-	ecder, err := x509.MarshalECPrivateKey(priv)
-	if err != nil {
-		log.WithError(err).Error("Failed to marshal private key")
-		return err
-	}
-	pem.Encode(keyOut, &pem.Block{Type: "EC PRIVATE KEY", Bytes: ecder})
-	pem.Encode(keyOut, &pem.Block{Type: "CERTIFICATE", Bytes: tlsCert})
-
-	keyOut.Close()
 	log.WithField("path", privFile).Debug("TLS private key saved successfully")
 	fmt.Printf("\tTLS private key saved to: %s\n", privFile)
 
 	// CRL
-	crlFile := filepath.Join(privStore, host+".crl")
-	log.WithField("path", crlFile).Debug("Creating CRL")
-	crlOut, err := os.OpenFile(crlFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
-	if err != nil {
-		log.WithError(err).WithField("path", crlFile).Error("Failed to create CRL file")
-		return fmt.Errorf("failed to open %s for writing: %s", crlFile, err)
-	}
 	crlcert, err := x509.ParseCertificate(tlsCert)
 	if err != nil {
 		log.WithError(err).Error("Failed to parse certificate for CRL creation")
 		return fmt.Errorf("Certificate with unknown critical extension was not parsed: %s", err)
 	}
-
-	now := time.Now()
-	revokedCerts := []pkix.RevokedCertificate{
-		{
-			SerialNumber:   crlcert.SerialNumber,
-			RevocationTime: now,
-		},
+	if err := writeTLSCRL(host, crlcert, priv, revokedEntries(host)); err != nil {
+		return err
 	}
+	fmt.Printf("\tTLS CRL saved to: %s\n", host+".crl")
 
-	crlBytes, err := crlcert.CreateCRL(rand.Reader, priv, revokedCerts, now, now)
-	if err != nil {
-		log.WithError(err).Error("Failed to create CRL")
-		return fmt.Errorf("error creating CRL: %s", err)
+	return nil
+}
+
+// newTLSKeyPair generates a key and a certificate for host according to
+// profile. keyPEM holds the key followed by the certificate, like the .pem
+// files of the TLS key store.
+func newTLSKeyPair(host string, profile *CertProfile) (priv crypto.Signer, der, certPEM, keyPEM []byte, err error) {
+	if profile == nil {
+		profile = DefaultGarlicCertProfile()
 	}
-	_, err = x509.ParseDERCRL(crlBytes)
+	log.WithFields(logrus.Fields{
+		"host":      host,
+		"algorithm": profile.KeyAlgorithm.String(),
+	}).Debug("Generating new TLS certificate")
+	fmt.Println("Generating TLS keys. This may take a minute...")
+	priv, err = profile.GenerateKey()
 	if err != nil {
-		log.WithError(err).Error("Failed to validate generated CRL")
-		return fmt.Errorf("error reparsing CRL: %s", err)
+		log.WithError(err).Error("Failed to generate private key")
+		return nil, nil, nil, nil, err
 	}
-	pem.Encode(crlOut, &pem.Block{Type: "X509 CRL", Bytes: crlBytes})
-	crlOut.Close()
-	fmt.Printf("\tTLS CRL saved to: %s\n", crlFile)
-
-	return nil
+	der, err = NewTLSCertificateWithProfile(profile, priv, host)
+	if nil != err {
+		log.WithError(err).Error("Failed to create new TLS certificate")
+		return nil, nil, nil, nil, err
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	var keyOut bytes.Buffer
+	if err := encodeTLSPrivateKey(&keyOut, priv); err != nil {
+		log.WithError(err).Error("Failed to marshal private key")
+		return nil, nil, nil, nil, err
+	}
+	keyOut.Write(certPEM)
+	return priv, der, certPEM, keyOut.Bytes(), nil
 }
 
 // NewTLSCertificate generates a new TLS certificate for the given hostname,
 // returning it as bytes.
-func NewTLSCertificate(host string, priv *ecdsa.PrivateKey) ([]byte, error) {
+func NewTLSCertificate(host string, priv crypto.Signer) ([]byte, error) {
 	return NewTLSCertificateAltNames(priv, host)
 }
 
 // NewTLSCertificateAltNames generates a new TLS certificate for the given hostname,
 // and a list of alternate names, returning it as bytes.
-func NewTLSCertificateAltNames(priv *ecdsa.PrivateKey, hosts ...string) ([]byte, error) {
+func NewTLSCertificateAltNames(priv crypto.Signer, hosts ...string) ([]byte, error) {
+	return NewTLSCertificateWithProfile(DefaultGarlicCertProfile(), priv, hosts...)
+}
+
+// NewTLSCertificateWithProfile generates a new self-signed TLS certificate
+// for the given hostnames using the subject, validity and usages of profile,
+// returning it as bytes. priv may be an ECDSA, Ed25519 or RSA private key
+// and does not need to match profile.KeyAlgorithm.
+func NewTLSCertificateWithProfile(profile *CertProfile, priv crypto.Signer, hosts ...string) ([]byte, error) {
+	if profile == nil {
+		profile = DefaultGarlicCertProfile()
+	}
+	sigAlg, keyUsage, err := signatureAlgorithm(priv)
+	if err != nil {
+		return nil, err
+	}
 	notBefore := time.Now()
-	notAfter := notBefore.Add(5 * 365 * 24 * time.Hour)
+	notAfter := notBefore.Add(profile.validity())
 	host := ""
 	if len(hosts) > 0 {
 		host = hosts[0]
@@ -245,29 +350,33 @@ func NewTLSCertificateAltNames(priv *ecdsa.PrivateKey, hosts ...string) ([]byte,
 		return nil, err
 	}
 
+	subject := profile.Subject
+	if subject.CommonName == "" {
+		subject.CommonName = host
+	}
+
 	template := x509.Certificate{
-		SerialNumber: serialNumber,
-		Subject: pkix.Name{
-			Organization:       []string{"I2P Anonymous Network"},
-			OrganizationalUnit: []string{"I2P"},
-			Locality:           []string{"XX"},
-			StreetAddress:      []string{"XX"},
-			Country:            []string{"XX"},
-			CommonName:         host,
-		},
+		SerialNumber:       serialNumber,
+		Subject:            subject,
 		NotBefore:          notBefore,
 		NotAfter:           notAfter,
-		SignatureAlgorithm: x509.ECDSAWithSHA512,
+		SignatureAlgorithm: sigAlg,
 
-		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		KeyUsage:              keyUsage,
+		ExtKeyUsage:           profile.extKeyUsage(),
 		BasicConstraintsValid: true,
 		IsCA:                  true,
-		DNSNames:              hosts[1:],
 	}
 
-	hosts = append(hosts, strings.Split(host, ",")...)
-	for _, h := range hosts {
+	names := append([]string{}, hosts...)
+	names = append(names, strings.Split(host, ",")...)
+	names = append(names, profile.AltNames...)
+	seen := make(map[string]bool)
+	for _, h := range names {
+		if h == "" || strings.Contains(h, ",") || seen[h] {
+			continue
+		}
+		seen[h] = true
 		if ip := net.ParseIP(h); ip != nil {
 			template.IPAddresses = append(template.IPAddresses, ip)
 		} else {
@@ -275,7 +384,7 @@ func NewTLSCertificateAltNames(priv *ecdsa.PrivateKey, hosts ...string) ([]byte,
 		}
 	}
 
-	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, priv.Public(), priv)
 	if err != nil {
 		return nil, err
 	}
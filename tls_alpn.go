@@ -0,0 +1,150 @@
+package onramp
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ALPN protocol identifiers for HTTP.
+const (
+	ALPN_HTTP2  = "h2"
+	ALPN_HTTP11 = "http/1.1"
+)
+
+// ALPNListener splits a TLS listener into one net.Listener per ALPN
+// protocol. Connections are handshaken as they are accepted and delivered
+// to the listener for the protocol the client negotiated. Connections
+// which negotiated no protocol, or one without a listener, are returned by
+// Accept. Connections which aren't accepted within TLS_HANDSHAKE_TIMEOUT
+// are closed. The connections are always *tls.Conn, so http.Server serves
+// HTTP/2 on them when "h2" was negotiated.
+type ALPNListener struct {
+	net.Listener
+	mu        sync.RWMutex
+	protocols map[string]*virtualListener
+	accept    *virtualListener
+}
+
+// NewALPNListener wraps l, which must return *tls.Conn connections like
+// the listeners returned by ListenTLS. Only protocols offered in the
+// listener's tls.Config NextProtos can be negotiated.
+func NewALPNListener(l net.Listener) *ALPNListener {
+	log.WithField("address", l.Addr().String()).Debug("Creating ALPN listener")
+	a := &ALPNListener{
+		Listener:  l,
+		protocols: make(map[string]*virtualListener),
+		accept:    newVirtualListener(l.Addr()),
+	}
+	go a.serve()
+	return a
+}
+
+// Protocol returns the listener for connections which negotiated proto.
+func (a *ALPNListener) Protocol(proto string) net.Listener {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if l, ok := a.protocols[proto]; ok {
+		return l
+	}
+	l := newVirtualListener(a.Addr())
+	a.protocols[proto] = l
+	return l
+}
+
+// Accept returns the next connection which negotiated no protocol or one
+// without a listener of its own.
+// implements net.Listener
+func (a *ALPNListener) Accept() (net.Conn, error) {
+	return a.accept.Accept()
+}
+
+// Close closes the underlying listener and every protocol listener.
+// implements net.Listener
+func (a *ALPNListener) Close() error {
+	a.accept.Close()
+	a.mu.Lock()
+	for _, l := range a.protocols {
+		l.Close()
+	}
+	a.mu.Unlock()
+	return a.Listener.Close()
+}
+
+func (a *ALPNListener) serve() {
+	for {
+		conn, err := a.Listener.Accept()
+		if err != nil {
+			log.WithError(err).Debug("ALPN listener stopped accepting")
+			a.accept.Close()
+			return
+		}
+		tlsConn, ok := conn.(*tls.Conn)
+		if !ok {
+			log.WithField("type", fmt.Sprintf("%T", conn)).Error("ALPN listener accepted a connection without TLS")
+			conn.Close()
+			continue
+		}
+		go a.dispatch(tlsConn)
+	}
+}
+
+func (a *ALPNListener) dispatch(conn *tls.Conn) {
+	if err := handshakeWithTimeout(conn); err != nil {
+		log.WithError(err).Debug("TLS handshake failed")
+		conn.Close()
+		return
+	}
+	proto := conn.ConnectionState().NegotiatedProtocol
+	a.mu.RLock()
+	l := a.protocols[proto]
+	a.mu.RUnlock()
+	log.WithFields(logrus.Fields{
+		"protocol": proto,
+		"routed":   l != nil,
+	}).Debug("Routing TLS connection by ALPN")
+	if l == nil {
+		l = a.accept
+	}
+	if !l.deliverTimeout(conn, TLS_HANDSHAKE_TIMEOUT) {
+		// nobody accepts the connections for proto
+		log.WithField("protocol", proto).Debug("No listener accepted TLS connection, closing it")
+		conn.Close()
+	}
+}
+
+// ListenALPN returns an ALPNListener for the Garlic structure's I2P keys.
+// If protos are given they replace NextProtos, otherwise NextProtos must
+// already be set.
+func (g *Garlic) ListenALPN(protos ...string) (*ALPNListener, error) {
+	if len(protos) > 0 {
+		g.NextProtos = protos
+	}
+	if len(g.NextProtos) == 0 {
+		return nil, fmt.Errorf("onramp ListenALPN: no ALPN protocols configured")
+	}
+	l, err := g.ListenTLS()
+	if err != nil {
+		return nil, err
+	}
+	return NewALPNListener(l), nil
+}
+
+// ListenALPN returns an ALPNListener for the Onion's keys. If protos are
+// given they replace NextProtos, otherwise NextProtos must already be set.
+func (o *Onion) ListenALPN(protos ...string) (*ALPNListener, error) {
+	if len(protos) > 0 {
+		o.NextProtos = protos
+	}
+	if len(o.NextProtos) == 0 {
+		return nil, fmt.Errorf("onramp ListenALPN: no ALPN protocols configured")
+	}
+	l, err := o.ListenTLS()
+	if err != nil {
+		return nil, err
+	}
+	return NewALPNListener(l), nil
+}
@@ -0,0 +1,121 @@
+//go:build !gen
+// +build !gen
+
+package onramp
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestALPNListener(t *testing.T) {
+	defer func(path string) { TLS_KEYSTORE_PATH = path }(TLS_KEYSTORE_PATH)
+	TLS_KEYSTORE_PATH = t.TempDir()
+	cert, err := TLSKeysWithProfile("alpn.example.i2p", &CertProfile{KeyAlgorithm: CERT_KEY_ECDSA_P256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	alpn := NewALPNListener(tls.NewListener(tcp, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{ALPN_HTTP2, ALPN_HTTP11, "onramp-test"},
+	}))
+	defer alpn.Close()
+
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	})}
+	go server.Serve(alpn.Protocol(ALPN_HTTP2))
+	go server.Serve(alpn.Protocol(ALPN_HTTP11))
+	defer server.Close()
+
+	for _, proto := range []string{ALPN_HTTP2, ALPN_HTTP11} {
+		client := &http.Client{Transport: &http.Transport{
+			ForceAttemptHTTP2: proto == ALPN_HTTP2,
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true, NextProtos: []string{proto}},
+		}}
+		resp, err := client.Get("https://" + tcp.Addr().String() + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		want := "HTTP/2.0"
+		if proto == ALPN_HTTP11 {
+			want = "HTTP/1.1"
+		}
+		if string(body) != want {
+			t.Errorf("%s: served %q", proto, body)
+		}
+	}
+
+	custom := alpn.Protocol("onramp-test")
+	go func() {
+		conn, err := tls.Dial("tcp", tcp.Addr().String(), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"onramp-test"}})
+		if err == nil {
+			conn.Write([]byte("x"))
+			conn.Close()
+		}
+	}()
+	conn, err := custom.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := conn.(*tls.Conn).ConnectionState().NegotiatedProtocol; p != "onramp-test" {
+		t.Errorf("negotiated %q", p)
+	}
+	conn.Close()
+
+	go func() {
+		conn, err := tls.Dial("tcp", tcp.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		if err == nil {
+			conn.Write([]byte("x"))
+			conn.Close()
+		}
+	}()
+	conn, err = alpn.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestALPNListenerUnaccepted(t *testing.T) {
+	defer func(path string) { TLS_KEYSTORE_PATH = path }(TLS_KEYSTORE_PATH)
+	TLS_KEYSTORE_PATH = t.TempDir()
+	defer func(timeout time.Duration) { TLS_HANDSHAKE_TIMEOUT = timeout }(TLS_HANDSHAKE_TIMEOUT)
+	TLS_HANDSHAKE_TIMEOUT = time.Second
+	cert, err := TLSKeysWithProfile("alpn.example.i2p", &CertProfile{KeyAlgorithm: CERT_KEY_ECDSA_P256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	alpn := NewALPNListener(tls.NewListener(tcp, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"onramp-test"},
+	}))
+	defer alpn.Close()
+	alpn.Protocol("onramp-test")
+	// nobody accepts on either listener, so the connections are closed
+	for _, protos := range [][]string{{"onramp-test"}, nil} {
+		conn, err := tls.Dial("tcp", tcp.Addr().String(), &tls.Config{InsecureSkipVerify: true, NextProtos: protos})
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("%v: read %v, want EOF", protos, err)
+		}
+		conn.Close()
+	}
+}
@@ -0,0 +1,410 @@
+package onramp
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// CRL reason codes from RFC 5280 section 5.3.1 which are meaningful for
+// hidden service certificates.
+const (
+	CRL_REASON_UNSPECIFIED            = 0
+	CRL_REASON_KEY_COMPROMISE         = 1
+	CRL_REASON_SUPERSEDED             = 4
+	CRL_REASON_CESSATION_OF_OPERATION = 5
+)
+
+// TLS_CRL_UPDATE_INTERVAL is the time between a CRL's ThisUpdate and
+// NextUpdate. CRLs are re-signed once less than half of it remains.
+var TLS_CRL_UPDATE_INTERVAL = 7 * 24 * time.Hour
+
+// TLS_CRL_ACCEPT_STALE makes CheckTLSRevocation accept certificates whose
+// CRL is past its NextUpdate, with a warning, as long as they aren't
+// revoked in it. A CRL goes stale when nothing re-signs it, see
+// ScheduleTLSCRLRefresh. If it is false such certificates are rejected.
+var TLS_CRL_ACCEPT_STALE = true
+
+func tlsCRLPath(host string) (string, error) {
+	if KEYSTORE != nil {
+		return "", fmt.Errorf("onramp: CRLs aren't kept for keys in KEYSTORE: %w", ErrKeystoreUnsupported)
+	}
+	tlsKeystorePath, err := TLSKeystorePath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(tlsKeystorePath, host+".crl"), nil
+}
+
+// loadTLSKeyPair loads the certificate and signer stored for host.
+func loadTLSKeyPair(host string) (*x509.Certificate, crypto.Signer, error) {
+	if KEYSTORE != nil {
+		return nil, nil, fmt.Errorf("onramp: CRLs aren't kept for keys in KEYSTORE: %w", ErrKeystoreUnsupported)
+	}
+	tlsKeystorePath, err := TLSKeystorePath()
+	if err != nil {
+		return nil, nil, err
+	}
+	pair, err := tls.LoadX509KeyPair(
+		filepath.Join(tlsKeystorePath, host+".crt"),
+		filepath.Join(tlsKeystorePath, host+".pem"),
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	signer, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, nil, fmt.Errorf("onramp: TLS key for %s cannot sign", host)
+	}
+	return leaf, signer, nil
+}
+
+// TLSCRL returns the certificate revocation list stored for host. CRLs
+// written by old versions of onramp, which revoked the certificate they
+// were issued with, are not returned.
+func TLSCRL(host string) (*x509.RevocationList, error) {
+	crlPath, err := tlsCRLPath(host)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(crlPath)
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+	crl, err := x509.ParseRevocationList(data)
+	if err != nil {
+		return nil, fmt.Errorf("onramp TLSCRL: %v", err)
+	}
+	if crl.Number == nil {
+		return nil, fmt.Errorf("onramp TLSCRL: %s is a legacy CRL without a CRL number", crlPath)
+	}
+	return crl, nil
+}
+
+// writeTLSCRL signs a new CRL for host containing entries and stores it
+// in the TLS keystore.
+func writeTLSCRL(host string, issuer *x509.Certificate, priv crypto.Signer, entries []x509.RevocationListEntry) error {
+	number := big.NewInt(1)
+	if old, err := TLSCRL(host); err == nil {
+		number.Add(old.Number, big.NewInt(1))
+	}
+	now := time.Now()
+	template := &x509.RevocationList{
+		RevokedCertificateEntries: entries,
+		Number:                    number,
+		ThisUpdate:                now,
+		NextUpdate:                now.Add(TLS_CRL_UPDATE_INTERVAL),
+	}
+	crlBytes, err := x509.CreateRevocationList(rand.Reader, template, issuer, priv)
+	if err != nil {
+		log.WithError(err).Error("Failed to create CRL")
+		return fmt.Errorf("error creating CRL: %s", err)
+	}
+	if _, err := x509.ParseRevocationList(crlBytes); err != nil {
+		log.WithError(err).Error("Failed to validate generated CRL")
+		return fmt.Errorf("error reparsing CRL: %s", err)
+	}
+	crlFile, err := tlsCRLPath(host)
+	if err != nil {
+		return err
+	}
+	crlPEM := pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crlBytes})
+	if err := writeKeyFile(crlFile, crlPEM, 0600); err != nil {
+		log.WithError(err).WithField("path", crlFile).Error("Failed to write CRL file")
+		return fmt.Errorf("failed to open %s for writing: %s", crlFile, err)
+	}
+	log.WithFields(logrus.Fields{
+		"path":        crlFile,
+		"number":      number,
+		"revoked":     len(entries),
+		"next_update": template.NextUpdate,
+	}).Debug("TLS CRL saved successfully")
+	return nil
+}
+
+// revokedEntries returns the entries of the current CRL for host, or none
+// if there is no usable CRL.
+func revokedEntries(host string) []x509.RevocationListEntry {
+	crl, err := TLSCRL(host)
+	if err != nil {
+		return nil
+	}
+	return crl.RevokedCertificateEntries
+}
+
+// RevokeTLSCertificate adds the certificate currently stored for host to
+// its CRL. The CRL is signed by the revoked key itself, which tells clients
+// the key must no longer be trusted; use RotateTLSCertificate to also
+// replace it.
+func RevokeTLSCertificate(host string, reason int) error {
+	log.WithFields(logrus.Fields{
+		"host":   host,
+		"reason": reason,
+	}).Debug("Revoking TLS certificate")
+	leaf, priv, err := loadTLSKeyPair(host)
+	if err != nil {
+		return fmt.Errorf("onramp RevokeTLSCertificate: %v", err)
+	}
+	if leaf.KeyUsage&x509.KeyUsageCRLSign == 0 {
+		return fmt.Errorf("onramp RevokeTLSCertificate: certificate for %s cannot sign CRLs, rotate it instead", host)
+	}
+	entries := appendRevocation(revokedEntries(host), leaf.SerialNumber, reason)
+	if err := writeTLSCRL(host, leaf, priv, entries); err != nil {
+		return fmt.Errorf("onramp RevokeTLSCertificate: %v", err)
+	}
+	return nil
+}
+
+func appendRevocation(entries []x509.RevocationListEntry, serial *big.Int, reason int) []x509.RevocationListEntry {
+	for _, e := range entries {
+		if e.SerialNumber.Cmp(serial) == 0 {
+			return entries
+		}
+	}
+	return append(entries, x509.RevocationListEntry{
+		SerialNumber:   serial,
+		RevocationTime: time.Now(),
+		ReasonCode:     reason,
+	})
+}
+
+// tlsRotations counts the certificates RotateTLSCertificate replaced, so
+// listeners holding certificates know when to reload them.
+var tlsRotations atomic.Uint64
+
+// RotateTLSCertificate replaces the certificate stored for host with a new
+// one generated according to profile. The old certificate is revoked with
+// reason and copied to the "revoked" directory of the TLS keystore, and the
+// CRL is re-signed with the new key. The new certificate is generated
+// before anything is replaced, so if that fails the old one stays in use.
+func RotateTLSCertificate(host string, profile *CertProfile, reason int) (tls.Certificate, error) {
+	log.WithFields(logrus.Fields{
+		"host":   host,
+		"reason": reason,
+	}).Debug("Rotating TLS certificate")
+	priv, der, certPEM, keyPEM, err := newTLSKeyPair(host, profile)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("onramp RotateTLSCertificate: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("onramp RotateTLSCertificate: %v", err)
+	}
+	if err := replaceTLSCertificate(host, leaf, priv, certPEM, keyPEM, reason); err != nil {
+		return tls.Certificate{}, fmt.Errorf("onramp RotateTLSCertificate: %v", err)
+	}
+	tlsRotations.Add(1)
+	return TLSKeysWithProfile(host, profile)
+}
+
+// replaceTLSCertificate archives and revokes the certificate stored for
+// host, and stores the new one in its place, under the lock
+// CreateTLSCertificateWithProfile takes. If storing the new certificate
+// fails, the old one is restored.
+func replaceTLSCertificate(host string, leaf *x509.Certificate, priv crypto.Signer, certPEM, keyPEM []byte, reason int) error {
+	tlsKeystorePath, err := TLSKeystorePath()
+	if err != nil {
+		return err
+	}
+	certPath := filepath.Join(tlsKeystorePath, host+".crt")
+	keyPath := filepath.Join(tlsKeystorePath, host+".pem")
+	unlock, err := lockKeyFile(keyPath)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	old, _, err := loadTLSKeyPair(host)
+	if err != nil {
+		return err
+	}
+	oldCert, err := os.ReadFile(certPath)
+	if err != nil {
+		return err
+	}
+	oldKey, err := os.ReadFile(keyPath)
+	if err != nil {
+		return err
+	}
+	entries := appendRevocation(revokedEntries(host), old.SerialNumber, reason)
+	if err := archiveTLSCertificate(host, old, oldCert, oldKey); err != nil {
+		return err
+	}
+	if err := writeKeyFile(keyPath, keyPEM, 0600); err != nil {
+		return err
+	}
+	if err := writeKeyFile(certPath, certPEM, 0644); err != nil {
+		if restoreErr := writeKeyFile(keyPath, oldKey, 0600); restoreErr != nil {
+			log.WithError(restoreErr).WithField("path", keyPath).Error("Failed to restore TLS key")
+		}
+		return err
+	}
+	return writeTLSCRL(host, leaf, priv, entries)
+}
+
+// archiveTLSCertificate stores copies of the certificate and key of host
+// in the revoked directory of the TLS keystore.
+func archiveTLSCertificate(host string, cert *x509.Certificate, certPEM, keyPEM []byte) error {
+	tlsKeystorePath, err := TLSKeystorePath()
+	if err != nil {
+		return err
+	}
+	archive := filepath.Join(tlsKeystorePath, "revoked")
+	if err := os.MkdirAll(archive, 0700); err != nil {
+		return err
+	}
+	serial := cert.SerialNumber.Text(16)
+	for ext, data := range map[string][]byte{".crt": certPEM, ".pem": keyPEM} {
+		to := filepath.Join(archive, host+"."+serial+ext)
+		log.WithFields(logrus.Fields{
+			"host": host,
+			"to":   to,
+		}).Debug("Archiving revoked TLS material")
+		if err := writeKeyFile(to, data, 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RefreshTLSCRL re-signs the CRL for host with the current key if less than
+// half of TLS_CRL_UPDATE_INTERVAL remains until its NextUpdate, or if there
+// is no usable CRL at all.
+func RefreshTLSCRL(host string) error {
+	crl, err := TLSCRL(host)
+	if err == nil && time.Until(crl.NextUpdate) > TLS_CRL_UPDATE_INTERVAL/2 {
+		return nil
+	}
+	leaf, priv, err := loadTLSKeyPair(host)
+	if err != nil {
+		return fmt.Errorf("onramp RefreshTLSCRL: %v", err)
+	}
+	if leaf.KeyUsage&x509.KeyUsageCRLSign == 0 {
+		log.WithField("host", host).Warn("TLS certificate cannot sign CRLs, not refreshing CRL")
+		return nil
+	}
+	log.WithField("host", host).Debug("Refreshing TLS CRL")
+	var entries []x509.RevocationListEntry
+	if crl != nil {
+		entries = crl.RevokedCertificateEntries
+	}
+	return writeTLSCRL(host, leaf, priv, entries)
+}
+
+// ScheduleTLSCRLRefresh keeps the CRLs of the given hosts fresh until ctx
+// is cancelled. It checks them every quarter of TLS_CRL_UPDATE_INTERVAL.
+func ScheduleTLSCRLRefresh(ctx context.Context, hosts ...string) {
+	refresh := func() {
+		for _, host := range hosts {
+			if err := RefreshTLSCRL(host); err != nil {
+				log.WithError(err).WithField("host", host).Error("Failed to refresh TLS CRL")
+			}
+		}
+	}
+	refresh()
+	ticker := time.NewTicker(TLS_CRL_UPDATE_INTERVAL / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			refresh()
+		}
+	}
+}
+
+// CheckTLSRevocation returns an error if cert appears in the CRL stored in
+// the TLS keystore for host. The CRL must be signed either by the
+// certificate currently stored for host or by cert itself. If there is no
+// CRL for host, or KEYSTORE keeps the keys, the certificate is accepted,
+// but a CRL which can't be read or parsed is an error. Stale CRLs are
+// accepted unless TLS_CRL_ACCEPT_STALE is false.
+func CheckTLSRevocation(host string, cert *x509.Certificate) error {
+	crl, err := TLSCRL(host)
+	if err != nil {
+		if os.IsNotExist(err) || errors.Is(err, ErrKeystoreUnsupported) {
+			return nil
+		}
+		log.WithError(err).WithField("host", host).Error("Unusable TLS CRL")
+		return fmt.Errorf("onramp: CRL for %s is unusable: %v", host, err)
+	}
+	verified := crl.CheckSignatureFrom(cert) == nil
+	if !verified {
+		if current, _, err := loadTLSKeyPair(host); err == nil {
+			verified = crl.CheckSignatureFrom(current) == nil
+		}
+	}
+	if !verified {
+		return fmt.Errorf("onramp: CRL for %s is not signed by a known certificate", host)
+	}
+	if time.Now().After(crl.NextUpdate) {
+		if !TLS_CRL_ACCEPT_STALE {
+			return fmt.Errorf("onramp: CRL for %s is stale since %s", host, crl.NextUpdate)
+		}
+		log.WithFields(logrus.Fields{
+			"host":        host,
+			"next_update": crl.NextUpdate,
+		}).Warn("TLS CRL is stale")
+	}
+	for _, e := range crl.RevokedCertificateEntries {
+		if e.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+			return fmt.Errorf("onramp: TLS certificate %s for %s was revoked at %s", cert.SerialNumber.Text(16), host, e.RevocationTime)
+		}
+	}
+	return nil
+}
+
+// VerifyTLSConnectionCRL can be used as tls.Config.VerifyConnection to
+// reject servers whose certificate was revoked in the TLS keystore.
+func VerifyTLSConnectionCRL(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return nil
+	}
+	return CheckTLSRevocation(cs.ServerName, cs.PeerCertificates[0])
+}
+
+// tlsClientConfig returns a copy of config, or a default configuration
+// for self-signed hidden service certificates if it is nil, which checks
+// the TLS keystore's CRLs for serverName.
+func tlsClientConfig(config *tls.Config, serverName string) *tls.Config {
+	var c *tls.Config
+	if config == nil {
+		// hidden service addresses authenticate the server, the
+		// certificates onramp generates are self-signed.
+		c = &tls.Config{InsecureSkipVerify: true}
+	} else {
+		c = config.Clone()
+	}
+	if c.ServerName == "" {
+		c.ServerName = serverName
+	}
+	verify := c.VerifyConnection
+	c.VerifyConnection = func(cs tls.ConnectionState) error {
+		if verify != nil {
+			if err := verify(cs); err != nil {
+				return err
+			}
+		}
+		return VerifyTLSConnectionCRL(cs)
+	}
+	return c
+}
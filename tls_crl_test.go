@@ -0,0 +1,141 @@
+//go:build !gen
+// +build !gen
+
+package onramp
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestTLSRevocation(t *testing.T) {
+	defer func(path string) { TLS_KEYSTORE_PATH = path }(TLS_KEYSTORE_PATH)
+	TLS_KEYSTORE_PATH = t.TempDir()
+	host := "revoke.example.onion"
+	cert, err := TLSKeysWithProfile(host, &CertProfile{KeyAlgorithm: CERT_KEY_ECDSA_P256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+	crl, err := TLSCRL(host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(crl.RevokedCertificateEntries) != 0 {
+		t.Fatalf("new CRL revokes %d certificates", len(crl.RevokedCertificateEntries))
+	}
+	if !crl.NextUpdate.After(crl.ThisUpdate) {
+		t.Fatal("CRL has no next update")
+	}
+	if err := CheckTLSRevocation(host, leaf); err != nil {
+		t.Fatal(err)
+	}
+	if err := RevokeTLSCertificate(host, CRL_REASON_KEY_COMPROMISE); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckTLSRevocation(host, leaf); err == nil {
+		t.Fatal("revoked certificate accepted")
+	}
+
+	// a failed rotation keeps the certificate
+	if _, err := RotateTLSCertificate(host, &CertProfile{KeyAlgorithm: CertKeyAlgorithm(99)}, CRL_REASON_SUPERSEDED); err == nil {
+		t.Fatal("rotated to an unsupported key algorithm")
+	}
+	if kept, err := TLSKeys(host); err != nil || !bytes.Equal(kept.Certificate[0], cert.Certificate[0]) {
+		t.Fatalf("the certificate wasn't kept: %v", err)
+	}
+
+	rotated, err := RotateTLSCertificate(host, &CertProfile{KeyAlgorithm: CERT_KEY_ED25519}, CRL_REASON_SUPERSEDED)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newLeaf, _ := x509.ParseCertificate(rotated.Certificate[0])
+	if err := CheckTLSRevocation(host, newLeaf); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckTLSRevocation(host, leaf); err == nil {
+		t.Fatal("rotated certificate accepted")
+	}
+	crl, err = TLSCRL(host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if crl.Number.Int64() < 3 {
+		t.Errorf("CRL number %v did not increase", crl.Number)
+	}
+	if err := crl.CheckSignatureFrom(newLeaf); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTLSClientConfigChecksCRL(t *testing.T) {
+	defer func(path string) { TLS_KEYSTORE_PATH = path }(TLS_KEYSTORE_PATH)
+	TLS_KEYSTORE_PATH = t.TempDir()
+	host := "client.example.onion"
+	cert, err := TLSKeysWithProfile(host, DefaultOnionCertProfile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	handshake := func() error {
+		c, s := net.Pipe()
+		defer c.Close()
+		defer s.Close()
+		go tls.Server(s, &tls.Config{Certificates: []tls.Certificate{cert}}).Handshake()
+		return tls.Client(c, tlsClientConfig(nil, host)).Handshake()
+	}
+	if err := handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := RevokeTLSCertificate(host, CRL_REASON_KEY_COMPROMISE); err != nil {
+		t.Fatal(err)
+	}
+	if err := handshake(); err == nil {
+		t.Fatal("handshake with revoked certificate succeeded")
+	}
+}
+
+func TestTLSRevocationBadCRL(t *testing.T) {
+	defer func(path string) { TLS_KEYSTORE_PATH = path }(TLS_KEYSTORE_PATH)
+	TLS_KEYSTORE_PATH = t.TempDir()
+	defer func(interval time.Duration) { TLS_CRL_UPDATE_INTERVAL = interval }(TLS_CRL_UPDATE_INTERVAL)
+	defer func(accept bool) { TLS_CRL_ACCEPT_STALE = accept }(TLS_CRL_ACCEPT_STALE)
+	host := "stale.example.onion"
+	if _, err := TLSKeysWithProfile(host, &CertProfile{KeyAlgorithm: CERT_KEY_ECDSA_P256}); err != nil {
+		t.Fatal(err)
+	}
+	leaf, priv, err := loadTLSKeyPair(host)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a stale CRL is accepted unless TLS_CRL_ACCEPT_STALE is false
+	TLS_CRL_UPDATE_INTERVAL = time.Millisecond
+	if err := writeTLSCRL(host, leaf, priv, nil); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if err := CheckTLSRevocation(host, leaf); err != nil {
+		t.Errorf("stale CRL: %v", err)
+	}
+	TLS_CRL_ACCEPT_STALE = false
+	if err := CheckTLSRevocation(host, leaf); err == nil {
+		t.Error("accepted a certificate with a stale CRL")
+	}
+
+	// a CRL which can't be parsed doesn't accept anything
+	crlPath, err := tlsCRLPath(host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(crlPath, []byte("garbage"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckTLSRevocation(host, leaf); err == nil {
+		t.Error("accepted a certificate with an unparsable CRL")
+	}
+}
@@ -0,0 +1,200 @@
+package onramp
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"time"
+)
+
+// CertKeyAlgorithm selects the type of private key generated for a TLS
+// certificate.
+type CertKeyAlgorithm int
+
+const (
+	// CERT_KEY_ECDSA_P384 is the default and matches the certificates
+	// onramp has always generated.
+	CERT_KEY_ECDSA_P384 CertKeyAlgorithm = iota
+	CERT_KEY_ECDSA_P256
+	CERT_KEY_ED25519
+	CERT_KEY_RSA
+)
+
+// DEFAULT_RSA_BITS is the RSA modulus size used when a CertProfile asks for
+// an RSA key without specifying RSABits.
+const DEFAULT_RSA_BITS = 3072
+
+// DEFAULT_CERT_VALIDITY is the validity period used when a CertProfile does
+// not specify one.
+const DEFAULT_CERT_VALIDITY = 5 * 365 * 24 * time.Hour
+
+func (a CertKeyAlgorithm) String() string {
+	switch a {
+	case CERT_KEY_ECDSA_P384:
+		return "ECDSA-P384"
+	case CERT_KEY_ECDSA_P256:
+		return "ECDSA-P256"
+	case CERT_KEY_ED25519:
+		return "Ed25519"
+	case CERT_KEY_RSA:
+		return "RSA"
+	default:
+		return fmt.Sprintf("CertKeyAlgorithm(%d)", int(a))
+	}
+}
+
+// CertProfile describes how onramp generates self-signed TLS certificates.
+// The zero value is usable and produces an ECDSA P-384 certificate with a
+// subject containing only the common name.
+type CertProfile struct {
+	// KeyAlgorithm is the kind of key generated for the certificate.
+	KeyAlgorithm CertKeyAlgorithm
+	// RSABits is the modulus size for CERT_KEY_RSA, DEFAULT_RSA_BITS if 0.
+	RSABits int
+	// Validity is how long the certificate is valid from the time it is
+	// generated, DEFAULT_CERT_VALIDITY if 0.
+	Validity time.Duration
+	// Subject is the certificate subject. If CommonName is empty it is set
+	// to the first hostname the certificate is generated for.
+	Subject pkix.Name
+	// AltNames are additional DNS names or IP addresses added to the
+	// certificate's subject alternative names.
+	AltNames []string
+	// ExtKeyUsage lists the extended key usages of the certificate,
+	// server authentication if empty.
+	ExtKeyUsage []x509.ExtKeyUsage
+}
+
+// DefaultGarlicCertProfile returns the profile used for Garlic services,
+// which keeps the I2P subject onramp has always used.
+func DefaultGarlicCertProfile() *CertProfile {
+	return &CertProfile{
+		Subject: pkix.Name{
+			Organization:       []string{"I2P Anonymous Network"},
+			OrganizationalUnit: []string{"I2P"},
+			Locality:           []string{"XX"},
+			StreetAddress:      []string{"XX"},
+			Country:            []string{"XX"},
+		},
+	}
+}
+
+// DefaultOnionCertProfile returns the profile used for Onion services. It
+// carries no identifying subject fields besides the common name.
+func DefaultOnionCertProfile() *CertProfile {
+	return &CertProfile{}
+}
+
+func (p *CertProfile) validity() time.Duration {
+	if p.Validity <= 0 {
+		return DEFAULT_CERT_VALIDITY
+	}
+	return p.Validity
+}
+
+func (p *CertProfile) extKeyUsage() []x509.ExtKeyUsage {
+	if len(p.ExtKeyUsage) == 0 {
+		return []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	}
+	return p.ExtKeyUsage
+}
+
+// GenerateKey creates a new private key of the profile's KeyAlgorithm.
+func (p *CertProfile) GenerateKey() (crypto.Signer, error) {
+	return p.generateKey(rand.Reader)
+}
+
+func (p *CertProfile) generateKey(r io.Reader) (crypto.Signer, error) {
+	switch p.KeyAlgorithm {
+	case CERT_KEY_ECDSA_P384:
+		return ecdsa.GenerateKey(elliptic.P384(), r)
+	case CERT_KEY_ECDSA_P256:
+		return ecdsa.GenerateKey(elliptic.P256(), r)
+	case CERT_KEY_ED25519:
+		_, priv, err := ed25519.GenerateKey(r)
+		if err != nil {
+			return nil, err
+		}
+		return priv, nil
+	case CERT_KEY_RSA:
+		bits := p.RSABits
+		if bits == 0 {
+			bits = DEFAULT_RSA_BITS
+		}
+		if bits < 2048 {
+			return nil, fmt.Errorf("onramp CertProfile: RSA keys must be at least 2048 bits, got %d", bits)
+		}
+		return rsa.GenerateKey(r, bits)
+	default:
+		return nil, fmt.Errorf("onramp CertProfile: unsupported key algorithm %s", p.KeyAlgorithm)
+	}
+}
+
+// signatureAlgorithm returns the signature algorithm for a certificate
+// signed by priv.
+func signatureAlgorithm(priv crypto.Signer) (x509.SignatureAlgorithm, x509.KeyUsage, error) {
+	usage := x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature
+	switch k := priv.(type) {
+	case *ecdsa.PrivateKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return x509.ECDSAWithSHA256, usage, nil
+		case elliptic.P384():
+			return x509.ECDSAWithSHA512, usage, nil
+		case elliptic.P521():
+			return x509.ECDSAWithSHA512, usage, nil
+		}
+		return 0, 0, fmt.Errorf("onramp: unsupported ECDSA curve %s", k.Curve.Params().Name)
+	case ed25519.PrivateKey:
+		return x509.PureEd25519, usage, nil
+	case *rsa.PrivateKey:
+		return x509.SHA256WithRSA, usage | x509.KeyUsageKeyEncipherment, nil
+	default:
+		return 0, 0, fmt.Errorf("onramp: unsupported private key type %T", priv)
+	}
+}
+
+// encodeTLSPrivateKey PEM-encodes priv for storage in the TLS keystore.
+// ECDSA keys use the SEC 1 form with explicit curve parameters like onramp
+// always has, everything else is stored as PKCS #8.
+func encodeTLSPrivateKey(w io.Writer, priv crypto.Signer) error {
+	if k, ok := priv.(*ecdsa.PrivateKey); ok {
+		var oid asn1.ObjectIdentifier
+		switch k.Curve {
+		case elliptic.P256():
+			oid = asn1.ObjectIdentifier{1, 2, 840, 10045, 3, 1, 7}
+		case elliptic.P384():
+			oid = asn1.ObjectIdentifier{1, 3, 132, 0, 34} // http://www.ietf.org/rfc/rfc5480.txt
+		case elliptic.P521():
+			oid = asn1.ObjectIdentifier{1, 3, 132, 0, 35}
+		}
+		if oid != nil {
+			params, err := asn1.Marshal(oid)
+			if err != nil {
+				return err
+			}
+			if err := pem.Encode(w, &pem.Block{Type: "EC PARAMETERS", Bytes: params}); err != nil {
+				return err
+			}
+		}
+		ecder, err := x509.MarshalECPrivateKey(k)
+		if err != nil {
+			return err
+		}
+		return pem.Encode(w, &pem.Block{Type: "EC PRIVATE KEY", Bytes: ecder})
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return err
+	}
+	return pem.Encode(w, &pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
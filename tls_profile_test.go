@@ -0,0 +1,90 @@
+//go:build !gen
+// +build !gen
+
+package onramp
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+	"time"
+)
+
+func TestCertProfileAlgorithms(t *testing.T) {
+	for _, alg := range []CertKeyAlgorithm{CERT_KEY_ECDSA_P384, CERT_KEY_ECDSA_P256, CERT_KEY_ED25519, CERT_KEY_RSA} {
+		profile := &CertProfile{
+			KeyAlgorithm: alg,
+			RSABits:      2048,
+			Validity:     24 * time.Hour,
+			Subject:      pkix.Name{Organization: []string{"Example"}},
+			AltNames:     []string{"www.example.onion", "127.0.0.1"},
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		}
+		priv, err := profile.GenerateKey()
+		if err != nil {
+			t.Fatalf("%s: %v", alg, err)
+		}
+		der, err := NewTLSCertificateWithProfile(profile, priv, "example.onion")
+		if err != nil {
+			t.Fatalf("%s: %v", alg, err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatalf("%s: %v", alg, err)
+		}
+		switch alg {
+		case CERT_KEY_ED25519:
+			if _, ok := cert.PublicKey.(ed25519.PublicKey); !ok {
+				t.Errorf("%s: unexpected public key %T", alg, cert.PublicKey)
+			}
+		case CERT_KEY_RSA:
+			if _, ok := cert.PublicKey.(*rsa.PublicKey); !ok {
+				t.Errorf("%s: unexpected public key %T", alg, cert.PublicKey)
+			}
+		default:
+			if _, ok := cert.PublicKey.(*ecdsa.PublicKey); !ok {
+				t.Errorf("%s: unexpected public key %T", alg, cert.PublicKey)
+			}
+		}
+		if cert.Subject.CommonName != "example.onion" {
+			t.Errorf("%s: common name %q", alg, cert.Subject.CommonName)
+		}
+		if len(cert.Subject.Organization) != 1 || cert.Subject.Organization[0] != "Example" {
+			t.Errorf("%s: organization %v", alg, cert.Subject.Organization)
+		}
+		if err := cert.VerifyHostname("www.example.onion"); err != nil {
+			t.Errorf("%s: %v", alg, err)
+		}
+		if len(cert.IPAddresses) != 1 {
+			t.Errorf("%s: IP addresses %v", alg, cert.IPAddresses)
+		}
+		if len(cert.ExtKeyUsage) != 2 {
+			t.Errorf("%s: extended key usage %v", alg, cert.ExtKeyUsage)
+		}
+		if cert.NotAfter.Sub(cert.NotBefore) != 24*time.Hour {
+			t.Errorf("%s: validity %v", alg, cert.NotAfter.Sub(cert.NotBefore))
+		}
+	}
+}
+
+func TestTLSKeysWithProfile(t *testing.T) {
+	defer func(path string) { TLS_KEYSTORE_PATH = path }(TLS_KEYSTORE_PATH)
+	TLS_KEYSTORE_PATH = t.TempDir()
+	for _, alg := range []CertKeyAlgorithm{CERT_KEY_ECDSA_P256, CERT_KEY_ED25519, CERT_KEY_RSA} {
+		host := alg.String() + ".example.onion"
+		cert, err := TLSKeysWithProfile(host, &CertProfile{KeyAlgorithm: alg, RSABits: 2048})
+		if err != nil {
+			t.Fatalf("%s: %v", alg, err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(leaf.Subject.Organization) != 0 {
+			t.Errorf("%s: unexpected organization %v", alg, leaf.Subject.Organization)
+		}
+	}
+}
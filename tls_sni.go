@@ -0,0 +1,334 @@
+package onramp
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/cretz/bine/torutil"
+)
+
+// TLS_HANDSHAKE_TIMEOUT limits how long listeners which inspect the TLS
+// handshake wait for a client to complete it, and how long the listeners
+// which dispatch connections to other listeners wait for them to be
+// accepted before closing them. Hidden service round trips are slow, so it
+// is generous.
+var TLS_HANDSHAKE_TIMEOUT = 2 * time.Minute
+
+type sniRoute struct {
+	cert *tls.Certificate
+	// rotation is the value of tlsRotations when cert was loaded
+	rotation uint64
+	listener *virtualListener
+	backend  string
+}
+
+// SNIListener serves several TLS hostnames on a single hidden service
+// listener. Certificates are selected by the server name the client asks
+// for and taken from the TLS keystore, generating them the first time a
+// name is configured. Connections for a configured name are delivered to
+// the listener returned by Host or proxied to the backend configured with
+// HostBackend, and closed if that listener doesn't accept them. All other
+// connections are returned by Accept and use the certificate of the
+// default host. Certificates replaced by RotateTLSCertificate are reloaded
+// on the next handshake.
+type SNIListener struct {
+	net.Listener
+	profile     *CertProfile
+	defaultHost string
+	mu          sync.RWMutex
+	routes      map[string]*sniRoute
+	accept      *virtualListener
+	nextProtos  []string
+}
+
+func normalizeHost(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
+
+// NewSNIListener wraps l, which must return plain connections, in an
+// SNIListener. defaultHost is used for clients which send no server name or
+// one which is not configured. Certificates are generated according to
+// profile.
+func NewSNIListener(l net.Listener, profile *CertProfile, defaultHost string) (*SNIListener, error) {
+	return newSNIListener(l, profile, defaultHost, nil)
+}
+
+// NewSNIListenerALPN is like NewSNIListener, but also offers nextProtos to
+// clients. The result can be wrapped in an ALPNListener.
+func NewSNIListenerALPN(l net.Listener, profile *CertProfile, defaultHost string, nextProtos []string) (*SNIListener, error) {
+	return newSNIListener(l, profile, defaultHost, nextProtos)
+}
+
+func newSNIListener(l net.Listener, profile *CertProfile, defaultHost string, nextProtos []string) (*SNIListener, error) {
+	log.WithFields(logrus.Fields{
+		"address":      l.Addr().String(),
+		"default_host": defaultHost,
+	}).Debug("Creating SNI listener")
+	s := &SNIListener{
+		Listener:    l,
+		profile:     profile,
+		defaultHost: normalizeHost(defaultHost),
+		routes:      make(map[string]*sniRoute),
+		accept:      newVirtualListener(l.Addr()),
+		nextProtos:  nextProtos,
+	}
+	if _, err := s.route(s.defaultHost); err != nil {
+		return nil, err
+	}
+	go s.serve()
+	return s, nil
+}
+
+// route returns the route for name, creating it and its certificate if
+// it does not exist yet.
+func (s *SNIListener) route(name string) (*sniRoute, error) {
+	name = normalizeHost(name)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r, ok := s.routes[name]; ok {
+		return r, nil
+	}
+	rotation := tlsRotations.Load()
+	cert, err := TLSKeysWithProfile(name, s.profile)
+	if err != nil {
+		return nil, fmt.Errorf("onramp SNIListener: %v", err)
+	}
+	r := &sniRoute{cert: &cert, rotation: rotation}
+	s.routes[name] = r
+	return r, nil
+}
+
+// Host configures name on the listener and returns a net.Listener which
+// receives the TLS connections for it.
+func (s *SNIListener) Host(name string) (net.Listener, error) {
+	log.WithField("host", name).Debug("Adding SNI host")
+	r, err := s.route(name)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r.listener == nil {
+		r.listener = newVirtualListener(s.Addr())
+		r.backend = ""
+	}
+	return r.listener, nil
+}
+
+// HostBackend configures name on the listener and proxies the decrypted
+// connections for it to the TCP service at backend.
+func (s *SNIListener) HostBackend(name, backend string) error {
+	log.WithFields(logrus.Fields{
+		"host":    name,
+		"backend": backend,
+	}).Debug("Adding SNI backend")
+	r, err := s.route(name)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r.listener != nil {
+		r.listener.Close()
+		r.listener = nil
+	}
+	r.backend = backend
+	return nil
+}
+
+// Hosts returns the names configured on the listener.
+func (s *SNIListener) Hosts() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	hosts := make([]string, 0, len(s.routes))
+	for name := range s.routes {
+		hosts = append(hosts, name)
+	}
+	return hosts
+}
+
+// lookup returns the configured name for a server name and its route,
+// the default host's if it is not configured.
+func (s *SNIListener) lookup(name string) (string, *sniRoute) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	name = normalizeHost(name)
+	if r, ok := s.routes[name]; ok {
+		return name, r
+	}
+	return s.defaultHost, s.routes[s.defaultHost]
+}
+
+// getCertificate returns the certificate of the route for the client's
+// server name, reloading it if any certificate was rotated since it was
+// loaded.
+func (s *SNIListener) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name, r := s.lookup(hello.ServerName)
+	rotation := tlsRotations.Load()
+	s.mu.RLock()
+	cert, current := r.cert, r.rotation == rotation
+	s.mu.RUnlock()
+	if current {
+		return cert, nil
+	}
+	log.WithField("host", name).Debug("Reloading TLS certificate after rotation")
+	reloaded, err := TLSKeysWithProfile(name, s.profile)
+	if err != nil {
+		log.WithError(err).WithField("host", name).Error("Failed to reload TLS certificate")
+		return nil, fmt.Errorf("onramp SNIListener: %v", err)
+	}
+	s.mu.Lock()
+	r.cert, r.rotation = &reloaded, rotation
+	s.mu.Unlock()
+	return &reloaded, nil
+}
+
+// Accept returns the next connection for the default host or for a name
+// without its own listener or backend.
+// implements net.Listener
+func (s *SNIListener) Accept() (net.Conn, error) {
+	return s.accept.Accept()
+}
+
+// Close closes the underlying listener and every host listener.
+// implements net.Listener
+func (s *SNIListener) Close() error {
+	s.accept.Close()
+	s.mu.Lock()
+	for _, r := range s.routes {
+		if r.listener != nil {
+			r.listener.Close()
+		}
+	}
+	s.mu.Unlock()
+	return s.Listener.Close()
+}
+
+func (s *SNIListener) serve() {
+	config := &tls.Config{
+		GetCertificate: s.getCertificate,
+		NextProtos:     s.nextProtos,
+	}
+	for {
+		conn, err := s.Listener.Accept()
+		if err != nil {
+			log.WithError(err).Debug("SNI listener stopped accepting")
+			s.accept.Close()
+			return
+		}
+		go s.dispatch(tls.Server(conn, config))
+	}
+}
+
+func (s *SNIListener) dispatch(conn *tls.Conn) {
+	if err := handshakeWithTimeout(conn); err != nil {
+		log.WithError(err).Debug("TLS handshake failed")
+		conn.Close()
+		return
+	}
+	name := conn.ConnectionState().ServerName
+	s.mu.RLock()
+	r, ok := s.routes[normalizeHost(name)]
+	var listener *virtualListener
+	var backend string
+	if ok {
+		listener, backend = r.listener, r.backend
+	}
+	s.mu.RUnlock()
+	log.WithFields(logrus.Fields{
+		"server_name": name,
+		"backend":     backend,
+	}).Debug("Routing TLS connection")
+	if backend != "" {
+		proxyToBackend(conn, backend)
+		return
+	}
+	// a name with its own listener never falls back to Accept
+	if listener == nil {
+		listener = s.accept
+	}
+	if !listener.deliverTimeout(conn, TLS_HANDSHAKE_TIMEOUT) {
+		log.WithField("server_name", name).Debug("No listener accepted TLS connection, closing it")
+		conn.Close()
+	}
+}
+
+func handshakeWithTimeout(conn *tls.Conn) error {
+	conn.SetDeadline(time.Now().Add(TLS_HANDSHAKE_TIMEOUT))
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+	return conn.SetDeadline(time.Time{})
+}
+
+// proxyToBackend copies data between conn and a new TCP connection to
+// backend until either side closes.
+func proxyToBackend(conn net.Conn, backend string) {
+	defer conn.Close()
+	remote, err := net.Dial("tcp", backend)
+	if err != nil {
+		log.WithError(err).WithField("backend", backend).Error("Failed to dial backend")
+		return
+	}
+	defer remote.Close()
+	go io.Copy(remote, conn)
+	io.Copy(conn, remote)
+}
+
+// ListenSNI returns an SNIListener on the Garlic structure's I2P keys. Its
+// default host is the .b32.i2p address, hosts can be any further names,
+// like subdomains or human-readable .i2p names, which point at it. It
+// offers the ALPN protocols in NextProtos.
+func (g *Garlic) ListenSNI(hosts ...string) (*SNIListener, error) {
+	log.WithField("hosts", hosts).Debug("Creating SNI listener for Garlic service")
+	listener, err := g.Listen()
+	if err != nil {
+		return nil, err
+	}
+	keys, err := g.Keys()
+	if err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("onramp ListenSNI: %v", err)
+	}
+	return newSNIListenerWithHosts(listener, g.certProfile(), keys.Addr().Base32(), g.NextProtos, hosts)
+}
+
+// ListenSNI returns an SNIListener on the Onion's keys. Its default host is
+// the .onion address, hosts can be any further names, like subdomains,
+// which point at it. It offers the ALPN protocols in NextProtos.
+func (o *Onion) ListenSNI(hosts ...string) (*SNIListener, error) {
+	log.WithField("hosts", hosts).Debug("Creating SNI listener for Onion service")
+	listener, err := o.Listen()
+	if err != nil {
+		return nil, err
+	}
+	keys, err := o.Keys()
+	if err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("onramp ListenSNI: %v", err)
+	}
+	onionHost := torutil.OnionServiceIDFromPrivateKey(keys) + ".onion"
+	return newSNIListenerWithHosts(listener, o.certProfile(), onionHost, o.NextProtos, hosts)
+}
+
+func newSNIListenerWithHosts(listener net.Listener, profile *CertProfile, defaultHost string, nextProtos, hosts []string) (*SNIListener, error) {
+	s, err := newSNIListener(listener, profile, defaultHost, nextProtos)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	for _, host := range hosts {
+		if _, err := s.route(host); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
@@ -0,0 +1,148 @@
+//go:build !gen
+// +build !gen
+
+package onramp
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSNIListener(t *testing.T) {
+	defer func(path string) { TLS_KEYSTORE_PATH = path }(TLS_KEYSTORE_PATH)
+	TLS_KEYSTORE_PATH = t.TempDir()
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sni, err := NewSNIListener(tcp, &CertProfile{KeyAlgorithm: CERT_KEY_ECDSA_P256}, "default.example.i2p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sni.Close()
+	blog, err := sni.Host("blog.example.i2p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		conn, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		conn.Write([]byte("backend"))
+		conn.Close()
+	}()
+	if err := sni.HostBackend("api.example.i2p", backend.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+
+	dial := func(name string) *tls.Conn {
+		conn, err := tls.Dial("tcp", tcp.Addr().String(), &tls.Config{ServerName: name, InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cn := conn.ConnectionState().PeerCertificates[0].Subject.CommonName; cn != name && name != "unknown.example.i2p" {
+			t.Errorf("got certificate for %q, want %q", cn, name)
+		}
+		return conn
+	}
+	expect := func(l net.Listener, name string) {
+		client := dial(name)
+		defer client.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if got := conn.(*tls.Conn).ConnectionState().ServerName; got != name {
+			t.Errorf("listener got %q, want %q", got, name)
+		}
+	}
+	expect(blog, "blog.example.i2p")
+	expect(sni, "default.example.i2p")
+	expect(sni, "unknown.example.i2p")
+
+	api := dial("api.example.i2p")
+	defer api.Close()
+	body, err := io.ReadAll(api)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "backend" {
+		t.Errorf("backend returned %q", body)
+	}
+
+	// the listener serves the rotated certificate
+	old := dial("blog.example.i2p")
+	old.Close()
+	if _, err := RotateTLSCertificate("blog.example.i2p", &CertProfile{KeyAlgorithm: CERT_KEY_ECDSA_P256}, CRL_REASON_SUPERSEDED); err != nil {
+		t.Fatal(err)
+	}
+	rotated := dial("blog.example.i2p")
+	rotated.Close()
+	if old.ConnectionState().PeerCertificates[0].Equal(rotated.ConnectionState().PeerCertificates[0]) {
+		t.Error("the listener kept the rotated certificate")
+	}
+}
+
+func TestSNIListenerUnaccepted(t *testing.T) {
+	defer func(path string) { TLS_KEYSTORE_PATH = path }(TLS_KEYSTORE_PATH)
+	TLS_KEYSTORE_PATH = t.TempDir()
+	defer func(timeout time.Duration) { TLS_HANDSHAKE_TIMEOUT = timeout }(TLS_HANDSHAKE_TIMEOUT)
+	TLS_HANDSHAKE_TIMEOUT = time.Second
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sni, err := NewSNIListener(tcp, &CertProfile{KeyAlgorithm: CERT_KEY_ECDSA_P256}, "default.example.i2p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sni.Close()
+	if _, err := sni.Host("blog.example.i2p"); err != nil {
+		t.Fatal(err)
+	}
+	// nobody accepts on either listener, so the connections are closed
+	for _, name := range []string{"blog.example.i2p", "unknown.example.i2p"} {
+		conn, err := tls.Dial("tcp", tcp.Addr().String(), &tls.Config{ServerName: name, InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("%s: read %v, want EOF", name, err)
+		}
+		conn.Close()
+	}
+
+	// a name with a listener doesn't fall back to Accept
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := sni.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+	conn, err := tls.Dial("tcp", tcp.Addr().String(), &tls.Config{ServerName: "blog.example.i2p", InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read %v, want EOF", err)
+	}
+	select {
+	case conn := <-accepted:
+		conn.Close()
+		t.Error("the default listener accepted a connection for a configured name")
+	default:
+	}
+}
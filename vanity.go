@@ -0,0 +1,325 @@
+//go:build !gen
+// +build !gen
+
+package onramp
+
+import (
+	"context"
+	stded25519 "crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cretz/bine/torutil/ed25519"
+	"github.com/go-i2p/i2pkeys"
+	"github.com/sirupsen/logrus"
+)
+
+// Vanity searches for keys whose onion or b32.i2p address starts with a
+// prefix. Every character of the prefix makes the search take 32 times
+// longer.
+type Vanity struct {
+	// Prefix is what the address has to start with, in base32: the
+	// letters a to z and the digits 2 to 7.
+	Prefix string
+	// Workers is the number of goroutines searching, runtime.NumCPU() if
+	// zero.
+	Workers int
+	// Progress is called every ProgressInterval while searching and once
+	// when the search ends.
+	Progress func(VanityProgress)
+	// ProgressInterval is a second if zero.
+	ProgressInterval time.Duration
+}
+
+// VanityProgress is the state of a vanity search.
+type VanityProgress struct {
+	Attempts uint64
+	Elapsed  time.Duration
+	// Rate is the number of keys tried per second.
+	Rate float64
+	// Probability is the chance a search finds the prefix within Attempts.
+	Probability float64
+	// ETA is the expected remaining time. Every attempt is as likely to
+	// succeed as the first, so it doesn't shrink while searching.
+	ETA time.Duration
+	// Done is true in the last report.
+	Done bool
+}
+
+// Attempts returns the expected number of keys the search tries.
+func (v *Vanity) Attempts() float64 {
+	return math.Pow(32, float64(len(v.Prefix)))
+}
+
+// Estimate returns the expected time the search takes when rate keys are
+// tried per second, as OnionRate and I2PRate measure.
+func (v *Vanity) Estimate(rate float64) time.Duration {
+	if rate <= 0 {
+		return time.Duration(math.MaxInt64)
+	}
+	seconds := v.Attempts() / rate
+	if seconds >= math.MaxInt64/float64(time.Second) {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// OnionRate measures how many onion keys per second the search tries on
+// this machine, by trying them during d.
+func (v *Vanity) OnionRate(d time.Duration) float64 {
+	return v.rate(d, v.onionWorker)
+}
+
+// I2PRate measures how many I2P destinations per second the search tries
+// on this machine, by trying them during d.
+func (v *Vanity) I2PRate(d time.Duration) float64 {
+	return v.rate(d, v.i2pWorker)
+}
+
+// Onion searches for Tor keys whose onion address starts with the prefix,
+// until ctx is done. The error then wraps ctx.Err().
+func (v *Vanity) Onion(ctx context.Context) (ed25519.KeyPair, error) {
+	if err := v.validate(51); err != nil {
+		return nil, fmt.Errorf("onramp Vanity.Onion: %v", err)
+	}
+	found, err := v.search(ctx, v.onionWorker)
+	if err != nil {
+		return nil, fmt.Errorf("onramp Vanity.Onion: %w", err)
+	}
+	return found.(ed25519.KeyPair), nil
+}
+
+// I2P searches for I2P keys whose b32.i2p address starts with the
+// prefix, until ctx is done. The keys are generated locally, with an
+// Ed25519 signing key and an X25519 encryption key.
+func (v *Vanity) I2P(ctx context.Context) (i2pkeys.I2PKeys, error) {
+	if err := v.validate(51); err != nil {
+		return i2pkeys.I2PKeys{}, fmt.Errorf("onramp Vanity.I2P: %v", err)
+	}
+	found, err := v.search(ctx, v.i2pWorker)
+	if err != nil {
+		return i2pkeys.I2PKeys{}, fmt.Errorf("onramp Vanity.I2P: %w", err)
+	}
+	return found.(i2pkeys.I2PKeys), nil
+}
+
+// StoreOnion searches for Tor keys like Onion does and stores them for
+// the given onion key name, which must not have keys yet.
+func (v *Vanity) StoreOnion(ctx context.Context, keyName string) (ed25519.KeyPair, error) {
+	if ok, err := keyStored(TorKeystorePath, "onionkeys", keyName+".tor.private"); err != nil {
+		return nil, fmt.Errorf("onramp Vanity.StoreOnion: %v", err)
+	} else if ok {
+		return nil, fmt.Errorf("onramp Vanity.StoreOnion: %s already has keys", keyName)
+	}
+	keys, err := v.Onion(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return ImportTorKeys(keyName, keys.PrivateKey())
+}
+
+// StoreI2P searches for I2P keys like I2P does and stores them for the
+// given tunnel name, which must not have keys yet.
+func (v *Vanity) StoreI2P(ctx context.Context, tunName string) (i2pkeys.I2PKeys, error) {
+	if ok, err := keyStored(I2PKeystorePath, "i2pkeys", tunName+".i2p.private"); err != nil {
+		return i2pkeys.I2PKeys{}, fmt.Errorf("onramp Vanity.StoreI2P: %v", err)
+	} else if ok {
+		return i2pkeys.I2PKeys{}, fmt.Errorf("onramp Vanity.StoreI2P: %s already has keys", tunName)
+	}
+	keys, err := v.I2P(ctx)
+	if err != nil {
+		return i2pkeys.I2PKeys{}, err
+	}
+	return ImportI2PKeys(tunName, []byte(keys.Both))
+}
+
+// validate lower-cases the prefix and checks it can be an address prefix
+// of up to max characters. Longer prefixes depend on the checksum of onion
+// addresses, or on the last bit of b32 ones.
+func (v *Vanity) validate(max int) error {
+	v.Prefix = strings.ToLower(v.Prefix)
+	if v.Prefix == "" || len(v.Prefix) > max {
+		return fmt.Errorf("prefix must have 1 to %d characters", max)
+	}
+	if strings.Trim(v.Prefix, "abcdefghijklmnopqrstuvwxyz234567") != "" {
+		return fmt.Errorf("prefix %q isn't base32", v.Prefix)
+	}
+	return nil
+}
+
+// vanityBatch is how many keys a worker tries between checking whether
+// the search is over.
+const vanityBatch = 64
+
+// vanityWorker tries a batch of keys and returns the one matching the
+// prefix, or nil. Every worker has its own.
+type vanityWorker func() (any, error)
+
+// search runs the workers newWorker returns until one finds a key or ctx
+// is done.
+func (v *Vanity) search(ctx context.Context, newWorker func() (vanityWorker, error)) (any, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	workers := v.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	log.WithFields(logrus.Fields{
+		"prefix":   v.Prefix,
+		"workers":  workers,
+		"attempts": v.Attempts(),
+	}).Debug("Searching for a vanity address")
+	var (
+		attempts atomic.Uint64
+		once     sync.Once
+		found    any
+		err      error
+		wg       sync.WaitGroup
+	)
+	finish := func(f any, e error) {
+		once.Do(func() {
+			found, err = f, e
+			cancel()
+		})
+	}
+	start := time.Now()
+	for i := 0; i < workers; i++ {
+		try, e := newWorker()
+		if e != nil {
+			finish(nil, e)
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				f, e := try()
+				attempts.Add(vanityBatch)
+				if f != nil || e != nil {
+					finish(f, e)
+					return
+				}
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	interval := v.ProgressInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for searching := true; searching; {
+		select {
+		case <-ticker.C:
+			v.report(attempts.Load(), time.Since(start), false)
+		case <-done:
+			searching = false
+		}
+	}
+	v.report(attempts.Load(), time.Since(start), true)
+	if found == nil && err == nil {
+		err = ctx.Err()
+	}
+	if found != nil {
+		log.WithFields(logrus.Fields{
+			"prefix":   v.Prefix,
+			"attempts": attempts.Load(),
+			"elapsed":  time.Since(start),
+		}).Debug("Found a vanity address")
+	}
+	return found, err
+}
+
+func (v *Vanity) report(attempts uint64, elapsed time.Duration, done bool) {
+	if v.Progress == nil {
+		return
+	}
+	p := VanityProgress{Attempts: attempts, Elapsed: elapsed, Done: done}
+	if elapsed > 0 {
+		p.Rate = float64(attempts) / elapsed.Seconds()
+	}
+	p.Probability = -math.Expm1(float64(attempts) * math.Log1p(-1/v.Attempts()))
+	p.ETA = v.Estimate(p.Rate)
+	v.Progress(p)
+}
+
+// rate runs workers which can't succeed for d and returns the keys they
+// tried per second.
+func (v *Vanity) rate(d time.Duration, newWorker func() (vanityWorker, error)) float64 {
+	var rate float64
+	w := &Vanity{
+		// a prefix longer than the hash or key never matches
+		Prefix:           strings.Repeat("a", 60),
+		Workers:          v.Workers,
+		Progress:         func(p VanityProgress) { rate = p.Rate },
+		ProgressInterval: 2 * d,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	w.search(ctx, newWorker)
+	return rate
+}
+
+// prefixBytes returns how many bytes encode to at least n base32
+// characters.
+func prefixBytes(n int) int {
+	return (n*5 + 7) / 8
+}
+
+func (v *Vanity) onionWorker() (vanityWorker, error) {
+	prefix := v.Prefix
+	n := prefixBytes(len(prefix))
+	buf := make([]byte, 0, 64)
+	var seed [stded25519.SeedSize]byte
+	return func() (any, error) {
+		for i := 0; i < vanityBatch; i++ {
+			if _, err := rand.Read(seed[:]); err != nil {
+				return nil, err
+			}
+			priv := stded25519.NewKeyFromSeed(seed[:])
+			// the onion address starts with the public key
+			pub := priv[stded25519.SeedSize:]
+			if n <= len(pub) && strings.HasPrefix(string(i2pBase32.AppendEncode(buf[:0], pub[:n])), prefix) {
+				return ed25519.FromCryptoPrivateKey(priv), nil
+			}
+		}
+		return nil, nil
+	}, nil
+}
+
+func (v *Vanity) i2pWorker() (vanityWorker, error) {
+	d, err := newLocalDestination(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	prefix := v.Prefix
+	n := prefixBytes(len(prefix))
+	dest := d.dest()
+	buf := make([]byte, 0, 64)
+	// changing the padding changes the address, which is cheaper than
+	// generating new keys
+	return func() (any, error) {
+		for i := 0; i < vanityBatch; i++ {
+			binary.BigEndian.PutUint64(d.padding[:], binary.BigEndian.Uint64(d.padding[:])+1)
+			d.setPadding(dest)
+			hash := sha256.Sum256(dest)
+			if n <= len(hash) && strings.HasPrefix(string(i2pBase32.AppendEncode(buf[:0], hash[:n])), prefix) {
+				return d.keys(), nil
+			}
+		}
+		return nil, nil
+	}, nil
+}
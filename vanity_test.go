@@ -0,0 +1,129 @@
+//go:build !gen
+// +build !gen
+
+package onramp
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	stded25519 "crypto/ed25519"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cretz/bine/torutil"
+)
+
+func TestVanityOnion(t *testing.T) {
+	var last VanityProgress
+	v := &Vanity{Prefix: "A", Workers: 2, Progress: func(p VanityProgress) { last = p }}
+	keys, err := v.Onion(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := torutil.OnionServiceIDFromV3PublicKey(keys.PublicKey()); !strings.HasPrefix(id, "a") {
+		t.Errorf("found %s.onion", id)
+	}
+	if !bytes.Equal(keys.PublicKey(), keys.PrivateKey().PublicKey()) {
+		t.Error("the public key doesn't belong to the private key")
+	}
+	if !last.Done || last.Attempts == 0 {
+		t.Errorf("last progress %+v", last)
+	}
+}
+
+func TestVanityI2P(t *testing.T) {
+	keys, err := (&Vanity{Prefix: "ab"}).I2P(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(keys.Addr().Base32(), "ab") {
+		t.Errorf("found %s", keys.Addr().Base32())
+	}
+	dest, enc, seed, rest, err := privateKeyParts(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sigType, _ := certSigType(dest); sigType != SIG_ED25519 || certCryptoType(dest) != ENC_ECIES_X25519 || len(rest) != 0 {
+		t.Errorf("destination has types %d/%d", sigType, certCryptoType(dest))
+	}
+	if pub := stded25519.NewKeyFromSeed(seed).Public().(stded25519.PublicKey); !bytes.Equal(pub, dest[352:384]) {
+		t.Error("the signing key doesn't belong to the destination")
+	}
+	x, err := ecdh.X25519().NewPrivateKey(enc)
+	if err != nil || !bytes.Equal(x.PublicKey().Bytes(), dest[:32]) {
+		t.Errorf("the encryption key doesn't belong to the destination: %v", err)
+	}
+	if !bytes.Equal(dest[32:64], dest[320:352]) {
+		t.Error("the padding isn't repeated")
+	}
+}
+
+func TestVanityCancel(t *testing.T) {
+	var reports []VanityProgress
+	v := &Vanity{
+		Prefix:           strings.Repeat("a", 20),
+		Progress:         func(p VanityProgress) { reports = append(reports, p) },
+		ProgressInterval: 10 * time.Millisecond,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := v.I2P(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("search ended with %v", err)
+	}
+	if len(reports) < 2 || !reports[len(reports)-1].Done {
+		t.Fatalf("progress reports %+v", reports)
+	}
+	last := reports[len(reports)-1]
+	if last.Rate <= 0 || last.ETA < 1000*time.Hour || last.Probability >= 0.01 {
+		t.Errorf("last progress %+v", last)
+	}
+	for _, prefix := range []string{"", "a1", strings.Repeat("a", 52)} {
+		if _, err := (&Vanity{Prefix: prefix}).Onion(ctx); err == nil {
+			t.Errorf("searched for %q", prefix)
+		}
+	}
+}
+
+func TestVanityEstimate(t *testing.T) {
+	v := &Vanity{Prefix: "abc"}
+	if d := v.Estimate(32 * 32 * 32); d != time.Second {
+		t.Errorf("estimated %s", d)
+	}
+	if rate := v.OnionRate(50 * time.Millisecond); rate <= 0 {
+		t.Errorf("onion rate %f", rate)
+	}
+	if rate := v.I2PRate(50 * time.Millisecond); rate <= 0 {
+		t.Errorf("I2P rate %f", rate)
+	}
+	if d := (&Vanity{Prefix: strings.Repeat("a", 51)}).Estimate(1e6); d <= 0 {
+		t.Errorf("estimated %s", d)
+	}
+}
+
+func TestVanityStore(t *testing.T) {
+	tempKeystores(t)
+	v := &Vanity{Prefix: "b"}
+	onion, err := v.StoreOnion(context.Background(), "svc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored, err := TorKeys("svc"); err != nil || !bytes.Equal(stored.PublicKey(), onion.PublicKey()) {
+		t.Errorf("stored another Tor key: %v", err)
+	}
+	keys, err := v.StoreI2P(context.Background(), "svc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored, err := I2PKeysWithTypes("svc", "127.0.0.1:1", I2PKeyTypes{Signature: SIG_ED25519}); err != nil || stored.Both != keys.Both {
+		t.Errorf("stored other I2P keys: %v", err)
+	}
+	if _, err := v.StoreOnion(context.Background(), "svc"); err == nil {
+		t.Error("replaced the Tor key")
+	}
+	if _, err := v.StoreI2P(context.Background(), "svc"); err == nil {
+		t.Error("replaced the I2P keys")
+	}
+}